@@ -0,0 +1,527 @@
+// Package bitswap exchanges blocks with the peers of a host: peers tell each other the blocks they want, answer
+// whether they have them, and send the blocks they are asked for, serving first the peers that gave them the most.
+package bitswap
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"io"
+	"p2p/blocks"
+	"p2p/blockstore"
+	"p2p/chunker"
+	"p2p/host"
+	"p2p/merkledag"
+	"p2p/network"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"sync"
+	"time"
+)
+
+// ProtocolID is the protocol negotiated on the streams carrying bitswap messages.
+const ProtocolID protocol.ID = "/p2p/bitswap/1.0.0"
+
+const (
+	// defaultRebroadcastInterval is how often the whole wantlist is sent again to every peer.
+	defaultRebroadcastInterval = 10 * time.Second
+	// defaultBlockTimeout is how long a peer has to send a block it was asked for before the next peer is.
+	defaultBlockTimeout = 10 * time.Second
+	// tickInterval is how often new peers are told the wantlist and slow peers are given up on.
+	tickInterval = time.Second
+	// sendTimeout bounds the writing of a message to a peer.
+	sendTimeout = 30 * time.Second
+	// sendQueueSize is the number of messages waiting to be sent to a peer.
+	sendQueueSize = 64
+	// fetchBatch is the number of blocks of a DAG wanted at once by GetFile.
+	fetchBatch = 256
+	// defaultChunker is the chunker the files fetched by GetFile are expected to be split with.
+	defaultChunker = "rabin"
+)
+
+// ErrClosed is returned by the requests made to a closed Bitswap.
+var ErrClosed = errors.New("bitswap closed")
+
+// config holds the settings of a Bitswap.
+type config struct {
+	rebroadcastInterval time.Duration
+	blockTimeout        time.Duration
+	chunker             string
+	logf                func(format string, args ...interface{})
+}
+
+// Option configures a Bitswap created by New.
+type Option func(cfg *config) error
+
+// WithRebroadcastInterval sets how often the whole wantlist is sent again to every peer, 10 seconds by default.
+// The peers that had none of the blocks are asked again.
+func WithRebroadcastInterval(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid rebroadcast interval %s", d)
+		}
+		cfg.rebroadcastInterval = d
+		return nil
+	}
+}
+
+// WithBlockTimeout sets how long a peer that has a block has to send it before the block is asked to the next
+// peer that has it, 10 seconds by default.
+func WithBlockTimeout(d time.Duration) Option {
+	return func(cfg *config) error {
+		if d <= 0 {
+			return fmt.Errorf("invalid block timeout %s", d)
+		}
+		cfg.blockTimeout = d
+		return nil
+	}
+}
+
+// WithChunker sets the chunker.FromString spec the files fetched by GetFile are expected to be split with, "rabin"
+// by default. GetFile refuses the DAGs of files split in smaller chunks than it cuts.
+func WithChunker(spec string) Option {
+	return func(cfg *config) error {
+		if err := chunker.CheckSpec(spec); err != nil {
+			return err
+		}
+		cfg.chunker = spec
+		return nil
+	}
+}
+
+// WithLogger sets a function a Bitswap reports the messages it fails to receive or send and the blocks it fails
+// to store to. Nothing is reported by default.
+func WithLogger(logf func(format string, args ...interface{})) Option {
+	return func(cfg *config) error {
+		cfg.logf = logf
+		return nil
+	}
+}
+
+// Stat is the state of a Bitswap.
+type Stat struct {
+	// Wantlist holds the blocks wanted, the highest priority first.
+	Wantlist []cid.Cid
+	// Peers holds the peers a ledger is kept for.
+	Peers []peer.ID
+	// BlocksReceived counts the wanted blocks received, DupBlksReceived the ones received but not wanted.
+	BlocksReceived  uint64
+	DupBlksReceived uint64
+}
+
+// Bitswap exchanges the blocks of a blockstore with the peers of a host. It is safe for concurrent use.
+type Bitswap struct {
+	host   host.Host
+	bs     blockstore.Blockstore
+	cfg    *config
+	client *client
+	engine *engine
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	queues map[peer.ID]*sendQueue
+}
+
+var _ merkledag.Getter = (*Bitswap)(nil)
+
+// New returns a Bitswap exchanging the blocks of bs with the peers of h, and handling the streams of ProtocolID
+// on h until it is closed.
+func New(h host.Host, bs blockstore.Blockstore, opts ...Option) (*Bitswap, error) {
+	cfg := &config{rebroadcastInterval: defaultRebroadcastInterval, blockTimeout: defaultBlockTimeout, chunker: defaultChunker}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Bitswap{host: h, bs: bs, cfg: cfg, ctx: ctx, cancel: cancel, queues: make(map[peer.ID]*sendQueue)}
+	b.client = newClient(bs, h.Peers, b.send, cfg.blockTimeout, b.logf)
+	b.engine = newEngine(bs, b.send)
+
+	h.SetStreamHandler(ProtocolID, b.handleStream)
+	b.wg.Add(2)
+	go func() {
+		defer b.wg.Done()
+		b.engine.run(ctx)
+	}()
+	go func() {
+		defer b.wg.Done()
+		b.run(ctx)
+	}()
+	return b, nil
+}
+
+// run ticks the client until ctx is done.
+func (b *Bitswap) run(ctx context.Context) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+			rebroadcast := time.Since(last) >= b.cfg.rebroadcastInterval
+			if rebroadcast {
+				last = time.Now()
+			}
+			b.client.tick(rebroadcast)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close stops handling the streams of ProtocolID and sending messages. The requests in progress fail.
+func (b *Bitswap) Close() error {
+	b.host.RemoveStreamHandler(ProtocolID)
+	b.cancel()
+	b.mu.Lock()
+	for _, q := range b.queues {
+		q.close()
+	}
+	b.queues = make(map[peer.ID]*sendQueue)
+	b.mu.Unlock()
+	b.wg.Wait()
+	return nil
+}
+
+// logf reports an event to the logger set by WithLogger, if any.
+func (b *Bitswap) logf(format string, args ...interface{}) {
+	if b.cfg.logf != nil {
+		b.cfg.logf(format, args...)
+	}
+}
+
+// handleStream receives the messages of a peer until it closes the stream. The wantlist of the peer is
+// forgotten then, it sends it again over its next stream.
+func (b *Bitswap) handleStream(s network.Stream) {
+	defer s.Close()
+	p := s.RemotePeer()
+	defer b.engine.peerGone(p)
+	for {
+		m, err := readMessage(s)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && b.ctx.Err() == nil {
+				b.logf("error receiving bitswap message from %s: %v", p, err)
+			}
+			return
+		}
+		if len(m.Blocks) > 0 {
+			b.engine.receivedBlocks(p, m.blockSize(), len(m.Blocks))
+			if stored := b.client.receive(b.ctx, p, m); len(stored) > 0 {
+				b.notify(stored)
+			}
+		} else if len(m.Presences) > 0 {
+			b.client.receive(b.ctx, p, m)
+		}
+		b.engine.receiveWantlist(p, m)
+	}
+}
+
+// GetBlock returns the block identified by c, from the blockstore or from the peers that have it.
+func (b *Bitswap) GetBlock(ctx context.Context, c cid.Cid) (*blocks.Block, error) {
+	ch, err := b.GetBlocks(ctx, []cid.Cid{c})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case blk, ok := <-ch:
+		if ok {
+			return blk, nil
+		}
+	case <-ctx.Done():
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("error getting block %s: %w", c, err)
+	}
+	return nil, ErrClosed
+}
+
+// Get is GetBlock, so a Bitswap is a merkledag.Getter fetching the blocks of a DAG from the peers.
+func (b *Bitswap) Get(ctx context.Context, c cid.Cid) (*blocks.Block, error) {
+	return b.GetBlock(ctx, c)
+}
+
+// GetBlocks returns a channel receiving the blocks identified by cids, in the order they are found, from the
+// blockstore or from the peers. The channel is closed once every block was received, or when ctx is done or
+// the Bitswap closed. The blocks received from peers are stored in the blockstore.
+func (b *Bitswap) GetBlocks(ctx context.Context, cids []cid.Cid) (<-chan *blocks.Block, error) {
+	if b.ctx.Err() != nil {
+		return nil, ErrClosed
+	}
+	seen := make(map[cid.Cid]bool, len(cids))
+	var local []*blocks.Block
+	var missing []cid.Cid
+	for _, c := range cids {
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		blk, err := b.bs.Get(ctx, c)
+		switch {
+		case err == nil:
+			local = append(local, blk)
+		case errors.Is(err, blockstore.ErrNotFound):
+			missing = append(missing, c)
+		default:
+			return nil, fmt.Errorf("error reading block %s: %v", c, err)
+		}
+	}
+
+	out := make(chan *blocks.Block, len(local))
+	for _, blk := range local {
+		out <- blk
+	}
+	if len(missing) == 0 {
+		close(out)
+		return out, nil
+	}
+
+	in := make(chan *blocks.Block, len(missing))
+	b.client.wantBlocks(missing, in)
+	go func() {
+		defer close(out)
+		defer b.client.cancelWants(missing, in)
+		for n := 0; n < len(missing); n++ {
+			select {
+			case blk := <-in:
+				select {
+				case out <- blk:
+				case <-ctx.Done():
+					return
+				case <-b.ctx.Done():
+					return
+				}
+			case <-ctx.Done():
+				return
+			case <-b.ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+// HasBlock stores blk and sends it to the peers that want it.
+func (b *Bitswap) HasBlock(ctx context.Context, blk *blocks.Block) error {
+	if err := b.bs.Put(ctx, blk); err != nil {
+		return err
+	}
+	b.notify([]*blocks.Block{blk})
+	return nil
+}
+
+// NotifyNewBlocks sends the blocks blks, already stored, to the peers that want them.
+func (b *Bitswap) NotifyNewBlocks(blks ...*blocks.Block) {
+	b.notify(blks)
+}
+
+func (b *Bitswap) notify(blks []*blocks.Block) {
+	cids := make([]cid.Cid, len(blks))
+	for i, blk := range blks {
+		cids[i] = blk.Cid()
+	}
+	b.engine.newBlocks(cids)
+}
+
+// GetFile writes the file whose DAG has root to w, fetching the blocks it misses from the peers, and returns
+// the bytes written. The nodes of the DAG are fetched level by level, every node of a level wanted at once, and
+// the DAG is refused as soon as it links more chunks than the file split with the chunker set by WithChunker
+// has, or more bytes than the size in the root. The chunks are then wanted in batches, and the file is read
+// from the blockstore.
+func (b *Bitswap) GetFile(ctx context.Context, root cid.Cid, w io.Writer) (int64, error) {
+	got, err := b.fetch(ctx, []cid.Cid{root})
+	if err != nil {
+		return 0, err
+	}
+	size, err := merkledag.FileSize(got[root])
+	if err != nil {
+		return 0, err
+	}
+	minChunk, err := chunker.MinSize(b.cfg.chunker)
+	if err != nil {
+		return 0, err
+	}
+	leaves, err := merkledag.ResolveLeaves(ctx, root, size, uint64(minChunk), b.fetchBatches)
+	if err != nil {
+		return 0, err
+	}
+	// The chunks are stored as they arrive, only a batch of them is held at a time.
+	for start := 0; start < len(leaves); start += fetchBatch {
+		end := start + fetchBatch
+		if end > len(leaves) {
+			end = len(leaves)
+		}
+		cids := make([]cid.Cid, 0, end-start)
+		for _, l := range leaves[start:end] {
+			cids = append(cids, l.Cid)
+		}
+		if _, err := b.fetch(ctx, cids); err != nil {
+			return 0, err
+		}
+	}
+	return merkledag.Cat(ctx, root, b.bs, w)
+}
+
+// fetchBatches gets every block of cids, fetchBatch blocks at a time, for the nodes of a DAG.
+func (b *Bitswap) fetchBatches(ctx context.Context, cids []cid.Cid) (map[cid.Cid]*blocks.Block, error) {
+	got := make(map[cid.Cid]*blocks.Block, len(cids))
+	for start := 0; start < len(cids); start += fetchBatch {
+		end := start + fetchBatch
+		if end > len(cids) {
+			end = len(cids)
+		}
+		blks, err := b.fetch(ctx, cids[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for c, blk := range blks {
+			got[c] = blk
+		}
+	}
+	return got, nil
+}
+
+// fetch gets every block of cids, failing if one of them could not be.
+func (b *Bitswap) fetch(ctx context.Context, cids []cid.Cid) (map[cid.Cid]*blocks.Block, error) {
+	ch, err := b.GetBlocks(ctx, cids)
+	if err != nil {
+		return nil, err
+	}
+	got := make(map[cid.Cid]*blocks.Block, len(cids))
+	for blk := range ch {
+		got[blk.Cid()] = blk
+	}
+	for _, c := range cids {
+		if got[c] == nil {
+			if err := ctx.Err(); err != nil {
+				return nil, fmt.Errorf("error getting block %s: %w", c, err)
+			}
+			return nil, ErrClosed
+		}
+	}
+	return got, nil
+}
+
+// LedgerForPeer returns the ledger of p.
+func (b *Bitswap) LedgerForPeer(p peer.ID) Receipt {
+	return b.engine.receipt(p)
+}
+
+// WantlistForPeer returns the blocks p wants and were not sent to it yet, the highest priority first.
+func (b *Bitswap) WantlistForPeer(p peer.ID) []Entry {
+	return b.engine.wantlist(p)
+}
+
+// Stat returns the state of b.
+func (b *Bitswap) Stat() Stat {
+	st := Stat{Wantlist: b.client.wantlist()}
+	b.client.mu.Lock()
+	st.BlocksReceived, st.DupBlksReceived = b.client.received, b.client.dups
+	b.client.mu.Unlock()
+	b.engine.mu.Lock()
+	for p := range b.engine.ledgers {
+		st.Peers = append(st.Peers, p)
+	}
+	b.engine.mu.Unlock()
+	return st
+}
+
+// send queues m to be sent to p, dropping it if the queue of p is full.
+func (b *Bitswap) send(p peer.ID, m *Message) {
+	b.mu.Lock()
+	if b.ctx.Err() != nil {
+		b.mu.Unlock()
+		return
+	}
+	q, ok := b.queues[p]
+	if !ok {
+		q = newSendQueue(b, p)
+		b.queues[p] = q
+	}
+	b.mu.Unlock()
+	q.push(m)
+}
+
+// sendQueue sends the messages to a peer in order over a stream, opened when the first message is sent.
+type sendQueue struct {
+	b        *Bitswap
+	p        peer.ID
+	messages chan *Message
+	done     chan struct{}
+	once     sync.Once
+	s        network.Stream
+}
+
+func newSendQueue(b *Bitswap, p peer.ID) *sendQueue {
+	q := &sendQueue{b: b, p: p, messages: make(chan *Message, sendQueueSize), done: make(chan struct{})}
+	b.wg.Add(1)
+	go q.run()
+	return q
+}
+
+// push queues m. The messages with blocks wait for room in the queue, the others are dropped if it is full:
+// the wantlists are sent again, the presences are asked again.
+func (q *sendQueue) push(m *Message) {
+	if len(m.Blocks) == 0 {
+		select {
+		case q.messages <- m:
+		case <-q.done:
+		default:
+			q.b.logf("dropping bitswap message to %s: queue full", q.p)
+		}
+		return
+	}
+	select {
+	case q.messages <- m:
+	case <-q.done:
+	}
+}
+
+func (q *sendQueue) close() {
+	q.once.Do(func() { close(q.done) })
+}
+
+func (q *sendQueue) run() {
+	defer q.b.wg.Done()
+	defer func() {
+		if q.s != nil {
+			_ = q.s.Close()
+		}
+	}()
+	for {
+		select {
+		case m := <-q.messages:
+			if err := q.write(m); err != nil {
+				q.b.logf("error sending bitswap message to %s: %v", q.p, err)
+			}
+		case <-q.done:
+			return
+		}
+	}
+}
+
+// write sends m over the stream to the peer, opening a new stream and trying once more if it fails.
+func (q *sendQueue) write(m *Message) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if q.s == nil {
+			ctx, cancel := context.WithTimeout(q.b.ctx, sendTimeout)
+			q.s, err = q.b.host.NewStream(ctx, q.p, ProtocolID)
+			cancel()
+			if err != nil {
+				return err
+			}
+		}
+		_ = q.s.SetWriteDeadline(time.Now().Add(sendTimeout))
+		if err = writeMessage(q.s, m); err == nil {
+			return nil
+		}
+		_ = q.s.Reset()
+		q.s = nil
+	}
+	return err
+}
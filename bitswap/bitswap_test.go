@@ -0,0 +1,240 @@
+package bitswap
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"net"
+	"p2p/blocks"
+	"p2p/blockstore"
+	"p2p/chunker"
+	"p2p/host"
+	"p2p/merkledag"
+	"p2p/network"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHost is a host connected to a single other testHost, opening streams over net.Pipe.
+type testHost struct {
+	host.Host
+	id     peer.ID
+	remote *testHost
+
+	mu       sync.Mutex
+	handlers map[protocol.ID]network.StreamHandler
+}
+
+// newTestHosts returns two hosts connected to each other.
+func newTestHosts() (*testHost, *testHost) {
+	a := &testHost{id: "alice", handlers: make(map[protocol.ID]network.StreamHandler)}
+	b := &testHost{id: "bob", handlers: make(map[protocol.ID]network.StreamHandler)}
+	a.remote, b.remote = b, a
+	return a, b
+}
+
+func (h *testHost) ID() peer.ID      { return h.id }
+func (h *testHost) Peers() []peer.ID { return []peer.ID{h.remote.id} }
+
+func (h *testHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.handlers[pid] = handler
+}
+
+func (h *testHost) RemoveStreamHandler(pid protocol.ID) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.handlers, pid)
+}
+
+func (h *testHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	if p != h.remote.id {
+		return nil, errors.New("not connected")
+	}
+	h.remote.mu.Lock()
+	handler, ok := h.remote.handlers[pids[0]]
+	h.remote.mu.Unlock()
+	if !ok {
+		return nil, errors.New("protocol not supported")
+	}
+	local, remote := net.Pipe()
+	go handler(&testStream{c: remote, p: h.id})
+	return &testStream{c: local, p: p}, nil
+}
+
+// testStream is a stream with peer p over a net.Conn.
+type testStream struct {
+	network.Stream
+	c net.Conn
+	p peer.ID
+}
+
+func (s *testStream) Read(b []byte) (int, error)         { return s.c.Read(b) }
+func (s *testStream) Write(b []byte) (int, error)        { return s.c.Write(b) }
+func (s *testStream) Close() error                       { return s.c.Close() }
+func (s *testStream) Reset() error                       { return s.c.Close() }
+func (s *testStream) SetWriteDeadline(t time.Time) error { return s.c.SetWriteDeadline(t) }
+func (s *testStream) RemotePeer() peer.ID                { return s.p }
+
+// newTestPair returns a Bitswap on each side of a pair of test hosts, with their blockstores.
+func newTestPair(t *testing.T, opts ...Option) (a, b *Bitswap, bsa, bsb blockstore.Blockstore) {
+	t.Helper()
+	ha, hb := newTestHosts()
+	bsa, bsb = blockstore.NewMemory(), blockstore.NewMemory()
+	a, err := New(ha, bsa, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	b, err = New(hb, bsb, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return a, b, bsa, bsb
+}
+
+func TestMessageRoundTrip(t *testing.T) {
+	blk := blocks.NewBlock([]byte("data"))
+	want := &Message{
+		Full: true,
+		Wantlist: []Entry{
+			{Cid: blk.Cid(), Priority: 7, WantType: WantHave, SendDontHave: true},
+			{Cid: blocks.NewBlock([]byte("other")).Cid(), Cancel: true},
+		},
+		Blocks:    []*blocks.Block{blk},
+		Presences: []Presence{{Cid: blk.Cid(), Type: DontHave}},
+	}
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Full || len(got.Wantlist) != 2 || got.Wantlist[0] != want.Wantlist[0] || got.Wantlist[1] != want.Wantlist[1] {
+		t.Errorf("wantlist received %+v, want %+v", got.Wantlist, want.Wantlist)
+	}
+	if len(got.Blocks) != 1 || got.Blocks[0].Cid() != blk.Cid() || !bytes.Equal(got.Blocks[0].RawData(), blk.RawData()) {
+		t.Errorf("blocks received %v, want %v", got.Blocks, want.Blocks)
+	}
+	if len(got.Presences) != 1 || got.Presences[0] != want.Presences[0] {
+		t.Errorf("presences received %+v, want %+v", got.Presences, want.Presences)
+	}
+
+	// A block whose data does not match its CID is refused.
+	buf.Reset()
+	other := blocks.NewBlock([]byte("forged"))
+	writeMessage(&buf, &Message{Blocks: []*blocks.Block{other}})
+	raw := bytes.Replace(buf.Bytes(), other.Cid().Bytes(), blk.Cid().Bytes(), 1)
+	if _, err := readMessage(bytes.NewReader(raw)); !errors.Is(err, blocks.ErrWrongHash) {
+		t.Errorf("message with a forged block: %v, want ErrWrongHash", err)
+	}
+}
+
+func TestGetBlock(t *testing.T) {
+	a, b, bsa, _ := newTestPair(t)
+	blk := blocks.NewBlock([]byte("block of alice"))
+	if err := bsa.Put(context.Background(), blk); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	got, err := b.GetBlock(ctx, blk.Cid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.RawData(), blk.RawData()) {
+		t.Errorf("received %q, want %q", got.RawData(), blk.RawData())
+	}
+	if ok, _ := b.bs.Has(ctx, blk.Cid()); !ok {
+		t.Error("the block received was not stored")
+	}
+	if st := b.Stat(); st.BlocksReceived != 1 {
+		t.Errorf("bob received %d blocks, want 1", st.BlocksReceived)
+	}
+	// The ledger of alice is updated once the block is sent.
+	for deadline := time.Now().Add(5 * time.Second); a.LedgerForPeer("bob").Sent != uint64(len(blk.RawData())); {
+		if time.Now().After(deadline) {
+			t.Fatalf("ledger of bob on alice: %+v", a.LedgerForPeer("bob"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := b.GetBlock(ctx, blocks.NewBlock([]byte("missing")).Cid()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("getting a block nobody has: %v, want DeadlineExceeded", err)
+	}
+}
+
+func TestGetFile(t *testing.T) {
+	_, b, bsa, _ := newTestPair(t, WithChunker("size-1024"))
+	data := make([]byte, 300<<10)
+	rand.Read(data)
+	root, err := merkledag.Build(chunker.NewSizeSplitter(bytes.NewReader(data), 1024), func(blk *blocks.Block) error {
+		return bsa.Put(context.Background(), blk)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var buf bytes.Buffer
+	n, err := b.GetFile(ctx, root, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("received %d bytes differing from the %d of the file", n, len(data))
+	}
+}
+
+func TestGetFileRefusesSmallerChunks(t *testing.T) {
+	_, b, bsa, _ := newTestPair(t, WithChunker("size-4096"))
+	data := make([]byte, 64<<10)
+	rand.Read(data)
+	root, err := merkledag.Build(chunker.NewSizeSplitter(bytes.NewReader(data), 1024), func(blk *blocks.Block) error {
+		return bsa.Put(context.Background(), blk)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if _, err := b.GetFile(ctx, root, &bytes.Buffer{}); err == nil {
+		t.Error("a file split in chunks smaller than the chunker allows was fetched")
+	}
+	var leaves int
+	for c := range mustKeys(t, b.bs) {
+		if c.Type() == cid.Raw {
+			leaves++
+		}
+	}
+	if leaves != 0 {
+		t.Errorf("%d chunks of a refused file were fetched", leaves)
+	}
+}
+
+func mustKeys(t *testing.T, bs blockstore.Blockstore) map[cid.Cid]bool {
+	t.Helper()
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[cid.Cid]bool)
+	for c := range ch {
+		keys[c] = true
+	}
+	return keys
+}
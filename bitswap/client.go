@@ -0,0 +1,300 @@
+package bitswap
+
+import (
+	"context"
+	"github.com/ipfs/go-cid"
+	"p2p/blocks"
+	"p2p/blockstore"
+	"p2p/peer"
+	"sort"
+	"sync"
+	"time"
+)
+
+// want is a block wanted by the node and the search for a peer having it.
+type want struct {
+	priority  int32
+	listeners []chan<- *blocks.Block
+	// asked holds the peers sent a want-have, dontHave the ones answering DONT_HAVE or failing to send the block.
+	asked    map[peer.ID]bool
+	dontHave map[peer.ID]bool
+	// haves holds the peers answering HAVE, in order, not asked for the block yet.
+	haves []peer.ID
+	// blockFrom is the peer asked for the block at blockAt, empty if none was.
+	blockFrom peer.ID
+	blockAt   time.Time
+}
+
+// outgoing is a message to send once the lock of the client is released.
+type outgoing struct {
+	p   peer.ID
+	msg *Message
+}
+
+// client searches the peers for the blocks the node wants: it asks every peer whether it has them, then asks
+// the first peer answering HAVE for the block, and the next one if it fails to send it.
+type client struct {
+	bs           blockstore.Blockstore
+	send         func(p peer.ID, m *Message)
+	peers        func() []peer.ID
+	blockTimeout time.Duration
+	logf         func(format string, args ...interface{})
+
+	mu       sync.Mutex
+	wants    map[cid.Cid]*want
+	known    map[peer.ID]bool
+	priority int32
+	received uint64
+	dups     uint64
+}
+
+func newClient(bs blockstore.Blockstore, peers func() []peer.ID, send func(p peer.ID, m *Message), blockTimeout time.Duration,
+	logf func(format string, args ...interface{})) *client {
+	return &client{
+		bs:           bs,
+		send:         send,
+		peers:        peers,
+		blockTimeout: blockTimeout,
+		logf:         logf,
+		wants:        make(map[cid.Cid]*want),
+		known:        make(map[peer.ID]bool),
+		priority:     1 << 30,
+	}
+}
+
+func (c *client) flush(out []outgoing) {
+	for _, o := range out {
+		c.send(o.p, o.msg)
+	}
+}
+
+// add queues the entries for p in out, merging them with the message queued for p if any.
+func add(out []outgoing, p peer.ID, entries ...Entry) []outgoing {
+	for i := range out {
+		if out[i].p == p {
+			out[i].msg.Wantlist = append(out[i].msg.Wantlist, entries...)
+			return out
+		}
+	}
+	return append(out, outgoing{p: p, msg: &Message{Wantlist: entries}})
+}
+
+func wantHave(k cid.Cid, w *want) Entry {
+	return Entry{Cid: k, Priority: w.priority, WantType: WantHave, SendDontHave: true}
+}
+
+func wantBlock(k cid.Cid, w *want) Entry {
+	return Entry{Cid: k, Priority: w.priority, WantType: WantBlock, SendDontHave: true}
+}
+
+// wantBlocks adds the listener ch to the wants of keys, and asks every peer for the blocks not wanted yet.
+// Blocks requested earlier get a higher priority.
+func (c *client) wantBlocks(keys []cid.Cid, ch chan<- *blocks.Block) {
+	c.mu.Lock()
+	var fresh []cid.Cid
+	for _, k := range keys {
+		w, ok := c.wants[k]
+		if !ok {
+			w = &want{priority: c.priority, asked: make(map[peer.ID]bool), dontHave: make(map[peer.ID]bool)}
+			c.priority--
+			c.wants[k] = w
+			fresh = append(fresh, k)
+		}
+		w.listeners = append(w.listeners, ch)
+	}
+	var out []outgoing
+	for _, p := range c.peers() {
+		for _, k := range fresh {
+			w := c.wants[k]
+			w.asked[p] = true
+			out = add(out, p, wantHave(k, w))
+		}
+	}
+	c.mu.Unlock()
+	c.flush(out)
+}
+
+// cancelWants removes the listener ch from the wants of keys, and cancels the wants left without listeners.
+func (c *client) cancelWants(keys []cid.Cid, ch chan<- *blocks.Block) {
+	c.mu.Lock()
+	var out []outgoing
+	for _, k := range keys {
+		w, ok := c.wants[k]
+		if !ok {
+			continue
+		}
+		for i, l := range w.listeners {
+			if l == ch {
+				w.listeners = append(w.listeners[:i], w.listeners[i+1:]...)
+				break
+			}
+		}
+		if len(w.listeners) == 0 {
+			delete(c.wants, k)
+			out = c.cancel(out, k, w, "")
+		}
+	}
+	c.mu.Unlock()
+	c.flush(out)
+}
+
+// cancel queues a cancel of the want of k for every peer it was sent to but except. c.mu must be held.
+func (c *client) cancel(out []outgoing, k cid.Cid, w *want, except peer.ID) []outgoing {
+	for p := range w.asked {
+		if p != except {
+			out = add(out, p, Entry{Cid: k, Cancel: true})
+		}
+	}
+	return out
+}
+
+// receive handles the blocks and presences of a message from p, and returns the blocks it wanted.
+func (c *client) receive(ctx context.Context, p peer.ID, m *Message) []*blocks.Block {
+	var wanted []*blocks.Block
+	c.mu.Lock()
+	for _, b := range m.Blocks {
+		if _, ok := c.wants[b.Cid()]; ok {
+			wanted = append(wanted, b)
+		} else {
+			c.dups++
+		}
+	}
+	c.mu.Unlock()
+
+	// Blocks are stored before they are delivered, so the listeners find them in the blockstore.
+	var stored []*blocks.Block
+	for _, b := range wanted {
+		if err := c.bs.Put(ctx, b); err != nil {
+			c.logf("error storing block %s: %v", b.Cid(), err)
+			continue
+		}
+		stored = append(stored, b)
+	}
+
+	c.mu.Lock()
+	var out []outgoing
+	var delivered []*blocks.Block
+	for _, b := range stored {
+		w, ok := c.wants[b.Cid()]
+		if !ok {
+			c.dups++
+			continue
+		}
+		delete(c.wants, b.Cid())
+		c.received++
+		for _, l := range w.listeners {
+			l <- b
+		}
+		out = c.cancel(out, b.Cid(), w, p)
+		delivered = append(delivered, b)
+	}
+	for _, pr := range m.Presences {
+		w, ok := c.wants[pr.Cid]
+		if !ok {
+			continue
+		}
+		switch pr.Type {
+		case Have:
+			if w.blockFrom == "" {
+				w.blockFrom, w.blockAt = p, time.Now()
+				out = add(out, p, wantBlock(pr.Cid, w))
+			} else if w.blockFrom != p && !contains(w.haves, p) {
+				w.haves = append(w.haves, p)
+			}
+		case DontHave:
+			w.dontHave[p] = true
+			if w.blockFrom == p {
+				out = c.next(out, pr.Cid, w)
+			}
+		}
+	}
+	c.mu.Unlock()
+	c.flush(out)
+	return delivered
+}
+
+// next asks the next peer that answered HAVE for the block of w, if any. c.mu must be held.
+func (c *client) next(out []outgoing, k cid.Cid, w *want) []outgoing {
+	w.blockFrom = ""
+	for len(w.haves) > 0 {
+		p := w.haves[0]
+		w.haves = w.haves[1:]
+		if !w.dontHave[p] {
+			w.blockFrom, w.blockAt = p, time.Now()
+			return add(out, p, wantBlock(k, w))
+		}
+	}
+	return out
+}
+
+func contains(ps []peer.ID, p peer.ID) bool {
+	for _, q := range ps {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+// tick moves on from the peers slow to send the blocks asked to them, and tells the wantlist to the peers
+// connected since the last tick, or to every peer if rebroadcast is set.
+func (c *client) tick(rebroadcast bool) {
+	now := time.Now()
+	peers := c.peers()
+	c.mu.Lock()
+	var out []outgoing
+	for k, w := range c.wants {
+		if w.blockFrom != "" && now.Sub(w.blockAt) > c.blockTimeout {
+			out = add(out, w.blockFrom, Entry{Cid: k, Cancel: true})
+			w.dontHave[w.blockFrom] = true
+			out = c.next(out, k, w)
+		}
+	}
+	connected := make(map[peer.ID]bool, len(peers))
+	for _, p := range peers {
+		connected[p] = true
+		if !rebroadcast && c.known[p] {
+			continue
+		}
+		// The full wantlist replaces the one the peer holds, and asks again the peers that did not have a block.
+		msg := &Message{Full: true}
+		for k, w := range c.wants {
+			delete(w.dontHave, p)
+			w.asked[p] = true
+			if w.blockFrom == p {
+				msg.Wantlist = append(msg.Wantlist, wantBlock(k, w))
+			} else {
+				msg.Wantlist = append(msg.Wantlist, wantHave(k, w))
+			}
+			if len(msg.Wantlist) == maxEntriesPerMessage {
+				break
+			}
+		}
+		if len(msg.Wantlist) > 0 || c.known[p] {
+			out = append(out, outgoing{p: p, msg: msg})
+		}
+	}
+	c.known = connected
+	c.mu.Unlock()
+	c.flush(out)
+}
+
+// wantlist returns the blocks wanted by the node, the highest priority first.
+func (c *client) wantlist() []cid.Cid {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	type entry struct {
+		k        cid.Cid
+		priority int32
+	}
+	entries := make([]entry, 0, len(c.wants))
+	for k, w := range c.wants {
+		entries = append(entries, entry{k, w.priority})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].priority > entries[j].priority })
+	keys := make([]cid.Cid, len(entries))
+	for i, e := range entries {
+		keys[i] = e.k
+	}
+	return keys
+}
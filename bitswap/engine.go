@@ -0,0 +1,267 @@
+package bitswap
+
+import (
+	"context"
+	"github.com/ipfs/go-cid"
+	"p2p/blockstore"
+	"p2p/peer"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tasksPerTurn is the number of wants of a peer answered before the next peer gets its turn.
+const tasksPerTurn = 8
+
+// Receipt summarizes the ledger of a peer.
+type Receipt struct {
+	Peer peer.ID
+	// Value is the debt ratio of the peer: the bytes sent to it over the bytes received from it plus one.
+	// Peers with the lowest ratio are served first.
+	Value float64
+	// Sent and Recv count the bytes of the blocks sent to and received from the peer.
+	Sent uint64
+	Recv uint64
+	// Exchanged counts the blocks sent to and received from the peer.
+	Exchanged uint64
+}
+
+// ledger is what the node knows of a peer: the blocks exchanged with it and what it wants.
+type ledger struct {
+	sent       uint64
+	recv       uint64
+	exchanged  uint64
+	wants      map[cid.Cid]Entry
+	tasks      []cid.Cid
+	queued     map[cid.Cid]bool
+	lastServed time.Time
+}
+
+func newLedger() *ledger {
+	return &ledger{wants: make(map[cid.Cid]Entry), queued: make(map[cid.Cid]bool)}
+}
+
+func (l *ledger) debtRatio() float64 {
+	return float64(l.sent) / float64(l.recv+1)
+}
+
+// enqueue adds a task answering the want of c, unless there is one already.
+func (l *ledger) enqueue(c cid.Cid) {
+	if !l.queued[c] {
+		l.queued[c] = true
+		l.tasks = append(l.tasks, c)
+	}
+}
+
+// engine answers the wantlists of peers from the blockstore, serving the peers in turn.
+type engine struct {
+	bs   blockstore.Blockstore
+	send func(p peer.ID, m *Message)
+
+	mu      sync.Mutex
+	ledgers map[peer.ID]*ledger
+	wake    chan struct{}
+}
+
+func newEngine(bs blockstore.Blockstore, send func(p peer.ID, m *Message)) *engine {
+	return &engine{bs: bs, send: send, ledgers: make(map[peer.ID]*ledger), wake: make(chan struct{}, 1)}
+}
+
+// ledger returns the ledger of p, creating it if needed. e.mu must be held.
+func (e *engine) ledger(p peer.ID) *ledger {
+	l, ok := e.ledgers[p]
+	if !ok {
+		l = newLedger()
+		e.ledgers[p] = l
+	}
+	return l
+}
+
+func (e *engine) signal() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// receiveWantlist applies the wantlist of a message from p.
+func (e *engine) receiveWantlist(p peer.ID, m *Message) {
+	if !m.Full && len(m.Wantlist) == 0 {
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l := e.ledger(p)
+	if m.Full {
+		l.wants = make(map[cid.Cid]Entry, len(m.Wantlist))
+	}
+	for _, entry := range m.Wantlist {
+		if entry.Cancel {
+			delete(l.wants, entry.Cid)
+			continue
+		}
+		l.wants[entry.Cid] = entry
+		l.enqueue(entry.Cid)
+	}
+	e.signal()
+}
+
+// receivedBlocks counts the blocks received from p.
+func (e *engine) receivedBlocks(p peer.ID, size int, n int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l := e.ledger(p)
+	l.recv += uint64(size)
+	l.exchanged += uint64(n)
+}
+
+// newBlocks answers the wants of the blocks cids, just stored.
+func (e *engine) newBlocks(cids []cid.Cid) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, l := range e.ledgers {
+		for _, c := range cids {
+			if _, ok := l.wants[c]; ok {
+				l.enqueue(c)
+			}
+		}
+	}
+	e.signal()
+}
+
+// peerGone forgets the wants of p, keeping its ledger.
+func (e *engine) peerGone(p peer.ID) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if l, ok := e.ledgers[p]; ok {
+		l.wants = make(map[cid.Cid]Entry)
+		l.tasks, l.queued = nil, make(map[cid.Cid]bool)
+	}
+}
+
+func (e *engine) receipt(p peer.ID) Receipt {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	r := Receipt{Peer: p}
+	if l, ok := e.ledgers[p]; ok {
+		r.Value, r.Sent, r.Recv, r.Exchanged = l.debtRatio(), l.sent, l.recv, l.exchanged
+	}
+	return r
+}
+
+func (e *engine) wantlist(p peer.ID) []Entry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	l, ok := e.ledgers[p]
+	if !ok {
+		return nil
+	}
+	entries := make([]Entry, 0, len(l.wants))
+	for _, entry := range l.wants {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Priority > entries[j].Priority })
+	return entries
+}
+
+// next picks the peer whose wants are answered next, the one with the lowest debt ratio, the one served the
+// longest ago among equals, and returns up to tasksPerTurn of its wants, the highest priority first.
+func (e *engine) next() (peer.ID, []Entry) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var best peer.ID
+	var bl *ledger
+	for p, l := range e.ledgers {
+		if len(l.tasks) == 0 {
+			continue
+		}
+		if bl == nil || l.debtRatio() < bl.debtRatio() ||
+			(l.debtRatio() == bl.debtRatio() && l.lastServed.Before(bl.lastServed)) {
+			best, bl = p, l
+		}
+	}
+	if bl == nil {
+		return "", nil
+	}
+	bl.lastServed = time.Now()
+
+	sort.SliceStable(bl.tasks, func(i, j int) bool {
+		return bl.wants[bl.tasks[i]].Priority > bl.wants[bl.tasks[j]].Priority
+	})
+	var entries []Entry
+	n := 0
+	for _, c := range bl.tasks {
+		n++
+		delete(bl.queued, c)
+		// Wants cancelled since they were queued are dropped.
+		if entry, ok := bl.wants[c]; ok {
+			entries = append(entries, entry)
+			if len(entries) == tasksPerTurn {
+				break
+			}
+		}
+	}
+	bl.tasks = bl.tasks[n:]
+	return best, entries
+}
+
+// run answers the wants of peers until ctx is done.
+func (e *engine) run(ctx context.Context) {
+	for {
+		p, entries := e.next()
+		if p == "" {
+			select {
+			case <-e.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		e.answer(ctx, p, entries)
+	}
+}
+
+// answer answers the wants entries of p: blocks for the wanted blocks it has, HAVE for the others it has,
+// and DONT_HAVE for the rest if p asked for it. Wants answered with a block or a HAVE are done, the others
+// are answered again once the block is stored.
+func (e *engine) answer(ctx context.Context, p peer.ID, entries []Entry) {
+	msg := &Message{}
+	var done []cid.Cid
+	sent, n := 0, 0
+	for _, entry := range entries {
+		if entry.WantType == WantBlock {
+			b, err := e.bs.Get(ctx, entry.Cid)
+			if err == nil {
+				if len(msg.Blocks) > 0 && msg.blockSize()+len(b.RawData()) > maxBlocksPerMessage {
+					e.send(p, msg)
+					msg = &Message{}
+				}
+				msg.Blocks = append(msg.Blocks, b)
+				done = append(done, entry.Cid)
+				sent += len(b.RawData())
+				n++
+				continue
+			}
+		} else if ok, err := e.bs.Has(ctx, entry.Cid); err == nil && ok {
+			msg.Presences = append(msg.Presences, Presence{Cid: entry.Cid, Type: Have})
+			done = append(done, entry.Cid)
+			continue
+		}
+		if entry.SendDontHave {
+			msg.Presences = append(msg.Presences, Presence{Cid: entry.Cid, Type: DontHave})
+		}
+	}
+
+	e.mu.Lock()
+	l := e.ledger(p)
+	for _, c := range done {
+		delete(l.wants, c)
+	}
+	l.sent += uint64(sent)
+	l.exchanged += uint64(n)
+	e.mu.Unlock()
+
+	if !msg.empty() {
+		e.send(p, msg)
+	}
+}
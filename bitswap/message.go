@@ -0,0 +1,261 @@
+package bitswap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"io"
+	"p2p/blocks"
+)
+
+// maxMessageSize bounds the messages a peer accepts. Senders keep the blocks of a message under
+// maxBlocksPerMessage bytes, a single block always fitting.
+const (
+	maxMessageSize       = 4 << 20
+	maxBlocksPerMessage  = 1 << 20
+	maxEntriesPerMessage = 4096
+)
+
+// WantType tells what a peer wants of a block.
+type WantType uint8
+
+const (
+	// WantBlock asks for the block itself.
+	WantBlock WantType = 0
+	// WantHave asks whether the peer has the block, answered with a HAVE.
+	WantHave WantType = 1
+)
+
+// PresenceType tells whether a peer has a block.
+type PresenceType uint8
+
+const (
+	// Have tells that the peer has the block.
+	Have PresenceType = 0
+	// DontHave tells that the peer does not have the block.
+	DontHave PresenceType = 1
+)
+
+// Entry is a change to the wantlist of a peer.
+type Entry struct {
+	Cid cid.Cid
+	// Priority orders the blocks wanted by a peer, the highest first.
+	Priority int32
+	// Cancel removes the block from the wantlist.
+	Cancel   bool
+	WantType WantType
+	// SendDontHave asks for a DONT_HAVE if the peer does not have the block, rather than no answer.
+	SendDontHave bool
+}
+
+// Presence tells whether a peer has a block.
+type Presence struct {
+	Cid  cid.Cid
+	Type PresenceType
+}
+
+// Message is sent by a peer to another on the bitswap protocol. It is a uint32 big endian length followed by:
+//
+//	full       uint8 (1 if the wantlist replaces the one the receiver holds for the sender)
+//	wantlist   uint32 count, each: uint16 length + CID, int32 priority, uint8 flags
+//	           (1 cancel, 2 want-have rather than want-block, 4 send DONT_HAVE)
+//	blocks     uint32 count, each: uint16 length + CID, uint32 length + data
+//	presences  uint32 count, each: uint16 length + CID, uint8 type (0 HAVE, 1 DONT_HAVE)
+type Message struct {
+	Full      bool
+	Wantlist  []Entry
+	Blocks    []*blocks.Block
+	Presences []Presence
+}
+
+// Entry flags.
+const (
+	flagCancel       = 1
+	flagWantHave     = 2
+	flagSendDontHave = 4
+)
+
+// empty reports whether m carries nothing.
+func (m *Message) empty() bool {
+	return !m.Full && len(m.Wantlist) == 0 && len(m.Blocks) == 0 && len(m.Presences) == 0
+}
+
+// blockSize returns the size of the data of the blocks of m.
+func (m *Message) blockSize() int {
+	size := 0
+	for _, b := range m.Blocks {
+		size += len(b.RawData())
+	}
+	return size
+}
+
+// writeMessage sends m on w.
+func writeMessage(w io.Writer, m *Message) error {
+	body := make([]byte, 0, 1+12+m.blockSize()+len(m.Blocks)*48+len(m.Wantlist)*48+len(m.Presences)*48)
+	if m.Full {
+		body = append(body, 1)
+	} else {
+		body = append(body, 0)
+	}
+	body = binary.BigEndian.AppendUint32(body, uint32(len(m.Wantlist)))
+	for _, e := range m.Wantlist {
+		body = appendCid(body, e.Cid)
+		body = binary.BigEndian.AppendUint32(body, uint32(e.Priority))
+		var flags uint8
+		if e.Cancel {
+			flags |= flagCancel
+		}
+		if e.WantType == WantHave {
+			flags |= flagWantHave
+		}
+		if e.SendDontHave {
+			flags |= flagSendDontHave
+		}
+		body = append(body, flags)
+	}
+	body = binary.BigEndian.AppendUint32(body, uint32(len(m.Blocks)))
+	for _, b := range m.Blocks {
+		body = appendCid(body, b.Cid())
+		body = binary.BigEndian.AppendUint32(body, uint32(len(b.RawData())))
+		body = append(body, b.RawData()...)
+	}
+	body = binary.BigEndian.AppendUint32(body, uint32(len(m.Presences)))
+	for _, p := range m.Presences {
+		body = appendCid(body, p.Cid)
+		body = append(body, uint8(p.Type))
+	}
+	if len(body) > maxMessageSize {
+		return fmt.Errorf("message of %d bytes is too large", len(body))
+	}
+
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(body)), uint32(len(body)))
+	if _, err := w.Write(append(buf, body...)); err != nil {
+		return fmt.Errorf("error sending message: %v", err)
+	}
+	return nil
+}
+
+func appendCid(buf []byte, c cid.Cid) []byte {
+	b := c.Bytes()
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(b)))
+	return append(buf, b...)
+}
+
+// readMessage receives a message from r. The blocks are checked against their CIDs.
+func readMessage(r io.Reader) (*Message, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > maxMessageSize {
+		return nil, fmt.Errorf("message of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("error reading message: %v", err)
+	}
+	d := &decoder{body: body}
+
+	m := &Message{Full: d.uint8() == 1}
+	n := d.count()
+	for i := 0; i < n && d.err == nil; i++ {
+		e := Entry{Cid: d.cid(), Priority: int32(d.uint32())}
+		flags := d.uint8()
+		e.Cancel = flags&flagCancel != 0
+		if flags&flagWantHave != 0 {
+			e.WantType = WantHave
+		}
+		e.SendDontHave = flags&flagSendDontHave != 0
+		m.Wantlist = append(m.Wantlist, e)
+	}
+	n = d.count()
+	for i := 0; i < n && d.err == nil; i++ {
+		c := d.cid()
+		data := d.bytes(int(d.uint32()))
+		if d.err != nil {
+			break
+		}
+		b, err := blocks.NewBlockWithCid(append([]byte(nil), data...), c)
+		if err != nil {
+			return nil, err
+		}
+		m.Blocks = append(m.Blocks, b)
+	}
+	n = d.count()
+	for i := 0; i < n && d.err == nil; i++ {
+		p := Presence{Cid: d.cid(), Type: PresenceType(d.uint8())}
+		if p.Type != Have && p.Type != DontHave {
+			d.err = fmt.Errorf("invalid presence %d", p.Type)
+		}
+		m.Presences = append(m.Presences, p)
+	}
+	if d.err == nil && len(d.body) > 0 {
+		d.err = errors.New("trailing data")
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("invalid message: %v", d.err)
+	}
+	return m, nil
+}
+
+// decoder reads the fields of a message body, remembering the first error.
+type decoder struct {
+	body []byte
+	err  error
+}
+
+func (d *decoder) bytes(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.body) {
+		d.err = errors.New("truncated message")
+		return nil
+	}
+	b := d.body[:n]
+	d.body = d.body[n:]
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	if b := d.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.bytes(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+// count reads the number of items of a list, at most maxEntriesPerMessage.
+func (d *decoder) count() int {
+	n := d.uint32()
+	if n > maxEntriesPerMessage && d.err == nil {
+		d.err = fmt.Errorf("too many items %d", n)
+	}
+	return int(n)
+}
+
+func (d *decoder) cid() cid.Cid {
+	b := d.bytes(2)
+	if b == nil {
+		return cid.Undef
+	}
+	raw := d.bytes(int(binary.BigEndian.Uint16(b)))
+	if len(raw) == 0 {
+		if d.err == nil {
+			d.err = errors.New("empty CID")
+		}
+		return cid.Undef
+	}
+	c, err := cid.Cast(raw)
+	if err != nil && d.err == nil {
+		d.err = err
+	}
+	return c
+}
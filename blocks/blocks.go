@@ -0,0 +1,62 @@
+// Package blocks holds content-addressed blocks: data and the CID identifying it, derived from its hash.
+package blocks
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	mh "github.com/multiformats/go-multihash"
+)
+
+// ErrWrongHash is returned when data does not match the CID it is said to have.
+var ErrWrongHash = errors.New("data does not match its CID")
+
+// Block is an immutable piece of data with its CID.
+type Block struct {
+	cid  cid.Cid
+	data []byte
+}
+
+// NewBlock returns a raw block holding data, identified by a CIDv1 with the sha2-256 hash of data.
+func NewBlock(data []byte) *Block {
+	return NewBlockWithCodec(data, cid.Raw)
+}
+
+// NewBlockWithCodec returns a block holding data encoded with the multicodec codec, identified by a CIDv1
+// with the sha2-256 hash of data.
+func NewBlockWithCodec(data []byte, codec uint64) *Block {
+	c, err := cid.Prefix{Version: 1, Codec: codec, MhType: mh.SHA2_256, MhLength: -1}.Sum(data)
+	if err != nil {
+		// sha2-256 is always available.
+		panic(err)
+	}
+	return &Block{cid: c, data: data}
+}
+
+// NewBlockWithCid returns a block holding data identified by c, verifying that c is the hash of data.
+// An error wrapping ErrWrongHash is returned if it is not.
+func NewBlockWithCid(data []byte, c cid.Cid) (*Block, error) {
+	sum, err := c.Prefix().Sum(data)
+	if err != nil {
+		return nil, fmt.Errorf("error hashing block %s: %v", c, err)
+	}
+	if !sum.Equals(c) {
+		return nil, fmt.Errorf("block %s: %w", c, ErrWrongHash)
+	}
+	return &Block{cid: c, data: data}, nil
+}
+
+// Cid returns the CID of the block.
+func (b *Block) Cid() cid.Cid {
+	return b.cid
+}
+
+// RawData returns the data of the block, which must not be modified.
+func (b *Block) RawData() []byte {
+	return b.data
+}
+
+// String returns the CID of the block.
+func (b *Block) String() string {
+	return fmt.Sprintf("[Block %s]", b.cid)
+}
@@ -0,0 +1,30 @@
+// Package blockstore stores content-addressed blocks, in memory or in a sharded directory, and keeps the
+// blocks of pinned content when the others are garbage collected.
+package blockstore
+
+import (
+	"context"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"p2p/blocks"
+)
+
+// ErrNotFound is returned when a block is not in a blockstore.
+var ErrNotFound = errors.New("block not found")
+
+// Blockstore holds blocks by CID. Implementations are safe for concurrent use.
+type Blockstore interface {
+	// Put stores b, doing nothing if it is already stored.
+	Put(ctx context.Context, b *blocks.Block) error
+	// Get returns the block identified by c, or an error wrapping ErrNotFound.
+	Get(ctx context.Context, c cid.Cid) (*blocks.Block, error)
+	// Has reports whether the block identified by c is stored.
+	Has(ctx context.Context, c cid.Cid) (bool, error)
+	// GetSize returns the size of the block identified by c, or an error wrapping ErrNotFound.
+	GetSize(ctx context.Context, c cid.Cid) (int, error)
+	// Delete removes the block identified by c, doing nothing if it is not stored.
+	Delete(ctx context.Context, c cid.Cid) error
+	// AllKeysChan returns a channel receiving the CID of every block stored, closed once they were all sent
+	// or when ctx is done.
+	AllKeysChan(ctx context.Context) (<-chan cid.Cid, error)
+}
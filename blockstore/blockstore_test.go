@@ -0,0 +1,196 @@
+package blockstore
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/ipfs/go-cid"
+	"os"
+	"p2p/blocks"
+	"p2p/chunker"
+	"p2p/merkledag"
+	"path/filepath"
+	"testing"
+)
+
+func allKeys(t *testing.T, bs Blockstore) map[cid.Cid]bool {
+	t.Helper()
+	ch, err := bs.AllKeysChan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := make(map[cid.Cid]bool)
+	for c := range ch {
+		keys[c] = true
+	}
+	return keys
+}
+
+func TestBlockstores(t *testing.T) {
+	flatfs, err := NewFlatFS(t.TempDir(), WithSync(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, bs := range map[string]Blockstore{"memory": NewMemory(), "flatfs": flatfs} {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			a, b := blocks.NewBlock([]byte("a")), blocks.NewBlock([]byte("bb"))
+			for _, blk := range []*blocks.Block{a, b, a} {
+				if err := bs.Put(ctx, blk); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := bs.Get(ctx, b.Cid())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Cid() != b.Cid() || !bytes.Equal(got.RawData(), b.RawData()) {
+				t.Errorf("Get returned %s, want %s", got, b)
+			}
+			if size, err := bs.GetSize(ctx, b.Cid()); err != nil || size != 2 {
+				t.Errorf("GetSize = %d, %v, want 2", size, err)
+			}
+			if keys := allKeys(t, bs); len(keys) != 2 || !keys[a.Cid()] || !keys[b.Cid()] {
+				t.Errorf("AllKeysChan sent %v, want %s and %s", keys, a.Cid(), b.Cid())
+			}
+
+			if err := bs.Delete(ctx, a.Cid()); err != nil {
+				t.Fatal(err)
+			}
+			if err := bs.Delete(ctx, a.Cid()); err != nil {
+				t.Errorf("deleting a missing block: %v", err)
+			}
+			if ok, err := bs.Has(ctx, a.Cid()); err != nil || ok {
+				t.Errorf("Has of a deleted block = %v, %v", ok, err)
+			}
+			if _, err := bs.Get(ctx, a.Cid()); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get of a deleted block: %v, want ErrNotFound", err)
+			}
+			if _, err := bs.GetSize(ctx, a.Cid()); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetSize of a deleted block: %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestFlatFSDetectsCorruption(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := NewFlatFS(dir, WithSync(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := blocks.NewBlock([]byte("data"))
+	if err := fs.Put(context.Background(), b); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(fs.path(b.Cid()), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Get(context.Background(), b.Cid()); !errors.Is(err, blocks.ErrWrongHash) {
+		t.Errorf("Get of a corrupted block: %v, want ErrWrongHash", err)
+	}
+}
+
+// addFile stores a DAG of random data split in chunks of 1 KiB in bs and returns its root.
+func addFile(t *testing.T, bs Blockstore, size int) cid.Cid {
+	t.Helper()
+	data := make([]byte, size)
+	rand.Read(data)
+	root, err := merkledag.Build(chunker.NewSizeSplitter(bytes.NewReader(data), 1024), func(b *blocks.Block) error {
+		return bs.Put(context.Background(), b)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+func TestGC(t *testing.T) {
+	ctx := context.Background()
+	bs := NewMemory()
+	path := filepath.Join(t.TempDir(), "pins.json")
+	p, err := NewPinner(bs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := addFile(t, bs, 200<<10)
+	kept := len(allKeys(t, bs))
+	loose := blocks.NewBlock([]byte("loose"))
+	direct := blocks.NewBlock([]byte("direct"))
+	bs.Put(ctx, loose)
+	bs.Put(ctx, direct)
+
+	if err := p.Pin(ctx, file, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Pin(ctx, direct.Cid(), false); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Pin(ctx, blocks.NewBlock([]byte("missing")).Cid(), false); !errors.Is(err, ErrNotFound) {
+		t.Errorf("pinning a missing block: %v, want ErrNotFound", err)
+	}
+
+	res, err := p.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Removed != 1 || res.Freed != int64(len(loose.RawData())) {
+		t.Errorf("GC removed %d blocks, %d bytes, want the loose block only", res.Removed, res.Freed)
+	}
+	if keys := allKeys(t, bs); len(keys) != kept+1 || !keys[direct.Cid()] {
+		t.Errorf("GC kept %d blocks, want the %d of the file and the direct pin", len(keys), kept)
+	}
+
+	// The pins are saved and loaded again.
+	p, err = NewPinner(bs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pinned, recursive := p.IsPinned(file); !pinned || !recursive {
+		t.Errorf("file pinned %v, recursive %v once the pins are loaded again", pinned, recursive)
+	}
+	if err := p.Unpin(ctx, file); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.Unpin(ctx, file); !errors.Is(err, ErrNotPinned) {
+		t.Errorf("unpinning twice: %v, want ErrNotPinned", err)
+	}
+	if _, err := p.GC(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if keys := allKeys(t, bs); len(keys) != 1 || !keys[direct.Cid()] {
+		t.Errorf("GC kept %d blocks once the file is unpinned, want the direct pin only", len(keys))
+	}
+}
+
+func TestGCKeepsIncompletePins(t *testing.T) {
+	ctx := context.Background()
+	bs := NewMemory()
+	p, err := NewPinner(bs, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := addFile(t, bs, 200<<10)
+	if err := p.Pin(ctx, file, true); err != nil {
+		t.Fatal(err)
+	}
+	var leaf cid.Cid
+	for c := range allKeys(t, bs) {
+		if c.Type() == cid.Raw {
+			leaf = c
+			break
+		}
+	}
+	bs.Delete(ctx, leaf)
+
+	res, err := p.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Removed != 0 || len(res.Incomplete) != 1 || res.Incomplete[0] != file {
+		t.Errorf("GC of an incomplete pin: %+v, want nothing removed and the pin reported", res)
+	}
+}
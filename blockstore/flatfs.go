@@ -0,0 +1,224 @@
+package blockstore
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"os"
+	"p2p/blocks"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// shardingFile names the file of a flatfs directory recording how it is sharded.
+	shardingFile = "SHARDING"
+	// shardingSpec is the sharding of flatfs directories: by the two characters before the last one of the
+	// name of a block, which spreads blocks evenly over 1024 directories.
+	shardingSpec = "/repo/flatfs/shard/v1/next-to-last/2"
+	// extension is the extension of the files holding blocks.
+	extension = ".data"
+	// tempPrefix starts the names of the files blocks are written to before they are renamed into place.
+	tempPrefix = ".put-"
+)
+
+// encoding turns CIDs into file names, valid on case insensitive file systems.
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// FlatFS is a Blockstore holding every block in a file of its own, in a directory sharded like the flatfs
+// datastore of IPFS.
+type FlatFS struct {
+	dir  string
+	sync bool
+	logf func(format string, args ...interface{})
+}
+
+// config holds the settings of a FlatFS.
+type config struct {
+	sync bool
+	logf func(format string, args ...interface{})
+}
+
+// Option configures a FlatFS opened by NewFlatFS.
+type Option func(cfg *config) error
+
+// WithSync sets whether blocks are flushed to disk before Put returns, true by default. Without it, the
+// blocks put shortly before a crash may be lost, never corrupted.
+func WithSync(sync bool) Option {
+	return func(cfg *config) error {
+		cfg.sync = sync
+		return nil
+	}
+}
+
+// WithLogger sets a function a FlatFS reports the shards it fails to list to. Nothing is reported by default.
+func WithLogger(logf func(format string, args ...interface{})) Option {
+	return func(cfg *config) error {
+		cfg.logf = logf
+		return nil
+	}
+}
+
+// NewFlatFS opens the flatfs directory dir, creating it if needed.
+func NewFlatFS(dir string, opts ...Option) (*FlatFS, error) {
+	cfg := &config{sync: true}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating blockstore directory: %v", err)
+	}
+	spec, err := os.ReadFile(filepath.Join(dir, shardingFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err := os.WriteFile(filepath.Join(dir, shardingFile), []byte(shardingSpec+"\n"), 0644); err != nil {
+			return nil, fmt.Errorf("error creating blockstore directory: %v", err)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("error opening blockstore directory: %v", err)
+	case strings.TrimSpace(string(spec)) != shardingSpec:
+		return nil, fmt.Errorf("blockstore directory %s is sharded with %s", dir, strings.TrimSpace(string(spec)))
+	}
+	return &FlatFS{dir: dir, sync: cfg.sync, logf: cfg.logf}, nil
+}
+
+// path returns the path of the file holding the block identified by c.
+func (fs *FlatFS) path(c cid.Cid) string {
+	name := encoding.EncodeToString(c.Bytes())
+	shard := name[len(name)-3 : len(name)-1]
+	return filepath.Join(fs.dir, shard, name+extension)
+}
+
+func (fs *FlatFS) Put(ctx context.Context, b *blocks.Block) error {
+	path := fs.path(b.Cid())
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error storing block %s: %v", b.Cid(), err)
+	}
+	// The block is written to a temporary file first, so that a block file is always complete.
+	tmp, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return fmt.Errorf("error storing block %s: %v", b.Cid(), err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(b.RawData())
+	if err == nil && fs.sync {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err == nil && fs.sync {
+		err = syncDir(dir)
+	}
+	if err != nil {
+		return fmt.Errorf("error storing block %s: %v", b.Cid(), err)
+	}
+	return nil
+}
+
+// syncDir flushes the entries of dir to disk.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// Get returns the block identified by c. The data read is checked against c, and an error wrapping
+// blocks.ErrWrongHash is returned if the file holding it was corrupted.
+func (fs *FlatFS) Get(ctx context.Context, c cid.Cid) (*blocks.Block, error) {
+	data, err := os.ReadFile(fs.path(c))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%s: %w", c, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading block %s: %v", c, err)
+	}
+	return blocks.NewBlockWithCid(data, c)
+}
+
+func (fs *FlatFS) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	_, err := os.Stat(fs.path(c))
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error looking up block %s: %v", c, err)
+	}
+	return true, nil
+}
+
+func (fs *FlatFS) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	info, err := os.Stat(fs.path(c))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, fmt.Errorf("%s: %w", c, ErrNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error looking up block %s: %v", c, err)
+	}
+	return int(info.Size()), nil
+}
+
+func (fs *FlatFS) Delete(ctx context.Context, c cid.Cid) error {
+	if err := os.Remove(fs.path(c)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error deleting block %s: %v", c, err)
+	}
+	return nil
+}
+
+// AllKeysChan lists the shards one after the other, and skips the files that do not hold a block.
+func (fs *FlatFS) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	shards, err := os.ReadDir(fs.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing blocks: %v", err)
+	}
+	ch := make(chan cid.Cid)
+	go func() {
+		defer close(ch)
+		for _, shard := range shards {
+			if !shard.IsDir() {
+				continue
+			}
+			entries, err := os.ReadDir(filepath.Join(fs.dir, shard.Name()))
+			if err != nil {
+				if fs.logf != nil {
+					fs.logf("error listing blocks in %s: %v", shard.Name(), err)
+				}
+				continue
+			}
+			for _, e := range entries {
+				name := e.Name()
+				if !strings.HasSuffix(name, extension) || strings.HasPrefix(name, tempPrefix) {
+					continue
+				}
+				b, err := encoding.DecodeString(strings.TrimSuffix(name, extension))
+				if err != nil {
+					continue
+				}
+				c, err := cid.Cast(b)
+				if err != nil {
+					continue
+				}
+				select {
+				case ch <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return ch, nil
+}
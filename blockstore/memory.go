@@ -0,0 +1,81 @@
+package blockstore
+
+import (
+	"context"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"p2p/blocks"
+	"sync"
+)
+
+// memory is a Blockstore holding blocks in a map.
+type memory struct {
+	mu     sync.RWMutex
+	blocks map[cid.Cid]*blocks.Block
+}
+
+// NewMemory returns an empty Blockstore holding blocks in memory, lost when the process exits.
+func NewMemory() Blockstore {
+	return &memory{blocks: make(map[cid.Cid]*blocks.Block)}
+}
+
+func (m *memory) Put(ctx context.Context, b *blocks.Block) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blocks[b.Cid()] = b
+	return nil
+}
+
+func (m *memory) Get(ctx context.Context, c cid.Cid) (*blocks.Block, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	b, ok := m.blocks[c]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", c, ErrNotFound)
+	}
+	return b, nil
+}
+
+func (m *memory) Has(ctx context.Context, c cid.Cid) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.blocks[c]
+	return ok, nil
+}
+
+func (m *memory) GetSize(ctx context.Context, c cid.Cid) (int, error) {
+	b, err := m.Get(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	return len(b.RawData()), nil
+}
+
+func (m *memory) Delete(ctx context.Context, c cid.Cid) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blocks, c)
+	return nil
+}
+
+func (m *memory) AllKeysChan(ctx context.Context) (<-chan cid.Cid, error) {
+	m.mu.RLock()
+	keys := make([]cid.Cid, 0, len(m.blocks))
+	for c := range m.blocks {
+		keys = append(keys, c)
+	}
+	m.mu.RUnlock()
+
+	ch := make(chan cid.Cid)
+	go func() {
+		defer close(ch)
+		for _, c := range keys {
+			select {
+			case ch <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,260 @@
+package blockstore
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"os"
+	"p2p/merkledag"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// ErrNotPinned is returned when unpinning a CID that is not pinned.
+var ErrNotPinned = errors.New("not pinned")
+
+// Pin keeps a block from being garbage collected, and every block below it if it is recursive.
+type Pin struct {
+	Cid       cid.Cid `json:"cid"`
+	Recursive bool    `json:"recursive"`
+}
+
+// Pinner records the pins of a Blockstore and garbage collects the blocks none of them keeps. Pins are
+// saved to a file, if it has one, every time they change.
+type Pinner struct {
+	bs   Blockstore
+	path string
+
+	// gc is held for writing by GC and for reading by PinLock, so that blocks being added are not
+	// collected before they are pinned.
+	gc sync.RWMutex
+
+	mu   sync.Mutex
+	pins map[cid.Cid]bool
+}
+
+// GCResult is the outcome of a garbage collection.
+type GCResult struct {
+	// Removed is the number of blocks deleted.
+	Removed int
+	// Freed is the size of the blocks deleted.
+	Freed int64
+	// Incomplete holds the recursive pins some blocks below which are missing. The blocks present were kept.
+	Incomplete []cid.Cid
+}
+
+// NewPinner returns the pinner of bs, with the pins saved in the JSON file at path. An empty path keeps the
+// pins in memory only.
+func NewPinner(bs Blockstore, path string) (*Pinner, error) {
+	p := &Pinner{bs: bs, path: path, pins: make(map[cid.Cid]bool)}
+	if path == "" {
+		return p, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading pins: %v", err)
+	}
+	var pins []Pin
+	if err := json.Unmarshal(data, &pins); err != nil {
+		return nil, fmt.Errorf("error decoding pins: %v", err)
+	}
+	for _, pin := range pins {
+		p.pins[pin.Cid] = pin.Recursive
+	}
+	return p, nil
+}
+
+// PinLock keeps garbage collection from running until the returned function is called. Blocks are
+// collected if they are not pinned, so content being added must be pinned before releasing the lock.
+func (p *Pinner) PinLock() func() {
+	p.gc.RLock()
+	return p.gc.RUnlock
+}
+
+// Pin pins c, and every block below it if recursive is set. The blocks must all be in the blockstore, an
+// error wrapping ErrNotFound is returned otherwise. Pinning a recursive pin directly keeps it recursive.
+func (p *Pinner) Pin(ctx context.Context, c cid.Cid, recursive bool) error {
+	if recursive {
+		if err := walk(ctx, p.bs, c, func(cid.Cid) {}); err != nil {
+			return err
+		}
+	} else if ok, err := p.bs.Has(ctx, c); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("%s: %w", c, ErrNotFound)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.pins[c] && !recursive {
+		return nil
+	}
+	p.pins[c] = recursive
+	return p.save()
+}
+
+// Unpin removes the pin of c, returning an error wrapping ErrNotPinned if there is none. The blocks it kept
+// are deleted by the next garbage collection, unless another pin keeps them.
+func (p *Pinner) Unpin(ctx context.Context, c cid.Cid) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.pins[c]; !ok {
+		return fmt.Errorf("%s: %w", c, ErrNotPinned)
+	}
+	delete(p.pins, c)
+	return p.save()
+}
+
+// IsPinned reports whether c is pinned itself, and whether recursively. Blocks below a recursive pin are
+// kept without being pinned themselves.
+func (p *Pinner) IsPinned(c cid.Cid) (pinned bool, recursive bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	recursive, pinned = p.pins[c]
+	return pinned, recursive
+}
+
+// Pins returns every pin, sorted by CID.
+func (p *Pinner) Pins() []Pin {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.list()
+}
+
+// list returns the pins sorted by CID. p.mu must be held.
+func (p *Pinner) list() []Pin {
+	pins := make([]Pin, 0, len(p.pins))
+	for c, recursive := range p.pins {
+		pins = append(pins, Pin{Cid: c, Recursive: recursive})
+	}
+	sort.Slice(pins, func(i, j int) bool { return pins[i].Cid.KeyString() < pins[j].Cid.KeyString() })
+	return pins
+}
+
+// save writes the pins to the file of p, replacing it atomically. p.mu must be held.
+func (p *Pinner) save() error {
+	if p.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(p.list(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding pins: %v", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p.path), filepath.Base(p.path)+".*")
+	if err != nil {
+		return fmt.Errorf("error saving pins: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p.path)
+	}
+	if err != nil {
+		return fmt.Errorf("error saving pins: %v", err)
+	}
+	return nil
+}
+
+// GC deletes every block of the blockstore that no pin keeps. It waits for the holders of PinLock, and
+// blocks them until it is done.
+func (p *Pinner) GC(ctx context.Context) (GCResult, error) {
+	var res GCResult
+	p.gc.Lock()
+	defer p.gc.Unlock()
+
+	keep := make(map[cid.Cid]struct{})
+	for _, pin := range p.Pins() {
+		if !pin.Recursive {
+			keep[pin.Cid] = struct{}{}
+			continue
+		}
+		err := walk(ctx, p.bs, pin.Cid, func(c cid.Cid) { keep[c] = struct{}{} })
+		if errors.Is(err, ErrNotFound) {
+			// Keep what is left of the pinned content.
+			res.Incomplete = append(res.Incomplete, pin.Cid)
+		} else if err != nil {
+			return res, err
+		}
+	}
+
+	keys, err := p.bs.AllKeysChan(ctx)
+	if err != nil {
+		return res, err
+	}
+	for c := range keys {
+		if _, ok := keep[c]; ok {
+			continue
+		}
+		size, err := p.bs.GetSize(ctx, c)
+		if err != nil {
+			continue
+		}
+		if err := p.bs.Delete(ctx, c); err != nil {
+			return res, err
+		}
+		res.Removed++
+		res.Freed += int64(size)
+	}
+	return res, ctx.Err()
+}
+
+// walk calls visit with root and every block below it, reading the nodes from bs. Raw leaves are not read.
+// It visits every block it can and returns an error wrapping ErrNotFound if some were missing.
+func walk(ctx context.Context, bs Blockstore, root cid.Cid, visit func(c cid.Cid)) error {
+	seen := make(map[cid.Cid]struct{})
+	stack := []cid.Cid{root}
+	var missing error
+	for len(stack) > 0 {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		c := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		seen[c] = struct{}{}
+		visit(c)
+
+		if c.Type() == cid.Raw {
+			if missing == nil {
+				if ok, err := bs.Has(ctx, c); err != nil {
+					return err
+				} else if !ok {
+					missing = fmt.Errorf("%s: %w", c, ErrNotFound)
+				}
+			}
+			continue
+		}
+		b, err := bs.Get(ctx, c)
+		if errors.Is(err, ErrNotFound) {
+			if missing == nil {
+				missing = err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		links, err := merkledag.Links(b)
+		if err != nil {
+			return err
+		}
+		for _, l := range links {
+			stack = append(stack, l.Cid)
+		}
+	}
+	return missing
+}
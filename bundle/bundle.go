@@ -0,0 +1,424 @@
+// Package bundle encrypts payloads to the peer ID of their recipient, so that a relay can hold them for a
+// recipient that is offline and forward them once it comes back, without being able to read or alter them.
+package bundle
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"hash"
+	"io"
+	cr "p2p/crypto"
+	"p2p/peer"
+	"time"
+)
+
+const (
+	// magic starts every bundle, its last byte being the version of the format.
+	magic = "p2pbndl\x01"
+	// chunkSize is the size of the chunks the payload is encrypted in.
+	chunkSize = 64 << 10
+	// maxHeaderSize bounds the header of a bundle.
+	maxHeaderSize = 64 << 10
+	// finalChunk flags the length of the last chunk of a bundle.
+	finalChunk = 1 << 31
+	// keyInfo and signaturePrefix separate the keys and signatures of bundles from those of other protocols.
+	keyInfo         = "p2p bundle key v1"
+	signaturePrefix = "p2p bundle signature v1:"
+)
+
+var (
+	// ErrNotRecipient is returned when opening a bundle encrypted to another peer.
+	ErrNotRecipient = errors.New("bundle is not for this peer")
+	// ErrInvalid is returned for a bundle that was altered, truncated or not signed by its sender.
+	ErrInvalid = errors.New("invalid bundle")
+)
+
+// Envelope is the part of a bundle that is not encrypted, which tells a relay whom to forward it to.
+type Envelope struct {
+	Recipient peer.ID
+	// ephemeral is the X25519 public key the sender generated for the bundle.
+	ephemeral []byte
+	// raw holds the envelope as it was read, which the signature of the sender covers.
+	raw []byte
+}
+
+// Header describes a bundle once opened.
+type Header struct {
+	// Sender is the peer that sealed and signed the bundle, Recipient the peer it was encrypted to.
+	Sender    peer.ID
+	Recipient peer.ID
+	// Name is the name the sender gave the payload, usually the name of the file it was read from.
+	Name    string
+	Created time.Time
+	// Size is the size of the payload.
+	Size uint64
+}
+
+// header is the first chunk of a bundle.
+type header struct {
+	SenderKey []byte    `json:"sender_key"`
+	Name      string    `json:"name,omitempty"`
+	Created   time.Time `json:"created"`
+}
+
+// Seal writes to w the payload read from r encrypted to recipient and signed with the key of the sender, under
+// name.
+//
+// The bundle starts with an envelope in clear, holding the peer ID of the recipient and an X25519 key generated for
+// the bundle. The key the payload is encrypted with is derived from the exchange of that key with the X25519 form
+// of the Ed25519 key held by the peer ID of the recipient, so that only the recipient can derive it again. The
+// header and the payload follow in chunks encrypted with ChaCha20-Poly1305, then the Ed25519 signature of the
+// sender over the envelope, the header and the payload, so that the recipient knows who sealed the bundle and that
+// no chunk was removed, reordered or replaced.
+func Seal(w io.Writer, r io.Reader, sender cr.PrivKey, recipient peer.ID, name string) error {
+	recipientKey, err := recipient.ExtractPublicKey()
+	if err != nil {
+		return fmt.Errorf("error reading key of recipient %s: %v", recipient, err)
+	}
+	recipientX, err := cr.X25519PublicKey(recipientKey)
+	if err != nil {
+		return fmt.Errorf("error converting key of recipient %s: %v", recipient, err)
+	}
+	senderKey, err := sender.GetPublic().Raw()
+	if err != nil {
+		return err
+	}
+
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := io.ReadFull(rand.Reader, ephemeral); err != nil {
+		return fmt.Errorf("error generating key: %v", err)
+	}
+	ephemeralPub, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	shared, err := curve25519.X25519(ephemeral, recipientX)
+	if err != nil {
+		return fmt.Errorf("error exchanging key with recipient %s: %v", recipient, err)
+	}
+	cw, err := newChunkWriter(w, shared, ephemeralPub, recipientX)
+	if err != nil {
+		return err
+	}
+
+	env := encodeEnvelope(recipient, ephemeralPub)
+	if _, err := w.Write(env); err != nil {
+		return fmt.Errorf("error writing bundle: %v", err)
+	}
+	transcript := newTranscript(env)
+
+	hdr, err := json.Marshal(&header{SenderKey: senderKey, Name: name, Created: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if len(hdr) > maxHeaderSize {
+		return errors.New("name of payload is too long")
+	}
+	transcript.Write(hdr)
+	if err := cw.write(hdr, false); err != nil {
+		return err
+	}
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			transcript.Write(buf[:n])
+			if err := cw.write(buf[:n], false); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading payload: %v", err)
+		}
+	}
+
+	sig, err := sender.Sign(transcript.Sum(nil))
+	if err != nil {
+		return fmt.Errorf("error signing bundle: %v", err)
+	}
+	return cw.write(sig, true)
+}
+
+// Open decrypts the bundle read from r with the key of its recipient, writes its payload to w and returns its
+// header once the signature of its sender is verified. As the payload is written while it is decrypted, what was
+// written to w must be discarded if an error is returned. ErrNotRecipient is returned if the bundle is not for the
+// owner of key, and an error wrapping ErrInvalid if it was altered or truncated.
+func Open(w io.Writer, r io.Reader, key cr.PrivKey) (*Header, error) {
+	env, err := ReadEnvelope(r)
+	if err != nil {
+		return nil, err
+	}
+	self, err := peer.GenerateIDFromPubKey(key.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	if env.Recipient != self {
+		return nil, ErrNotRecipient
+	}
+	scalar, err := cr.X25519PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	selfX, err := cr.X25519PublicKey(key.GetPublic())
+	if err != nil {
+		return nil, err
+	}
+	shared, err := curve25519.X25519(scalar, env.ephemeral)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	chunks, err := newChunkReader(r, shared, env.ephemeral, selfX)
+	if err != nil {
+		return nil, err
+	}
+	transcript := newTranscript(env.raw)
+
+	data, final, err := chunks.read()
+	if err != nil {
+		return nil, err
+	}
+	if final || len(data) > maxHeaderSize {
+		return nil, fmt.Errorf("%w: missing header", ErrInvalid)
+	}
+	transcript.Write(data)
+	var hdr header
+	if err := json.Unmarshal(data, &hdr); err != nil {
+		return nil, fmt.Errorf("%w: error decoding header: %v", ErrInvalid, err)
+	}
+	senderKey, err := cr.UnmarshalEd25519PublicKey(hdr.SenderKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	sender, err := peer.GenerateIDFromPubKey(senderKey)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Header{Sender: sender, Recipient: env.Recipient, Name: hdr.Name, Created: hdr.Created}
+	for {
+		data, final, err := chunks.read()
+		if err != nil {
+			return nil, err
+		}
+		if final {
+			if ok, err := senderKey.Verify(transcript.Sum(nil), data); err != nil || !ok {
+				return nil, fmt.Errorf("%w: bad signature of %s", ErrInvalid, sender)
+			}
+			return h, nil
+		}
+		transcript.Write(data)
+		if _, err := w.Write(data); err != nil {
+			return nil, fmt.Errorf("error writing payload: %v", err)
+		}
+		h.Size += uint64(len(data))
+	}
+}
+
+// ReadEnvelope reads the envelope of the bundle read from r, leaving r at its first chunk.
+func ReadEnvelope(r io.Reader) (*Envelope, error) {
+	var head [len(magic) + 2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("error reading bundle: %v", err)
+	}
+	if string(head[:len(magic)]) != magic {
+		return nil, errors.New("not a bundle, or of an unknown version")
+	}
+	idLen := binary.BigEndian.Uint16(head[len(magic):])
+	rest := make([]byte, int(idLen)+curve25519.PointSize)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, fmt.Errorf("error reading bundle: %v", err)
+	}
+	recipient := peer.ID(rest[:idLen])
+	if _, err := recipient.ExtractPublicKey(); err != nil {
+		return nil, fmt.Errorf("invalid recipient of bundle: %v", err)
+	}
+	return &Envelope{
+		Recipient: recipient,
+		ephemeral: rest[idLen:],
+		raw:       append(head[:], rest...),
+	}, nil
+}
+
+// encodeEnvelope returns the envelope of a bundle for recipient, exchanging the ephemeral key: the magic, a uint16
+// big endian length and the peer ID, then the key.
+func encodeEnvelope(recipient peer.ID, ephemeral []byte) []byte {
+	env := append([]byte(magic), 0, 0)
+	binary.BigEndian.PutUint16(env[len(magic):], uint16(len(recipient)))
+	env = append(env, recipient...)
+	return append(env, ephemeral...)
+}
+
+// newTranscript returns the hash signed by the sender of a bundle, starting with its envelope.
+func newTranscript(env []byte) hash.Hash {
+	h := sha256.New()
+	h.Write([]byte(signaturePrefix))
+	h.Write(env)
+	return h
+}
+
+// deriveKey derives the key the chunks of a bundle are encrypted with from the shared secret of the exchange of
+// the ephemeral key with the key of the recipient.
+func deriveKey(shared, ephemeral, recipient []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), recipient...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, []byte(keyInfo)), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// chunkNonce returns the nonce of chunk i, the counter followed by a byte flagging the last chunk, so that chunks
+// cannot be reordered and a truncated bundle is noticed.
+func chunkNonce(i uint64, final bool) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.BigEndian.PutUint64(nonce[3:11], i)
+	if final {
+		nonce[11] = 1
+	}
+	return nonce
+}
+
+// chunkWriter encrypts chunks: each is a uint32 big endian length of ciphertext, its top bit flagging the last
+// chunk, followed by the ciphertext.
+type chunkWriter struct {
+	w    io.Writer
+	aead interface {
+		Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	}
+	n   uint64
+	buf []byte
+}
+
+func newChunkWriter(w io.Writer, shared, ephemeral, recipient []byte) (*chunkWriter, error) {
+	key, err := deriveKey(shared, ephemeral, recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkWriter{w: w, aead: aead, buf: make([]byte, 0, 4+chunkSize+chacha20poly1305.Overhead)}, nil
+}
+
+func (c *chunkWriter) write(data []byte, final bool) error {
+	length := uint32(len(data) + chacha20poly1305.Overhead)
+	if final {
+		length |= finalChunk
+	}
+	buf := binary.BigEndian.AppendUint32(c.buf[:0], length)
+	buf = c.aead.Seal(buf, chunkNonce(c.n, final), data, nil)
+	c.n++
+	if _, err := c.w.Write(buf); err != nil {
+		return fmt.Errorf("error writing bundle: %v", err)
+	}
+	return nil
+}
+
+// chunkReader decrypts the chunks written by a chunkWriter.
+type chunkReader struct {
+	r    io.Reader
+	aead interface {
+		Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+	}
+	n   uint64
+	buf []byte
+}
+
+func newChunkReader(r io.Reader, shared, ephemeral, recipient []byte) (*chunkReader, error) {
+	key, err := deriveKey(shared, ephemeral, recipient)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkReader{r: r, aead: aead, buf: make([]byte, maxChunk)}, nil
+}
+
+// maxChunk is the largest ciphertext of a chunk, the header being encrypted in a single one.
+const maxChunk = maxHeaderSize + chacha20poly1305.Overhead
+
+// read returns the next chunk decrypted, and whether it is the last one.
+func (c *chunkReader) read() ([]byte, bool, error) {
+	data, final, err := readChunk(c.r, c.buf)
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, false, fmt.Errorf("%w: truncated", ErrInvalid)
+		}
+		return nil, false, err
+	}
+	plain, err := c.aead.Open(data[:0], chunkNonce(c.n, final), data, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("%w: chunk %d does not authenticate", ErrInvalid, c.n)
+	}
+	c.n++
+	return plain, final, nil
+}
+
+// readChunk reads the next chunk from r into buf, without decrypting it.
+func readChunk(r io.Reader, buf []byte) ([]byte, bool, error) {
+	var head [4]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, false, err
+	}
+	length := binary.BigEndian.Uint32(head[:])
+	final := length&finalChunk != 0
+	length &^= finalChunk
+	if length < chacha20poly1305.Overhead || int(length) > len(buf) {
+		return nil, false, fmt.Errorf("%w: chunk of %d bytes", ErrInvalid, length)
+	}
+	if _, err := io.ReadFull(r, buf[:length]); err != nil {
+		return nil, false, err
+	}
+	return buf[:length], final, nil
+}
+
+// copyBundle copies the bundle read from r to w as it is, up to limit bytes, and returns its envelope. The
+// chunks are not decrypted, only their lengths are read to find the end of the bundle.
+func copyBundle(w io.Writer, r io.Reader, limit int64) (*Envelope, int64, error) {
+	env, err := ReadEnvelope(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := w.Write(env.raw); err != nil {
+		return nil, 0, err
+	}
+	written := int64(len(env.raw))
+	buf := make([]byte, 4+maxChunk)
+	for {
+		data, final, err := readChunk(r, buf[4:])
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return nil, written, fmt.Errorf("%w: truncated", ErrInvalid)
+			}
+			return nil, written, err
+		}
+		length := uint32(len(data))
+		if final {
+			length |= finalChunk
+		}
+		binary.BigEndian.PutUint32(buf, length)
+		if written += int64(4 + len(data)); written > limit {
+			return nil, written, fmt.Errorf("bundle is larger than %d bytes", limit)
+		}
+		if _, err := w.Write(buf[:4+len(data)]); err != nil {
+			return nil, written, err
+		}
+		if final {
+			return env, written, nil
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package bundle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	cr "p2p/crypto"
+	"p2p/peer"
+	"path/filepath"
+	"testing"
+)
+
+// newPeer returns the key and the peer ID of a new peer.
+func newPeer(t *testing.T) (cr.PrivKey, peer.ID) {
+	t.Helper()
+	priv, pub, err := cr.GenerateEd25519KeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.GenerateIDFromPubKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return priv, id
+}
+
+// seal returns payload sealed by sender to recipient under name.
+func seal(t *testing.T, payload []byte, sender cr.PrivKey, recipient peer.ID, name string) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	if err := Seal(&sealed, bytes.NewReader(payload), sender, recipient, name); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+// envelopeSize returns the size of the envelope of a bundle sealed to recipient.
+func envelopeSize(recipient peer.ID) int {
+	return len(encodeEnvelope(recipient, make([]byte, 32)))
+}
+
+func TestSealOpen(t *testing.T) {
+	senderKey, sender := newPeer(t)
+	recipientKey, recipient := newPeer(t)
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 7} {
+		payload := make([]byte, size)
+		rand.Read(payload)
+		sealed := seal(t, payload, senderKey, recipient, "report.pdf")
+		if bytes.Contains(sealed, []byte("report.pdf")) {
+			t.Errorf("bundle of %d bytes holds the name in clear", size)
+		}
+
+		var opened bytes.Buffer
+		h, err := Open(&opened, bytes.NewReader(sealed), recipientKey)
+		if err != nil {
+			t.Fatalf("Open of %d bytes: %v", size, err)
+		}
+		if !bytes.Equal(opened.Bytes(), payload) {
+			t.Errorf("Open of %d bytes returned another payload", size)
+		}
+		if h.Sender != sender || h.Recipient != recipient || h.Name != "report.pdf" || h.Size != uint64(size) {
+			t.Errorf("Open of %d bytes = %+v", size, h)
+		}
+		env, err := ReadEnvelope(bytes.NewReader(sealed))
+		if err != nil || env.Recipient != recipient {
+			t.Errorf("ReadEnvelope = %v, %v, want recipient %s", env, err, recipient)
+		}
+	}
+}
+
+func TestOpenWrongRecipient(t *testing.T) {
+	senderKey, _ := newPeer(t)
+	_, recipient := newPeer(t)
+	otherKey, _ := newPeer(t)
+	sealed := seal(t, []byte("secret"), senderKey, recipient, "secret.txt")
+
+	var opened bytes.Buffer
+	if _, err := Open(&opened, bytes.NewReader(sealed), otherKey); !errors.Is(err, ErrNotRecipient) {
+		t.Errorf("Open by another peer = %v, want %v", err, ErrNotRecipient)
+	}
+	if _, err := Open(&opened, bytes.NewReader(sealed), senderKey); !errors.Is(err, ErrNotRecipient) {
+		t.Errorf("Open by the sender = %v, want %v", err, ErrNotRecipient)
+	}
+	if opened.Len() != 0 {
+		t.Errorf("Open wrote %d bytes of a bundle for another peer", opened.Len())
+	}
+
+	// A bundle whose envelope is readdressed cannot be opened by its new recipient either.
+	otherKey, other := newPeer(t)
+	env := envelopeSize(recipient)
+	forged := append(encodeEnvelope(other, sealed[env-32:env]), sealed[env:]...)
+	if _, err := Open(&opened, bytes.NewReader(forged), otherKey); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Open of a readdressed bundle = %v, want %v", err, ErrInvalid)
+	}
+}
+
+func TestOpenTampered(t *testing.T) {
+	senderKey, _ := newPeer(t)
+	recipientKey, recipient := newPeer(t)
+	payload := make([]byte, 3*chunkSize+7)
+	rand.Read(payload)
+	sealed := seal(t, payload, senderKey, recipient, "data.bin")
+	env := envelopeSize(recipient)
+
+	tests := []struct {
+		name   string
+		offset int
+	}{
+		{"ephemeral key", env - 1},
+		{"length of the header", env + 3},
+		{"header", env + 10},
+		{"payload", env + len(sealed)/2},
+		{"final flag", len(sealed) - 64 - 16 - 4},
+		{"signature", len(sealed) - 1},
+	}
+	for _, tt := range tests {
+		tampered := append([]byte{}, sealed...)
+		tampered[tt.offset] ^= 0x80
+		if _, err := Open(&bytes.Buffer{}, bytes.NewReader(tampered), recipientKey); !errors.Is(err, ErrInvalid) {
+			t.Errorf("%s altered: Open = %v, want %v", tt.name, err, ErrInvalid)
+		}
+	}
+
+	for _, size := range []int{env, env + 100, len(sealed) - 64 - 16 - 4, len(sealed) - 1} {
+		if _, err := Open(&bytes.Buffer{}, bytes.NewReader(sealed[:size]), recipientKey); !errors.Is(err, ErrInvalid) {
+			t.Errorf("truncated to %d bytes of %d: Open = %v, want %v", size, len(sealed), err, ErrInvalid)
+		}
+	}
+}
+
+func TestOpenReordered(t *testing.T) {
+	senderKey, _ := newPeer(t)
+	recipientKey, recipient := newPeer(t)
+	payload := make([]byte, 2*chunkSize)
+	rand.Read(payload)
+	sealed := seal(t, payload, senderKey, recipient, "data.bin")
+
+	// The two payload chunks precede the signature, each a length and chunkSize bytes with their tag.
+	size := 4 + chunkSize + 16
+	second := len(sealed) - (4 + 64 + 16) - size
+	first := second - size
+	reordered := append([]byte{}, sealed[:first]...)
+	reordered = append(reordered, sealed[second:second+size]...)
+	reordered = append(reordered, sealed[first:second]...)
+	reordered = append(reordered, sealed[second+size:]...)
+	if _, err := Open(&bytes.Buffer{}, bytes.NewReader(reordered), recipientKey); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Open of reordered chunks = %v, want %v", err, ErrInvalid)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	senderKey, _ := newPeer(t)
+	recipientKey, recipient := newPeer(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := Extract(bytes.NewReader(seal(t, []byte("new"), senderKey, recipient, "notes.txt")), recipientKey, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, h.Name)); string(data) != "new" {
+		t.Errorf("extracted %q, want the payload", data)
+	}
+
+	for _, name := range []string{"", "..", "../escape", "a/b", `a\b`} {
+		sealed := seal(t, []byte("payload"), senderKey, recipient, name)
+		if _, err := Extract(bytes.NewReader(sealed), recipientKey, dir); !errors.Is(err, ErrInvalid) {
+			t.Errorf("Extract of %q = %v, want %v", name, err, ErrInvalid)
+		}
+	}
+	sealed := seal(t, []byte("payload"), senderKey, recipient, "cut.txt")
+	if _, err := Extract(bytes.NewReader(sealed[:len(sealed)-1]), recipientKey, dir); !errors.Is(err, ErrInvalid) {
+		t.Errorf("Extract of a truncated bundle = %v, want %v", err, ErrInvalid)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("%d files in the output directory, want only notes.txt", len(entries))
+	}
+}
@@ -0,0 +1,67 @@
+package bundle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	cr "p2p/crypto"
+	"p2p/peer"
+	"path/filepath"
+	"strings"
+)
+
+// SealFile writes to w the file at path sealed to recipient with the key of the sender, under the name of the
+// file.
+func SealFile(w io.Writer, path string, sender cr.PrivKey, recipient peer.ID) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+	bw := bufio.NewWriterSize(w, 4+chunkSize+64)
+	if err := Seal(bw, bufio.NewReaderSize(file, chunkSize), sender, recipient, filepath.Base(path)); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Extract opens the bundle read from r with the key of its recipient and stores its payload in the directory
+// outputDir, under the name the sender gave it, replacing the file of the same name if there is one. The payload
+// is written to a temporary file first, which only takes its name once the signature of the sender is verified.
+func Extract(r io.Reader, key cr.PrivKey, outputDir string) (*Header, error) {
+	tmp, err := os.CreateTemp(outputDir, ".bundle.*.part")
+	if err != nil {
+		return nil, fmt.Errorf("error creating file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriterSize(tmp, chunkSize)
+	h, err := Open(w, r, key)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := storedName(h.Name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(outputDir, name)); err != nil {
+		return nil, fmt.Errorf("error storing file: %v", err)
+	}
+	return h, nil
+}
+
+// storedName returns the name a payload called name is stored under, refusing the names that would leave the
+// output directory.
+func storedName(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) || strings.ContainsRune(name, 0) {
+		return "", fmt.Errorf("%w: invalid name %q", ErrInvalid, name)
+	}
+	return name, nil
+}
@@ -0,0 +1,381 @@
+package bundle
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	cr "p2p/crypto"
+	"p2p/host"
+	"p2p/internal/wire"
+	"p2p/network"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// DepositProtocolID is the protocol negotiated on streams leaving a bundle with a relay.
+	DepositProtocolID protocol.ID = "/p2p/bundle/deposit/1.0.0"
+	// CollectProtocolID is the protocol negotiated on streams collecting from a relay the bundles it holds for the
+	// peer.
+	CollectProtocolID protocol.ID = "/p2p/bundle/collect/1.0.0"
+)
+
+const (
+	defaultMaxSize = 1 << 30
+	defaultTTL     = 7 * 24 * time.Hour
+	// maxMessageSize bounds the status messages a peer accepts.
+	maxMessageSize = 64 << 10
+	// bundleExt ends the names of the bundles held by a mailbox.
+	bundleExt = ".bundle"
+)
+
+// config holds the settings of a mailbox.
+type config struct {
+	maxSize int64
+	ttl     time.Duration
+	logger  func(format string, args ...interface{})
+}
+
+// Option configures a mailbox created by NewMailbox, or the collection of bundles by Collect.
+type Option func(cfg *config) error
+
+// newConfig returns the default settings overridden by opts.
+func newConfig(opts []Option) (*config, error) {
+	cfg := &config{maxSize: defaultMaxSize, ttl: defaultTTL}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// logf reports an event to the logger set by WithLogger, if any.
+func (cfg *config) logf(format string, args ...interface{}) {
+	if cfg.logger != nil {
+		cfg.logger(format, args...)
+	}
+}
+
+// WithMaxSize sets the size of the largest bundle the mailbox accepts, 1 GiB by default.
+func WithMaxSize(size int64) Option {
+	return func(cfg *config) error {
+		if size <= 0 {
+			return errors.New("max size must be positive")
+		}
+		cfg.maxSize = size
+		return nil
+	}
+}
+
+// WithTTL sets how long the mailbox holds a bundle its recipient does not collect, a week by default. Bundles are
+// held until they are collected if ttl is 0.
+func WithTTL(ttl time.Duration) Option {
+	return func(cfg *config) error {
+		if ttl < 0 {
+			return errors.New("ttl must not be negative")
+		}
+		cfg.ttl = ttl
+		return nil
+	}
+}
+
+// WithLogger sets a function a mailbox reports the bundles it holds, expires and fails to take or hand out to, and
+// Collect the bundles it receives and drops. Nothing is reported by default.
+func WithLogger(logf func(format string, args ...interface{})) Option {
+	return func(cfg *config) error {
+		cfg.logger = logf
+		return nil
+	}
+}
+
+// Mailbox holds bundles for their recipients on a relay, in a directory per recipient, until they collect them.
+// It cannot read them: it only reads their envelopes to learn their recipients. It is safe for concurrent use.
+type Mailbox struct {
+	dir string
+	cfg *config
+}
+
+// NewMailbox returns a mailbox holding its bundles in the directory dir, created if needed.
+func NewMailbox(dir string, opts ...Option) (*Mailbox, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("error creating mailbox: %v", err)
+	}
+	return &Mailbox{dir: dir, cfg: cfg}, nil
+}
+
+// Deposit stores the bundle read from r and returns its recipient and the ID it is held under. The bundle is
+// checked to be whole, but cannot be checked to be authentic, which only its recipient can do.
+func (m *Mailbox) Deposit(r io.Reader) (peer.ID, string, error) {
+	tmp, err := os.CreateTemp(m.dir, ".deposit.*")
+	if err != nil {
+		return "", "", fmt.Errorf("error creating file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	w := bufio.NewWriterSize(tmp, 4+chunkSize+64)
+	env, _, err := copyBundle(w, r, m.cfg.maxSize)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	dir := m.recipientDir(env.Recipient)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", "", fmt.Errorf("error creating mailbox: %v", err)
+	}
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", "", err
+	}
+	// IDs sort in the order the bundles were deposited.
+	id := fmt.Sprintf("%020d-%s", time.Now().UnixNano(), hex.EncodeToString(suffix))
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, id+bundleExt)); err != nil {
+		return "", "", fmt.Errorf("error storing bundle: %v", err)
+	}
+	return env.Recipient, id, nil
+}
+
+// Pending returns the IDs of the bundles held for p, the oldest first, removing those held for longer than the
+// ttl of the mailbox.
+func (m *Mailbox) Pending(p peer.ID) ([]string, error) {
+	entries, err := os.ReadDir(m.recipientDir(p))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error reading mailbox: %v", err)
+	}
+	var ids []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !strings.HasSuffix(name, bundleExt) {
+			continue
+		}
+		id := strings.TrimSuffix(name, bundleExt)
+		if m.cfg.ttl > 0 {
+			if info, err := e.Info(); err == nil && time.Since(info.ModTime()) > m.cfg.ttl {
+				m.cfg.logf("dropping bundle %s for %s, held for longer than %v", id, p, m.cfg.ttl)
+				_ = m.Remove(p, id)
+				continue
+			}
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Open returns the bundle held for p under id.
+func (m *Mailbox) Open(p peer.ID, id string) (*os.File, error) {
+	path, err := m.bundlePath(p, id)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+// Remove removes the bundle held for p under id.
+func (m *Mailbox) Remove(p peer.ID, id string) error {
+	path, err := m.bundlePath(p, id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing bundle: %v", err)
+	}
+	return nil
+}
+
+// recipientDir returns the directory of the bundles held for p.
+func (m *Mailbox) recipientDir(p peer.ID) string {
+	return filepath.Join(m.dir, p.String())
+}
+
+// bundlePath returns the path of the bundle held for p under id.
+func (m *Mailbox) bundlePath(p peer.ID, id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", fmt.Errorf("invalid bundle id %q", id)
+	}
+	return filepath.Join(m.recipientDir(p), id+bundleExt), nil
+}
+
+// status answers a deposit.
+type status struct {
+	Error string `json:"error,omitempty"`
+	ID    string `json:"id,omitempty"`
+}
+
+// Register makes h serve m to its peers: it holds the bundles deposited on DepositProtocolID, and hands a peer
+// the bundles held for it on CollectProtocolID.
+func (m *Mailbox) Register(h host.Host) {
+	h.SetStreamHandler(DepositProtocolID, func(s network.Stream) {
+		defer s.Close()
+		if err := m.ServeDeposit(context.Background(), s); err != nil {
+			m.cfg.logf("error holding bundle from %s: %v", s.RemotePeer(), err)
+		}
+	})
+	h.SetStreamHandler(CollectProtocolID, func(s network.Stream) {
+		defer s.Close()
+		if err := m.ServeCollect(context.Background(), s, s.RemotePeer()); err != nil {
+			m.cfg.logf("error handing bundles to %s: %v", s.RemotePeer(), err)
+		}
+	})
+}
+
+// ServeDeposit stores the bundle sent with Send over conn, and answers with the ID it is held under.
+func (m *Mailbox) ServeDeposit(ctx context.Context, conn io.ReadWriter) error {
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	recipient, id, err := m.Deposit(conn)
+	if err != nil {
+		_ = wire.WriteMessage(conn, &status{Error: err.Error()}, maxMessageSize)
+		return wire.ContextError(ctx, err)
+	}
+	m.cfg.logf("holding bundle %s for %s", id, recipient)
+	return wire.ContextError(ctx, wire.WriteMessage(conn, &status{ID: id}, maxMessageSize))
+}
+
+// ServeCollect sends p, the peer on the other end of conn, the bundles held for it, and removes those it
+// acknowledges. Each bundle is announced by a byte 1 and a uint64 big endian size, and is acknowledged by a byte 1,
+// or a byte 0 for the mailbox to keep holding it. A byte 0 ends the bundles.
+func (m *Mailbox) ServeCollect(ctx context.Context, conn io.ReadWriter, p peer.ID) error {
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	ids, err := m.Pending(p)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := m.hand(conn, p, id); err != nil {
+			return wire.ContextError(ctx, err)
+		}
+	}
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return wire.ContextError(ctx, err)
+	}
+	return nil
+}
+
+// hand sends p the bundle held under id, and removes it once acknowledged.
+func (m *Mailbox) hand(conn io.ReadWriter, p peer.ID, id string) error {
+	file, err := m.Open(p, id)
+	if err != nil {
+		// A bundle collected meanwhile is skipped.
+		return nil
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	var head [9]byte
+	head[0] = 1
+	binary.BigEndian.PutUint64(head[1:], uint64(info.Size()))
+	if _, err := conn.Write(head[:]); err != nil {
+		return fmt.Errorf("error sending bundle: %v", err)
+	}
+	if _, err := io.Copy(conn, file); err != nil {
+		return fmt.Errorf("error sending bundle: %v", err)
+	}
+	var ack [1]byte
+	if _, err := io.ReadFull(conn, ack[:]); err != nil {
+		return fmt.Errorf("error reading acknowledgement: %v", err)
+	}
+	if ack[0] == 1 {
+		return m.Remove(p, id)
+	}
+	return nil
+}
+
+// Send leaves the bundle read from bundle with the relay on the other end of conn, a stream negotiating
+// DepositProtocolID, and returns the ID the relay holds it under.
+func Send(ctx context.Context, conn io.ReadWriter, bundle io.Reader) (string, error) {
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	// The bundle is read as the relay does, so that a truncated one is noticed here rather than left waiting for.
+	w := bufio.NewWriterSize(conn, 4+chunkSize+64)
+	if _, _, err := copyBundle(w, bundle, math.MaxInt64); err != nil {
+		return "", wire.ContextError(ctx, err)
+	}
+	if err := w.Flush(); err != nil {
+		return "", wire.ContextError(ctx, fmt.Errorf("error sending bundle: %v", err))
+	}
+	var s status
+	if err := wire.ReadMessage(conn, &s, maxMessageSize); err != nil {
+		return "", wire.ContextError(ctx, err)
+	}
+	if s.Error != "" {
+		return "", fmt.Errorf("relay refused bundle: %s", s.Error)
+	}
+	return s.ID, nil
+}
+
+// Collect asks the relay on the other end of conn, a stream negotiating CollectProtocolID, for the bundles it holds
+// for the owner of key, and extracts them in the directory outputDir as Extract does. It returns the headers of
+// the bundles received. A bundle that is invalid or not for the owner of key is dropped, and reported to the
+// logger set by WithLogger in opts, while a bundle that cannot be stored is left with the relay, the first such
+// error being returned once every bundle was received.
+func Collect(ctx context.Context, conn io.ReadWriter, key cr.PrivKey, outputDir string, opts ...Option) ([]*Header, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	var headers []*Header
+	var firstErr error
+	for {
+		var head [9]byte
+		if _, err := io.ReadFull(conn, head[:1]); err != nil {
+			return headers, wire.ContextError(ctx, fmt.Errorf("error reading bundles: %v", err))
+		}
+		if head[0] == 0 {
+			return headers, firstErr
+		}
+		if _, err := io.ReadFull(conn, head[1:]); err != nil {
+			return headers, wire.ContextError(ctx, fmt.Errorf("error reading bundles: %v", err))
+		}
+		lr := &io.LimitedReader{R: conn, N: int64(binary.BigEndian.Uint64(head[1:]))}
+		h, err := Extract(lr, key, outputDir)
+		if _, derr := io.Copy(io.Discard, lr); derr != nil || lr.N != 0 {
+			return headers, wire.ContextError(ctx, errors.New("error reading bundles: connection closed"))
+		}
+
+		ack := byte(1)
+		switch {
+		case err == nil:
+			cfg.logf("received %s from %s, sealed on %s", h.Name, h.Sender, h.Created.Format(time.RFC3339))
+			headers = append(headers, h)
+		case errors.Is(err, ErrInvalid) || errors.Is(err, ErrNotRecipient):
+			cfg.logf("dropping bundle: %v", err)
+		default:
+			ack = 0
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if _, err := conn.Write([]byte{ack}); err != nil {
+			return headers, wire.ContextError(ctx, fmt.Errorf("error acknowledging bundle: %v", err))
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package bundle
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMailbox(t *testing.T) {
+	senderKey, _ := newPeer(t)
+	_, alice := newPeer(t)
+	_, bob := newPeer(t)
+	mb, err := NewMailbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		sealed := seal(t, []byte(name), senderKey, alice, name)
+		recipient, id, err := mb.Deposit(bytes.NewReader(sealed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if recipient != alice {
+			t.Errorf("Deposit = %s, want recipient %s", recipient, alice)
+		}
+		ids = append(ids, id)
+
+		f, err := mb.Open(alice, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		held := new(bytes.Buffer)
+		held.ReadFrom(f)
+		f.Close()
+		if !bytes.Equal(held.Bytes(), sealed) {
+			t.Errorf("bundle %s is not held as deposited", id)
+		}
+	}
+
+	pending, err := mb.Pending(alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 2 || pending[0] != ids[0] || pending[1] != ids[1] {
+		t.Errorf("Pending = %v, want %v", pending, ids)
+	}
+	if pending, _ := mb.Pending(bob); len(pending) != 0 {
+		t.Errorf("Pending of another peer = %v", pending)
+	}
+
+	if err := mb.Remove(alice, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := mb.Pending(alice); len(pending) != 1 || pending[0] != ids[1] {
+		t.Errorf("Pending after Remove = %v, want [%s]", pending, ids[1])
+	}
+	for _, id := range []string{"", "../x", "a/b", "a.b"} {
+		if _, err := mb.Open(alice, id); err == nil {
+			t.Errorf("Open accepted id %q", id)
+		}
+	}
+}
+
+func TestMailboxRefuses(t *testing.T) {
+	senderKey, _ := newPeer(t)
+	_, recipient := newPeer(t)
+	dir := t.TempDir()
+	mb, err := NewMailbox(dir, WithMaxSize(4096))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := seal(t, make([]byte, 1024), senderKey, recipient, "small")
+	if _, _, err := mb.Deposit(bytes.NewReader(sealed[:len(sealed)-1])); err == nil {
+		t.Error("Deposit accepted a truncated bundle")
+	}
+	if _, _, err := mb.Deposit(bytes.NewReader(seal(t, make([]byte, 8192), senderKey, recipient, "large"))); err == nil {
+		t.Error("Deposit accepted a bundle larger than the max size")
+	}
+	if _, _, err := mb.Deposit(bytes.NewReader([]byte("not a bundle at all"))); err == nil {
+		t.Error("Deposit accepted data that is not a bundle")
+	}
+	if pending, _ := mb.Pending(recipient); len(pending) != 0 {
+		t.Errorf("Pending = %v after refused deposits", pending)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("%d entries left in the mailbox after refused deposits", len(entries))
+	}
+}
+
+func TestMailboxTTL(t *testing.T) {
+	senderKey, _ := newPeer(t)
+	_, recipient := newPeer(t)
+	mb, err := NewMailbox(t.TempDir(), WithTTL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, old, err := mb.Deposit(bytes.NewReader(seal(t, []byte("old"), senderKey, recipient, "old")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, recent, err := mb.Deposit(bytes.NewReader(seal(t, []byte("recent"), senderKey, recipient, "recent")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path, _ := mb.bundlePath(recipient, old)
+	past := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(path, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	pending, err := mb.Pending(recipient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0] != recent {
+		t.Errorf("Pending = %v, want [%s]", pending, recent)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expired bundle was not removed")
+	}
+}
+
+func TestCollect(t *testing.T) {
+	senderKey, sender := newPeer(t)
+	recipientKey, recipient := newPeer(t)
+	otherKey, _ := newPeer(t)
+	mb, err := NewMailbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := mb.Deposit(bytes.NewReader(seal(t, []byte("hello"), senderKey, recipient, "hello.txt"))); err != nil {
+		t.Fatal(err)
+	}
+	// A bundle altered after it was deposited is dropped by the recipient.
+	tampered := seal(t, []byte("altered"), otherKey, recipient, "altered.txt")
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := mb.Deposit(bytes.NewReader(tampered)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	a, b := net.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		defer b.Close()
+		served <- mb.ServeCollect(ctx, b, recipient)
+	}()
+	out := t.TempDir()
+	headers, err := Collect(ctx, a, recipientKey, out)
+	a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+
+	if len(headers) != 1 || headers[0].Name != "hello.txt" || headers[0].Sender != sender {
+		t.Fatalf("Collect = %+v, want hello.txt from %s", headers, sender)
+	}
+	if data, _ := os.ReadFile(filepath.Join(out, "hello.txt")); string(data) != "hello" {
+		t.Errorf("collected %q, want the payload", data)
+	}
+	if _, err := os.Stat(filepath.Join(out, "altered.txt")); !os.IsNotExist(err) {
+		t.Errorf("altered bundle was extracted")
+	}
+	if pending, _ := mb.Pending(recipient); len(pending) != 0 {
+		t.Errorf("Pending = %v after collection, want the bundles removed", pending)
+	}
+}
+
+func TestSend(t *testing.T) {
+	senderKey, _ := newPeer(t)
+	_, recipient := newPeer(t)
+	mb, err := NewMailbox(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	a, b := net.Pipe()
+	go func() {
+		defer b.Close()
+		mb.ServeDeposit(ctx, b)
+	}()
+	id, err := Send(ctx, a, bytes.NewReader(seal(t, []byte("hello"), senderKey, recipient, "hello.txt")))
+	a.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, _ := mb.Pending(recipient); len(pending) != 1 || pending[0] != id {
+		t.Errorf("Pending = %v, want [%s]", pending, id)
+	}
+}
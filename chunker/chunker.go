@@ -0,0 +1,142 @@
+// Package chunker splits data into chunks, either of a fixed size or at boundaries found in the content with
+// Rabin fingerprints, so that data inserted or removed in a file only changes the chunks around it.
+package chunker
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// DefaultBlockSize is the size of the chunks of the fixed size splitter, and the average size of the chunks
+// of the Rabin splitter, unless set otherwise.
+const DefaultBlockSize = 256 << 10
+
+// MaxBlockSize bounds the size of the chunks of every splitter.
+const MaxBlockSize = 1 << 20
+
+// Splitter splits the data of a reader into chunks.
+type Splitter interface {
+	// NextBytes returns the next chunk, or io.EOF once the data is split whole. Chunks are never empty,
+	// and the slice returned is only valid until the next call.
+	NextBytes() ([]byte, error)
+}
+
+// sizeSplitter cuts the data every size bytes.
+type sizeSplitter struct {
+	r    io.Reader
+	buf  []byte
+	done bool
+}
+
+// NewSizeSplitter returns a splitter cutting the data read from r in chunks of size bytes, the last one
+// being shorter.
+func NewSizeSplitter(r io.Reader, size int) Splitter {
+	return &sizeSplitter{r: r, buf: make([]byte, size)}
+}
+
+func (s *sizeSplitter) NextBytes() ([]byte, error) {
+	if s.done {
+		return nil, io.EOF
+	}
+	n, err := io.ReadFull(s.r, s.buf)
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		s.done = true
+	case err == io.EOF:
+		s.done = true
+		return nil, io.EOF
+	case err != nil:
+		return nil, err
+	}
+	return s.buf[:n], nil
+}
+
+// FromString returns the splitter of r described by spec, which is the same on every node splitting data
+// the same way:
+//
+//	""                              fixed chunks of DefaultBlockSize bytes
+//	"size-<size>"                   fixed chunks of size bytes
+//	"rabin"                         Rabin chunks of DefaultBlockSize bytes on average
+//	"rabin-<avg>"                   Rabin chunks of about avg bytes
+//	"rabin-<min>-<avg>-<max>"       Rabin chunks of about avg bytes, between min and max
+func FromString(r io.Reader, spec string) (Splitter, error) {
+	if err := CheckSpec(spec); err != nil {
+		return nil, err
+	}
+	switch parts := strings.Split(spec, "-"); {
+	case spec == "":
+		return NewSizeSplitter(r, DefaultBlockSize), nil
+	case parts[0] == "size":
+		size, _ := strconv.Atoi(parts[1])
+		return NewSizeSplitter(r, size), nil
+	case len(parts) == 1:
+		return NewRabin(r, DefaultBlockSize), nil
+	case len(parts) == 2:
+		avg, _ := strconv.Atoi(parts[1])
+		return NewRabin(r, avg), nil
+	default:
+		min, _ := strconv.Atoi(parts[1])
+		avg, _ := strconv.Atoi(parts[2])
+		max, _ := strconv.Atoi(parts[3])
+		return NewRabinMinMax(r, min, avg, max), nil
+	}
+}
+
+// CheckSpec returns an error if spec does not describe a splitter FromString knows.
+func CheckSpec(spec string) error {
+	if spec == "" {
+		return nil
+	}
+	parts := strings.Split(spec, "-")
+	sizes := make([]int, 0, 3)
+	for _, p := range parts[1:] {
+		n, err := strconv.Atoi(p)
+		if err != nil || n <= 0 || n > MaxBlockSize {
+			return fmt.Errorf("invalid chunker %q: sizes must be between 1 and %d", spec, MaxBlockSize)
+		}
+		sizes = append(sizes, n)
+	}
+	switch {
+	case parts[0] == "size" && len(sizes) == 1:
+	case parts[0] == "rabin" && (len(sizes) <= 1 || len(sizes) == 3):
+		if len(sizes) == 3 && !(sizes[0] <= sizes[1] && sizes[1] <= sizes[2]) {
+			return fmt.Errorf("invalid chunker %q: sizes must be in increasing order", spec)
+		}
+		if len(sizes) > 0 && sizes[len(sizes)/2] < 16 {
+			return errors.New("invalid chunker: Rabin chunks must be at least 16 bytes on average")
+		}
+	default:
+		return fmt.Errorf("unknown chunker %q", spec)
+	}
+	return nil
+}
+
+// MinSize returns the size of the smallest chunk the splitter described by spec cuts, the last chunk of the data
+// aside, which can be shorter.
+func MinSize(spec string) (int, error) {
+	if err := CheckSpec(spec); err != nil {
+		return 0, err
+	}
+	var min int
+	switch parts := strings.Split(spec, "-"); {
+	case spec == "":
+		return DefaultBlockSize, nil
+	case parts[0] == "size":
+		size, _ := strconv.Atoi(parts[1])
+		return size, nil
+	case len(parts) == 1:
+		min = DefaultBlockSize / 3
+	case len(parts) == 2:
+		avg, _ := strconv.Atoi(parts[1])
+		min = avg / 3
+	default:
+		min, _ = strconv.Atoi(parts[1])
+	}
+	if min < windowSize {
+		min = windowSize
+	}
+	return min, nil
+}
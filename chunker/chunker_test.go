@@ -0,0 +1,64 @@
+package chunker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestMinSize(t *testing.T) {
+	tests := []struct {
+		spec string
+		min  int
+	}{
+		{"", DefaultBlockSize},
+		{"size-1000", 1000},
+		{"rabin", DefaultBlockSize / 3},
+		{"rabin-3000", 1000},
+		{"rabin-90", windowSize},
+		{"rabin-500-1000-2000", 500},
+		{"rabin-16-32-64", windowSize},
+	}
+	for _, tt := range tests {
+		got, err := MinSize(tt.spec)
+		if err != nil || got != tt.min {
+			t.Errorf("MinSize(%q) = %d, %v, want %d", tt.spec, got, err, tt.min)
+		}
+	}
+	if _, err := MinSize("rabin-0"); err == nil {
+		t.Error("MinSize accepted an invalid spec")
+	}
+}
+
+func TestChunksAreAtLeastMinSize(t *testing.T) {
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	for _, spec := range []string{"", "size-4096", "rabin-8192", "rabin-1024-4096-16384"} {
+		min, err := MinSize(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		spl, err := FromString(bytes.NewReader(data), spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var total int
+		for {
+			chunk, err := spl.NextBytes()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			total += len(chunk)
+			if len(chunk) < min && total != len(data) {
+				t.Fatalf("%q cut a chunk of %d bytes before the last, below %d", spec, len(chunk), min)
+			}
+		}
+		if total != len(data) {
+			t.Fatalf("%q split %d bytes of %d", spec, total, len(data))
+		}
+	}
+}
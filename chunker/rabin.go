@@ -0,0 +1,131 @@
+package chunker
+
+import (
+	"bufio"
+	"io"
+	"math/bits"
+)
+
+// polynomial is the irreducible polynomial of degree 53 over GF(2) the fingerprints are computed modulo.
+// Splitters using another one would cut the same data elsewhere.
+const polynomial pol = 0x3DA3358B4DC173
+
+// windowSize is the number of bytes the fingerprint is computed over.
+const windowSize = 64
+
+// pol is a polynomial over GF(2), bit i being the coefficient of x^i.
+type pol uint64
+
+// deg returns the degree of x, -1 for the zero polynomial.
+func (x pol) deg() int {
+	return bits.Len64(uint64(x)) - 1
+}
+
+// mod returns the remainder of the division of x by d.
+func (x pol) mod(d pol) pol {
+	for x.deg() >= d.deg() {
+		x ^= d << uint(x.deg()-d.deg())
+	}
+	return x
+}
+
+// tables hold the precomputed steps of the rolling fingerprint.
+type tables struct {
+	// out[b] is the fingerprint of b followed by windowSize-1 zero bytes, removed when b leaves the window.
+	out [256]pol
+	// mod[b] reduces a fingerprint whose top byte is b after it is shifted by a byte.
+	mod [256]pol
+}
+
+var rabinTables = newTables(polynomial)
+
+func newTables(p pol) *tables {
+	t := &tables{}
+	k := p.deg()
+	for b := 0; b < 256; b++ {
+		var h pol
+		h = ((h << 8) | pol(b)).mod(p)
+		for i := 0; i < windowSize-1; i++ {
+			h = (h << 8).mod(p)
+		}
+		t.out[b] = h
+		t.mod[b] = (pol(b) << uint(k)).mod(p) | pol(b)<<uint(k)
+	}
+	return t
+}
+
+// rabin cuts the data where the fingerprint of the last windowSize bytes has its low bits all zero.
+type rabin struct {
+	r        *bufio.Reader
+	min, max int
+	mask     pol
+	shift    uint
+	buf      []byte
+	done     bool
+}
+
+// NewRabin returns a splitter cutting the data read from r in chunks of about avg bytes, between a third of
+// avg and one and a half times avg.
+func NewRabin(r io.Reader, avg int) Splitter {
+	return NewRabinMinMax(r, avg/3, avg, avg+avg/2)
+}
+
+// NewRabinMinMax returns a splitter cutting the data read from r in chunks of about avg bytes, rounded
+// down to a power of two, and of at least min and at most max bytes. The boundaries only depend on the
+// content, so that data inserted or removed only changes the chunks around it.
+func NewRabinMinMax(r io.Reader, min, avg, max int) Splitter {
+	if max > MaxBlockSize {
+		max = MaxBlockSize
+	}
+	if min < windowSize {
+		min = windowSize
+	}
+	if max < min {
+		max = min
+	}
+	return &rabin{
+		r:     bufio.NewReaderSize(r, 64<<10),
+		min:   min,
+		max:   max,
+		mask:  pol(1)<<uint(bits.Len(uint(avg))-1) - 1,
+		shift: uint(polynomial.deg() - 8),
+		buf:   make([]byte, 0, max),
+	}
+}
+
+func (c *rabin) NextBytes() ([]byte, error) {
+	if c.done {
+		return nil, io.EOF
+	}
+	c.buf = c.buf[:0]
+	var window [windowSize]byte
+	var digest pol
+	pos := 0
+	t := rabinTables
+	for len(c.buf) < c.max {
+		b, err := c.r.ReadByte()
+		if err == io.EOF {
+			c.done = true
+			if len(c.buf) == 0 {
+				return nil, io.EOF
+			}
+			return c.buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+
+		// Slide the window: remove the oldest byte and append b.
+		digest ^= t.out[window[pos]]
+		window[pos] = b
+		pos = (pos + 1) % windowSize
+		index := byte(digest >> c.shift)
+		digest = (digest<<8 | pol(b)) ^ t.mod[index]
+
+		if len(c.buf) >= c.min && digest&c.mask == 0 {
+			break
+		}
+	}
+	return c.buf, nil
+}
@@ -0,0 +1,372 @@
+// Package conngater provides a connection gater backed by allow and deny lists of
+// peer IDs, multiaddrs and subnets, persisted to a JSON file.
+package conngater
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"net"
+	"os"
+	"p2p/connmgr"
+	"p2p/network"
+	"p2p/peer"
+	"path/filepath"
+	"sync"
+)
+
+// BasicConnectionGater is a connmgr.ConnectionGater enforcing a deny list and an allow list.
+//
+// A connection is refused if its peer, its remote multiaddr or the subnet of its remote IP is
+// denied. Once the allow list holds any entry, a connection is also refused unless its peer,
+// its remote multiaddr or its subnet is allowed. A listed multiaddr matches every address it
+// is a prefix of, so /ip4/10.0.0.1 matches /ip4/10.0.0.1/tcp/5031.
+//
+// Every change is saved to the file the gater was created with, if any.
+type BasicConnectionGater struct {
+	mu    sync.RWMutex
+	path  string
+	deny  *Rules
+	allow *Rules
+}
+
+var _ connmgr.ConnectionGater = (*BasicConnectionGater)(nil)
+
+// Rules is a list of peers, multiaddrs and subnets, either allowed or denied by a BasicConnectionGater.
+type Rules struct {
+	g       *BasicConnectionGater
+	peers   map[peer.ID]struct{}
+	addrs   []ma.Multiaddr
+	subnets []*net.IPNet
+}
+
+// persistedRules is the JSON representation of Rules.
+type persistedRules struct {
+	Peers   []peer.ID `json:"peers,omitempty"`
+	Addrs   []string  `json:"addrs,omitempty"`
+	Subnets []string  `json:"subnets,omitempty"`
+}
+
+// persistedGater is the JSON representation of a BasicConnectionGater.
+type persistedGater struct {
+	Deny  persistedRules `json:"deny"`
+	Allow persistedRules `json:"allow"`
+}
+
+// NewBasicConnectionGater returns a gater whose lists are loaded from and saved to the JSON file at path.
+// The file is created on the first change if it does not exist. An empty path keeps the lists in memory.
+func NewBasicConnectionGater(path string) (*BasicConnectionGater, error) {
+	g := &BasicConnectionGater{path: path}
+	g.deny = newRules(g)
+	g.allow = newRules(g)
+	if path == "" {
+		return g, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return g, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading gater lists: %v", err)
+	}
+	var pg persistedGater
+	if err := json.Unmarshal(data, &pg); err != nil {
+		return nil, fmt.Errorf("error decoding gater lists: %v", err)
+	}
+	if err := g.deny.load(pg.Deny); err != nil {
+		return nil, err
+	}
+	if err := g.allow.load(pg.Allow); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Deny returns the deny list of the gater.
+func (g *BasicConnectionGater) Deny() *Rules {
+	return g.deny
+}
+
+// Allow returns the allow list of the gater.
+func (g *BasicConnectionGater) Allow() *Rules {
+	return g.allow
+}
+
+// InterceptPeerDial refuses to dial denied peers.
+func (g *BasicConnectionGater) InterceptPeerDial(p peer.ID) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return !g.deny.hasPeer(p)
+}
+
+// InterceptAddrDial refuses to dial denied addresses and peers.
+func (g *BasicConnectionGater) InterceptAddrDial(p peer.ID, addr ma.Multiaddr) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return !g.deny.hasPeer(p) && !g.deny.matchAddr(addr)
+}
+
+// InterceptAccept refuses inbound connections from denied addresses.
+func (g *BasicConnectionGater) InterceptAccept(addrs network.ConnMultiaddrs) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return !g.deny.matchAddr(addrs.RemoteMultiaddr())
+}
+
+// InterceptSecured refuses denied peers, and peers not allowed once the allow list holds any entry.
+func (g *BasicConnectionGater) InterceptSecured(_ network.Direction, p peer.ID, addrs network.ConnMultiaddrs) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.allowed(p, addrs.RemoteMultiaddr())
+}
+
+// InterceptUpgraded checks the lists once more, in case they changed while the connection was set up.
+func (g *BasicConnectionGater) InterceptUpgraded(c network.Conn) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	return g.allowed(c.RemotePeer(), c.RemoteMultiaddr())
+}
+
+// allowed applies both lists to a connection with peer p at addr. The lock must be held.
+func (g *BasicConnectionGater) allowed(p peer.ID, addr ma.Multiaddr) bool {
+	if g.deny.hasPeer(p) || g.deny.matchAddr(addr) {
+		return false
+	}
+	if g.allow.empty() {
+		return true
+	}
+	return g.allow.hasPeer(p) || g.allow.matchAddr(addr)
+}
+
+// save writes the lists deny and allow to the file of the gater. The lock must be held.
+func (g *BasicConnectionGater) save(deny, allow *Rules) error {
+	if g.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(persistedGater{Deny: deny.persisted(), Allow: allow.persisted()}, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so that a crash never leaves a truncated file behind.
+	tmp, err := os.CreateTemp(filepath.Dir(g.path), filepath.Base(g.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("error saving gater lists: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error saving gater lists: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error saving gater lists: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), g.path); err != nil {
+		return fmt.Errorf("error saving gater lists: %v", err)
+	}
+	return nil
+}
+
+func newRules(g *BasicConnectionGater) *Rules {
+	return &Rules{g: g, peers: make(map[peer.ID]struct{})}
+}
+
+// AddPeer adds peer p to the list.
+func (r *Rules) AddPeer(p peer.ID) error {
+	return r.update(func(next *Rules) {
+		next.peers[p] = struct{}{}
+	})
+}
+
+// RemovePeer removes peer p from the list.
+func (r *Rules) RemovePeer(p peer.ID) error {
+	return r.update(func(next *Rules) {
+		delete(next.peers, p)
+	})
+}
+
+// Peers returns the peers in the list.
+func (r *Rules) Peers() []peer.ID {
+	r.g.mu.RLock()
+	defer r.g.mu.RUnlock()
+	peers := make([]peer.ID, 0, len(r.peers))
+	for p := range r.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// AddAddr adds addr to the list. It matches every multiaddr it is a prefix of.
+func (r *Rules) AddAddr(addr ma.Multiaddr) error {
+	return r.update(func(next *Rules) {
+		for _, a := range next.addrs {
+			if a.Equal(addr) {
+				return
+			}
+		}
+		next.addrs = append(next.addrs, addr)
+	})
+}
+
+// RemoveAddr removes addr from the list.
+func (r *Rules) RemoveAddr(addr ma.Multiaddr) error {
+	return r.update(func(next *Rules) {
+		for i, a := range next.addrs {
+			if a.Equal(addr) {
+				next.addrs = append(next.addrs[:i], next.addrs[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// Addrs returns the multiaddrs in the list.
+func (r *Rules) Addrs() []ma.Multiaddr {
+	r.g.mu.RLock()
+	defer r.g.mu.RUnlock()
+	return append([]ma.Multiaddr(nil), r.addrs...)
+}
+
+// AddSubnet adds the subnet ipnet to the list.
+func (r *Rules) AddSubnet(ipnet *net.IPNet) error {
+	return r.update(func(next *Rules) {
+		for _, n := range next.subnets {
+			if n.String() == ipnet.String() {
+				return
+			}
+		}
+		next.subnets = append(next.subnets, ipnet)
+	})
+}
+
+// RemoveSubnet removes the subnet ipnet from the list.
+func (r *Rules) RemoveSubnet(ipnet *net.IPNet) error {
+	return r.update(func(next *Rules) {
+		for i, n := range next.subnets {
+			if n.String() == ipnet.String() {
+				next.subnets = append(next.subnets[:i], next.subnets[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+// Subnets returns the subnets in the list.
+func (r *Rules) Subnets() []*net.IPNet {
+	r.g.mu.RLock()
+	defer r.g.mu.RUnlock()
+	return append([]*net.IPNet(nil), r.subnets...)
+}
+
+// update applies change to a copy of the list and saves the gater with it, replacing the list with the copy only
+// once saved, so that a change that cannot be saved is not applied either.
+func (r *Rules) update(change func(next *Rules)) error {
+	r.g.mu.Lock()
+	defer r.g.mu.Unlock()
+	next := r.clone()
+	change(next)
+	deny, allow := r.g.deny, r.g.allow
+	if r == deny {
+		deny = next
+	} else {
+		allow = next
+	}
+	if err := r.g.save(deny, allow); err != nil {
+		return err
+	}
+	r.peers, r.addrs, r.subnets = next.peers, next.addrs, next.subnets
+	return nil
+}
+
+// clone returns a copy of the list that can be changed without changing it. The lock must be held.
+func (r *Rules) clone() *Rules {
+	c := &Rules{
+		g:       r.g,
+		peers:   make(map[peer.ID]struct{}, len(r.peers)),
+		addrs:   append([]ma.Multiaddr(nil), r.addrs...),
+		subnets: append([]*net.IPNet(nil), r.subnets...),
+	}
+	for p := range r.peers {
+		c.peers[p] = struct{}{}
+	}
+	return c
+}
+
+// hasPeer reports whether p is in the list. The lock must be held.
+func (r *Rules) hasPeer(p peer.ID) bool {
+	if p == "" {
+		return false
+	}
+	_, ok := r.peers[p]
+	return ok
+}
+
+// matchAddr reports whether addr matches an address or subnet of the list. The lock must be held.
+func (r *Rules) matchAddr(addr ma.Multiaddr) bool {
+	if addr == nil {
+		return false
+	}
+	for _, a := range r.addrs {
+		if bytes.HasPrefix(addr.Bytes(), a.Bytes()) {
+			return true
+		}
+	}
+	if len(r.subnets) == 0 {
+		return false
+	}
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return false
+	}
+	for _, n := range r.subnets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// empty reports whether the list has no entry. The lock must be held.
+func (r *Rules) empty() bool {
+	return len(r.peers) == 0 && len(r.addrs) == 0 && len(r.subnets) == 0
+}
+
+// persisted returns the JSON representation of the list. The lock must be held.
+func (r *Rules) persisted() persistedRules {
+	var pr persistedRules
+	for p := range r.peers {
+		pr.Peers = append(pr.Peers, p)
+	}
+	for _, a := range r.addrs {
+		pr.Addrs = append(pr.Addrs, a.String())
+	}
+	for _, n := range r.subnets {
+		pr.Subnets = append(pr.Subnets, n.String())
+	}
+	return pr
+}
+
+// load fills the list from its JSON representation.
+func (r *Rules) load(pr persistedRules) error {
+	for _, p := range pr.Peers {
+		r.peers[p] = struct{}{}
+	}
+	for _, s := range pr.Addrs {
+		addr, err := ma.NewMultiaddr(s)
+		if err != nil {
+			return fmt.Errorf("invalid multiaddr %q in gater lists: %v", s, err)
+		}
+		r.addrs = append(r.addrs, addr)
+	}
+	for _, s := range pr.Subnets {
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return fmt.Errorf("invalid subnet %q in gater lists: %v", s, err)
+		}
+		r.subnets = append(r.subnets, ipnet)
+	}
+	return nil
+}
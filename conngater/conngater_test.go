@@ -0,0 +1,145 @@
+package conngater
+
+import (
+	"crypto/rand"
+	ma "github.com/multiformats/go-multiaddr"
+	"net"
+	cr "p2p/crypto"
+	"p2p/network"
+	"p2p/peer"
+	"path/filepath"
+	"testing"
+)
+
+// addrs are the multiaddrs of a connection, of which the gater only reads the remote one.
+type addrs struct {
+	remote ma.Multiaddr
+}
+
+func (a addrs) LocalMultiaddr() ma.Multiaddr  { return nil }
+func (a addrs) RemoteMultiaddr() ma.Multiaddr { return a.remote }
+
+func newPeerID(t *testing.T) peer.ID {
+	t.Helper()
+	_, pub, err := cr.GenerateEd25519KeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := peer.GenerateIDFromPubKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestGaterLists(t *testing.T) {
+	g, err := NewBasicConnectionGater("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob, mallory := newPeerID(t), newPeerID(t), newPeerID(t)
+	_, subnet, _ := net.ParseCIDR("10.1.0.0/16")
+	inside := addrs{ma.StringCast("/ip4/10.1.2.3/tcp/4001")}
+	outside := addrs{ma.StringCast("/ip4/192.0.2.1/tcp/4001")}
+
+	if !g.InterceptSecured(network.DirInbound, alice, outside) {
+		t.Error("empty lists refused a connection")
+	}
+	if err := g.Deny().AddPeer(mallory); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Deny().AddAddr(ma.StringCast("/ip4/192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	if g.InterceptPeerDial(mallory) || !g.InterceptPeerDial(alice) {
+		t.Error("InterceptPeerDial does not follow the deny list")
+	}
+	if g.InterceptAccept(outside) || !g.InterceptAccept(inside) {
+		t.Error("InterceptAccept does not match the denied address as a prefix")
+	}
+
+	if err := g.Allow().AddSubnet(subnet); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Allow().AddPeer(bob); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name  string
+		p     peer.ID
+		addrs addrs
+		ok    bool
+	}{
+		{"allowed subnet", alice, inside, true},
+		{"allowed peer", bob, addrs{ma.StringCast("/ip4/198.51.100.1/tcp/4001")}, true},
+		{"not allowed", alice, addrs{ma.StringCast("/ip4/198.51.100.1/tcp/4001")}, false},
+		{"denied peer in allowed subnet", mallory, inside, false},
+		{"allowed peer at denied address", bob, outside, false},
+	}
+	for _, tt := range tests {
+		if got := g.InterceptSecured(network.DirInbound, tt.p, tt.addrs); got != tt.ok {
+			t.Errorf("%s: InterceptSecured = %v, want %v", tt.name, got, tt.ok)
+		}
+	}
+}
+
+func TestGaterPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gater.json")
+	g, err := NewBasicConnectionGater(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPeerID(t)
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/8")
+	if err := g.Deny().AddPeer(p); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Deny().AddSubnet(subnet); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Allow().AddAddr(ma.StringCast("/ip4/192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Allow().AddAddr(ma.StringCast("/ip4/192.0.2.2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := g.Allow().RemoveAddr(ma.StringCast("/ip4/192.0.2.1")); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := NewBasicConnectionGater(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peers := loaded.Deny().Peers(); len(peers) != 1 || peers[0] != p {
+		t.Errorf("denied peers = %v, want [%s]", peers, p)
+	}
+	if subnets := loaded.Deny().Subnets(); len(subnets) != 1 || subnets[0].String() != "10.0.0.0/8" {
+		t.Errorf("denied subnets = %v, want [10.0.0.0/8]", subnets)
+	}
+	if as := loaded.Allow().Addrs(); len(as) != 1 || as[0].String() != "/ip4/192.0.2.2" {
+		t.Errorf("allowed addrs = %v, want [/ip4/192.0.2.2]", as)
+	}
+}
+
+func TestGaterChangeNotSaved(t *testing.T) {
+	// The directory of the file does not exist, so that no change can be saved.
+	g, err := NewBasicConnectionGater(filepath.Join(t.TempDir(), "missing", "gater.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPeerID(t)
+	_, subnet, _ := net.ParseCIDR("10.0.0.0/8")
+	if err := g.Deny().AddPeer(p); err == nil {
+		t.Fatal("AddPeer saved to a missing directory")
+	}
+	if err := g.Allow().AddSubnet(subnet); err == nil {
+		t.Fatal("AddSubnet saved to a missing directory")
+	}
+	if len(g.Deny().Peers()) != 0 || len(g.Allow().Subnets()) != 0 {
+		t.Error("a change that could not be saved was applied")
+	}
+	if !g.InterceptPeerDial(p) {
+		t.Error("a peer whose denial could not be saved is refused")
+	}
+}
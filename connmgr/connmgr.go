@@ -0,0 +1,396 @@
+// Package connmgr keeps the number of open connections of a host within bounds.
+//
+// Once the number of connections goes over a high watermark, the connection manager closes the
+// connections of the least valuable peers until it is back to a low watermark. The value of a peer
+// is the sum of the tags services put on it, peers that are protected or whose connections are
+// younger than the grace period are never pruned.
+package connmgr
+
+import (
+	"context"
+	"errors"
+	"p2p/network"
+	"p2p/peer"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnManager tracks the connections of a host and prunes them when there are too many.
+type ConnManager interface {
+	// TagPeer sets the value of tag on peer p, replacing any previous value.
+	TagPeer(p peer.ID, tag string, val int)
+	// UntagPeer removes tag from peer p.
+	UntagPeer(p peer.ID, tag string)
+	// UpsertTag updates the value of tag on peer p with upsert, which receives the current
+	// value, zero if the tag is not set.
+	UpsertTag(p peer.ID, tag string, upsert func(int) int)
+	// GetTagInfo returns the tags and connections of peer p, nil if the peer is unknown.
+	GetTagInfo(p peer.ID) *TagInfo
+
+	// Protect protects peer p from pruning on behalf of tag. A peer stays protected
+	// as long as at least one tag protects it.
+	Protect(p peer.ID, tag string)
+	// Unprotect removes the protection tag put on peer p, returning whether the peer is still protected.
+	Unprotect(p peer.ID, tag string) bool
+	// IsProtected returns whether peer p is protected by tag, or by any tag if tag is empty.
+	IsProtected(p peer.ID, tag string) bool
+
+	// TrimOpenConns closes connections until the low watermark is reached.
+	TrimOpenConns(ctx context.Context)
+
+	// Connected is called by the host when a connection is opened.
+	Connected(c network.Conn)
+	// Disconnected is called by the host when a connection is closed.
+	Disconnected(c network.Conn)
+
+	// Close stops the connection manager.
+	Close() error
+}
+
+// TagInfo stores the metadata associated with a peer.
+type TagInfo struct {
+	FirstSeen time.Time
+	Value     int
+	// Tags maps tag names to their value, decaying tags included.
+	Tags map[string]int
+	// Conns maps the remote address of every connection to the time it was opened.
+	Conns map[string]time.Time
+}
+
+// peerInfo is what the connection manager knows about a peer.
+type peerInfo struct {
+	id        peer.ID
+	tags      map[string]int
+	decaying  map[*decayingTag]*DecayingValue
+	value     int
+	conns     map[network.Conn]time.Time
+	firstSeen time.Time
+}
+
+// BasicConnMgr is a ConnManager that trims connections based on the tags of their peers.
+type BasicConnMgr struct {
+	cfg *config
+
+	mu        sync.Mutex
+	peers     map[peer.ID]*peerInfo
+	protected map[peer.ID]map[string]struct{}
+	connCount int
+	lastTrim  time.Time
+
+	decayer *decayer
+
+	trigger   chan struct{}
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+var _ ConnManager = (*BasicConnMgr)(nil)
+
+// NewConnManager returns a connection manager that trims connections down to low
+// once there are more than high of them.
+func NewConnManager(low, high int, opts ...Option) (*BasicConnMgr, error) {
+	if low < 0 || high < low {
+		return nil, errors.New("invalid watermarks: low must be positive and not greater than high")
+	}
+	cfg := &config{
+		lowWater:        low,
+		highWater:       high,
+		gracePeriod:     time.Minute,
+		silencePeriod:   10 * time.Second,
+		decayResolution: time.Minute,
+	}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	cm := &BasicConnMgr{
+		cfg:       cfg,
+		peers:     make(map[peer.ID]*peerInfo),
+		protected: make(map[peer.ID]map[string]struct{}),
+		trigger:   make(chan struct{}, 1),
+		closing:   make(chan struct{}),
+	}
+	cm.decayer = newDecayer(cm)
+
+	cm.wg.Add(2)
+	go cm.background()
+	go cm.decayer.run()
+	return cm, nil
+}
+
+// background trims connections when triggered and every silence period.
+func (cm *BasicConnMgr) background() {
+	defer cm.wg.Done()
+	ticker := time.NewTicker(cm.cfg.silencePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-cm.trigger:
+		case <-cm.closing:
+			return
+		}
+		cm.mu.Lock()
+		over := cm.connCount > cm.cfg.highWater
+		cm.mu.Unlock()
+		if over {
+			cm.trim()
+		}
+	}
+}
+
+// TrimOpenConns closes connections until the low watermark is reached. Calls within
+// the silence period of the previous trim do nothing.
+func (cm *BasicConnMgr) TrimOpenConns(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		cm.trim()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+// trim closes the connections of the least valuable peers.
+func (cm *BasicConnMgr) trim() {
+	for _, c := range cm.connsToClose() {
+		c.Close()
+	}
+}
+
+// connsToClose selects the connections to close to get back to the low watermark.
+func (cm *BasicConnMgr) connsToClose() []network.Conn {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(cm.lastTrim) < cm.cfg.silencePeriod {
+		return nil
+	}
+	cm.lastTrim = now
+	if cm.connCount <= cm.cfg.lowWater {
+		return nil
+	}
+
+	candidates := make([]*peerInfo, 0, len(cm.peers))
+	for id, info := range cm.peers {
+		if len(info.conns) == 0 || len(cm.protected[id]) > 0 {
+			continue
+		}
+		candidates = append(candidates, info)
+	}
+	// Prune the least valuable peers first, and among them the ones with the most connections.
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].value != candidates[j].value {
+			return candidates[i].value < candidates[j].value
+		}
+		return len(candidates[i].conns) > len(candidates[j].conns)
+	})
+
+	target := cm.connCount - cm.cfg.lowWater
+	var toClose []network.Conn
+	for _, info := range candidates {
+		if target <= 0 {
+			break
+		}
+		// Peers with a connection still in its grace period are kept entirely.
+		young := false
+		for _, opened := range info.conns {
+			if now.Sub(opened) < cm.cfg.gracePeriod {
+				young = true
+				break
+			}
+		}
+		if young {
+			continue
+		}
+		for c := range info.conns {
+			toClose = append(toClose, c)
+			target--
+		}
+	}
+	return toClose
+}
+
+// Connected starts tracking c, triggering a trim if there are now too many connections.
+func (cm *BasicConnMgr) Connected(c network.Conn) {
+	cm.mu.Lock()
+	info := cm.peerInfo(c.RemotePeer())
+	if _, ok := info.conns[c]; !ok {
+		info.conns[c] = time.Now()
+		cm.connCount++
+	}
+	over := cm.connCount > cm.cfg.highWater
+	cm.mu.Unlock()
+
+	if over {
+		select {
+		case cm.trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Disconnected stops tracking c. The tags of a peer are forgotten along with its last connection.
+func (cm *BasicConnMgr) Disconnected(c network.Conn) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	info, ok := cm.peers[c.RemotePeer()]
+	if !ok {
+		return
+	}
+	if _, ok := info.conns[c]; !ok {
+		return
+	}
+	delete(info.conns, c)
+	cm.connCount--
+	if len(info.conns) == 0 {
+		delete(cm.peers, info.id)
+	}
+}
+
+// peerInfo returns the info of peer p, creating it if needed. The lock must be held.
+func (cm *BasicConnMgr) peerInfo(p peer.ID) *peerInfo {
+	info, ok := cm.peers[p]
+	if !ok {
+		info = &peerInfo{
+			id:        p,
+			tags:      make(map[string]int),
+			decaying:  make(map[*decayingTag]*DecayingValue),
+			conns:     make(map[network.Conn]time.Time),
+			firstSeen: time.Now(),
+		}
+		cm.peers[p] = info
+	}
+	return info
+}
+
+// TagPeer sets the value of tag on peer p.
+func (cm *BasicConnMgr) TagPeer(p peer.ID, tag string, val int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	info := cm.peerInfo(p)
+	info.value += val - info.tags[tag]
+	info.tags[tag] = val
+}
+
+// UntagPeer removes tag from peer p.
+func (cm *BasicConnMgr) UntagPeer(p peer.ID, tag string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	info, ok := cm.peers[p]
+	if !ok {
+		return
+	}
+	info.value -= info.tags[tag]
+	delete(info.tags, tag)
+}
+
+// UpsertTag updates the value of tag on peer p.
+func (cm *BasicConnMgr) UpsertTag(p peer.ID, tag string, upsert func(int) int) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	info := cm.peerInfo(p)
+	old := info.tags[tag]
+	val := upsert(old)
+	info.value += val - old
+	info.tags[tag] = val
+}
+
+// GetTagInfo returns the tags and connections of peer p.
+func (cm *BasicConnMgr) GetTagInfo(p peer.ID) *TagInfo {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	info, ok := cm.peers[p]
+	if !ok {
+		return nil
+	}
+	out := &TagInfo{
+		FirstSeen: info.firstSeen,
+		Value:     info.value,
+		Tags:      make(map[string]int, len(info.tags)+len(info.decaying)),
+		Conns:     make(map[string]time.Time, len(info.conns)),
+	}
+	for tag, val := range info.tags {
+		out.Tags[tag] = val
+	}
+	for tag, dv := range info.decaying {
+		out.Tags[tag.name] = dv.Value
+	}
+	for c, opened := range info.conns {
+		out.Conns[c.RemoteAddr().String()] = opened
+	}
+	return out
+}
+
+// Protect protects peer p from pruning on behalf of tag.
+func (cm *BasicConnMgr) Protect(p peer.ID, tag string) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	tags, ok := cm.protected[p]
+	if !ok {
+		tags = make(map[string]struct{})
+		cm.protected[p] = tags
+	}
+	tags[tag] = struct{}{}
+}
+
+// Unprotect removes the protection tag put on peer p.
+func (cm *BasicConnMgr) Unprotect(p peer.ID, tag string) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	tags, ok := cm.protected[p]
+	if !ok {
+		return false
+	}
+	delete(tags, tag)
+	if len(tags) == 0 {
+		delete(cm.protected, p)
+		return false
+	}
+	return true
+}
+
+// IsProtected returns whether peer p is protected by tag, or by any tag if tag is empty.
+func (cm *BasicConnMgr) IsProtected(p peer.ID, tag string) bool {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	tags := cm.protected[p]
+	if tag == "" {
+		return len(tags) > 0
+	}
+	_, ok := tags[tag]
+	return ok
+}
+
+// Close stops the background trimming and decaying.
+func (cm *BasicConnMgr) Close() error {
+	cm.closeOnce.Do(func() {
+		close(cm.closing)
+	})
+	cm.wg.Wait()
+	return nil
+}
+
+// NullConnMgr is a ConnManager that does nothing, used when a host has no connection manager.
+type NullConnMgr struct{}
+
+var _ ConnManager = NullConnMgr{}
+
+func (NullConnMgr) TagPeer(peer.ID, string, int)             {}
+func (NullConnMgr) UntagPeer(peer.ID, string)                {}
+func (NullConnMgr) UpsertTag(peer.ID, string, func(int) int) {}
+func (NullConnMgr) GetTagInfo(peer.ID) *TagInfo              { return &TagInfo{} }
+func (NullConnMgr) Protect(peer.ID, string)                  {}
+func (NullConnMgr) Unprotect(peer.ID, string) bool           { return false }
+func (NullConnMgr) IsProtected(peer.ID, string) bool         { return false }
+func (NullConnMgr) TrimOpenConns(context.Context)            {}
+func (NullConnMgr) Connected(network.Conn)                   {}
+func (NullConnMgr) Disconnected(network.Conn)                {}
+func (NullConnMgr) Close() error                             { return nil }
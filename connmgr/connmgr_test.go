@@ -0,0 +1,112 @@
+package connmgr
+
+import (
+	"context"
+	"net"
+	"p2p/network"
+	"p2p/peer"
+	"testing"
+	"time"
+)
+
+// testConn is a connection to peer p whose Close is reported on closed.
+type testConn struct {
+	network.Conn
+	p      peer.ID
+	closed chan<- *testConn
+}
+
+func (c *testConn) RemotePeer() peer.ID  { return c.p }
+func (c *testConn) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 5031} }
+func (c *testConn) Close() error {
+	c.closed <- c
+	return nil
+}
+
+func TestTrimOpenConns(t *testing.T) {
+	cm, err := NewConnManager(2, 10, WithGracePeriod(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+
+	closed := make(chan *testConn, 8)
+	conns := make(map[string]*testConn)
+	for _, name := range []string{"a", "b1", "b2", "c", "d"} {
+		c := &testConn{p: peer.ID(name[:1]), closed: closed}
+		conns[name] = c
+		cm.Connected(c)
+	}
+	cm.TagPeer("a", "friend", 10)
+	cm.TagPeer("c", "friend", 5)
+	cm.UpsertTag("c", "friend", func(v int) int { return v + 1 })
+	cm.Protect("d", "keep")
+	if info := cm.GetTagInfo("c"); info.Value != 6 || len(info.Conns) != 1 {
+		t.Errorf("tag info of c: %+v", info)
+	}
+
+	// Five connections down to two: the two of b, worth nothing, then the one of c, worth less than a.
+	cm.TrimOpenConns(context.Background())
+	got := make(map[*testConn]bool)
+	for len(closed) > 0 {
+		got[<-closed] = true
+	}
+	for name, c := range conns {
+		want := name == "b1" || name == "b2" || name == "c"
+		if got[c] != want {
+			t.Errorf("connection %s closed: %v, want %v", name, got[c], want)
+		}
+	}
+}
+
+func TestTrimKeepsYoungConns(t *testing.T) {
+	cm, err := NewConnManager(0, 10, WithGracePeriod(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+
+	closed := make(chan *testConn, 8)
+	for _, p := range []peer.ID{"a", "b", "c"} {
+		cm.Connected(&testConn{p: p, closed: closed})
+	}
+	cm.TrimOpenConns(context.Background())
+	if len(closed) != 0 {
+		t.Errorf("%d connections in their grace period were closed", len(closed))
+	}
+}
+
+func TestHighWatermarkTriggersTrim(t *testing.T) {
+	cm, err := NewConnManager(1, 2, WithGracePeriod(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cm.Close()
+
+	closed := make(chan *testConn, 8)
+	for _, p := range []peer.ID{"a", "b", "c"} {
+		cm.Connected(&testConn{p: p, closed: closed})
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-closed:
+			cm.Disconnected(c)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d connections closed after going over the high watermark, want 2", i)
+		}
+	}
+	select {
+	case <-closed:
+		t.Error("the connection manager trimmed below the low watermark")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNewConnManagerRefusesInvalidWatermarks(t *testing.T) {
+	if _, err := NewConnManager(3, 2); err == nil {
+		t.Error("a low watermark greater than the high watermark was accepted")
+	}
+	if _, err := NewConnManager(-1, 2); err == nil {
+		t.Error("a negative low watermark was accepted")
+	}
+}
@@ -0,0 +1,256 @@
+package connmgr
+
+import (
+	"fmt"
+	"p2p/peer"
+	"time"
+)
+
+// Decayer is implemented by connection managers supporting decaying tags. A decaying tag
+// is a tag whose value automatically changes over time, for example to reward recent activity.
+type Decayer interface {
+	// RegisterDecayingTag creates a decaying tag. decay is applied to every value of the tag
+	// each interval, bump combines the current value with the delta passed to DecayingTag.Bump.
+	RegisterDecayingTag(name string, interval time.Duration, decay DecayFn, bump BumpFn) (DecayingTag, error)
+}
+
+// DecayingTag is a tag whose value decays over time.
+type DecayingTag interface {
+	// Name returns the name of the tag.
+	Name() string
+	// Interval returns how often the value of the tag decays.
+	Interval() time.Duration
+	// Bump applies the bump function of the tag to the value of peer p.
+	Bump(p peer.ID, delta int) error
+	// Remove removes the tag from peer p.
+	Remove(p peer.ID) error
+	// Close removes the tag from every peer and unregisters it.
+	Close() error
+}
+
+// DecayingValue is the value of a decaying tag on a peer.
+type DecayingValue struct {
+	Tag       DecayingTag
+	Peer      peer.ID
+	Added     time.Time
+	LastVisit time.Time
+	Value     int
+}
+
+// DecayFn returns the value of a decaying tag after one interval, and whether the tag must be removed.
+type DecayFn func(value DecayingValue) (after int, rm bool)
+
+// BumpFn returns the value of a decaying tag after bumping it by delta.
+type BumpFn func(value DecayingValue, delta int) (after int)
+
+// DecayNone never decays a value.
+func DecayNone() DecayFn {
+	return func(value DecayingValue) (int, bool) {
+		return value.Value, false
+	}
+}
+
+// DecayFixed subtracts minuend from the value each interval, removing the tag once it is not positive.
+func DecayFixed(minuend int) DecayFn {
+	return func(value DecayingValue) (int, bool) {
+		v := value.Value - minuend
+		return v, v <= 0
+	}
+}
+
+// DecayLinear multiplies the value by coef each interval, removing the tag once it is not positive.
+func DecayLinear(coef float64) DecayFn {
+	return func(value DecayingValue) (int, bool) {
+		v := int(float64(value.Value) * coef)
+		return v, v <= 0
+	}
+}
+
+// DecayExpireWhenInactive removes the tag once it was not bumped for after.
+func DecayExpireWhenInactive(after time.Duration) DecayFn {
+	return func(value DecayingValue) (int, bool) {
+		return value.Value, time.Since(value.LastVisit) >= after
+	}
+}
+
+// BumpSumUnbounded adds delta to the value.
+func BumpSumUnbounded() BumpFn {
+	return func(value DecayingValue, delta int) int {
+		return value.Value + delta
+	}
+}
+
+// BumpSumBounded adds delta to the value, keeping it within [min, max].
+func BumpSumBounded(min, max int) BumpFn {
+	return func(value DecayingValue, delta int) int {
+		v := value.Value + delta
+		if v < min {
+			return min
+		}
+		if v > max {
+			return max
+		}
+		return v
+	}
+}
+
+// BumpOverwrite replaces the value with delta.
+func BumpOverwrite() BumpFn {
+	return func(value DecayingValue, delta int) int {
+		return delta
+	}
+}
+
+// decayer applies the decay functions of the registered decaying tags. Its state is guarded by the
+// lock of the connection manager, the values live in the peerInfo of each peer.
+type decayer struct {
+	cm   *BasicConnMgr
+	tags map[string]*decayingTag
+}
+
+// decayingTag is the DecayingTag implementation.
+type decayingTag struct {
+	d         *decayer
+	name      string
+	interval  time.Duration
+	decayFn   DecayFn
+	bumpFn    BumpFn
+	nextDecay time.Time
+	closed    bool
+}
+
+var _ Decayer = (*BasicConnMgr)(nil)
+
+func newDecayer(cm *BasicConnMgr) *decayer {
+	return &decayer{cm: cm, tags: make(map[string]*decayingTag)}
+}
+
+// RegisterDecayingTag creates a decaying tag. The interval is rounded up to the decay resolution of the manager.
+func (cm *BasicConnMgr) RegisterDecayingTag(name string, interval time.Duration, decay DecayFn, bump BumpFn) (DecayingTag, error) {
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if _, ok := cm.decayer.tags[name]; ok {
+		return nil, fmt.Errorf("decaying tag %s already registered", name)
+	}
+	if res := cm.cfg.decayResolution; interval < res {
+		interval = res
+	}
+	tag := &decayingTag{
+		d:         cm.decayer,
+		name:      name,
+		interval:  interval,
+		decayFn:   decay,
+		bumpFn:    bump,
+		nextDecay: time.Now().Add(interval),
+	}
+	cm.decayer.tags[name] = tag
+	return tag, nil
+}
+
+// run applies the decay functions every decay resolution until the manager is closed.
+func (d *decayer) run() {
+	defer d.cm.wg.Done()
+	ticker := time.NewTicker(d.cm.cfg.decayResolution)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.tick(now)
+		case <-d.cm.closing:
+			return
+		}
+	}
+}
+
+// tick decays the values of the tags whose interval elapsed.
+func (d *decayer) tick(now time.Time) {
+	d.cm.mu.Lock()
+	defer d.cm.mu.Unlock()
+	for _, tag := range d.tags {
+		if now.Before(tag.nextDecay) {
+			continue
+		}
+		tag.nextDecay = now.Add(tag.interval)
+		for _, info := range d.cm.peers {
+			dv, ok := info.decaying[tag]
+			if !ok {
+				continue
+			}
+			after, rm := tag.decayFn(*dv)
+			info.value += after - dv.Value
+			dv.Value = after
+			if rm {
+				info.value -= dv.Value
+				delete(info.decaying, tag)
+			}
+		}
+	}
+}
+
+// Name returns the name of the tag.
+func (t *decayingTag) Name() string {
+	return t.name
+}
+
+// Interval returns how often the value of the tag decays.
+func (t *decayingTag) Interval() time.Duration {
+	return t.interval
+}
+
+// Bump applies the bump function of the tag to the value of peer p.
+func (t *decayingTag) Bump(p peer.ID, delta int) error {
+	cm := t.d.cm
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if t.closed {
+		return fmt.Errorf("decaying tag %s closed", t.name)
+	}
+	info := cm.peerInfo(p)
+	now := time.Now()
+	dv, ok := info.decaying[t]
+	if !ok {
+		dv = &DecayingValue{Tag: t, Peer: p, Added: now}
+		info.decaying[t] = dv
+	}
+	after := t.bumpFn(*dv, delta)
+	info.value += after - dv.Value
+	dv.Value = after
+	dv.LastVisit = now
+	return nil
+}
+
+// Remove removes the tag from peer p.
+func (t *decayingTag) Remove(p peer.ID) error {
+	cm := t.d.cm
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if t.closed {
+		return fmt.Errorf("decaying tag %s closed", t.name)
+	}
+	if info, ok := cm.peers[p]; ok {
+		if dv, ok := info.decaying[t]; ok {
+			info.value -= dv.Value
+			delete(info.decaying, t)
+		}
+	}
+	return nil
+}
+
+// Close removes the tag from every peer and unregisters it.
+func (t *decayingTag) Close() error {
+	cm := t.d.cm
+	cm.mu.Lock()
+	defer cm.mu.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	for _, info := range cm.peers {
+		if dv, ok := info.decaying[t]; ok {
+			info.value -= dv.Value
+			delete(info.decaying, t)
+		}
+	}
+	delete(t.d.tags, t.name)
+	return nil
+}
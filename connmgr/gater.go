@@ -0,0 +1,31 @@
+package connmgr
+
+import (
+	ma "github.com/multiformats/go-multiaddr"
+	"p2p/network"
+	"p2p/peer"
+)
+
+// ConnectionGater is consulted by the host at every stage of setting up a connection,
+// and can refuse the connection at any of them.
+//
+// Outbound connections go through InterceptPeerDial (when the peer is known before dialing),
+// InterceptAddrDial, InterceptSecured and InterceptUpgraded. Inbound connections go through
+// InterceptAccept, InterceptSecured and InterceptUpgraded.
+type ConnectionGater interface {
+	// InterceptPeerDial is called before dialing peer p.
+	InterceptPeerDial(p peer.ID) (allow bool)
+
+	// InterceptAddrDial is called before dialing addr, the address of peer p.
+	// p is empty if the peer is not known before the handshake.
+	InterceptAddrDial(p peer.ID, addr ma.Multiaddr) (allow bool)
+
+	// InterceptAccept is called right after accepting an inbound connection, before the handshake.
+	InterceptAccept(addrs network.ConnMultiaddrs) (allow bool)
+
+	// InterceptSecured is called once the handshake identified the remote peer p.
+	InterceptSecured(dir network.Direction, p peer.ID, addrs network.ConnMultiaddrs) (allow bool)
+
+	// InterceptUpgraded is called once the connection is multiplexed, before any stream is accepted over it.
+	InterceptUpgraded(c network.Conn) (allow bool)
+}
@@ -0,0 +1,51 @@
+package connmgr
+
+import (
+	"errors"
+	"time"
+)
+
+// config is the configuration of a BasicConnMgr.
+type config struct {
+	lowWater        int
+	highWater       int
+	gracePeriod     time.Duration
+	silencePeriod   time.Duration
+	decayResolution time.Duration
+}
+
+// Option configures a BasicConnMgr.
+type Option func(*config) error
+
+// WithGracePeriod sets how long a new connection is protected from pruning. Defaults to one minute.
+func WithGracePeriod(p time.Duration) Option {
+	return func(cfg *config) error {
+		if p < 0 {
+			return errors.New("grace period must be non-negative")
+		}
+		cfg.gracePeriod = p
+		return nil
+	}
+}
+
+// WithSilencePeriod sets the minimum time between two trims. Defaults to ten seconds.
+func WithSilencePeriod(p time.Duration) Option {
+	return func(cfg *config) error {
+		if p <= 0 {
+			return errors.New("silence period must be positive")
+		}
+		cfg.silencePeriod = p
+		return nil
+	}
+}
+
+// WithDecayResolution sets how often decaying tags are visited. Defaults to one minute.
+func WithDecayResolution(r time.Duration) Option {
+	return func(cfg *config) error {
+		if r <= 0 {
+			return errors.New("decay resolution must be positive")
+		}
+		cfg.decayResolution = r
+		return nil
+	}
+}
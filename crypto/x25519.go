@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"crypto/ed25519"
+	"crypto/sha512"
+	"errors"
+	"math/big"
+)
+
+// X25519KeySize is the size of X25519 public and private keys.
+const X25519KeySize = 32
+
+var (
+	// curveP is the prime 2^255 - 19 of the field of Curve25519 and Edwards25519.
+	curveP, _ = new(big.Int).SetString("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffed", 16)
+	// curveD is the constant d of Edwards25519, -121665/121666.
+	curveD, _ = new(big.Int).SetString("52036cee2b6ffe738cc740797779e89800700a4d4141d8ab75eb4dca135978a3", 16)
+)
+
+// X25519PublicKey returns the X25519 public key matching the Ed25519 public key pub, the Montgomery form
+// u = (1 + y) / (1 - y) of its point, so that data can be encrypted to the owner of a signing key.
+func X25519PublicKey(pub PubKey) ([]byte, error) {
+	edk, ok := pub.(*Ed25519PublicKey)
+	if !ok {
+		return nil, ErrBadKeyType
+	}
+	if len(edk.k) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+
+	// The key is the little endian y coordinate, its top bit holding the sign of x.
+	le := make([]byte, ed25519.PublicKeySize)
+	copy(le, edk.k)
+	le[31] &= 0x7f
+	y := new(big.Int).SetBytes(reverse(le))
+	one := big.NewInt(1)
+	if y.Cmp(curveP) >= 0 || y.Cmp(one) == 0 {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+
+	// The point must be on the curve: x^2 = (y^2 - 1) / (d y^2 + 1) must have a root.
+	y2 := new(big.Int).Mul(y, y)
+	num := new(big.Int).Sub(y2, one)
+	den := new(big.Int).Mul(curveD, y2)
+	den.Add(den, one).Mod(den, curveP)
+	x2 := num.Mul(num, new(big.Int).ModInverse(den, curveP))
+	x2.Mod(x2, curveP)
+	if new(big.Int).ModSqrt(x2, curveP) == nil {
+		return nil, errors.New("invalid ed25519 public key")
+	}
+
+	num = new(big.Int).Add(one, y)
+	den = new(big.Int).Sub(one, y)
+	den.Mod(den, curveP)
+	u := num.Mul(num, new(big.Int).ModInverse(den, curveP))
+	u.Mod(u, curveP)
+
+	out := make([]byte, X25519KeySize)
+	u.FillBytes(out)
+	return reverse(out), nil
+}
+
+// X25519PrivateKey returns the X25519 private key matching the Ed25519 private key priv, the clamped scalar
+// Ed25519 derives from its seed, so that its owner can decrypt the data encrypted to X25519PublicKey.
+func X25519PrivateKey(priv PrivKey) ([]byte, error) {
+	edk, ok := priv.(*Ed25519PrivateKey)
+	if !ok {
+		return nil, ErrBadKeyType
+	}
+	if len(edk.k) != ed25519.PrivateKeySize {
+		return nil, errors.New("invalid ed25519 private key")
+	}
+	h := sha512.Sum512(edk.k.Seed())
+	out := make([]byte, X25519KeySize)
+	copy(out, h[:X25519KeySize])
+	out[0] &= 248
+	out[31] &= 127
+	out[31] |= 64
+	return out, nil
+}
+
+// reverse reverses b in place and returns it, converting between little and big endian.
+func reverse(b []byte) []byte {
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"golang.org/x/crypto/curve25519"
+	"testing"
+)
+
+func TestX25519KeysMatch(t *testing.T) {
+	for i := 0; i < 32; i++ {
+		priv, pub, err := GenerateEd25519KeyPair(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		scalar, err := X25519PrivateKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := curve25519.X25519(scalar, curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := X25519PublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("X25519PublicKey = %x, want %x, the public key of X25519PrivateKey", got, want)
+		}
+	}
+}
+
+func TestX25519SharedSecret(t *testing.T) {
+	alice, _, err := GenerateEd25519KeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, _, err := GenerateEd25519KeyPair(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := func(priv, peer PrivKey) []byte {
+		scalar, err := X25519PrivateKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		point, err := X25519PublicKey(peer.GetPublic())
+		if err != nil {
+			t.Fatal(err)
+		}
+		shared, err := curve25519.X25519(scalar, point)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return shared
+	}
+	if a, b := secret(alice, bob), secret(bob, alice); !bytes.Equal(a, b) {
+		t.Errorf("shared secrets differ: %x and %x", a, b)
+	}
+}
+
+func TestX25519PublicKeyInvalid(t *testing.T) {
+	// y is the little endian key, the sign of x left clear.
+	withY := func(y ...byte) []byte { return append(y, make([]byte, 32-len(y))...) }
+	aboveP := bytes.Repeat([]byte{0xff}, 32)
+	aboveP[31] = 0x7f
+
+	tests := []struct {
+		name string
+		key  []byte
+	}{
+		{"identity", withY(1)},
+		// y = 2 has no x on the curve: (y^2 - 1) / (d y^2 + 1) is not a square.
+		{"off the curve", withY(2)},
+		{"y above the prime", aboveP},
+		{"short", make([]byte, 31)},
+	}
+	for _, tt := range tests {
+		if _, err := X25519PublicKey(&Ed25519PublicKey{k: tt.key}); err == nil {
+			t.Errorf("%s: X25519PublicKey accepted %x", tt.name, tt.key)
+		}
+	}
+}
+
+func TestX25519BadKeyType(t *testing.T) {
+	if _, err := X25519PublicKey(nil); !errors.Is(err, ErrBadKeyType) {
+		t.Errorf("X25519PublicKey(nil) = %v, want %v", err, ErrBadKeyType)
+	}
+	if _, err := X25519PrivateKey(nil); !errors.Is(err, ErrBadKeyType) {
+		t.Errorf("X25519PrivateKey(nil) = %v, want %v", err, ErrBadKeyType)
+	}
+}
@@ -0,0 +1,194 @@
+package dirsync
+
+import (
+	"crypto/sha256"
+	"fmt"
+	mh "github.com/multiformats/go-multihash"
+	"io"
+	"os"
+	"p2p/transfer"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// stateDir is the directory a receiver keeps its state in, at the root of the synchronized directory. It is
+// never synchronized.
+const stateDir = ".p2psync"
+
+// Entry describes a file, directory or symbolic link of a synchronized directory.
+type Entry struct {
+	transfer.ManifestEntry
+	// Hash is the base58 encoded SHA2-256 multihash of a file.
+	Hash string `json:"hash,omitempty"`
+}
+
+// Manifest lists a synchronized directory, sorted by path so that directories come before their content.
+type Manifest struct {
+	Entries []Entry `json:"entries"`
+}
+
+// index returns the entries of m by path.
+func (m *Manifest) index() map[string]*Entry {
+	idx := make(map[string]*Entry, len(m.Entries))
+	for i := range m.Entries {
+		idx[m.Entries[i].Path] = &m.Entries[i]
+	}
+	return idx
+}
+
+// cached is the hash of a file, valid as long as its size and modification time are unchanged.
+type cached struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// Cache keeps the hashes of files between synchronizations, so that only the files that changed are hashed
+// again. It is safe for concurrent use.
+type Cache struct {
+	mu     sync.Mutex
+	hashes map[string]cached
+}
+
+// NewCache returns an empty cache.
+func NewCache() *Cache {
+	return &Cache{hashes: make(map[string]cached)}
+}
+
+// hash returns the hash of the file at p, described by info, reading it unless c knows it.
+func (c *Cache) hash(p string, info os.FileInfo) (string, error) {
+	if c != nil {
+		c.mu.Lock()
+		h, ok := c.hashes[p]
+		c.mu.Unlock()
+		if ok && h.size == info.Size() && h.modTime.Equal(info.ModTime()) {
+			return h.hash, nil
+		}
+	}
+	hash, err := hashFile(p)
+	if err != nil {
+		return "", err
+	}
+	if c != nil {
+		c.mu.Lock()
+		c.hashes[p] = cached{size: info.Size(), modTime: info.ModTime(), hash: hash}
+		c.mu.Unlock()
+	}
+	return hash, nil
+}
+
+// hashFile returns the base58 encoded SHA2-256 multihash of the file at p.
+func hashFile(p string) (string, error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return encodeHash(hasher.Sum(nil))
+}
+
+// encodeHash returns the base58 encoded multihash of the SHA2-256 digest sum.
+func encodeHash(sum []byte) (string, error) {
+	encoded, err := mh.Encode(sum, mh.SHA2_256)
+	if err != nil {
+		return "", err
+	}
+	return mh.Multihash(encoded).B58String(), nil
+}
+
+// BuildManifest lists the directory at root with the hash of every file, taken from cache if it knows it. The
+// root itself, the state directory of the receiver and the files skipped by transfer.BuildManifest are left out.
+func BuildManifest(root string, cache *Cache) (*Manifest, error) {
+	listing, err := transfer.BuildManifest(root)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	for _, e := range listing.Entries {
+		if e.Path == "." || e.Path == stateDir || strings.HasPrefix(e.Path, stateDir+"/") {
+			continue
+		}
+		entry := Entry{ManifestEntry: e}
+		if e.Type == transfer.EntryFile {
+			p := filepath.Join(root, filepath.FromSlash(e.Path))
+			info, err := os.Lstat(p)
+			if err != nil {
+				// A file removed since the directory was read is left out.
+				continue
+			}
+			if entry.Hash, err = cache.hash(p, info); err != nil {
+				return nil, fmt.Errorf("error hashing %s: %v", e.Path, err)
+			}
+			entry.Size, entry.ModTime = uint64(info.Size()), info.ModTime()
+		}
+		m.Entries = append(m.Entries, entry)
+	}
+	return m, nil
+}
+
+// checkEntry returns an error unless e can be stored below the root of a synchronized directory.
+func checkEntry(e *Entry) error {
+	p := e.Path
+	if p == "" || p == "." || path.IsAbs(p) || path.Clean(p) != p || p == ".." || strings.HasPrefix(p, "../") ||
+		strings.Contains(p, `\`) {
+		return fmt.Errorf("invalid path %q", p)
+	}
+	if p == stateDir || strings.HasPrefix(p, stateDir+"/") {
+		return fmt.Errorf("path %q is reserved", p)
+	}
+	switch e.Type {
+	case transfer.EntryDir:
+	case transfer.EntryFile:
+		if _, err := mh.FromB58String(e.Hash); err != nil {
+			return fmt.Errorf("invalid hash of %s: %v", p, err)
+		}
+	case transfer.EntrySymlink:
+		// Whether the link stays inside the directory depends on the other links, see checkManifest.
+		target := e.Target
+		if target == "" || path.IsAbs(target) || filepath.IsAbs(filepath.FromSlash(target)) {
+			return fmt.Errorf("invalid link target %q of %s", target, p)
+		}
+	default:
+		return fmt.Errorf("unknown type %q of %s", e.Type, p)
+	}
+	return nil
+}
+
+// checkManifest returns an error unless every entry of m can be stored below the root of a synchronized directory:
+// entries must be valid and unique, only directories may hold other entries, and links must point inside the
+// directory without going through another link.
+func checkManifest(m *Manifest) error {
+	idx := make(map[string]*Entry, len(m.Entries))
+	for i := range m.Entries {
+		e := &m.Entries[i]
+		if err := checkEntry(e); err != nil {
+			return err
+		}
+		if _, ok := idx[e.Path]; ok {
+			return fmt.Errorf("duplicate path %q", e.Path)
+		}
+		idx[e.Path] = e
+	}
+	isLink := func(p string) bool {
+		e := idx[p]
+		return e != nil && e.Type == transfer.EntrySymlink
+	}
+	for _, e := range m.Entries {
+		for parent := path.Dir(e.Path); parent != "."; parent = path.Dir(parent) {
+			if pe, ok := idx[parent]; ok && pe.Type != transfer.EntryDir {
+				return fmt.Errorf("%s is below %s, which is not a directory", e.Path, parent)
+			}
+		}
+		if e.Type == transfer.EntrySymlink && !transfer.SymlinkInRoot(e.Path, e.Target, isLink) {
+			return fmt.Errorf("link %s points outside of the directory", e.Path)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package dirsync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"p2p/host"
+	"p2p/network"
+	"p2p/peer"
+	"sync"
+	"time"
+)
+
+// retryInterval is how long Mirror waits before synchronizing again after a failure, unless the directory
+// changes first.
+const retryInterval = 10 * time.Second
+
+// Opener opens a connection to the receiver of a synchronization, such as a stream negotiating ProtocolID.
+type Opener func(ctx context.Context) (io.ReadWriteCloser, error)
+
+// Mirror keeps the receiver reached through open a copy of the directory dir until ctx is done: it pushes dir
+// with opts right away, then whenever dir changes, over a new connection each time. The hashes of the files are
+// cached between synchronizations unless WithCache gives a cache. A failed synchronization is retried after a
+// while. Mirror only returns once ctx is done, with its error, or once dir cannot be watched anymore.
+//
+// Changes made on the receiver are not sent back: the files modified there are overwritten by the next
+// synchronization, and those added there are handled according to its delete policy.
+func Mirror(ctx context.Context, open Opener, dir string, opts ...Option) error {
+	stopped := make(chan error, 1)
+	changes, err := watchReporting(ctx, dir, func(err error) { stopped <- err })
+	if err != nil {
+		return err
+	}
+	logf := loggerOf(opts)
+	opts = append([]Option{WithCache(NewCache())}, opts...)
+	for {
+		var retry *time.Timer
+		if err := pushOnce(ctx, open, dir, opts); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logf("error synchronizing %s, retrying in %v: %v", dir, retryInterval, err)
+			retry = time.NewTimer(retryInterval)
+		}
+		select {
+		case <-ctx.Done():
+			stopTimer(retry)
+			return ctx.Err()
+		case _, ok := <-changes:
+			stopTimer(retry)
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				select {
+				case err := <-stopped:
+					return fmt.Errorf("stopped watching %s: %v", dir, err)
+				default:
+					return fmt.Errorf("stopped watching %s", dir)
+				}
+			}
+		case <-timerC(retry):
+		}
+	}
+}
+
+// timerC returns the channel of t, nil if t is nil.
+func timerC(t *time.Timer) <-chan time.Time {
+	if t == nil {
+		return nil
+	}
+	return t.C
+}
+
+// stopTimer stops t if it is not nil.
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+// pushOnce pushes dir over a connection opened with open.
+func pushOnce(ctx context.Context, open Opener, dir string, opts []Option) error {
+	conn, err := open(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = Push(ctx, conn, dir, opts...)
+	return err
+}
+
+// StreamOpener returns an Opener of streams from h to p negotiating ProtocolID.
+func StreamOpener(h host.Host, p peer.ID) Opener {
+	return func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return h.NewStream(ctx, p, ProtocolID)
+	}
+}
+
+// Register makes h store in dir the directories its peers push to it on ProtocolID, received with opts. A single
+// synchronization runs at a time, the others waiting for it to end.
+func Register(h host.Host, dir string, opts ...Option) {
+	var mu sync.Mutex
+	cache := NewCache()
+	logf := loggerOf(opts)
+	opts = append([]Option{WithCache(cache)}, opts...)
+	h.SetStreamHandler(ProtocolID, func(s network.Stream) {
+		defer s.Close()
+		mu.Lock()
+		defer mu.Unlock()
+		result, err := Receive(context.Background(), s, dir, opts...)
+		if err != nil {
+			logf("error synchronizing %s from %s: %v", dir, s.RemotePeer(), err)
+			return
+		}
+		for _, p := range result.Failed {
+			logf("kept the old version of %s, which changed while %s sent it", p, s.RemotePeer())
+		}
+	})
+}
@@ -0,0 +1,431 @@
+package dirsync
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// minBlockSize and maxBlockSize bound the blocks a file is split into for its signature.
+	minBlockSize = 2 << 10
+	maxBlockSize = 64 << 10
+	// strongSize is the size of the strong checksum of a block, a truncated SHA2-256.
+	strongSize = 16
+	// maxLiteral is the most data sent in a single literal operation.
+	maxLiteral = 1 << 20
+	// maxBlocks bounds the blocks of a signature a sender accepts.
+	maxBlocks = 1 << 22
+)
+
+// Delta operations.
+const (
+	opEnd     = 0
+	opCopy    = 1
+	opLiteral = 2
+)
+
+// blockSizeFor returns the size of the blocks a file of size bytes is split into, about its square root as in
+// rsync, so that the signature and the chance of a match grow together.
+func blockSizeFor(size int64) int {
+	bs := int(math.Sqrt(float64(size))) &^ 7
+	if bs < minBlockSize {
+		return minBlockSize
+	}
+	if bs > maxBlockSize {
+		return maxBlockSize
+	}
+	return bs
+}
+
+// weakSum is the rolling checksum of rsync, made of the sum of the bytes of a block and the sum of those sums.
+type weakSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newWeakSum(block []byte) weakSum {
+	var w weakSum
+	for i, c := range block {
+		w.a += uint32(c)
+		w.b += uint32(len(block)-i) * uint32(c)
+	}
+	w.n = uint32(len(block))
+	return w
+}
+
+func (w weakSum) value() uint32 {
+	return (w.a & 0xffff) | w.b<<16
+}
+
+// roll moves the block one byte forward, dropping out and adding in.
+func (w *weakSum) roll(out, in byte) {
+	w.a += uint32(in) - uint32(out)
+	w.b += w.a - w.n*uint32(out)
+}
+
+func strongSum(block []byte) [strongSize]byte {
+	sum := sha256.Sum256(block)
+	var s [strongSize]byte
+	copy(s[:], sum[:])
+	return s
+}
+
+// signature holds the checksums of the blocks of the receiver's version of a file. The last block may be
+// shorter than the others.
+type signature struct {
+	blockSize int
+	lastSize  int
+	weak      []uint32
+	strong    [][strongSize]byte
+}
+
+// computeSignature returns the signature of the data read from r, size bytes.
+func computeSignature(r io.Reader, size int64) (*signature, error) {
+	sig := &signature{blockSize: blockSizeFor(size)}
+	buf := make([]byte, sig.blockSize)
+	br := bufio.NewReaderSize(r, 1<<20)
+	for {
+		n, err := io.ReadFull(br, buf)
+		if n > 0 {
+			sig.weak = append(sig.weak, newWeakSum(buf[:n]).value())
+			sig.strong = append(sig.strong, strongSum(buf[:n]))
+			sig.lastSize = n
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// size returns the size of block i.
+func (sig *signature) size(i int) int {
+	if i == len(sig.weak)-1 {
+		return sig.lastSize
+	}
+	return sig.blockSize
+}
+
+// writeSignature sends sig on w: a uint32 block size, a uint32 count of blocks, a uint32 size of the last one,
+// then every block as a uint32 weak checksum followed by its strong checksum.
+func writeSignature(w io.Writer, sig *signature) error {
+	buf := make([]byte, 0, 12+len(sig.weak)*(4+strongSize))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(sig.blockSize))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(sig.weak)))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(sig.lastSize))
+	for i := range sig.weak {
+		buf = binary.BigEndian.AppendUint32(buf, sig.weak[i])
+		buf = append(buf, sig.strong[i][:]...)
+	}
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("error sending signature: %v", err)
+	}
+	return nil
+}
+
+// readSignature receives a signature sent with writeSignature.
+func readSignature(r io.Reader) (*signature, error) {
+	var head [12]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return nil, fmt.Errorf("error reading signature: %v", err)
+	}
+	sig := &signature{blockSize: int(binary.BigEndian.Uint32(head[0:])), lastSize: int(binary.BigEndian.Uint32(head[8:]))}
+	count := binary.BigEndian.Uint32(head[4:])
+	if count > maxBlocks || (count > 0 && (sig.blockSize < 1 || sig.blockSize > maxBlockSize ||
+		sig.lastSize < 1 || sig.lastSize > sig.blockSize)) {
+		return nil, errors.New("invalid signature")
+	}
+	// The blocks are read a few thousands at a time, so that a peer lying about their count does not get more
+	// memory allocated than it sends.
+	const entry = 4 + strongSize
+	buf := make([]byte, 4096*entry)
+	for remaining := int(count); remaining > 0; {
+		n := remaining
+		if n > 4096 {
+			n = 4096
+		}
+		if _, err := io.ReadFull(r, buf[:n*entry]); err != nil {
+			return nil, fmt.Errorf("error reading signature: %v", err)
+		}
+		for j := 0; j < n; j++ {
+			var strong [strongSize]byte
+			copy(strong[:], buf[j*entry+4:(j+1)*entry])
+			sig.weak = append(sig.weak, binary.BigEndian.Uint32(buf[j*entry:]))
+			sig.strong = append(sig.strong, strong)
+		}
+		remaining -= n
+	}
+	return sig, nil
+}
+
+// deltaStats counts the bytes of a file sent as literals and those the receiver copies from its version.
+type deltaStats struct {
+	literal uint64
+	matched uint64
+}
+
+// deltaWriter encodes the operations rebuilding a file from the blocks of the receiver's version and literal
+// data: a uint8 operation, then for a copy a uint32 first block and a uint32 count of blocks, for a literal a
+// uint32 length and the data. The end operation ends the file.
+type deltaWriter struct {
+	w     *bufio.Writer
+	sig   *signature
+	stats deltaStats
+	// first and count are the blocks of a copy not written yet.
+	first, count int
+}
+
+func (d *deltaWriter) copyBlock(i int) error {
+	d.stats.matched += uint64(d.sig.size(i))
+	if d.count > 0 && d.first+d.count == i {
+		d.count++
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.first, d.count = i, 1
+	return nil
+}
+
+func (d *deltaWriter) flushCopy() error {
+	if d.count == 0 {
+		return nil
+	}
+	var op [9]byte
+	op[0] = opCopy
+	binary.BigEndian.PutUint32(op[1:], uint32(d.first))
+	binary.BigEndian.PutUint32(op[5:], uint32(d.count))
+	d.count = 0
+	_, err := d.w.Write(op[:])
+	return err
+}
+
+func (d *deltaWriter) literal(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	d.stats.literal += uint64(len(data))
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxLiteral {
+			n = maxLiteral
+		}
+		var op [5]byte
+		op[0] = opLiteral
+		binary.BigEndian.PutUint32(op[1:], uint32(n))
+		if _, err := d.w.Write(op[:]); err != nil {
+			return err
+		}
+		if _, err := d.w.Write(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+func (d *deltaWriter) end() error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+	if err := d.w.WriteByte(opEnd); err != nil {
+		return err
+	}
+	return d.w.Flush()
+}
+
+// writeDelta sends on w the operations rebuilding the data read from r out of the blocks described by sig,
+// which has none if the receiver has no version of the file.
+func writeDelta(w io.Writer, r io.Reader, sig *signature) (deltaStats, error) {
+	d := &deltaWriter{w: bufio.NewWriterSize(w, 64<<10), sig: sig}
+	if err := delta(d, r); err != nil {
+		return d.stats, fmt.Errorf("error sending file: %v", err)
+	}
+	return d.stats, nil
+}
+
+func delta(d *deltaWriter, r io.Reader) error {
+	sig := d.sig
+	if len(sig.weak) == 0 {
+		buf := make([]byte, maxLiteral)
+		for {
+			n, err := io.ReadFull(r, buf)
+			if err := d.literal(buf[:n]); err != nil {
+				return err
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return d.end()
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	blocks := make(map[uint32][]int, len(sig.weak))
+	for i, w := range sig.weak {
+		// The short last block only matches the end of the file.
+		if sig.size(i) == sig.blockSize {
+			blocks[w] = append(blocks[w], i)
+		}
+	}
+	match := func(window []byte, weak uint32) int {
+		candidates := blocks[weak]
+		if len(candidates) == 0 {
+			return -1
+		}
+		strong := strongSum(window)
+		for _, i := range candidates {
+			if sig.strong[i] == strong {
+				return i
+			}
+		}
+		return -1
+	}
+
+	bs := sig.blockSize
+	// buf holds the data read and not sent yet: the literal data from 0 to pos, then the window being matched.
+	buf := make([]byte, 0, 2*maxLiteral+bs)
+	pos := 0
+	eof := false
+	// fill reads until the window and what follows it hold need bytes, or the file ends.
+	fill := func(need int) error {
+		for !eof && len(buf)-pos < need {
+			if len(buf) == cap(buf) {
+				// Only happens once the literal was sent, see below.
+				return errors.New("delta buffer full")
+			}
+			n, err := r.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if err == io.EOF {
+				eof = true
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var weak weakSum
+	fresh := true
+	for {
+		if pos >= maxLiteral {
+			if err := d.literal(buf[:pos]); err != nil {
+				return err
+			}
+			buf = append(buf[:0], buf[pos:]...)
+			pos = 0
+		}
+		if err := fill(bs); err != nil {
+			return err
+		}
+		if len(buf)-pos < bs {
+			break
+		}
+		window := buf[pos : pos+bs]
+		if fresh {
+			weak = newWeakSum(window)
+			fresh = false
+		}
+		if i := match(window, weak.value()); i >= 0 {
+			if err := d.literal(buf[:pos]); err != nil {
+				return err
+			}
+			if err := d.copyBlock(i); err != nil {
+				return err
+			}
+			buf = append(buf[:0], buf[pos+bs:]...)
+			pos, fresh = 0, true
+			continue
+		}
+		if len(buf)-pos == bs {
+			// The next byte is needed to roll the window.
+			if err := fill(bs + 1); err != nil {
+				return err
+			}
+			if len(buf)-pos == bs {
+				break
+			}
+		}
+		weak.roll(buf[pos], buf[pos+bs])
+		pos++
+	}
+
+	// What is left is shorter than a block, or the end of the file: it may be the short last block.
+	rest := buf[pos:]
+	last := len(sig.weak) - 1
+	if len(rest) == sig.lastSize && newWeakSum(rest).value() == sig.weak[last] && strongSum(rest) == sig.strong[last] {
+		if err := d.literal(buf[:pos]); err != nil {
+			return err
+		}
+		if err := d.copyBlock(last); err != nil {
+			return err
+		}
+	} else if err := d.literal(buf); err != nil {
+		return err
+	}
+	return d.end()
+}
+
+// applyDelta writes to w the file rebuilt from the operations read from r and the blocks of base, the
+// receiver's version, whose signature is sig. It returns the bytes received and those copied from base.
+func applyDelta(w io.Writer, r io.Reader, base io.ReaderAt, sig *signature) (deltaStats, error) {
+	var stats deltaStats
+	var op [9]byte
+	buf := make([]byte, maxBlockSize)
+	for {
+		if _, err := io.ReadFull(r, op[:1]); err != nil {
+			return stats, fmt.Errorf("error reading file: %v", err)
+		}
+		switch op[0] {
+		case opEnd:
+			return stats, nil
+		case opCopy:
+			if _, err := io.ReadFull(r, op[1:9]); err != nil {
+				return stats, fmt.Errorf("error reading file: %v", err)
+			}
+			first, count := int(binary.BigEndian.Uint32(op[1:])), int(binary.BigEndian.Uint32(op[5:]))
+			if base == nil || first+count > len(sig.weak) || first+count < first {
+				return stats, errors.New("copy of a block the receiver does not have")
+			}
+			for i := first; i < first+count; i++ {
+				block := buf[:sig.size(i)]
+				if _, err := base.ReadAt(block, int64(i)*int64(sig.blockSize)); err != nil {
+					return stats, fmt.Errorf("error reading local file: %v", err)
+				}
+				if _, err := w.Write(block); err != nil {
+					return stats, err
+				}
+				stats.matched += uint64(len(block))
+			}
+		case opLiteral:
+			if _, err := io.ReadFull(r, op[1:5]); err != nil {
+				return stats, fmt.Errorf("error reading file: %v", err)
+			}
+			n := int64(binary.BigEndian.Uint32(op[1:]))
+			if n > maxLiteral {
+				return stats, fmt.Errorf("literal of %d bytes is too large", n)
+			}
+			copied, err := io.CopyN(w, r, n)
+			stats.literal += uint64(copied)
+			if err != nil {
+				return stats, fmt.Errorf("error reading file: %v", err)
+			}
+		default:
+			return stats, fmt.Errorf("unknown operation %d", op[0])
+		}
+	}
+}
+
+// emptySignature is the signature of a file the receiver does not have.
+var emptySignature = &signature{}
@@ -0,0 +1,651 @@
+// Package dirsync keeps directories in sync across peers: a sender pushes its directory to a receiver, which
+// only asks for the files that differ and, for the large ones, only for the blocks it does not already have.
+package dirsync
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"p2p/internal/wire"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"p2p/transfer"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ProtocolID is the protocol negotiated on streams synchronizing a directory.
+const ProtocolID protocol.ID = "/p2p/dirsync/1.0.0"
+
+const (
+	// maxMessageSize bounds the manifests and plans a peer accepts.
+	maxMessageSize = 64 << 20
+	// defaultDeltaThreshold is the size from which a modified file is sent as a delta of the receiver's version.
+	defaultDeltaThreshold = 64 << 10
+)
+
+// DeletePolicy tells what a receiver does with the entries the sender does not have.
+type DeletePolicy string
+
+const (
+	// DeleteKeep keeps them.
+	DeleteKeep DeletePolicy = "keep"
+	// DeleteRemove removes them.
+	DeleteRemove DeletePolicy = "remove"
+	// DeleteTrash moves them to .p2psync/trash/<time of the synchronization>/ below the root of the directory.
+	DeleteTrash DeletePolicy = "trash"
+)
+
+// config holds the settings of a synchronization.
+type config struct {
+	deletePolicy   DeletePolicy
+	deltaThreshold int64
+	cache          *Cache
+	allowed        map[peer.ID]bool
+	logger         func(format string, args ...interface{})
+}
+
+// Option configures a synchronization.
+type Option func(cfg *config) error
+
+func newConfig(opts []Option) (*config, error) {
+	cfg := &config{deletePolicy: DeleteKeep, deltaThreshold: defaultDeltaThreshold}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// logf reports an event to the logger set by WithLogger, if any.
+func (cfg *config) logf(format string, args ...interface{}) {
+	if cfg.logger != nil {
+		cfg.logger(format, args...)
+	}
+}
+
+// loggerOf returns the function reporting to the logger set by WithLogger in opts, which does nothing if there is
+// none. Invalid options are left to the synchronizations using them to report.
+func loggerOf(opts []Option) func(format string, args ...interface{}) {
+	cfg := &config{}
+	for _, opt := range opts {
+		_ = opt(cfg)
+	}
+	return cfg.logf
+}
+
+// WithDeletePolicy sets what the receiver does with the files, directories and links the sender does not have,
+// DeleteKeep by default.
+func WithDeletePolicy(policy DeletePolicy) Option {
+	return func(cfg *config) error {
+		switch policy {
+		case DeleteKeep, DeleteRemove, DeleteTrash:
+		default:
+			return fmt.Errorf("unknown delete policy %s", policy)
+		}
+		cfg.deletePolicy = policy
+		return nil
+	}
+}
+
+// WithDeltaThreshold sets the size from which the receiver asks for a modified file as a delta of its version,
+// 64 KiB by default. Smaller files are sent whole.
+func WithDeltaThreshold(size int64) Option {
+	return func(cfg *config) error {
+		if size < 0 {
+			return errors.New("delta threshold must not be negative")
+		}
+		cfg.deltaThreshold = size
+		return nil
+	}
+}
+
+// WithCache keeps the hashes of the files in cache, so that the next synchronizations only hash the files that
+// changed.
+func WithCache(cache *Cache) Option {
+	return func(cfg *config) error {
+		cfg.cache = cache
+		return nil
+	}
+}
+
+// AllowPeers makes the receiver refuse the synchronizations from any peer but ids. Every peer is accepted if this
+// option is not given.
+func AllowPeers(ids ...peer.ID) Option {
+	return func(cfg *config) error {
+		if cfg.allowed == nil {
+			cfg.allowed = make(map[peer.ID]bool, len(ids))
+		}
+		for _, id := range ids {
+			cfg.allowed[id] = true
+		}
+		return nil
+	}
+}
+
+// WithLogger sets a function Mirror reports the synchronizations it retries to, and the receivers set up by
+// Register the synchronizations they fail and the files they keep the old version of. Nothing is reported by
+// default.
+func WithLogger(logf func(format string, args ...interface{})) Option {
+	return func(cfg *config) error {
+		cfg.logger = logf
+		return nil
+	}
+}
+
+// Result sums up a synchronization.
+type Result struct {
+	// Files counts the files sent, Unchanged those the receiver already had.
+	Files     int `json:"files"`
+	Unchanged int `json:"unchanged"`
+	// Literal counts the bytes of the files sent, Matched the bytes the receiver copied from its versions.
+	Literal uint64 `json:"literal"`
+	Matched uint64 `json:"matched"`
+	// Deleted counts the entries removed or moved to the trash.
+	Deleted int `json:"deleted"`
+	// Failed holds the paths of the files that changed while they were sent, which are left as they were.
+	Failed []string `json:"failed,omitempty"`
+}
+
+// planFile is a file the receiver asks for, as a delta of its version if Delta is set.
+type planFile struct {
+	Path  string `json:"path"`
+	Delta bool   `json:"delta,omitempty"`
+}
+
+// plan answers the manifest of the sender with the files the receiver asks for, in order.
+type plan struct {
+	Error string     `json:"error,omitempty"`
+	Files []planFile `json:"files,omitempty"`
+}
+
+// summary ends a synchronization.
+type summary struct {
+	Error  string `json:"error,omitempty"`
+	Result Result `json:"result"`
+}
+
+// Push synchronizes the directory dir to the receiver on the other end of conn, which stores it with Receive.
+//
+// The sender sends the manifest of dir, with the hash of every file, and the receiver answers with the files it
+// does not have in the same version. A modified file larger than the delta threshold of the receiver is sent as a
+// delta: the receiver sends the checksums of the blocks of its version, and the sender sends the blocks it does not
+// find among them, found with the rolling checksum of rsync at any offset, and the indexes of those it does.
+func Push(ctx context.Context, conn io.ReadWriter, dir string, opts ...Option) (*Result, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	res, err := push(conn, dir, cfg)
+	return res, wire.ContextError(ctx, err)
+}
+
+func push(conn io.ReadWriter, dir string, cfg *config) (*Result, error) {
+	manifest, err := BuildManifest(dir, cfg.cache)
+	if err != nil {
+		return nil, err
+	}
+	if err := wire.WriteMessage(conn, manifest, maxMessageSize); err != nil {
+		return nil, err
+	}
+	var p plan
+	if err := wire.ReadMessage(conn, &p, maxMessageSize); err != nil {
+		return nil, err
+	}
+	if p.Error != "" {
+		return nil, fmt.Errorf("receiver refused: %s", p.Error)
+	}
+
+	entries := manifest.index()
+	for _, f := range p.Files {
+		e, ok := entries[f.Path]
+		if !ok || e.Type != transfer.EntryFile {
+			return nil, fmt.Errorf("receiver asked for %s, which is not a file", f.Path)
+		}
+		sig := emptySignature
+		if f.Delta {
+			if sig, err = readSignature(conn); err != nil {
+				return nil, err
+			}
+		}
+		// A file removed since the manifest was built is sent empty, which the receiver finds out of its hash.
+		var r io.Reader = bytes.NewReader(nil)
+		file, err := os.Open(filepath.Join(dir, filepath.FromSlash(f.Path)))
+		if err == nil {
+			r = file
+		}
+		_, err = writeDelta(conn, r, sig)
+		if file != nil {
+			file.Close()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Path, err)
+		}
+	}
+
+	var s summary
+	if err := wire.ReadMessage(conn, &s, maxMessageSize); err != nil {
+		return nil, err
+	}
+	if s.Error != "" {
+		return nil, fmt.Errorf("receiver failed: %s", s.Error)
+	}
+	return &s.Result, nil
+}
+
+// Receive stores the directory sent with Push over conn in dir, created if needed, so that it becomes a copy of
+// the directory of the sender. Files are written to .p2psync/tmp below dir first and renamed into place once
+// their hash matches the manifest, so a file is either in its old or its new version. Files that changed on the
+// sender while they were sent keep their old version and are reported in Result.Failed. The entries the sender
+// does not have are handled according to the policy set by WithDeletePolicy, and the modes and modification times
+// of the sender are applied.
+func Receive(ctx context.Context, conn io.ReadWriter, dir string, opts ...Option) (*Result, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	res, err := receive(conn, dir, cfg)
+	return res, wire.ContextError(ctx, err)
+}
+
+func receive(conn io.ReadWriter, dir string, cfg *config) (*Result, error) {
+	br := bufio.NewReaderSize(conn, 64<<10)
+	var remote Manifest
+	if err := wire.ReadMessage(br, &remote, maxMessageSize); err != nil {
+		return nil, err
+	}
+	r := &receiver{dir: dir, cfg: cfg, stamp: time.Now().UTC().Format("20060102T150405.000")}
+	files, err := r.plan(conn, &remote)
+	if err != nil {
+		// The sender is told why the synchronization was refused.
+		_ = wire.WriteMessage(conn, &plan{Error: err.Error()}, maxMessageSize)
+		return nil, err
+	}
+	if err := wire.WriteMessage(conn, &plan{Files: files}, maxMessageSize); err != nil {
+		return nil, err
+	}
+
+	entries := remote.index()
+	for _, f := range files {
+		if err := r.receiveFile(conn, br, entries[f.Path], f.Delta); err != nil {
+			return nil, fmt.Errorf("%s: %v", f.Path, err)
+		}
+	}
+	if err := r.apply(&remote); err != nil {
+		_ = wire.WriteMessage(conn, &summary{Error: err.Error()}, maxMessageSize)
+		return nil, err
+	}
+	if err := wire.WriteMessage(conn, &summary{Result: r.result}, maxMessageSize); err != nil {
+		return nil, err
+	}
+	return &r.result, nil
+}
+
+// receiver applies the manifest of a sender to a directory.
+type receiver struct {
+	dir    string
+	cfg    *config
+	stamp  string
+	local  map[string]*Entry
+	result Result
+}
+
+// path returns the path on disk of the entry at the slash separated path p. It is refused if a directory above
+// the entry is a link or not a directory, so that nothing outside the directory is ever reached through a link.
+func (r *receiver) path(p string) (string, error) {
+	if parent := path.Dir(p); parent != "." {
+		dir := r.dir
+		for _, elem := range strings.Split(parent, "/") {
+			dir = filepath.Join(dir, elem)
+			info, err := os.Lstat(dir)
+			if errors.Is(err, os.ErrNotExist) {
+				break
+			}
+			if err != nil {
+				return "", err
+			}
+			if !info.IsDir() {
+				return "", fmt.Errorf("%s is below a link or a file", p)
+			}
+		}
+	}
+	return filepath.Join(r.dir, filepath.FromSlash(p)), nil
+}
+
+// isLink reports whether the entry at the slash separated path p is a symbolic link.
+func (r *receiver) isLink(p string) bool {
+	dest, err := r.path(p)
+	if err != nil {
+		return false
+	}
+	info, err := os.Lstat(dest)
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// openFile opens the regular file at the slash separated path p, which must not be a link.
+func (r *receiver) openFile(p string) (*os.File, error) {
+	dest, err := r.path(p)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Lstat(dest); err != nil || !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", p)
+	}
+	return os.Open(dest)
+}
+
+// plan checks the manifest remote and returns the files the receiver asks for.
+func (r *receiver) plan(conn io.ReadWriter, remote *Manifest) ([]planFile, error) {
+	if r.cfg.allowed != nil {
+		p := remotePeer(conn)
+		if p == "" || !r.cfg.allowed[p] {
+			return nil, errors.New("peer is not allowed to synchronize")
+		}
+	}
+	if err := checkManifest(remote); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(r.dir, stateDir, "tmp"), 0755); err != nil {
+		return nil, fmt.Errorf("error creating directory: %v", err)
+	}
+	local, err := BuildManifest(r.dir, r.cfg.cache)
+	if err != nil {
+		return nil, err
+	}
+	r.local = local.index()
+
+	var files []planFile
+	for _, e := range remote.Entries {
+		if e.Type != transfer.EntryFile {
+			continue
+		}
+		l := r.local[e.Path]
+		if l != nil && l.Type == transfer.EntryFile && l.Hash == e.Hash {
+			r.result.Unchanged++
+			continue
+		}
+		delta := l != nil && l.Type == transfer.EntryFile && int64(l.Size) >= r.cfg.deltaThreshold
+		files = append(files, planFile{Path: e.Path, Delta: delta})
+	}
+	return files, nil
+}
+
+// receiveFile receives the file e, as a delta of the local version if delta is set, and moves it into place if
+// its hash matches e.
+func (r *receiver) receiveFile(conn io.Writer, br io.Reader, e *Entry, delta bool) error {
+	sig := emptySignature
+	var base *os.File
+	if delta {
+		// The sender is sent the signature of an empty file if the local version cannot be read.
+		if file, err := r.openFile(e.Path); err == nil {
+			defer file.Close()
+			if info, err := file.Stat(); err == nil {
+				if s, err := computeSignature(file, info.Size()); err == nil {
+					base, sig = file, s
+				}
+			}
+		}
+		if err := writeSignature(conn, sig); err != nil {
+			return err
+		}
+	}
+
+	tmp, err := os.CreateTemp(filepath.Join(r.dir, stateDir, "tmp"), "file.*")
+	if err != nil {
+		return fmt.Errorf("error creating file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	hasher := sha256.New()
+	w := bufio.NewWriterSize(io.MultiWriter(tmp, hasher), 64<<10)
+	var readerAt io.ReaderAt
+	if base != nil {
+		readerAt = base
+	}
+	stats, err := applyDelta(w, br, readerAt, sig)
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	r.result.Literal += stats.literal
+	r.result.Matched += stats.matched
+
+	hash, err := encodeHash(hasher.Sum(nil))
+	if err != nil {
+		return err
+	}
+	if hash != e.Hash {
+		r.result.Failed = append(r.result.Failed, e.Path)
+		return nil
+	}
+	if err := os.Chmod(tmp.Name(), os.FileMode(e.Mode).Perm()); err != nil {
+		return err
+	}
+	if err := os.Chtimes(tmp.Name(), e.ModTime, e.ModTime); err != nil {
+		return err
+	}
+	if err := r.ensureParent(e.Path); err != nil {
+		return err
+	}
+	p, err := r.path(e.Path)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(p); err == nil && info.IsDir() {
+		if err := r.discard(e.Path); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp.Name(), p); err != nil {
+		return fmt.Errorf("error storing file: %v", err)
+	}
+	r.result.Files++
+	return nil
+}
+
+// ensureParent creates the directories above the entry at p, replacing whatever is in their place.
+func (r *receiver) ensureParent(p string) error {
+	parent := path.Dir(p)
+	if parent == "." {
+		return nil
+	}
+	return r.ensureDir(parent)
+}
+
+// ensureDir makes the entry at p a directory, replacing whatever is in its place and creating its parents. The
+// parents come first, so that a link in place of one of them is replaced rather than followed.
+func (r *receiver) ensureDir(p string) error {
+	if err := r.ensureParent(p); err != nil {
+		return err
+	}
+	dest, err := r.path(p)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(dest); err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		if err := r.discard(p); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(dest, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("error creating directory: %v", err)
+	}
+	return nil
+}
+
+// discard removes the entry at p, or moves it to the trash with DeleteTrash. A link is removed, not what it
+// points to.
+func (r *receiver) discard(p string) error {
+	dest, err := r.path(p)
+	if err != nil {
+		return err
+	}
+	if r.cfg.deletePolicy != DeleteTrash {
+		if err := os.RemoveAll(dest); err != nil {
+			return fmt.Errorf("error removing %s: %v", p, err)
+		}
+		return nil
+	}
+	trashed := filepath.Join(r.dir, stateDir, "trash", r.stamp, filepath.FromSlash(p))
+	if err := os.MkdirAll(filepath.Dir(trashed), 0755); err != nil {
+		return fmt.Errorf("error creating trash: %v", err)
+	}
+	if err := os.Rename(dest, trashed); err != nil {
+		return fmt.Errorf("error moving %s to the trash: %v", p, err)
+	}
+	return nil
+}
+
+// apply creates the directories and links of remote, sets the modes and modification times of its entries, and
+// handles the local entries it does not have.
+func (r *receiver) apply(remote *Manifest) error {
+	for _, e := range remote.Entries {
+		switch e.Type {
+		case transfer.EntryDir:
+			if err := r.ensureDir(e.Path); err != nil {
+				return err
+			}
+		case transfer.EntrySymlink:
+			if err := r.ensureParent(e.Path); err != nil {
+				return err
+			}
+			dest, err := r.path(e.Path)
+			if err != nil {
+				return err
+			}
+			if target, err := os.Readlink(dest); err == nil && target == filepath.FromSlash(e.Target) {
+				continue
+			}
+			// The links of the directory that the sender does not have are checked as well as its own.
+			if !transfer.SymlinkInRoot(e.Path, e.Target, r.isLink) {
+				return fmt.Errorf("link %s points outside of the directory", e.Path)
+			}
+			if _, err := os.Lstat(dest); err == nil {
+				if err := r.discard(e.Path); err != nil {
+					return err
+				}
+			}
+			if err := os.Symlink(filepath.FromSlash(e.Target), dest); err != nil {
+				return fmt.Errorf("error creating link: %v", err)
+			}
+		case transfer.EntryFile:
+			// The files kept as they were get the mode and modification time of the sender's version.
+			if l := r.local[e.Path]; l != nil && l.Type == transfer.EntryFile && l.Hash == e.Hash {
+				if err := r.setMetadata(&e); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if r.cfg.deletePolicy != DeleteKeep {
+		entries := remote.index()
+		var extra []string
+		for p := range r.local {
+			if _, ok := entries[p]; !ok {
+				extra = append(extra, p)
+			}
+		}
+		sort.Strings(extra)
+		// An entry below a directory already discarded went with it.
+		var last string
+		for _, p := range extra {
+			if last != "" && strings.HasPrefix(p, last+"/") {
+				continue
+			}
+			// So did an entry below a directory replaced by a file or a link, which must not be followed.
+			if r.replacedParent(p, entries) {
+				continue
+			}
+			dest, err := r.path(p)
+			if err != nil {
+				return err
+			}
+			if _, err := os.Lstat(dest); err != nil {
+				continue
+			}
+			if err := r.discard(p); err != nil {
+				return err
+			}
+			r.result.Deleted++
+			last = p
+		}
+	}
+
+	// Directories get their modes and modification times last, the deepest first, as adding to a directory
+	// changes its modification time.
+	for i := len(remote.Entries) - 1; i >= 0; i-- {
+		e := remote.Entries[i]
+		if e.Type != transfer.EntryDir {
+			continue
+		}
+		if err := r.setMetadata(&e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setMetadata gives the entry of e on disk the mode and modification time of e, unless a link took its place.
+func (r *receiver) setMetadata(e *Entry) error {
+	dest, err := r.path(e.Path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(dest)
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		return fmt.Errorf("%s was replaced by a link", e.Path)
+	}
+	if mode := os.FileMode(e.Mode).Perm(); info.Mode().Perm() != mode {
+		if err := os.Chmod(dest, mode); err != nil {
+			return err
+		}
+	}
+	if !info.ModTime().Equal(e.ModTime) {
+		if err := os.Chtimes(dest, e.ModTime, e.ModTime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replacedParent reports whether a directory above the entry at p is not a directory in entries.
+func (r *receiver) replacedParent(p string, entries map[string]*Entry) bool {
+	for parent := path.Dir(p); parent != "."; parent = path.Dir(parent) {
+		if e, ok := entries[parent]; ok && e.Type != transfer.EntryDir {
+			return true
+		}
+	}
+	return false
+}
+
+// remotePeer returns the peer on the other end of conn if it is a stream that tells.
+func remotePeer(conn io.ReadWriter) peer.ID {
+	if s, ok := conn.(interface{ RemotePeer() peer.ID }); ok {
+		return s.RemotePeer()
+	}
+	return ""
+}
@@ -0,0 +1,195 @@
+package dirsync
+
+import (
+	"context"
+	"net"
+	"os"
+	"p2p/internal/wire"
+	"p2p/transfer"
+	"path/filepath"
+	"testing"
+)
+
+// synchronize pushes src to dst over a pipe, dst being received with opts.
+func synchronize(t *testing.T, src, dst string, opts ...Option) *Result {
+	t.Helper()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := Push(context.Background(), a, src)
+		errc <- err
+	}()
+	res, err := Receive(context.Background(), b, dst, opts...)
+	if err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("Push: %v", err)
+	}
+	return res
+}
+
+// pushManifest sends manifest to a receiver storing it in dst with opts, as a sender having no file would, and
+// returns the error of the receiver.
+func pushManifest(t *testing.T, manifest *Manifest, dst string, opts ...Option) error {
+	t.Helper()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	go func() {
+		if err := wire.WriteMessage(a, manifest, maxMessageSize); err != nil {
+			return
+		}
+		var p plan
+		if err := wire.ReadMessage(a, &p, maxMessageSize); err != nil || p.Error != "" {
+			return
+		}
+		var s summary
+		_ = wire.ReadMessage(a, &s, maxMessageSize)
+	}()
+	_, err := Receive(context.Background(), b, dst, opts...)
+	return err
+}
+
+func writeFile(t *testing.T, p, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func link(name, target string) Entry {
+	return Entry{ManifestEntry: transfer.ManifestEntry{Path: name, Type: transfer.EntrySymlink, Target: target}}
+}
+
+func TestDeletePolicies(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "a.txt"), "alpha")
+	writeFile(t, filepath.Join(src, "sub", "b.txt"), "beta")
+
+	tests := []struct {
+		policy  DeletePolicy
+		kept    bool
+		trashed bool
+	}{
+		{DeleteKeep, true, false},
+		{DeleteRemove, false, false},
+		{DeleteTrash, false, true},
+	}
+	for _, tt := range tests {
+		dst := t.TempDir()
+		writeFile(t, filepath.Join(dst, "sub", "b.txt"), "old beta")
+		writeFile(t, filepath.Join(dst, "extra", "c.txt"), "gamma")
+
+		res := synchronize(t, src, dst, WithDeletePolicy(tt.policy))
+		for p, want := range map[string]string{"a.txt": "alpha", "sub/b.txt": "beta"} {
+			data, err := os.ReadFile(filepath.Join(dst, filepath.FromSlash(p)))
+			if err != nil || string(data) != want {
+				t.Errorf("%s: %s holds %q, %v, want %q", tt.policy, p, data, err, want)
+			}
+		}
+		if res.Files != 2 {
+			t.Errorf("%s: sent %d files, want 2", tt.policy, res.Files)
+		}
+
+		_, err := os.Stat(filepath.Join(dst, "extra", "c.txt"))
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%s: extra/c.txt kept = %v, want %v", tt.policy, kept, tt.kept)
+		}
+		trashed, _ := filepath.Glob(filepath.Join(dst, stateDir, "trash", "*", "extra", "c.txt"))
+		if (len(trashed) == 1) != tt.trashed {
+			t.Errorf("%s: extra/c.txt in the trash = %v, want %v", tt.policy, trashed, tt.trashed)
+		}
+		if wantDeleted := map[bool]int{true: 0, false: 1}[tt.kept]; res.Deleted != wantDeleted {
+			t.Errorf("%s: deleted %d entries, want %d", tt.policy, res.Deleted, wantDeleted)
+		}
+	}
+}
+
+func TestReceiveRefusesLinksThroughLinks(t *testing.T) {
+	parent := t.TempDir()
+	dst := filepath.Join(parent, "dst")
+	victim := filepath.Join(parent, "victim")
+	writeFile(t, victim, "outside")
+	if err := os.Symlink("victim", filepath.Join(parent, "link")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+
+	// Each link points inside the directory on its own, but m goes through l to its parent, where m/victim is.
+	manifest := &Manifest{Entries: []Entry{link("l", "."), link("m", "l/.."), link("m/victim", "x")}}
+	for _, policy := range []DeletePolicy{DeleteKeep, DeleteRemove, DeleteTrash} {
+		if err := pushManifest(t, manifest, dst, WithDeletePolicy(policy)); err == nil {
+			t.Errorf("%s: the manifest was accepted", policy)
+		}
+		if data, err := os.ReadFile(victim); err != nil || string(data) != "outside" {
+			t.Fatalf("%s: the file outside of the directory was changed: %q, %v", policy, data, err)
+		}
+		if _, err := os.Lstat(filepath.Join(dst, "m")); err == nil {
+			t.Errorf("%s: link m was created", policy)
+		}
+	}
+}
+
+func TestReceiveReplacesLinksOfTheDirectory(t *testing.T) {
+	parent := t.TempDir()
+	dst := filepath.Join(parent, "dst")
+	outside := filepath.Join(parent, "outside")
+	writeFile(t, filepath.Join(outside, "f"), "outside")
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "outside"), filepath.Join(dst, "d")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+
+	// A link of the sender may not go through the links of the receiver either.
+	if err := pushManifest(t, &Manifest{Entries: []Entry{link("x", "d/..")}}, dst); err == nil {
+		t.Error("a link going through a link of the directory was created")
+	}
+
+	// An entry below d replaces the link with a directory rather than following it.
+	if err := pushManifest(t, &Manifest{Entries: []Entry{link("d/f", "g")}}, dst, WithDeletePolicy(DeleteRemove)); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(outside, "f")); err != nil || string(data) != "outside" {
+		t.Fatalf("the file outside of the directory was changed: %q, %v", data, err)
+	}
+	info, err := os.Lstat(filepath.Join(dst, "d"))
+	if err != nil || !info.IsDir() {
+		t.Fatalf("d is not a directory: %v", err)
+	}
+	if target, err := os.Readlink(filepath.Join(dst, "d", "f")); err != nil || target != "g" {
+		t.Errorf("d/f links to %q, %v, want g", target, err)
+	}
+}
+
+func TestCheckManifest(t *testing.T) {
+	file := Entry{ManifestEntry: transfer.ManifestEntry{Path: "f", Type: transfer.EntryFile},
+		Hash: "QmYwAPJzv5CZsnA625s3Xf2nemtYgPpHdWEz79ojWnPbdG"}
+	below := file
+	below.Path = "f/g"
+	tests := []struct {
+		name     string
+		manifest Manifest
+		ok       bool
+	}{
+		{"links", Manifest{Entries: []Entry{link("l", "."), link("m", "l"), link("n", "sub/../f")}}, true},
+		{"chained links", Manifest{Entries: []Entry{link("l", "."), link("m", "l/..")}}, false},
+		{"through a link", Manifest{Entries: []Entry{link("l", "sub"), link("m", "l/x")}}, false},
+		{"outside", Manifest{Entries: []Entry{link("l", "../x")}}, false},
+		{"below a link", Manifest{Entries: []Entry{link("l", "."), link("l/x", "y")}}, false},
+		{"below a file", Manifest{Entries: []Entry{file, below}}, false},
+		{"duplicate", Manifest{Entries: []Entry{file, file}}, false},
+		{"reserved", Manifest{Entries: []Entry{link(stateDir+"/x", "y")}}, false},
+	}
+	for _, tt := range tests {
+		if err := checkManifest(&tt.manifest); (err == nil) != tt.ok {
+			t.Errorf("%s: checkManifest = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
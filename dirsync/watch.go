@@ -0,0 +1,61 @@
+package dirsync
+
+import (
+	"context"
+	"time"
+)
+
+// settleDelay is how long a directory must stay unchanged before a burst of changes is reported.
+const settleDelay = 500 * time.Millisecond
+
+// Watch returns a channel receiving a value once the directory dir or anything below it changed, after the
+// changes settled. Changes made while the previous one was not received yet are reported once. The state
+// directory of the receiver is not watched. The channel is closed once ctx is done.
+//
+// Changes are reported by inotify on Linux and found by reading the directory every couple of seconds elsewhere.
+func Watch(ctx context.Context, dir string) (<-chan struct{}, error) {
+	return watchReporting(ctx, dir, nil)
+}
+
+// watchReporting is Watch calling stopped, if not nil, with the error that ended the watch before ctx was done,
+// before the channel is closed.
+func watchReporting(ctx context.Context, dir string, stopped func(err error)) (<-chan struct{}, error) {
+	raw, err := watch(ctx, dir, stopped)
+	if err != nil {
+		return nil, err
+	}
+	changes := make(chan struct{}, 1)
+	go debounce(raw, changes)
+	return changes, nil
+}
+
+// debounce sends a value to out once no value was received from in for settleDelay, and closes out once in is
+// closed.
+func debounce(in <-chan struct{}, out chan<- struct{}) {
+	defer close(out)
+	timer := time.NewTimer(settleDelay)
+	timer.Stop()
+	for {
+		select {
+		case _, ok := <-in:
+			if !ok {
+				timer.Stop()
+				return
+			}
+			timer.Reset(settleDelay)
+		case <-timer.C:
+			select {
+			case out <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// notify sends a value to ch unless one is pending.
+func notify(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,116 @@
+//go:build linux
+
+package dirsync
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// watchMask selects the inotify events reporting a change of the content of a directory.
+const watchMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ATTRIB | syscall.IN_DELETE_SELF
+
+// watch returns a channel receiving a value on every inotify event below dir, closed once ctx is done or once
+// the events cannot be read anymore, after calling stopped with the error if it is not nil.
+func watch(ctx context.Context, dir string, stopped func(err error)) (<-chan struct{}, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("error creating inotify instance: %v", err)
+	}
+	// Being non blocking, the descriptor is read through the runtime poller, so closing it interrupts a read.
+	file := os.NewFile(uintptr(fd), "inotify")
+	w := &inotify{fd: fd, root: filepath.Clean(dir), dirs: make(map[int32]string)}
+	if err := w.addTree(dir); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	events := make(chan struct{}, 1)
+	go func() {
+		<-ctx.Done()
+		file.Close()
+	}()
+	go func() {
+		defer close(events)
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := file.Read(buf)
+			if err != nil {
+				if ctx.Err() == nil && stopped != nil {
+					stopped(err)
+				}
+				return
+			}
+			w.handle(buf[:n])
+			notify(events)
+		}
+	}()
+	return events, nil
+}
+
+// inotify tracks the directories watched by an inotify instance.
+type inotify struct {
+	fd   int
+	root string
+	dirs map[int32]string
+}
+
+// addTree watches the directory dir and those below it, but the state directory.
+func (w *inotify) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// A directory removed since it was listed is not watched.
+			if p == dir {
+				return err
+			}
+			return nil
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if d.Name() == stateDir && filepath.Dir(p) == w.root {
+			return filepath.SkipDir
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, p, watchMask)
+		if err != nil {
+			if p == dir {
+				return fmt.Errorf("error watching %s: %v", p, err)
+			}
+			return nil
+		}
+		w.dirs[int32(wd)] = p
+		return nil
+	})
+}
+
+// handle watches the directories created or moved in, as reported by the events in buf.
+func (w *inotify) handle(buf []byte) {
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[0]))
+		end := syscall.SizeofInotifyEvent + int(event.Len)
+		if end > len(buf) {
+			return
+		}
+		name := string(buf[syscall.SizeofInotifyEvent:end])
+		for len(name) > 0 && name[len(name)-1] == 0 {
+			name = name[:len(name)-1]
+		}
+		buf = buf[end:]
+
+		switch {
+		case event.Mask&syscall.IN_IGNORED != 0:
+			delete(w.dirs, event.Wd)
+		case event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			if parent, ok := w.dirs[event.Wd]; ok && name != "" {
+				// Its content may have been created before it was watched, but is synchronized all the same.
+				_ = w.addTree(filepath.Join(parent, name))
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+//go:build !linux
+
+package dirsync
+
+import (
+	"context"
+	"fmt"
+	"p2p/transfer"
+	"strings"
+	"time"
+)
+
+// pollInterval is how often a watched directory is read on the platforms without inotify.
+const pollInterval = 2 * time.Second
+
+// watch returns a channel receiving a value whenever the listing of dir, with the sizes and modification times
+// of its files, changed since it was last read, closed once ctx is done. Failing reads are retried, so stopped is
+// never called.
+func watch(ctx context.Context, dir string, stopped func(err error)) (<-chan struct{}, error) {
+	last, err := snapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+	events := make(chan struct{}, 1)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			current, err := snapshot(dir)
+			if err != nil || current == last {
+				continue
+			}
+			last = current
+			notify(events)
+		}
+	}()
+	return events, nil
+}
+
+// snapshot returns a string describing the entries below dir, which changes when any of them does.
+func snapshot(dir string) (string, error) {
+	manifest, err := transfer.BuildManifest(dir)
+	if err != nil {
+		return "", err
+	}
+	var b strings.Builder
+	for _, e := range manifest.Entries {
+		if e.Path == stateDir || strings.HasPrefix(e.Path, stateDir+"/") {
+			continue
+		}
+		fmt.Fprintf(&b, "%s\x00%s\x00%s\x00%d\x00%o\x00%d\n", e.Path, e.Type, e.Target, e.Size, e.Mode, e.ModTime.UnixNano())
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,291 @@
+package host
+
+import (
+	"errors"
+	"fmt"
+	"github.com/libp2p/go-yamux/v4"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+	"net"
+	cr "p2p/crypto"
+	"p2p/network"
+	"p2p/peer"
+	"p2p/pnet"
+	"sync"
+	"time"
+)
+
+// ErrGaterDisallowedConnection is returned when the connection gater refuses a connection.
+var ErrGaterDisallowedConnection = errors.New("gater disallows connection to peer")
+
+// connAddrs holds the multiaddrs of the two ends of a connection.
+type connAddrs struct {
+	local  ma.Multiaddr
+	remote ma.Multiaddr
+}
+
+var _ network.ConnMultiaddrs = (*connAddrs)(nil)
+
+// newConnAddrs returns the multiaddrs of raw, nil for an address that has no multiaddr representation.
+func newConnAddrs(raw net.Conn) *connAddrs {
+	local, _ := manet.FromNetAddr(raw.LocalAddr())
+	remote, _ := manet.FromNetAddr(raw.RemoteAddr())
+	return &connAddrs{local: local, remote: remote}
+}
+
+// LocalMultiaddr returns the local multiaddr of the connection.
+func (a *connAddrs) LocalMultiaddr() ma.Multiaddr {
+	return a.local
+}
+
+// RemoteMultiaddr returns the remote multiaddr of the connection.
+func (a *connAddrs) RemoteMultiaddr() ma.Multiaddr {
+	return a.remote
+}
+
+// conn is a connection to a remote peer that went through the handshake and is multiplexed with yamux.
+type conn struct {
+	*connAddrs
+	local     peer.ID
+	raw       net.Conn
+	session   *yamux.Session
+	remote    peer.ID
+	remoteKey cr.PubKey
+	dir       network.Direction
+	opened    time.Time
+	scope     network.ConnScope
+
+	mu      sync.Mutex
+	streams map[*stream]struct{}
+	closed  bool
+}
+
+// upgrade identifies the remote peer of raw and multiplexes it, accounting it in the resource manager
+// and asking the connection gater, if any, whether to go on at each step. For outbound connections,
+// expected is the peer that was dialed, empty if unknown. raw is closed if the upgrade fails.
+func (h *MyHost) upgrade(raw net.Conn, dir network.Direction, expected peer.ID) (*conn, error) {
+	addrs := newConnAddrs(raw)
+	if dir == network.DirInbound && h.gater != nil && !h.gater.InterceptAccept(addrs) {
+		raw.Close()
+		return nil, ErrGaterDisallowedConnection
+	}
+
+	// In a private network, everything after this point is encrypted with the PSK.
+	if h.psk != nil {
+		protected, err := pnet.NewProtectedConn(h.psk, raw)
+		if err != nil {
+			raw.Close()
+			return nil, err
+		}
+		raw = protected
+	}
+
+	scope, err := h.rcmgr.OpenConnection(dir, true)
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	fail := func(err error) (*conn, error) {
+		scope.Done()
+		raw.Close()
+		return nil, err
+	}
+
+	remote, remoteKey, err := handshake(raw, h.privKey)
+	if err != nil {
+		return fail(err)
+	}
+	if remote == h.peerID {
+		return fail(errors.New("connected to self"))
+	}
+	if expected != "" && remote != expected {
+		return fail(fmt.Errorf("dialed peer %s but connected to %s", expected, remote))
+	}
+	if h.gater != nil && !h.gater.InterceptSecured(dir, remote, addrs) {
+		return fail(ErrGaterDisallowedConnection)
+	}
+	if err := scope.SetPeer(remote); err != nil {
+		return fail(err)
+	}
+
+	// Every yamux stream reserves its receive window in a span of the connection scope.
+	newSpan := func() (yamux.MemoryManager, error) {
+		return scope.BeginSpan()
+	}
+	var session *yamux.Session
+	if dir == network.DirInbound {
+		session, err = yamux.Server(raw, nil, newSpan)
+	} else {
+		session, err = yamux.Client(raw, nil, newSpan)
+	}
+	if err != nil {
+		fmt.Printf("Could not wrap yamux on connection because %s \n", err.Error())
+		return fail(err)
+	}
+
+	c := &conn{
+		connAddrs: addrs,
+		local:     h.peerID,
+		raw:       raw,
+		session:   session,
+		remote:    remote,
+		remoteKey: remoteKey,
+		dir:       dir,
+		opened:    time.Now(),
+		scope:     scope,
+		streams:   make(map[*stream]struct{}),
+	}
+	if h.gater != nil && !h.gater.InterceptUpgraded(c) {
+		session.Close()
+		return fail(ErrGaterDisallowedConnection)
+	}
+	h.addConn(c)
+	h.cmgr.Connected(c)
+	go h.serveConn(c)
+	return c, nil
+}
+
+// addConn records c as a connection to its remote peer.
+func (h *MyHost) addConn(c *conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conns[c.remote] = append(h.conns[c.remote], c)
+}
+
+// removeConn forgets c and releases its resources.
+func (h *MyHost) removeConn(c *conn) {
+	h.mu.Lock()
+	conns := h.conns[c.remote]
+	for i, other := range conns {
+		if other == c {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(h.conns, c.remote)
+	} else {
+		h.conns[c.remote] = conns
+	}
+	h.mu.Unlock()
+
+	c.close()
+	h.cmgr.Disconnected(c)
+}
+
+// connToPeer returns the oldest open connection to p.
+func (h *MyHost) connToPeer(p peer.ID) *conn {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, c := range h.conns[p] {
+		if !c.session.IsClosed() {
+			return c
+		}
+	}
+	return nil
+}
+
+// serveConn accepts inbound streams until the connection is closed.
+func (h *MyHost) serveConn(c *conn) {
+	defer h.removeConn(c)
+	for {
+		ys, err := c.session.AcceptStream()
+		if err != nil {
+			return
+		}
+		scope, err := h.rcmgr.OpenStream(c.remote, network.DirInbound)
+		if err != nil {
+			fmt.Printf("Refusing stream from %s because %s\n", c.remote, err.Error())
+			ys.Reset()
+			continue
+		}
+		s := newStream(ys, c, scope, network.DirInbound)
+		go h.handleStream(s)
+	}
+}
+
+var _ network.Conn = (*conn)(nil)
+
+// Close closes the connection, which is then forgotten by the host.
+func (c *conn) Close() error {
+	return c.session.Close()
+}
+
+// LocalPeer returns the ID of the host.
+func (c *conn) LocalPeer() peer.ID {
+	return c.local
+}
+
+// RemotePeer returns the ID of the remote peer.
+func (c *conn) RemotePeer() peer.ID {
+	return c.remote
+}
+
+// RemotePublicKey returns the public key of the remote peer.
+func (c *conn) RemotePublicKey() cr.PubKey {
+	return c.remoteKey
+}
+
+// LocalAddr returns the local network address.
+func (c *conn) LocalAddr() net.Addr {
+	return c.raw.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address.
+func (c *conn) RemoteAddr() net.Addr {
+	return c.raw.RemoteAddr()
+}
+
+// Stat returns the direction, opening time and number of streams of the connection.
+func (c *conn) Stat() network.ConnStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return network.ConnStats{
+		Direction:  c.dir,
+		Opened:     c.opened,
+		NumStreams: len(c.streams),
+	}
+}
+
+// Scope returns the resource scope of the connection.
+func (c *conn) Scope() network.ConnScope {
+	return c.scope
+}
+
+// addStream tracks s until it is fully closed, returning false if the connection is already closed.
+func (c *conn) addStream(s *stream) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.streams[s] = struct{}{}
+	return true
+}
+
+// removeStream stops tracking s.
+func (c *conn) removeStream(s *stream) {
+	c.mu.Lock()
+	delete(c.streams, s)
+	c.mu.Unlock()
+}
+
+// close closes the connection and releases the scopes of the streams still open over it.
+func (c *conn) close() {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	streams := c.streams
+	c.streams = nil
+	c.mu.Unlock()
+
+	c.session.Close()
+	c.raw.Close()
+	for s := range streams {
+		s.release()
+	}
+	c.scope.Done()
+}
@@ -0,0 +1,123 @@
+package host
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	cr "p2p/crypto"
+	"p2p/peer"
+	"time"
+)
+
+const (
+	// handshakeTimeout bounds the whole identity exchange.
+	handshakeTimeout = 30 * time.Second
+	// handshakeNonceSize is the size of the challenge each side signs.
+	handshakeNonceSize = 32
+	// maxHandshakeMsgSize bounds the size of a public key or signature sent by the remote peer.
+	maxHandshakeMsgSize = 4096
+	// handshakeSigPrefix is prepended to the challenge before signing it.
+	handshakeSigPrefix = "p2p-handshake:"
+)
+
+// handshake exchanges public keys with the remote side of conn and proves that both sides own
+// the private key of the public key they sent, by signing a random challenge of the other side.
+// It returns the ID and public key of the remote peer.
+//
+// The peer ID only serves to account the connection in the scope of its peer. It does not
+// authenticate the connection: nothing that follows is encrypted or bound to the keys exchanged,
+// so whoever relays the handshake between two peers can take over the connection under the ID
+// of either.
+func handshake(conn net.Conn, privKey cr.PrivKey) (peer.ID, cr.PubKey, error) {
+	if err := conn.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+		return "", nil, err
+	}
+	defer conn.SetDeadline(time.Time{})
+
+	pubBytes, err := cr.MarshalPublicKey(privKey.GetPublic())
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, handshakeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	// Both sides send their public key and challenge, then read the other's.
+	if err := writeHandshakeMsg(conn, pubBytes); err != nil {
+		return "", nil, err
+	}
+	if err := writeHandshakeMsg(conn, nonce); err != nil {
+		return "", nil, err
+	}
+	remotePubBytes, err := readHandshakeMsg(conn)
+	if err != nil {
+		return "", nil, err
+	}
+	remoteNonce, err := readHandshakeMsg(conn)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(remoteNonce) != handshakeNonceSize {
+		return "", nil, errors.New("handshake: invalid challenge size")
+	}
+	if bytes.Equal(remoteNonce, nonce) {
+		return "", nil, errors.New("handshake: remote peer replayed our challenge")
+	}
+	remotePub, err := cr.UnmarshalPublicKey(remotePubBytes)
+	if err != nil {
+		return "", nil, fmt.Errorf("handshake: invalid public key: %v", err)
+	}
+
+	// Answer the remote challenge and check the answer to ours.
+	sig, err := privKey.Sign(append([]byte(handshakeSigPrefix), remoteNonce...))
+	if err != nil {
+		return "", nil, err
+	}
+	if err := writeHandshakeMsg(conn, sig); err != nil {
+		return "", nil, err
+	}
+	remoteSig, err := readHandshakeMsg(conn)
+	if err != nil {
+		return "", nil, err
+	}
+	ok, err := remotePub.Verify(append([]byte(handshakeSigPrefix), nonce...), remoteSig)
+	if err != nil || !ok {
+		return "", nil, errors.New("handshake: invalid signature from remote peer")
+	}
+
+	remoteID, err := peer.GenerateIDFromPubKey(remotePub)
+	if err != nil {
+		return "", nil, err
+	}
+	return remoteID, remotePub, nil
+}
+
+// writeHandshakeMsg writes msg prefixed with its size as a big endian uint16.
+func writeHandshakeMsg(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+// readHandshakeMsg reads a message written with writeHandshakeMsg.
+func readHandshakeMsg(r io.Reader) ([]byte, error) {
+	var size uint16
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return nil, fmt.Errorf("handshake: %v", err)
+	}
+	if size > maxHandshakeMsgSize {
+		return nil, errors.New("handshake: message too large")
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, fmt.Errorf("handshake: %v", err)
+	}
+	return msg, nil
+}
@@ -9,26 +9,35 @@ package host
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
-	"github.com/hashicorp/yamux"
 	ma "github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multistream"
 	"io"
 	"net"
 	"os"
+	"p2p/connmgr"
 	cr "p2p/crypto"
+	"p2p/metrics"
+	"p2p/network"
 	"p2p/peer"
+	"p2p/pnet"
+	protocol "p2p/protocols"
+	"p2p/ratelimit"
+	"p2p/rcmgr"
 	tr "p2p/transfer"
+	"sync"
+	"time"
 )
 
-// The string used for the multistream select protocol negotiation
 const (
-	multiStreamSelect   = "/multistream/1.0.0"
-	multiStreamSelectNL = "/multistream/1.0.0\n"
-	filename            = "random.txt"
-	inputPath           = "/Users/karan/Documents/Networks/p2p/testingSender/random.txt"
-	outputPath          = "/Users/karan/Documents/Networks/p2p/testingReceiver"
-	ifaceName           = "eth0" //change it to "en0" if you are on a Mac
+	filename   = "random.txt"
+	inputPath  = "/Users/karan/Documents/Networks/p2p/testingSender/random.txt"
+	outputPath = "/Users/karan/Documents/Networks/p2p/testingReceiver"
+	ifaceName  = "eth0" //change it to "en0" if you are on a Mac
+	// minFreeSpace is the disk space a received transfer must leave free in outputPath.
+	minFreeSpace = 1 << 30
 )
 
 // Host represents a single libp2p node in a peer-to-peer network.
@@ -41,6 +50,8 @@ const (
 type Host interface {
 	// ID returns the (local) peer.ID associated with this Host
 	ID() peer.ID
+	// PrivateKey returns the private key the peer ID of the Host is derived from
+	PrivateKey() cr.PrivKey
 	// Addrs Returns the listen addresses of the Host
 	Addrs() ma.Multiaddr
 	// Network  returns the Network interface of the Host
@@ -49,27 +60,57 @@ type Host interface {
 	Listener() net.Listener
 	// Connection returns the TCPConnection to peer of the host
 	Connection() *net.TCPConn
-	// StartListening listens to incoming connections on the listener
+	// Peers returns the peers the Host is connected to
+	Peers() []peer.ID
+	// ResourceManager returns the resource manager accounting the connections and streams of the Host
+	ResourceManager() network.ResourceManager
+	// ConnManager returns the connection manager pruning the connections of the Host
+	ConnManager() connmgr.ConnManager
+	// RateLimiter returns the manager pacing the streams of the Host, nil if they are not paced
+	RateLimiter() *ratelimit.Manager
+	// BandwidthReporter returns the reporter counting the traffic of the streams of the Host, nil if it is not counted
+	BandwidthReporter() metrics.Reporter
+	// Serve accepts incoming connections until the Host is closed
+	Serve() error
+	// Connect dials a peer at the given address, which may end with the /p2p/ component of the expected peer
+	Connect(ctx context.Context, addr ma.Multiaddr) (peer.ID, error)
+	// Close closes the listener and every connection of the Host
+	Close() error
+	// StartListening accepts an incoming connection and serves streams over it
 	StartListening() (net.Conn, error)
-	// StartSending creates a new outgoing connection
+	// StartSending creates a new outgoing connection and serves streams over it
 	StartSending() (net.Conn, error)
-	// NewConn returns a new stream if session is not nil
-	NewConn() (net.Conn, error)
-	// NewStream returns a new
-	NewStream() (*yamux.Stream, error)
+	// SetStreamHandler sets the handler invoked on inbound streams negotiating the given protocol
+	SetStreamHandler(pid protocol.ID, handler network.StreamHandler)
+	// RemoveStreamHandler removes the handler registered for the given protocol
+	RemoveStreamHandler(pid protocol.ID)
+	// NewStream opens a new stream to peer p and negotiates the first of pids it supports
+	NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error)
+	// StartReceiveFile accepts an incoming connection and stores the first file sent over it
 	StartReceiveFile()
+	// StartTransferFile dials a peer address obtained from the user and sends it a file
 	StartTransferFile()
 }
 
 // MyHost is an implementation of Host interface
 type MyHost struct {
 	peerID     peer.ID
+	privKey    cr.PrivKey
 	addrs      ma.Multiaddr
 	network    net.Interface
 	listener   net.Listener
 	connection *net.TCPConn
 	lConn      *net.Conn
-	session    *yamux.Session
+	mux        protocol.Switch
+	rcmgr      network.ResourceManager
+	cmgr       connmgr.ConnManager
+	gater      connmgr.ConnectionGater
+	psk        pnet.PSK
+	limiter    *ratelimit.Manager
+	reporter   metrics.Reporter
+
+	mu    sync.Mutex
+	conns map[peer.ID][]*conn
 }
 
 // ID returns the peer ID associated with this host
@@ -77,6 +118,11 @@ func (h *MyHost) ID() peer.ID {
 	return h.peerID
 }
 
+// PrivateKey returns the private key the peer ID of the host is derived from.
+func (h *MyHost) PrivateKey() cr.PrivKey {
+	return h.privKey
+}
+
 // Addrs returns the listen addresses of the host
 func (h *MyHost) Addrs() ma.Multiaddr {
 	return h.addrs
@@ -97,185 +143,318 @@ func (h *MyHost) Connection() *net.TCPConn {
 	return h.connection
 }
 
-func (h *MyHost) NewStream() (*yamux.Stream, error) {
-	con := h.connection
-	if con == nil {
-		fmt.Printf("No connection found to stream over")
-		return nil, errors.New("no connection found to stream over")
+// Peers returns the peers the host is connected to
+func (h *MyHost) Peers() []peer.ID {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	peers := make([]peer.ID, 0, len(h.conns))
+	for p := range h.conns {
+		peers = append(peers, p)
 	}
+	return peers
+}
+
+// ResourceManager returns the resource manager of the host
+func (h *MyHost) ResourceManager() network.ResourceManager {
+	return h.rcmgr
+}
+
+// ConnManager returns the connection manager of the host
+func (h *MyHost) ConnManager() connmgr.ConnManager {
+	return h.cmgr
+}
+
+// RateLimiter returns the manager pacing the streams of the host, nil if they are not paced.
+func (h *MyHost) RateLimiter() *ratelimit.Manager {
+	return h.limiter
+}
+
+// BandwidthReporter returns the reporter counting the traffic of the streams of the host, nil if it is not counted.
+func (h *MyHost) BandwidthReporter() metrics.Reporter {
+	return h.reporter
+}
 
-	yamuxSession, err := yamux.Server(con, nil)
-	defer func(yamuxSession *yamux.Session) {
-		err := yamuxSession.Close()
+// Serve accepts incoming connections on the listener until it is closed, upgrading each of them in the background.
+func (h *MyHost) Serve() error {
+	for {
+		raw, err := h.Listener().Accept()
 		if err != nil {
-			fmt.Printf("error %s/n", err.Error())
+			return err
 		}
-	}(yamuxSession)
-	//yamuxSession, err := setupSenderYamux(con, nil)
-
-	if err != nil {
-		fmt.Printf("Error opening a new stream because of %s\n", err)
-		return nil, err
+		go func() {
+			c, err := h.upgrade(raw, network.DirInbound, "")
+			if err != nil {
+				fmt.Printf("Could not upgrade connection from %s because %s\n", raw.RemoteAddr(), err.Error())
+				return
+			}
+			fmt.Printf("Peer %s connected\n", c.remote)
+		}()
 	}
+}
 
-	stream, err := yamuxSession.AcceptStream()
-	if err != nil {
-		// Ignore the error if it's related to the session being closed
-		if err != yamux.ErrSessionShutdown {
-			panic(err)
-		}
+// Close closes the listener and every connection of the host, then its connection and resource managers.
+func (h *MyHost) Close() error {
+	err := h.listener.Close()
+
+	h.mu.Lock()
+	var conns []*conn
+	for _, cs := range h.conns {
+		conns = append(conns, cs...)
+	}
+	h.mu.Unlock()
+	for _, c := range conns {
+		h.removeConn(c)
 	}
-	defer func(stream *yamux.Stream) {
-		err := stream.Close()
-		if err != nil {
-			fmt.Printf("error::%s \n", err.Error())
-		}
-	}(stream)
-	return stream, nil
 
+	h.cmgr.Close()
+	h.rcmgr.Close()
+	return err
 }
 
-// StartListening listens to incoming connections on the listener
+// StartListening accepts an incoming connection on the listener and starts serving streams over it
 func (h *MyHost) StartListening() (net.Conn, error) {
 	conn, err := h.Listener().Accept()
-	tcpConn, ok := conn.(*net.TCPConn)
-	if !ok {
-		fmt.Printf("Could not resolve Conn to TCPConn\n")
-	}
-	h.connection = tcpConn
-	fmt.Printf("conected to %s \n", conn.RemoteAddr())
 	if err != nil {
 		fmt.Printf("Could not accept connection on %s because %s\n", h.Addrs(), err.Error())
 		return nil, err
 	}
-	buf := make([]byte, 1024)
-	i, err := conn.Read(buf)
-	if err != nil {
-		fmt.Printf("Error %s encountered while readed\n", err.Error())
-		return nil, err
+	fmt.Printf("conected to %s \n", conn.RemoteAddr())
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		h.connection = tcpConn
 	}
-	//fmt.Printf("reading %d bytes which are: %s\n", i, buf[:i])
-	i, err = conn.Read(buf)
+
+	c, err := h.upgrade(conn, network.DirInbound, "")
 	if err != nil {
-		fmt.Printf("Error %s encountered while readed\n", err.Error())
+		fmt.Printf("Could not upgrade connection from %s because %s\n", conn.RemoteAddr(), err.Error())
 		return nil, err
 	}
-	//temp := string(buf[:i-1])
-
-	tempbuf := buf[:i-1]
-
-	fmt.Printf("reading again %d bytes which are: %s and multi is %s\n", i, "|"+string(tempbuf[len(tempbuf)-18:])+"|", "|"+multiStreamSelect+"|")
-	if string(tempbuf[len(tempbuf)-18:]) != multiStreamSelect {
-		fmt.Printf("Sender does not support multisteam select, Abort connection\n")
-		return nil, errors.New("sender does not multi-stream-select")
-	}
-	fmt.Printf("Sender supports multisteam select. Hooray!!!\n")
+	fmt.Printf("Peer %s connected\n", c.remote)
 
 	return conn, nil
-
 }
 
-// StartSending returns a new connection to the destination.
+// StartSending dials a peer address obtained from the user and starts serving streams over the connection.
 func (h *MyHost) StartSending() (net.Conn, error) {
 	// Get the destination address from the user.
 	addr, err := GetAddrFromUser()
 	if err != nil {
 		return nil, err
 	}
-	// Connect to the destination address over TCP/IP.
-	conn, err := connectTcpIp4(addr)
+	p, err := h.Connect(context.Background(), addr)
 	if err != nil {
+		fmt.Printf("Could not connect to %s because %s\n", addr, err.Error())
 		return nil, err
 	}
+	fmt.Printf("Connected to peer %s\n", p)
 
-	h.connection = conn
+	return h.connection, nil
+}
 
-	// Set up a new yamux session for the connection.
-	session, err := setupSenderYamux(conn, nil)
-	if err != nil {
-		return nil, err
+// Connect dials a peer at addr and upgrades the connection. If addr ends with a /p2p/ component,
+// the remote peer must prove it owns that peer ID, and an existing connection to it is reused.
+func (h *MyHost) Connect(ctx context.Context, addr ma.Multiaddr) (peer.ID, error) {
+	var expected peer.ID
+	transport, p2pPart := ma.SplitFunc(addr, func(c ma.Component) bool {
+		return c.Protocol().Code == ma.P_P2P
+	})
+	if p2pPart != nil {
+		value, err := p2pPart.ValueForProtocol(ma.P_P2P)
+		if err != nil {
+			return "", err
+		}
+		if expected, err = peer.Decode(value); err != nil {
+			return "", err
+		}
+		if h.connToPeer(expected) != nil {
+			return expected, nil
+		}
+		if h.gater != nil && !h.gater.InterceptPeerDial(expected) {
+			return "", ErrGaterDisallowedConnection
+		}
+	}
+	if h.gater != nil && !h.gater.InterceptAddrDial(expected, transport) {
+		return "", ErrGaterDisallowedConnection
 	}
 
-	h.session = session
-
-	// Open a new stream over the yamux session.
-	newConn, err := newConnYamux(session)
+	ipAddr, tcpPort, err := GetIp4TcpFromMultiaddr(transport)
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	var dialer net.Dialer
+	raw, err := dialer.DialContext(ctx, "tcp", ipAddr+":"+tcpPort)
+	if err != nil {
+		return "", err
+	}
+	if tcpConn, ok := raw.(*net.TCPConn); ok {
+		h.connection = tcpConn
 	}
 
-	// Write the stream select message to the new stream.
-	_, err = newConn.Write([]byte(multiStreamSelectNL))
+	c, err := h.upgrade(raw, network.DirOutbound, expected)
 	if err != nil {
-		fmt.Printf("Could not write on stream because %s\n", err.Error())
-		return nil, err
+		return "", err
 	}
+	return c.remote, nil
+}
 
-	return newConn, nil
+// SetStreamHandler sets the handler invoked on inbound streams negotiating the given protocol
+func (h *MyHost) SetStreamHandler(pid protocol.ID, handler network.StreamHandler) {
+	h.mux.AddHandler(string(pid), func(p string, rwc io.ReadWriteCloser) error {
+		s := rwc.(*stream)
+		if err := s.setProtocol(protocol.ID(p)); err != nil {
+			fmt.Printf("Refusing %s stream from %s because %s\n", p, s.RemotePeer(), err.Error())
+			s.Reset()
+			return err
+		}
+		handler(h.wrapStream(s))
+		return nil
+	})
 }
 
-// NewConn returns a new stream if session is not nil
-func (h *MyHost) NewConn() (net.Conn, error) {
-	if h.connection == nil {
-		return nil, errors.New("no Connection to multiplex over")
+// RemoveStreamHandler removes the handler registered for the given protocol
+func (h *MyHost) RemoveStreamHandler(pid protocol.ID) {
+	h.mux.RemoveHandler(string(pid))
+}
+
+// NewStream opens a new stream to peer p and negotiates the first of pids it supports.
+// The deadline of ctx, if any, also bounds the protocol negotiation. An error wrapping
+// network.ErrResourceLimitExceeded is returned if the stream would go over a resource limit.
+func (h *MyHost) NewStream(ctx context.Context, p peer.ID, pids ...protocol.ID) (network.Stream, error) {
+	if len(pids) == 0 {
+		return nil, errors.New("no protocol given to negotiate")
+	}
+	c := h.connToPeer(p)
+	if c == nil {
+		return nil, fmt.Errorf("no connection to peer %s", p)
 	}
 
-	conn, err := newConnYamux(h.session)
+	scope, err := h.rcmgr.OpenStream(p, network.DirOutbound)
 	if err != nil {
-		fmt.Printf("Could not create a new stream because of %s \n", err.Error())
 		return nil, err
 	}
-	return conn, nil
-}
-
-func (h *MyHost) StartReceiveFile() {
-	conn, err := h.Listener().Accept()
-	fmt.Printf("conected to %s \n", conn.RemoteAddr())
+	ys, err := c.session.OpenStream(ctx)
 	if err != nil {
-		fmt.Printf("Could not accept connection on %s because %s\n", h.Addrs(), err.Error())
+		scope.Done()
+		fmt.Printf("Error opening a new stream because of %s\n", err)
+		return nil, err
 	}
-	err = tr.ReceiveFile(conn, outputPath)
-	if err != nil {
-		err := fmt.Errorf("rrror in 'receiveFile': %s", err.Error())
-		println(err.Error())
+	s := newStream(ys, c, scope, network.DirOutbound)
 
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.SetDeadline(deadline)
+		defer s.SetDeadline(time.Time{})
 	}
-
-}
-func (h *MyHost) StartTransferFile() {
-	// Get the destination address from the user.
-	addr, err := GetAddrFromUser()
+	selected, err := multistream.SelectOneOf(protocol.ConvertToStrings(pids), s)
 	if err != nil {
-		fmt.Printf("Unable to get add because %s\n", err.Error())
+		_ = s.Reset()
+		return nil, err
 	}
-	// Connect to the destination address over TCP/IP.
-	conn, err := connectTcpIp4(addr)
-	if err != nil {
-		fmt.Printf("Unable to connect TCP because %s\n", err.Error())
+	if err := s.setProtocol(protocol.ID(selected)); err != nil {
+		_ = s.Reset()
+		return nil, err
 	}
+	return h.wrapStream(s), nil
+}
 
-	h.connection = conn
+// wrapStream returns s counted by the bandwidth reporter and paced by the rate limiter of the host, if it has
+// them. The traffic is counted as it goes through the stream, once paced.
+func (h *MyHost) wrapStream(s network.Stream) network.Stream {
+	if h.reporter != nil {
+		s = metrics.Stream(s, h.reporter)
+	}
+	if h.limiter != nil {
+		s = h.limiter.Stream(s)
+	}
+	return s
+}
 
-	// Set up a new yamux session for the connection.
-	session, err := setupSenderYamux(conn, nil)
-	if err != nil {
-		fmt.Printf("Unable to set up Yamux because %s\n", err.Error())
+// handleStream negotiates the protocol of an inbound stream and invokes its handler.
+func (h *MyHost) handleStream(s *stream) {
+	if err := h.mux.Handle(s); err != nil {
+		fmt.Printf("Could not negotiate a protocol on stream %d because %s\n", s.ID(), err.Error())
+		_ = s.Reset()
 	}
+}
 
-	// Open a new stream over the yamux session.
-	newConn, err := newConnYamux(session)
-	if err != nil {
-		fmt.Printf("Unable to send over streaed connection because %s\n", err.Error())
+// StartReceiveFile accepts an incoming connection and waits until the first file or directory sent over it
+// with the transfer protocols is stored in outputPath. Every transfer is offered to the user on the terminal,
+// and refused without asking if there is not enough disk space for it. Progress is shown as a progress bar.
+func (h *MyHost) StartReceiveFile() {
+	done := make(chan struct{})
+	var once sync.Once
+	stored := tr.WithStoredCallback(func(path string) {
+		fmt.Printf("Stored %s\n", path)
+		once.Do(func() { close(done) })
+	})
+	offers := []tr.Option{
+		tr.WithOfferPolicy(tr.MinFreeSpace(minFreeSpace)),
+		tr.WithOfferHandler(tr.PromptOffer(os.Stdin, os.Stdout)),
+		tr.WithProgress(tr.NewProgressBar(os.Stdout)),
+		tr.WithConnManager(h.cmgr),
+		tr.WithLogger(logf),
+	}
+	h.SetStreamHandler(tr.ProtocolID, func(s network.Stream) {
+		defer s.Close()
+		if err := tr.ReceiveFile(s, outputPath, append(offers, stored)...); err != nil {
+			fmt.Printf("Could not receive file from %s because %s\n", s.RemotePeer(), err.Error())
+		}
+	})
+	h.SetStreamHandler(tr.DirProtocolID, func(s network.Stream) {
+		defer s.Close()
+		if err := tr.ReceiveDir(s, outputPath, offers...); err != nil {
+			fmt.Printf("Could not receive directory from %s because %s\n", s.RemotePeer(), err.Error())
+			return
+		}
+		once.Do(func() { close(done) })
+	})
+	if _, err := h.StartListening(); err != nil {
+		return
+	}
+	<-done
+}
+
+// StartTransferFile dials a peer address obtained from the user and sends it the file at inputPath
+// with the transfer protocol, over several streams at once, or the directory at inputPath with the
+// directory transfer protocol.
+func (h *MyHost) StartTransferFile() {
+	if _, err := h.StartSending(); err != nil {
+		return
+	}
+	peers := h.Peers()
+	if len(peers) == 0 {
+		fmt.Printf("Not connected to any peer\n")
+		return
 	}
 
-	// Write the stream select message to the new stream.
+	if info, err := os.Stat(inputPath); err == nil && info.IsDir() {
+		s, err := h.NewStream(context.Background(), peers[0], tr.DirProtocolID)
+		if err != nil {
+			fmt.Printf("Unable to open a transfer stream because %s\n", err.Error())
+			return
+		}
+		defer s.Close()
+		err = tr.UploadDir(s, inputPath, tr.WithProgress(tr.NewProgressBar(os.Stdout)), tr.WithConnManager(h.cmgr),
+			tr.WithLogger(logf))
+		if err != nil {
+			fmt.Printf("Could not send %s because %s\n", inputPath, err.Error())
+		}
+		return
+	}
 
-	err = tr.UploadFile(newConn, filename, inputPath, 8)
+	open := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return h.NewStream(ctx, peers[0], tr.ProtocolID)
+	}
+	err := tr.UploadFileParallel(context.Background(), open, filename, inputPath, tr.WithProgress(tr.NewProgressBar(os.Stdout)),
+		tr.WithConnManager(h.cmgr), tr.WithLogger(logf))
 	if err != nil {
-		fmt.Printf("Could not write on stream because %s\n", err.Error())
+		fmt.Printf("Could not send %s because %s\n", inputPath, err.Error())
 	}
 }
 
+// logf prints what the transfers started from the terminal report, a line each.
+func logf(format string, args ...interface{}) {
+	fmt.Printf(format+"\n", args...)
+}
+
 // getMyMultiaddr returns the IP address and multiaddress of the specified network interface and TCP port.
 func getMyMultiaddr(inface, tcpPort string) (*net.Interface, ma.Multiaddr, error) {
 	// Get the network interface by name.
@@ -337,40 +516,101 @@ func _(conn net.Conn) []byte {
 }
 
 // GetHost returns a new Host object after generating a key pair, obtaining the local IPv4 address and TCP port,
+// and setting up a TCP listener. Errors are printed, use NewHost to handle them.
+// Parameters:
+// - port: a string representing the port number to listen to.
+// - opts: options configuring the host.
+// Returns:
+// - a Host object representing the local host, nil if it could not be created.
+func GetHost(port string, opts ...Option) Host {
+	host, err := NewHost(port, opts...)
+	if err != nil {
+		fmt.Printf("Could not create host because %s\n", err.Error())
+		return nil
+	}
+	return host
+}
+
+// NewHost returns a new Host object after generating a key pair, obtaining the local IPv4 address and TCP port,
 // and setting up a TCP listener.
 // Parameters:
 // - port: a string representing the port number to listen to.
+// - opts: options configuring the host.
 // Returns:
 // - a Host object representing the local host.
-func GetHost(port string) Host {
+// - an error object if the host could not be created.
+func NewHost(port string, opts ...Option) (Host, error) {
 	// Generate a key pair and obtain the peer ID.
-	_, pubKey, _ := cr.GenerateKeyPair(1, -1)
-	id, _ := peer.GenerateIDFromPubKey(pubKey)
+	privKey, pubKey, err := cr.GenerateKeyPair(cr.Ed25519, -1)
+	if err != nil {
+		return nil, err
+	}
+	id, err := peer.GenerateIDFromPubKey(pubKey)
+	if err != nil {
+		return nil, err
+	}
 
 	// Obtain the local multiaddress, IPv4 address, and TCP port.
+	network, addrs, err := getMyMultiaddr(ifaceName, port)
+	if err != nil {
+		return nil, err
+	}
 
-	network, addrs, _ := getMyMultiaddr(ifaceName, port)
-
-	ip4, tcpPort, _ := GetIp4TcpFromMultiaddr(addrs)
-
-	// Set up a TCP listener on the local IPv4 address and TCP port.
-	listener, err := net.Listen("tcp", ip4+":"+tcpPort)
+	ip4, tcpPort, err := GetIp4TcpFromMultiaddr(addrs)
 	if err != nil {
-		// Print an error message if the TCP listener could not be set up.
-		fmt.Printf("Could not listen on Address %s \n because %s", ip4+":"+tcpPort, err.Error())
+		return nil, err
 	}
 
-	// Create a new MyHost object with the obtained parameters and return it as a Host object.
+	// Create a new MyHost object with the obtained parameters.
 	host := &MyHost{
 		peerID:     id,
+		privKey:    privKey,
 		addrs:      addrs,
 		network:    *network,
-		listener:   listener,
 		connection: nil,
-		session:    nil,
 		lConn:      nil,
+		mux:        multistream.NewMultistreamMuxer[string](),
+		conns:      make(map[peer.ID][]*conn),
+	}
+	for _, opt := range opts {
+		if err := opt(host); err != nil {
+			host.closeManagers()
+			return nil, err
+		}
+	}
+	if host.cmgr == nil {
+		host.cmgr = connmgr.NullConnMgr{}
+	}
+	if host.rcmgr == nil {
+		host.rcmgr = rcmgr.NewResourceManager(rcmgr.DefaultLimits())
+	}
+	if host.psk == nil && pnet.ForcePrivateNetwork() {
+		host.closeManagers()
+		return nil, pnet.ErrNotInPrivateNetwork
+	}
+
+	// Set up a TCP listener on the local IPv4 address and TCP port.
+	listener, err := net.Listen("tcp", ip4+":"+tcpPort)
+	if err != nil {
+		// Print an error message if the TCP listener could not be set up.
+		fmt.Printf("Could not listen on Address %s \n because %s", ip4+":"+tcpPort, err.Error())
+		host.closeManagers()
+		return nil, err
+	}
+	host.listener = listener
+
+	return host, nil
+}
+
+// closeManagers closes the connection and resource managers of a host that could not be created, which it owns
+// as it would have closed them in Close.
+func (h *MyHost) closeManagers() {
+	if h.cmgr != nil {
+		h.cmgr.Close()
+	}
+	if h.rcmgr != nil {
+		h.rcmgr.Close()
 	}
-	return host
 }
 
 // GetIp4TcpFromMultiaddr extracts the IPv4 address and TCP port from a given multiaddress.
@@ -398,65 +638,6 @@ func GetIp4TcpFromMultiaddr(addr ma.Multiaddr) (string, string, error) {
 	return ipAddr, tcpPort, nil
 }
 
-// connectTcpIp4 returns tcp connection from multiaddr
-func connectTcpIp4(addr ma.Multiaddr) (*net.TCPConn, error) {
-
-	ipAddr, tcpPort, err := GetIp4TcpFromMultiaddr(addr)
-	if err != nil {
-		return nil, err
-	}
-
-	peerAddr := ipAddr + ":" + tcpPort
-	fmt.Printf("Resolved tcp addr from multiaddr: %s \n", peerAddr)
-
-	//Resolving the TCP address
-	ipAdd, err := net.ResolveTCPAddr("tcp", peerAddr)
-	if err != nil {
-		fmt.Printf("Error resolving TCP address(%s): %s \n", peerAddr, err)
-		return nil, err
-	}
-
-	// Get a TCP connection
-	conn, err := net.DialTCP("tcp", nil, ipAdd)
-	if err != nil {
-		fmt.Printf("Could not establish with peer %s because %s", peerAddr, err.Error())
-		return nil, err
-	}
-
-	return conn, nil
-}
-
-// setupSenderYamux returns yamux session after taking in connection and config
-// set config to nil for default configuration
-func setupSenderYamux(conn io.ReadWriteCloser, config *yamux.Config) (*yamux.Session, error) {
-
-	session, err := yamux.Client(conn, config)
-	if err != nil {
-		fmt.Printf("Could not wrap yamux on connection because %s \n", err.Error())
-		return nil, err
-	}
-	return session, nil
-}
-
-func newStream(sess *yamux.Session) (*yamux.Stream, error) {
-	k, err := sess.OpenStream()
-	if err != nil {
-		fmt.Printf("Error opening a new stream because of %s\n", err)
-		return nil, err
-	}
-	return k, nil
-
-}
-
-// newStream takes in a yamux session and returns a multiplexed connection
-func newConnYamux(session *yamux.Session) (net.Conn, error) {
-	stream, err := session.Open()
-	if err != nil {
-		fmt.Printf("Error opening a new Stream:%s \n", err.Error())
-	}
-	return stream, err
-}
-
 // GetAddrFromUser takes in user input to return a multi address or an error
 func GetAddrFromUser() (ma.Multiaddr, error) {
 	for {
@@ -0,0 +1,110 @@
+package host
+
+import (
+	"fmt"
+	"p2p/connmgr"
+	cr "p2p/crypto"
+	"p2p/metrics"
+	"p2p/network"
+	"p2p/peer"
+	"p2p/pnet"
+	"p2p/ratelimit"
+	"p2p/rcmgr"
+)
+
+// Option configures a host created by NewHost.
+type Option func(h *MyHost) error
+
+// WithIdentity makes the host use the private key priv, and the peer ID derived from it, in place of a key
+// generated for the host. A host keeping its key across restarts keeps its peer ID, so that its peers can find it
+// again and the data encrypted to it can still be read.
+func WithIdentity(priv cr.PrivKey) Option {
+	return func(h *MyHost) error {
+		id, err := peer.GenerateIDFromPubKey(priv.GetPublic())
+		if err != nil {
+			return err
+		}
+		h.privKey, h.peerID = priv, id
+		return nil
+	}
+}
+
+// WithResourceManager sets the resource manager accounting the connections and streams of the host.
+// A resource manager with rcmgr.DefaultLimits is used if this option is not given.
+func WithResourceManager(rm network.ResourceManager) Option {
+	return func(h *MyHost) error {
+		h.rcmgr = rm
+		return nil
+	}
+}
+
+// WithLimitConfigFile makes the host enforce the resource limits read from the JSON file at path.
+func WithLimitConfigFile(path string) Option {
+	return func(h *MyHost) error {
+		limits, err := rcmgr.LoadLimitConfig(path)
+		if err != nil {
+			return err
+		}
+		h.rcmgr = rcmgr.NewResourceManager(limits)
+		return nil
+	}
+}
+
+// WithConnectionManager sets the connection manager pruning the connections of the host.
+// Connections are never pruned if this option is not given.
+func WithConnectionManager(cm connmgr.ConnManager) Option {
+	return func(h *MyHost) error {
+		h.cmgr = cm
+		return nil
+	}
+}
+
+// WithConnectionGater sets the connection gater deciding which connections the host accepts and dials.
+func WithConnectionGater(g connmgr.ConnectionGater) Option {
+	return func(h *MyHost) error {
+		h.gater = g
+		return nil
+	}
+}
+
+// WithPSK makes the host a member of the private network protected by psk: it only talks to hosts
+// knowing the same key.
+func WithPSK(psk pnet.PSK) Option {
+	return func(h *MyHost) error {
+		if len(psk) != 32 {
+			return fmt.Errorf("expected a swarm key of 32 bytes, got %d", len(psk))
+		}
+		h.psk = psk
+		return nil
+	}
+}
+
+// WithSwarmKeyFile makes the host a member of the private network whose key is in the swarm.key file at path.
+func WithSwarmKeyFile(path string) Option {
+	return func(h *MyHost) error {
+		psk, err := pnet.LoadPSK(path)
+		if err != nil {
+			return err
+		}
+		h.psk = psk
+		return nil
+	}
+}
+
+// WithRateLimiter makes the host pace the reads and writes of its streams with the limits of m, which can be
+// changed while the host runs. Streams are not paced if this option is not given.
+func WithRateLimiter(m *ratelimit.Manager) Option {
+	return func(h *MyHost) error {
+		h.limiter = m
+		return nil
+	}
+}
+
+// WithBandwidthReporter makes the host count the bytes read and written on its streams with r, in total, per
+// peer and per protocol. The traffic is not counted if this option is not given.
+func WithBandwidthReporter(r metrics.Reporter) Option {
+	return func(h *MyHost) error {
+		h.reporter = r
+		return nil
+	}
+}
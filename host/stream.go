@@ -0,0 +1,175 @@
+package host
+
+import (
+	"errors"
+	"github.com/libp2p/go-yamux/v4"
+	"io"
+	"p2p/network"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"sync"
+	"time"
+)
+
+// Halves of a stream, used to know when a stream no longer holds resources.
+const (
+	readHalf = 1 << iota
+	writeHalf
+	bothHalves = readHalf | writeHalf
+)
+
+// stream is the network.Stream implementation backed by a yamux stream.
+type stream struct {
+	*yamux.Stream
+	conn  *conn
+	scope network.StreamScope
+
+	mu       sync.Mutex
+	stat     network.Stats
+	closed   int
+	released bool
+}
+
+var _ network.Stream = (*stream)(nil)
+
+// newStream wraps a yamux stream of c opened in the given direction, accounted in scope.
+func newStream(ys *yamux.Stream, c *conn, scope network.StreamScope, dir network.Direction) *stream {
+	s := &stream{
+		Stream: ys,
+		conn:   c,
+		scope:  scope,
+		stat: network.Stats{
+			Direction: dir,
+			Opened:    time.Now(),
+		},
+	}
+	if !c.addStream(s) {
+		s.Stream.Reset()
+		s.release()
+	}
+	return s
+}
+
+// ID returns the yamux stream ID.
+func (s *stream) ID() uint32 {
+	return s.Stream.StreamID()
+}
+
+// RemotePeer returns the peer on the other end of the stream.
+func (s *stream) RemotePeer() peer.ID {
+	return s.conn.remote
+}
+
+// Conn returns the connection the stream is multiplexed over.
+func (s *stream) Conn() network.Conn {
+	return s.conn
+}
+
+// Scope returns the resource scope of the stream.
+func (s *stream) Scope() network.StreamScope {
+	return s.scope
+}
+
+// Read reads from the stream, reporting a reset as network.ErrReset.
+func (s *stream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	switch {
+	case err == io.EOF:
+		s.closeHalves(readHalf)
+	case errors.Is(err, yamux.ErrStreamReset):
+		s.closeHalves(bothHalves)
+	}
+	return n, mapStreamErr(err)
+}
+
+// Write writes to the stream, reporting a reset as network.ErrReset.
+func (s *stream) Write(b []byte) (int, error) {
+	n, err := s.Stream.Write(b)
+	if errors.Is(err, yamux.ErrStreamReset) {
+		s.closeHalves(bothHalves)
+	}
+	return n, mapStreamErr(err)
+}
+
+// CloseWrite closes the stream for writing, the remote side reads io.EOF.
+func (s *stream) CloseWrite() error {
+	err := s.Stream.CloseWrite()
+	s.closeHalves(writeHalf)
+	return err
+}
+
+// CloseRead closes the stream for reading.
+func (s *stream) CloseRead() error {
+	err := s.Stream.CloseRead()
+	s.closeHalves(readHalf)
+	return err
+}
+
+// Close closes both halves of the stream.
+func (s *stream) Close() error {
+	err := s.Stream.Close()
+	s.closeHalves(bothHalves)
+	return err
+}
+
+// Reset aborts the stream on both sides.
+func (s *stream) Reset() error {
+	err := s.Stream.Reset()
+	s.closeHalves(bothHalves)
+	return err
+}
+
+// Protocol returns the protocol negotiated on this stream.
+func (s *stream) Protocol() protocol.ID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stat.Protocol
+}
+
+// Stat returns the direction, opening time and protocol of the stream.
+func (s *stream) Stat() network.Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stat
+}
+
+// setProtocol records the negotiated protocol and moves the stream into the protocol scope.
+func (s *stream) setProtocol(p protocol.ID) error {
+	s.mu.Lock()
+	s.stat.Protocol = p
+	s.mu.Unlock()
+	return s.scope.SetProtocol(p)
+}
+
+// closeHalves marks halves as closed and releases the stream once both are.
+func (s *stream) closeHalves(halves int) {
+	s.mu.Lock()
+	s.closed |= halves
+	done := s.closed == bothHalves
+	s.mu.Unlock()
+	if done {
+		s.release()
+	}
+}
+
+// release frees the resources held by the stream, once.
+func (s *stream) release() {
+	s.mu.Lock()
+	if s.released {
+		s.mu.Unlock()
+		return
+	}
+	s.released = true
+	s.mu.Unlock()
+
+	s.scope.Done()
+	s.conn.removeStream(s)
+}
+
+// mapStreamErr translates yamux specific errors into their network counterparts.
+func mapStreamErr(err error) error {
+	if errors.Is(err, yamux.ErrStreamReset) {
+		return network.ErrReset
+	}
+	return err
+}
@@ -0,0 +1,84 @@
+// Package wire holds the framing of the JSON messages the protocols of this module exchange on a stream, and the
+// handling of the context of such an exchange.
+package wire
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// WriteMessage sends v on w as a uint32 big endian length followed by its JSON encoding, refusing to send an
+// encoding over limit bytes.
+func WriteMessage(w io.Writer, v interface{}, limit uint32) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if uint64(len(data)) > uint64(limit) {
+		return fmt.Errorf("message of %d bytes is too large", len(data))
+	}
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	if _, err := w.Write(append(buf, data...)); err != nil {
+		return fmt.Errorf("error sending message: %v", err)
+	}
+	return nil
+}
+
+// ReadMessage receives a message sent with WriteMessage from r into v, refusing those over limit bytes.
+func ReadMessage(r io.Reader, v interface{}, limit uint32) error {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return fmt.Errorf("error reading message length: %v", err)
+	}
+	if length > limit {
+		return fmt.Errorf("message of %d bytes is too large", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("error reading message: %v", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("error decoding message: %v", err)
+	}
+	return nil
+}
+
+// WatchContext interrupts any blocking read or write on conn once ctx is done, by expiring its deadline or
+// closing it. The returned function stops watching and must be called once the exchange is over.
+func WatchContext(ctx context.Context, conn io.ReadWriter) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		select {
+		case <-ctx.Done():
+			switch c := conn.(type) {
+			case interface{ SetDeadline(time.Time) error }:
+				_ = c.SetDeadline(time.Unix(1, 0))
+			case io.Closer:
+				_ = c.Close()
+			}
+		case <-stop:
+		}
+	}()
+	return func() {
+		close(stop)
+		<-finished
+	}
+}
+
+// ContextError returns the error of ctx in place of err if ctx is done, as err is then caused by the
+// interruption of the exchange.
+func ContextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
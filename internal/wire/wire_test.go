@@ -0,0 +1,69 @@
+package wire
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	type message struct {
+		Name string `json:"name"`
+		Size uint64 `json:"size"`
+	}
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, message{Name: "a.txt", Size: 3}, 64); err != nil {
+		t.Fatal(err)
+	}
+	var got message
+	if err := ReadMessage(&buf, &got, 64); err != nil {
+		t.Fatal(err)
+	}
+	if got != (message{Name: "a.txt", Size: 3}) {
+		t.Errorf("received %+v", got)
+	}
+}
+
+func TestMessageLimit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteMessage(&buf, "a message too long", 8); err == nil {
+		t.Error("sent a message over the limit")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes of a message over the limit", buf.Len())
+	}
+	if err := WriteMessage(&buf, "a message too long", 64); err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err := ReadMessage(&buf, &s, 8); err == nil {
+		t.Error("received a message over the limit")
+	}
+}
+
+func TestWatchContext(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	stop := WatchContext(ctx, a)
+	defer stop()
+
+	done := make(chan error, 1)
+	go func() {
+		var s string
+		done <- ContextError(ctx, ReadMessage(a, &s, 64))
+	}()
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("ReadMessage = %v, want the error of the context", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the read was not interrupted")
+	}
+}
@@ -2,10 +2,14 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	ma "github.com/multiformats/go-multiaddr"
+	"io"
 	"os"
 	"p2p/host"
+	"p2p/network"
+	protocol "p2p/protocols"
 )
 
 // PrintProtocols takes in a multi address and returns the list of protocols in the address
@@ -24,7 +28,11 @@ const (
 
 func main() {
 
-	myHost := host.GetHost("5031")
+	myHost, err := host.NewHost("5031")
+	if err != nil {
+		fmt.Printf("Could not create host because %s\n", err.Error())
+		os.Exit(1)
+	}
 	fmt.Printf("ID: %s\nAddress: %s\n", myHost.ID(), myHost.Addrs())
 
 	scanner := bufio.NewScanner(os.Stdin)
@@ -32,13 +40,9 @@ func main() {
 	input := scanner.Text()
 	if input == "rec" {
 		receiverMethod(myHost)
+		// Inbound streams are served in the background until the user quits.
 		scanner := bufio.NewScanner(os.Stdin)
 		scanner.Scan()
-		input := scanner.Text()
-		if input == "go" {
-			fmt.Printf("in receive go\n")
-			receiveAgain(myHost)
-		}
 	}
 
 	if input == "send" {
@@ -63,6 +67,7 @@ func main() {
 }
 
 func receiverMethod(myHost host.Host) {
+	myHost.SetStreamHandler(protocol.TestingID, printStream)
 	_, _ = myHost.StartListening()
 }
 
@@ -71,8 +76,18 @@ func senderMethod(myHost host.Host) {
 }
 
 func sendAgain(myHost host.Host) {
-	sendingConn, err := myHost.NewConn()
-	i, err := sendingConn.Write([]byte("hello, This is sent over a new " +
+	peers := myHost.Peers()
+	if len(peers) == 0 {
+		fmt.Printf("Not connected to any peer\n")
+		return
+	}
+	stream, err := myHost.NewStream(context.Background(), peers[0], protocol.TestingID)
+	if err != nil {
+		fmt.Printf("Could not open a stream because %s\n", err.Error())
+		return
+	}
+	defer stream.Close()
+	i, err := stream.Write([]byte("hello, This is sent over a new " +
 		"Stream using the same connection. Isn't it efficient???\n"))
 	if err != nil {
 		return
@@ -80,18 +95,13 @@ func sendAgain(myHost host.Host) {
 	fmt.Printf("Wrote %d bytes\n", i)
 }
 
-func receiveAgain(myHost host.Host) {
-	fmt.Printf("In receive again %s \n", myHost.Listener().Addr())
-	stream, err := myHost.NewStream()
+// printStream reads an inbound stream until the sender closes it and prints what was received.
+func printStream(stream network.Stream) {
+	defer stream.Close()
+	fmt.Printf("New %s stream %d for %s from %s\n", stream.Stat().Direction, stream.ID(), stream.Protocol(), stream.RemotePeer())
+	buf, err := io.ReadAll(stream)
 	if err != nil {
-		fmt.Printf("Can't listen on %s because %s \n", myHost.Listener().Addr().String(), err.Error())
+		fmt.Printf("Error %s encountered while reading\n", err.Error())
 	}
-	fmt.Printf("Listening on %s \n", stream.LocalAddr())
-	buf := make([]byte, 1024)
-	i, err := stream.Read(buf)
-	if err != nil {
-		fmt.Printf("Error %s encountered while readin\n", err.Error())
-	}
-	fmt.Printf("reading %d bytes which are: %s\n", i, buf[:i])
-
+	fmt.Printf("reading %d bytes which are: %s\n", len(buf), buf)
 }
@@ -0,0 +1,100 @@
+package merkledag
+
+import (
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"io"
+	"p2p/blocks"
+	"p2p/chunker"
+)
+
+// DefaultMaxLinks is the most links a file node has, which keeps nodes under 8 KiB.
+const DefaultMaxLinks = 174
+
+// pending is a block linked by a node still to be built.
+type pending struct {
+	cid       cid.Cid
+	fileSize  uint64
+	totalSize uint64
+}
+
+// Build splits data with spl and assembles the chunks into a balanced DAG of file nodes with up to
+// DefaultMaxLinks links each, all leaves at the same depth, and returns its root. Every block is passed to
+// put as soon as it is built, children before their parents and leaves in the order of the data. A file of
+// a single chunk is its own root, and an empty file is an empty leaf.
+func Build(spl chunker.Splitter, put func(b *blocks.Block) error) (cid.Cid, error) {
+	// levels[i] holds the blocks of depth i from the bottom waiting for their parent.
+	var levels [][]pending
+	add := func(depth int, p pending) error {
+		for {
+			if depth == len(levels) {
+				levels = append(levels, make([]pending, 0, DefaultMaxLinks))
+			}
+			if len(levels[depth]) < DefaultMaxLinks {
+				levels[depth] = append(levels[depth], p)
+				return nil
+			}
+			// The level is full: its blocks get their parent, one level up, and p starts the next one.
+			parent, err := link(levels[depth], put)
+			if err != nil {
+				return err
+			}
+			levels[depth] = append(levels[depth][:0], p)
+			depth, p = depth+1, parent
+		}
+	}
+
+	for {
+		data, err := spl.NextBytes()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cid.Undef, fmt.Errorf("error reading data: %v", err)
+		}
+		leaf := blocks.NewBlock(append([]byte(nil), data...))
+		if err := put(leaf); err != nil {
+			return cid.Undef, err
+		}
+		if err := add(0, pending{cid: leaf.Cid(), fileSize: uint64(len(data)), totalSize: uint64(len(data))}); err != nil {
+			return cid.Undef, err
+		}
+	}
+	if len(levels) == 0 {
+		leaf := blocks.NewBlock([]byte{})
+		return leaf.Cid(), put(leaf)
+	}
+
+	// Link what is left level by level, so that every leaf ends up at the same depth.
+	for depth := 0; ; depth++ {
+		if depth == len(levels)-1 && len(levels[depth]) == 1 {
+			return levels[depth][0].cid, nil
+		}
+		parent, err := link(levels[depth], put)
+		if err != nil {
+			return cid.Undef, err
+		}
+		if err := add(depth+1, parent); err != nil {
+			return cid.Undef, err
+		}
+	}
+}
+
+// link builds the file node linking children and passes it to put.
+func link(children []pending, put func(b *blocks.Block) error) (pending, error) {
+	fs := &fsNode{typ: unixfsFile, blockSizes: make([]uint64, len(children))}
+	node := &Node{Links: make([]Link, len(children))}
+	var total uint64
+	for i, c := range children {
+		fs.fileSize += c.fileSize
+		fs.blockSizes[i] = c.fileSize
+		node.Links[i] = Link{Cid: c.cid, Size: c.totalSize}
+		total += c.totalSize
+	}
+	node.Data = fs.encode()
+	b := node.Block()
+	if err := put(b); err != nil {
+		return pending{}, err
+	}
+	return pending{cid: b.Cid(), fileSize: fs.fileSize, totalSize: total + uint64(len(b.RawData()))}, nil
+}
@@ -0,0 +1,151 @@
+// Package merkledag assembles chunks of a file into a Merkle DAG whose root CID identifies the file. Chunks
+// are raw leaves, linked by UnixFS file nodes encoded in dag-pb, the format IPFS uses for files.
+package merkledag
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"p2p/blocks"
+)
+
+// Link points from a node to a child block.
+type Link struct {
+	// Name is empty for the chunks of a file.
+	Name string
+	// Size is the total size of the blocks below the link, the child included.
+	Size uint64
+	Cid  cid.Cid
+}
+
+// Node is a dag-pb node: links to other blocks and data, a UnixFS description of the file for file nodes.
+type Node struct {
+	Links []Link
+	Data  []byte
+}
+
+// Protocol buffers wire types.
+const (
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// Encode returns the canonical dag-pb encoding of n: the links first, then the data.
+func (n *Node) Encode() []byte {
+	var buf []byte
+	for _, l := range n.Links {
+		var link []byte
+		link = appendBytesField(link, 1, l.Cid.Bytes())
+		link = appendBytesField(link, 2, []byte(l.Name))
+		link = appendVarintField(link, 3, l.Size)
+		buf = appendBytesField(buf, 2, link)
+	}
+	if n.Data != nil {
+		buf = appendBytesField(buf, 1, n.Data)
+	}
+	return buf
+}
+
+// Block returns the dag-pb block holding n.
+func (n *Node) Block() *blocks.Block {
+	return blocks.NewBlockWithCodec(n.Encode(), cid.DagProtobuf)
+}
+
+// DecodeNode decodes the dag-pb node encoded in data.
+func DecodeNode(data []byte) (*Node, error) {
+	n := &Node{}
+	err := readFields(data, func(field int, wire int, v uint64, b []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			n.Data = append([]byte{}, b...)
+		case field == 2 && wire == wireBytes:
+			l, err := decodeLink(b)
+			if err != nil {
+				return err
+			}
+			n.Links = append(n.Links, l)
+		default:
+			return fmt.Errorf("unexpected field %d", field)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid dag-pb node: %v", err)
+	}
+	return n, nil
+}
+
+func decodeLink(data []byte) (Link, error) {
+	var l Link
+	hasCid := false
+	err := readFields(data, func(field int, wire int, v uint64, b []byte) error {
+		switch {
+		case field == 1 && wire == wireBytes:
+			c, err := cid.Cast(b)
+			if err != nil {
+				return fmt.Errorf("invalid link: %v", err)
+			}
+			l.Cid, hasCid = c, true
+		case field == 2 && wire == wireBytes:
+			l.Name = string(b)
+		case field == 3 && wire == wireVarint:
+			l.Size = v
+		default:
+			return fmt.Errorf("unexpected link field %d", field)
+		}
+		return nil
+	})
+	if err == nil && !hasCid {
+		err = errors.New("link without a CID")
+	}
+	return l, err
+}
+
+func appendVarintField(buf []byte, field int, v uint64) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|wireVarint))
+	return binary.AppendUvarint(buf, v)
+}
+
+func appendBytesField(buf []byte, field int, b []byte) []byte {
+	buf = binary.AppendUvarint(buf, uint64(field<<3|wireBytes))
+	buf = binary.AppendUvarint(buf, uint64(len(b)))
+	return append(buf, b...)
+}
+
+// readFields calls fn with every field of the protocol buffers message in data: its number, wire type, and
+// value for varints or bytes for length-delimited fields. Other wire types are refused.
+func readFields(data []byte, fn func(field int, wire int, v uint64, b []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 || key>>3 == 0 || key>>3 > 1<<29 {
+			return errors.New("invalid field key")
+		}
+		data = data[n:]
+		field, wire := int(key>>3), int(key&7)
+		switch wire {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return errors.New("invalid varint")
+			}
+			data = data[n:]
+			if err := fn(field, wire, v, nil); err != nil {
+				return err
+			}
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return errors.New("truncated field")
+			}
+			b := data[n : n+int(length)]
+			data = data[n+int(length):]
+			if err := fn(field, wire, 0, b); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported wire type %d", wire)
+		}
+	}
+	return nil
+}
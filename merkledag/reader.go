@@ -0,0 +1,200 @@
+package merkledag
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"io"
+	"p2p/blocks"
+)
+
+// maxDepth bounds the depth of the DAGs ResolveLeaves expands, far above what a file of any size needs.
+const maxDepth = 16
+
+// Getter returns the block with a given CID, from a local store or from other peers.
+type Getter interface {
+	// Get returns the block identified by c, whose data matches c.
+	Get(ctx context.Context, c cid.Cid) (*blocks.Block, error)
+}
+
+// Links returns the links of b, none for a raw leaf.
+func Links(b *blocks.Block) ([]Link, error) {
+	switch b.Cid().Type() {
+	case cid.Raw:
+		return nil, nil
+	case cid.DagProtobuf:
+		node, err := DecodeNode(b.RawData())
+		if err != nil {
+			return nil, err
+		}
+		return node.Links, nil
+	default:
+		return nil, fmt.Errorf("block %s has unsupported codec %#x", b.Cid(), b.Cid().Type())
+	}
+}
+
+// FileSize returns the size of the file below b, the root of a file or one of its nodes.
+func FileSize(b *blocks.Block) (uint64, error) {
+	_, fs, err := decodeFile(b)
+	if err != nil {
+		return 0, err
+	}
+	if fs == nil {
+		return uint64(len(b.RawData())), nil
+	}
+	return fs.fileSize, nil
+}
+
+// decodeFile decodes b, a node of a file. The UnixFS description is nil for a raw leaf.
+func decodeFile(b *blocks.Block) (*Node, *fsNode, error) {
+	switch b.Cid().Type() {
+	case cid.Raw:
+		return nil, nil, nil
+	case cid.DagProtobuf:
+	default:
+		return nil, nil, fmt.Errorf("block %s has unsupported codec %#x", b.Cid(), b.Cid().Type())
+	}
+	node, err := DecodeNode(b.RawData())
+	if err != nil {
+		return nil, nil, err
+	}
+	fs, err := decodeFSNode(node.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if fs.typ != unixfsFile && fs.typ != unixfsRaw {
+		return nil, nil, fmt.Errorf("block %s is not a file", b.Cid())
+	}
+	if len(fs.blockSizes) != len(node.Links) {
+		return nil, nil, fmt.Errorf("block %s has %d links and %d block sizes", b.Cid(), len(node.Links), len(fs.blockSizes))
+	}
+	return node, fs, nil
+}
+
+// ResolveLeaves expands the nodes of the DAG below root level by level, fetching them with fetch, and returns the
+// links to its leaves in the order of the file, without fetching the leaves. The DAG describes a file of size bytes,
+// split in chunks of at least minChunk bytes but the last: the leaves found and the bytes of those that are raw
+// chunks are counted as the levels are expanded, and a DAG with more leaves or bytes than the file can hold is
+// refused before it is fetched further.
+func ResolveLeaves(ctx context.Context, root cid.Cid, size, minChunk uint64, fetch func(context.Context, []cid.Cid) (map[cid.Cid]*blocks.Block, error)) ([]Link, error) {
+	if minChunk == 0 {
+		minChunk = 1
+	}
+	maxLeaves := size/minChunk + 1
+	level := []Link{{Cid: root, Size: size}}
+	blks := make(map[cid.Cid]*blocks.Block)
+	for depth := 0; ; depth++ {
+		var nodes []cid.Cid
+		for _, l := range level {
+			switch l.Cid.Type() {
+			case cid.DagProtobuf:
+				if _, ok := blks[l.Cid]; !ok {
+					nodes = append(nodes, l.Cid)
+					blks[l.Cid] = nil
+				}
+			case cid.Raw:
+			default:
+				return nil, fmt.Errorf("block %s has unsupported codec %#x", l.Cid, l.Cid.Type())
+			}
+		}
+		if len(nodes) == 0 {
+			return level, nil
+		}
+		if depth == maxDepth {
+			return nil, errors.New("DAG too deep")
+		}
+		got, err := fetch(ctx, nodes)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range nodes {
+			if blks[c] = got[c]; blks[c] == nil {
+				return nil, fmt.Errorf("block %s was not received", c)
+			}
+		}
+
+		next := make([]Link, 0, len(level))
+		var bytes uint64
+		add := func(l Link) error {
+			next = append(next, l)
+			if l.Cid.Type() == cid.Raw {
+				bytes += l.Size
+			}
+			if uint64(len(next)) > maxLeaves || bytes > size {
+				return fmt.Errorf("DAG has more chunks than a file of %d bytes", size)
+			}
+			return nil
+		}
+		for _, l := range level {
+			if l.Cid.Type() != cid.DagProtobuf {
+				if err := add(l); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			links, err := Links(blks[l.Cid])
+			if err != nil {
+				return nil, err
+			}
+			for _, child := range links {
+				if err := add(child); err != nil {
+					return nil, err
+				}
+			}
+		}
+		level = next
+	}
+}
+
+// Cat writes the file whose DAG has root to w, fetching its blocks from g, and returns the bytes written.
+// The size of every node is checked against the data below it.
+func Cat(ctx context.Context, root cid.Cid, g Getter, w io.Writer) (int64, error) {
+	n, err := cat(ctx, root, g, w)
+	return int64(n), err
+}
+
+func cat(ctx context.Context, c cid.Cid, g Getter, w io.Writer) (uint64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	b, err := g.Get(ctx, c)
+	if err != nil {
+		return 0, err
+	}
+	if !b.Cid().Equals(c) {
+		return 0, fmt.Errorf("got block %s instead of %s", b.Cid(), c)
+	}
+	node, fs, err := decodeFile(b)
+	if err != nil {
+		return 0, err
+	}
+	if fs == nil {
+		if _, err := w.Write(b.RawData()); err != nil {
+			return 0, err
+		}
+		return uint64(len(b.RawData())), nil
+	}
+
+	var written uint64
+	if len(fs.data) > 0 {
+		if _, err := w.Write(fs.data); err != nil {
+			return 0, err
+		}
+		written += uint64(len(fs.data))
+	}
+	for i, l := range node.Links {
+		n, err := cat(ctx, l.Cid, g, w)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n != fs.blockSizes[i] {
+			return written, fmt.Errorf("block %s holds %d bytes instead of %d", l.Cid, n, fs.blockSizes[i])
+		}
+	}
+	if written != fs.fileSize {
+		return written, errors.New("file size does not match its blocks")
+	}
+	return written, nil
+}
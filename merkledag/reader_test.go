@@ -0,0 +1,115 @@
+package merkledag
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"p2p/blocks"
+	"p2p/chunker"
+	"strings"
+	"testing"
+)
+
+// memoryFetch returns a fetch function for ResolveLeaves serving the blocks of blks, which counts the
+// nodes asked for in fetched.
+func memoryFetch(blks map[cid.Cid]*blocks.Block, fetched *int) func(context.Context, []cid.Cid) (map[cid.Cid]*blocks.Block, error) {
+	return func(_ context.Context, cids []cid.Cid) (map[cid.Cid]*blocks.Block, error) {
+		got := make(map[cid.Cid]*blocks.Block, len(cids))
+		for _, c := range cids {
+			b, ok := blks[c]
+			if !ok {
+				return nil, fmt.Errorf("block %s not found", c)
+			}
+			got[c] = b
+		}
+		*fetched += len(cids)
+		return got, nil
+	}
+}
+
+func TestResolveLeaves(t *testing.T) {
+	data := make([]byte, 300<<10)
+	rand.Read(data)
+	blks := make(map[cid.Cid]*blocks.Block)
+	root, err := Build(chunker.NewSizeSplitter(bytes.NewReader(data), 1024), func(b *blocks.Block) error {
+		// Only the nodes are served, the leaves are never fetched.
+		if b.Cid().Type() == cid.DagProtobuf {
+			blks[b.Cid()] = b
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetched int
+	leaves, err := ResolveLeaves(context.Background(), root, uint64(len(data)), 1024, memoryFetch(blks, &fetched))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) != len(data)/1024 {
+		t.Fatalf("resolved %d leaves, want %d", len(leaves), len(data)/1024)
+	}
+	for i, l := range leaves {
+		if l.Cid != blocks.NewBlock(data[i*1024:(i+1)*1024]).Cid() {
+			t.Fatalf("leaf %d is %s, not the chunk at its offset", i, l.Cid)
+		}
+	}
+
+	if _, err := ResolveLeaves(context.Background(), root, uint64(len(data))-1, 1, memoryFetch(blks, &fetched)); err == nil {
+		t.Error("resolved the DAG of a larger file")
+	}
+	if _, err := ResolveLeaves(context.Background(), root, uint64(len(data))/1024-1, 1, memoryFetch(blks, &fetched)); err == nil {
+		t.Error("resolved more leaves than a file can hold")
+	}
+	if _, err := ResolveLeaves(context.Background(), root, uint64(len(data)), 2048, memoryFetch(blks, &fetched)); err == nil {
+		t.Error("resolved more leaves than the chunker cuts")
+	}
+}
+
+func TestResolveLeavesBoundsExpansion(t *testing.T) {
+	// Every node links the next one many times, which would double the leaves at every level.
+	leaf := blocks.NewBlock([]byte("x"))
+	blks := map[cid.Cid]*blocks.Block{leaf.Cid(): leaf}
+	child := Link{Cid: leaf.Cid(), Size: 0}
+	for i := 0; i < maxDepth; i++ {
+		node := &Node{}
+		for j := 0; j < 64; j++ {
+			node.Links = append(node.Links, child)
+		}
+		b := node.Block()
+		blks[b.Cid()] = b
+		child = Link{Cid: b.Cid()}
+	}
+
+	var fetched int
+	_, err := ResolveLeaves(context.Background(), child.Cid, 1000, 1, memoryFetch(blks, &fetched))
+	if err == nil || !strings.Contains(err.Error(), "more chunks") {
+		t.Fatalf("ResolveLeaves = %v, want the DAG refused for its chunks", err)
+	}
+	if fetched > 3 {
+		t.Errorf("fetched %d nodes before refusing the DAG", fetched)
+	}
+}
+
+func TestResolveLeavesBoundsEmptyChunks(t *testing.T) {
+	// Empty chunks add no bytes, so only the size of the chunks the chunker cuts bounds them.
+	empty := blocks.NewBlock(nil)
+	node := &Node{}
+	for i := 0; i < 64; i++ {
+		node.Links = append(node.Links, Link{Cid: empty.Cid()})
+	}
+	root := node.Block()
+	blks := map[cid.Cid]*blocks.Block{root.Cid(): root, empty.Cid(): empty}
+
+	var fetched int
+	if _, err := ResolveLeaves(context.Background(), root.Cid(), 1000, 1, memoryFetch(blks, &fetched)); err != nil {
+		t.Fatalf("ResolveLeaves = %v with chunks of a byte", err)
+	}
+	_, err := ResolveLeaves(context.Background(), root.Cid(), 1000, 100, memoryFetch(blks, &fetched))
+	if err == nil || !strings.Contains(err.Error(), "more chunks") {
+		t.Fatalf("ResolveLeaves = %v, want the DAG refused for its chunks", err)
+	}
+}
@@ -0,0 +1,62 @@
+package merkledag
+
+import (
+	"fmt"
+)
+
+// Types of UnixFS nodes. Only files are built, directories are sent with their own manifest.
+const (
+	unixfsRaw       = 0
+	unixfsDirectory = 1
+	unixfsFile      = 2
+)
+
+// fsNode is the UnixFS description of a file held in the data of a dag-pb node: the size of the file below
+// the node, and the size of the file below each of its links.
+type fsNode struct {
+	typ        uint64
+	data       []byte
+	fileSize   uint64
+	blockSizes []uint64
+}
+
+func (f *fsNode) encode() []byte {
+	buf := appendVarintField(nil, 1, f.typ)
+	if f.data != nil {
+		buf = appendBytesField(buf, 2, f.data)
+	}
+	buf = appendVarintField(buf, 3, f.fileSize)
+	for _, s := range f.blockSizes {
+		buf = appendVarintField(buf, 4, s)
+	}
+	return buf
+}
+
+func decodeFSNode(data []byte) (*fsNode, error) {
+	f := &fsNode{}
+	hasType := false
+	err := readFields(data, func(field int, wire int, v uint64, b []byte) error {
+		switch {
+		case field == 1 && wire == wireVarint:
+			f.typ, hasType = v, true
+		case field == 2 && wire == wireBytes:
+			f.data = append([]byte{}, b...)
+		case field == 3 && wire == wireVarint:
+			f.fileSize = v
+		case field == 4 && wire == wireVarint:
+			f.blockSizes = append(f.blockSizes, v)
+		case field >= 5 && field <= 8:
+			// Hash type and fanout of sharded directories, mode and modification time, all ignored.
+		default:
+			return fmt.Errorf("unexpected field %d", field)
+		}
+		return nil
+	})
+	if err == nil && !hasType {
+		err = fmt.Errorf("missing type")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid UnixFS node: %v", err)
+	}
+	return f, nil
+}
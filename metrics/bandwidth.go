@@ -0,0 +1,199 @@
+// Package metrics accounts the traffic of a host, in total, per peer and per protocol.
+package metrics
+
+import (
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"sync"
+	"time"
+)
+
+// Stats is the traffic of a peer, a protocol or a whole host.
+type Stats struct {
+	// TotalIn and TotalOut count the bytes received and sent.
+	TotalIn  int64
+	TotalOut int64
+	// RateIn and RateOut are moving averages of the bytes received and sent per second.
+	RateIn  float64
+	RateOut float64
+}
+
+// Reporter is told about the traffic of a host.
+type Reporter interface {
+	// LogSentMessage counts size bytes sent.
+	LogSentMessage(size int64)
+	// LogRecvMessage counts size bytes received.
+	LogRecvMessage(size int64)
+	// LogSentMessageStream counts size bytes sent on a stream of protocol proto with peer p.
+	LogSentMessageStream(size int64, proto protocol.ID, p peer.ID)
+	// LogRecvMessageStream counts size bytes received on a stream of protocol proto with peer p.
+	LogRecvMessageStream(size int64, proto protocol.ID, p peer.ID)
+	// GetBandwidthForPeer returns the traffic with peer p.
+	GetBandwidthForPeer(p peer.ID) Stats
+	// GetBandwidthForProtocol returns the traffic of protocol proto.
+	GetBandwidthForProtocol(proto protocol.ID) Stats
+	// GetBandwidthTotals returns the traffic of the whole host.
+	GetBandwidthTotals() Stats
+	// GetBandwidthByPeer returns the traffic of every peer.
+	GetBandwidthByPeer() map[peer.ID]Stats
+	// GetBandwidthByProtocol returns the traffic of every protocol.
+	GetBandwidthByProtocol() map[protocol.ID]Stats
+}
+
+// meters counts the traffic of one scope in both directions.
+type meters struct {
+	in  meter
+	out meter
+}
+
+func (ms *meters) stats(now time.Time) Stats {
+	totalIn, rateIn := ms.in.snapshot(now)
+	totalOut, rateOut := ms.out.snapshot(now)
+	return Stats{TotalIn: int64(totalIn), TotalOut: int64(totalOut), RateIn: rateIn, RateOut: rateOut}
+}
+
+// BandwidthCounter is a Reporter counting the traffic in total, per peer and per protocol. It is safe for
+// concurrent use. Messages logged without a stream only count towards the totals.
+type BandwidthCounter struct {
+	totals meters
+
+	mu        sync.RWMutex
+	peers     map[peer.ID]*meters
+	protocols map[protocol.ID]*meters
+}
+
+var _ Reporter = (*BandwidthCounter)(nil)
+
+// NewBandwidthCounter returns a counter with nothing counted yet.
+func NewBandwidthCounter() *BandwidthCounter {
+	return &BandwidthCounter{
+		peers:     make(map[peer.ID]*meters),
+		protocols: make(map[protocol.ID]*meters),
+	}
+}
+
+func (bwc *BandwidthCounter) LogSentMessage(size int64) {
+	bwc.totals.out.mark(uint64(size), time.Now())
+}
+
+func (bwc *BandwidthCounter) LogRecvMessage(size int64) {
+	bwc.totals.in.mark(uint64(size), time.Now())
+}
+
+func (bwc *BandwidthCounter) LogSentMessageStream(size int64, proto protocol.ID, p peer.ID) {
+	now := time.Now()
+	bwc.totals.out.mark(uint64(size), now)
+	bwc.peerMeters(p).out.mark(uint64(size), now)
+	bwc.protocolMeters(proto).out.mark(uint64(size), now)
+}
+
+func (bwc *BandwidthCounter) LogRecvMessageStream(size int64, proto protocol.ID, p peer.ID) {
+	now := time.Now()
+	bwc.totals.in.mark(uint64(size), now)
+	bwc.peerMeters(p).in.mark(uint64(size), now)
+	bwc.protocolMeters(proto).in.mark(uint64(size), now)
+}
+
+func (bwc *BandwidthCounter) GetBandwidthForPeer(p peer.ID) Stats {
+	bwc.mu.RLock()
+	ms, ok := bwc.peers[p]
+	bwc.mu.RUnlock()
+	if !ok {
+		return Stats{}
+	}
+	return ms.stats(time.Now())
+}
+
+func (bwc *BandwidthCounter) GetBandwidthForProtocol(proto protocol.ID) Stats {
+	bwc.mu.RLock()
+	ms, ok := bwc.protocols[proto]
+	bwc.mu.RUnlock()
+	if !ok {
+		return Stats{}
+	}
+	return ms.stats(time.Now())
+}
+
+func (bwc *BandwidthCounter) GetBandwidthTotals() Stats {
+	return bwc.totals.stats(time.Now())
+}
+
+func (bwc *BandwidthCounter) GetBandwidthByPeer() map[peer.ID]Stats {
+	now := time.Now()
+	bwc.mu.RLock()
+	defer bwc.mu.RUnlock()
+	stats := make(map[peer.ID]Stats, len(bwc.peers))
+	for p, ms := range bwc.peers {
+		stats[p] = ms.stats(now)
+	}
+	return stats
+}
+
+func (bwc *BandwidthCounter) GetBandwidthByProtocol() map[protocol.ID]Stats {
+	now := time.Now()
+	bwc.mu.RLock()
+	defer bwc.mu.RUnlock()
+	stats := make(map[protocol.ID]Stats, len(bwc.protocols))
+	for proto, ms := range bwc.protocols {
+		stats[proto] = ms.stats(now)
+	}
+	return stats
+}
+
+// Reset forgets everything counted so far.
+func (bwc *BandwidthCounter) Reset() {
+	bwc.mu.Lock()
+	defer bwc.mu.Unlock()
+	bwc.totals.in.reset()
+	bwc.totals.out.reset()
+	bwc.peers = make(map[peer.ID]*meters)
+	bwc.protocols = make(map[protocol.ID]*meters)
+}
+
+// TrimIdle forgets the peers and protocols without any traffic since t, keeping the totals.
+func (bwc *BandwidthCounter) TrimIdle(since time.Time) {
+	bwc.mu.Lock()
+	defer bwc.mu.Unlock()
+	for p, ms := range bwc.peers {
+		if ms.in.idleSince(since) && ms.out.idleSince(since) {
+			delete(bwc.peers, p)
+		}
+	}
+	for proto, ms := range bwc.protocols {
+		if ms.in.idleSince(since) && ms.out.idleSince(since) {
+			delete(bwc.protocols, proto)
+		}
+	}
+}
+
+func (bwc *BandwidthCounter) peerMeters(p peer.ID) *meters {
+	bwc.mu.RLock()
+	ms, ok := bwc.peers[p]
+	bwc.mu.RUnlock()
+	if ok {
+		return ms
+	}
+	bwc.mu.Lock()
+	defer bwc.mu.Unlock()
+	if ms, ok = bwc.peers[p]; !ok {
+		ms = &meters{}
+		bwc.peers[p] = ms
+	}
+	return ms
+}
+
+func (bwc *BandwidthCounter) protocolMeters(proto protocol.ID) *meters {
+	bwc.mu.RLock()
+	ms, ok := bwc.protocols[proto]
+	bwc.mu.RUnlock()
+	if ok {
+		return ms
+	}
+	bwc.mu.Lock()
+	defer bwc.mu.Unlock()
+	if ms, ok = bwc.protocols[proto]; !ok {
+		ms = &meters{}
+		bwc.protocols[proto] = ms
+	}
+	return ms
+}
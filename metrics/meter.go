@@ -0,0 +1,78 @@
+package metrics
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// alpha is the weight of the last second in the moving average of a rate. It makes a rate follow a change of
+// throughput within a few seconds.
+var alpha = 1 - math.Exp(-1)
+
+// meter counts bytes and keeps an exponential moving average of their rate, updated every second.
+type meter struct {
+	mu         sync.Mutex
+	total      uint64
+	pending    uint64
+	rate       float64
+	tick       time.Time
+	lastActive time.Time
+}
+
+// mark counts n bytes transferred at now.
+func (m *meter) mark(n uint64, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	m.total += n
+	m.pending += n
+	m.lastActive = now
+}
+
+// snapshot returns the bytes counted so far and their rate in bytes per second at now.
+func (m *meter) snapshot(now time.Time) (uint64, float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.advance(now)
+	return m.total, m.rate
+}
+
+// idleSince reports whether nothing was counted since t.
+func (m *meter) idleSince(t time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastActive.Before(t)
+}
+
+// advance folds the seconds elapsed until now into the rate: the bytes counted during the first one, and
+// nothing during the others. m.mu must be held.
+func (m *meter) advance(now time.Time) {
+	if m.tick.IsZero() {
+		m.tick = now
+		return
+	}
+	elapsed := now.Sub(m.tick)
+	if elapsed < time.Second {
+		return
+	}
+	seconds := int64(elapsed / time.Second)
+	m.rate += alpha * (float64(m.pending) - m.rate)
+	if seconds > 1 {
+		m.rate *= math.Pow(1-alpha, float64(seconds-1))
+	}
+	// Rates too small to matter are reported as 0.
+	if m.rate < 1e-3 {
+		m.rate = 0
+	}
+	m.pending = 0
+	m.tick = m.tick.Add(time.Duration(seconds) * time.Second)
+}
+
+// reset forgets everything counted so far.
+func (m *meter) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.total, m.pending, m.rate = 0, 0, 0
+	m.tick, m.lastActive = time.Time{}, time.Time{}
+}
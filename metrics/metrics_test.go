@@ -0,0 +1,126 @@
+package metrics
+
+import (
+	"io"
+	"math"
+	"net"
+	"p2p/network"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"testing"
+	"time"
+)
+
+func TestBandwidthCounter(t *testing.T) {
+	const echo, ping = protocol.ID("/echo"), protocol.ID("/ping")
+	alice, bob := peer.ID("alice"), peer.ID("bob")
+	bwc := NewBandwidthCounter()
+	bwc.LogSentMessageStream(100, echo, alice)
+	bwc.LogRecvMessageStream(40, echo, alice)
+	bwc.LogSentMessageStream(10, ping, bob)
+	bwc.LogRecvMessageStream(5, echo, bob)
+	bwc.LogSentMessage(1)
+
+	for _, tc := range []struct {
+		name    string
+		got     Stats
+		in, out int64
+	}{
+		{"totals", bwc.GetBandwidthTotals(), 45, 111},
+		{"alice", bwc.GetBandwidthForPeer(alice), 40, 100},
+		{"bob", bwc.GetBandwidthForPeer(bob), 5, 10},
+		{"echo", bwc.GetBandwidthForProtocol(echo), 45, 100},
+		{"ping", bwc.GetBandwidthForProtocol(ping), 0, 10},
+		{"unknown peer", bwc.GetBandwidthForPeer("carol"), 0, 0},
+	} {
+		if tc.got.TotalIn != tc.in || tc.got.TotalOut != tc.out {
+			t.Errorf("traffic of %s: %d in, %d out, want %d in, %d out", tc.name, tc.got.TotalIn, tc.got.TotalOut, tc.in, tc.out)
+		}
+	}
+	if got := bwc.GetBandwidthByPeer(); len(got) != 2 || got[alice].TotalOut != 100 {
+		t.Errorf("traffic by peer: %+v", got)
+	}
+	if got := bwc.GetBandwidthByProtocol(); len(got) != 2 || got[ping].TotalOut != 10 {
+		t.Errorf("traffic by protocol: %+v", got)
+	}
+
+	// Peers and protocols without traffic since then are forgotten, the totals are kept.
+	bwc.TrimIdle(time.Now().Add(time.Second))
+	if got := bwc.GetBandwidthByPeer(); len(got) != 0 {
+		t.Errorf("traffic by peer once trimmed: %+v", got)
+	}
+	if got := bwc.GetBandwidthTotals(); got.TotalOut != 111 {
+		t.Errorf("bytes sent once trimmed: %d, want 111", got.TotalOut)
+	}
+	bwc.Reset()
+	if got := bwc.GetBandwidthTotals(); got != (Stats{}) {
+		t.Errorf("totals once reset: %+v", got)
+	}
+}
+
+func TestMeterRate(t *testing.T) {
+	var m meter
+	start := time.Unix(1000, 0)
+	m.mark(0, start)
+	// A steady 1000 bytes per second.
+	for i := 0; i < 20; i++ {
+		m.mark(1000, start.Add(time.Duration(i)*time.Second+time.Second/2))
+	}
+	total, rate := m.snapshot(start.Add(20 * time.Second))
+	if total != 20000 {
+		t.Errorf("total = %d, want 20000", total)
+	}
+	if math.Abs(rate-1000) > 1 {
+		t.Errorf("rate of a steady 1000 B/s = %v", rate)
+	}
+
+	// Then nothing for ten seconds.
+	_, rate = m.snapshot(start.Add(30 * time.Second))
+	if want := 1000 * math.Pow(1-alpha, 10); math.Abs(rate-want) > 1 {
+		t.Errorf("rate after ten idle seconds = %v, want %v", rate, want)
+	}
+	_, rate = m.snapshot(start.Add(time.Hour))
+	if rate != 0 {
+		t.Errorf("rate after an idle hour = %v, want 0", rate)
+	}
+}
+
+// testStream is a stream of protocol pid with peer p over a net.Conn.
+type testStream struct {
+	network.Stream
+	c   net.Conn
+	p   peer.ID
+	pid protocol.ID
+}
+
+func (s *testStream) Read(b []byte) (int, error)  { return s.c.Read(b) }
+func (s *testStream) Write(b []byte) (int, error) { return s.c.Write(b) }
+func (s *testStream) RemotePeer() peer.ID         { return s.p }
+func (s *testStream) Protocol() protocol.ID       { return s.pid }
+
+func TestStream(t *testing.T) {
+	const echo = protocol.ID("/echo")
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	bwc := NewBandwidthCounter()
+	s := Stream(&testStream{c: a, p: "alice", pid: echo}, bwc)
+
+	go func() {
+		buf := make([]byte, 64)
+		n, _ := io.ReadFull(b, buf[:10])
+		b.Write(buf[:n/2])
+	}()
+	if _, err := s.Write(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(s, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if got := bwc.GetBandwidthForPeer("alice"); got.TotalIn != 5 || got.TotalOut != 10 {
+		t.Errorf("traffic of the stream: %d in, %d out, want 5 in, 10 out", got.TotalIn, got.TotalOut)
+	}
+	if got := bwc.GetBandwidthForProtocol(echo); got.TotalIn != 5 || got.TotalOut != 10 {
+		t.Errorf("traffic of %s: %d in, %d out, want 5 in, 10 out", echo, got.TotalIn, got.TotalOut)
+	}
+}
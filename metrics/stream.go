@@ -0,0 +1,32 @@
+package metrics
+
+import (
+	"p2p/network"
+)
+
+// stream is a network.Stream whose reads and writes are counted by a Reporter.
+type stream struct {
+	network.Stream
+	r Reporter
+}
+
+// Stream returns s with the bytes read and written on it counted by r, under its remote peer and protocol.
+func Stream(s network.Stream, r Reporter) network.Stream {
+	return &stream{Stream: s, r: r}
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	n, err := s.Stream.Read(p)
+	if n > 0 {
+		s.r.LogRecvMessageStream(int64(n), s.Protocol(), s.RemotePeer())
+	}
+	return n, err
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	n, err := s.Stream.Write(p)
+	if n > 0 {
+		s.r.LogSentMessageStream(int64(n), s.Protocol(), s.RemotePeer())
+	}
+	return n, err
+}
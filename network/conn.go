@@ -0,0 +1,52 @@
+package network
+
+import (
+	ma "github.com/multiformats/go-multiaddr"
+	"net"
+	cr "p2p/crypto"
+	"p2p/peer"
+	"time"
+)
+
+// ConnStats stores metadata pertaining to a given Conn.
+type ConnStats struct {
+	// Direction specifies whether this is an inbound or an outbound connection.
+	Direction Direction
+	// Opened is the timestamp when this connection was opened.
+	Opened time.Time
+	// NumStreams is the number of streams currently open over the connection.
+	NumStreams int
+}
+
+// ConnMultiaddrs exposes the multiaddrs of the two ends of a connection.
+type ConnMultiaddrs interface {
+	// LocalMultiaddr returns the local multiaddr of the connection.
+	LocalMultiaddr() ma.Multiaddr
+	// RemoteMultiaddr returns the remote multiaddr of the connection.
+	RemoteMultiaddr() ma.Multiaddr
+}
+
+// Conn is a connection to a remote peer, over which streams are multiplexed.
+type Conn interface {
+	ConnMultiaddrs
+
+	// Close closes the connection and every stream open over it.
+	Close() error
+
+	// LocalPeer returns the local peer of the connection.
+	LocalPeer() peer.ID
+	// RemotePeer returns the remote peer of the connection.
+	RemotePeer() peer.ID
+	// RemotePublicKey returns the public key the remote peer proved to own during the handshake.
+	RemotePublicKey() cr.PubKey
+
+	// LocalAddr returns the local network address.
+	LocalAddr() net.Addr
+	// RemoteAddr returns the remote network address.
+	RemoteAddr() net.Addr
+
+	// Stat returns metadata pertaining to this connection.
+	Stat() ConnStats
+	// Scope returns the resource scope of the connection.
+	Scope() ConnScope
+}
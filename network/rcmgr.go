@@ -0,0 +1,94 @@
+package network
+
+import (
+	"errors"
+	"p2p/peer"
+	protocol "p2p/protocols"
+)
+
+// ErrResourceLimitExceeded is returned when attempting to perform an operation that would
+// exceed the limits of one of the resource scopes involved.
+var ErrResourceLimitExceeded = errors.New("resource limit exceeded")
+
+// Memory reservation priorities. A reservation with priority p only succeeds while the scope
+// uses less than (p+1)/256 of its memory limit, so low priority reservations fail first.
+const (
+	ReservationPriorityLow    uint8 = 101
+	ReservationPriorityMedium uint8 = 152
+	ReservationPriorityHigh   uint8 = 203
+	ReservationPriorityAlways uint8 = 255
+)
+
+// ResourceManager tracks the resources used by connections and streams and refuses to open
+// new ones once a limit of the system, transient, peer, protocol or service scope is reached.
+type ResourceManager interface {
+	// OpenConnection creates a new connection scope, not yet associated with any peer,
+	// in the transient scope. usefd is true if the connection consumes a file descriptor.
+	OpenConnection(dir Direction, usefd bool) (ConnScope, error)
+
+	// OpenStream creates a new stream scope for a stream to peer p. The stream starts
+	// in the transient scope until its protocol is known.
+	OpenStream(p peer.ID, dir Direction) (StreamScope, error)
+
+	// ViewSystem returns the usage of the system scope.
+	ViewSystem() ScopeStat
+	// ViewTransient returns the usage of the transient scope.
+	ViewTransient() ScopeStat
+	// ViewPeer returns the usage of the scope of peer p.
+	ViewPeer(p peer.ID) ScopeStat
+	// ViewProtocol returns the usage of the scope of protocol pid.
+	ViewProtocol(pid protocol.ID) ScopeStat
+	// ViewService returns the usage of the scope of service svc.
+	ViewService(svc string) ScopeStat
+
+	// Close closes the resource manager.
+	Close() error
+}
+
+// ScopeStat is the resource usage of a scope.
+type ScopeStat struct {
+	NumStreamsInbound  int
+	NumStreamsOutbound int
+	NumConnsInbound    int
+	NumConnsOutbound   int
+	NumFD              int
+	Memory             int64
+}
+
+// ResourceScope is a scope against which memory can be reserved.
+type ResourceScope interface {
+	// ReserveMemory reserves size bytes of memory with the given priority, failing
+	// with ErrResourceLimitExceeded if this scope or one of its parents is out of memory.
+	ReserveMemory(size int, prio uint8) error
+	// ReleaseMemory releases memory previously reserved with ReserveMemory.
+	ReleaseMemory(size int)
+	// Stat returns the current usage of the scope.
+	Stat() ScopeStat
+}
+
+// ResourceScopeSpan is a short-lived scope whose reservations are all released by Done.
+type ResourceScopeSpan interface {
+	ResourceScope
+	// Done ends the span and releases everything reserved in it.
+	Done()
+}
+
+// ConnScope is the resource scope of a single connection.
+type ConnScope interface {
+	ResourceScopeSpan
+	// SetPeer moves the connection from the transient scope to the scope of peer p,
+	// once the remote peer has been identified.
+	SetPeer(p peer.ID) error
+	// BeginSpan creates a child span of the connection, used for the buffers of a single stream.
+	BeginSpan() (ResourceScopeSpan, error)
+}
+
+// StreamScope is the resource scope of a single stream.
+type StreamScope interface {
+	ResourceScopeSpan
+	// SetProtocol moves the stream from the transient scope to the scope of protocol pid.
+	SetProtocol(pid protocol.ID) error
+	// SetService attaches the stream to the scope of service svc, which must be called
+	// after SetProtocol.
+	SetService(svc string) error
+}
@@ -0,0 +1,88 @@
+// Package network provides the Stream abstraction handed to protocol handlers by a Host.
+package network
+
+import (
+	"errors"
+	"net"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"time"
+)
+
+// ErrReset is returned when reading or writing on a stream that was reset by either side.
+var ErrReset = errors.New("stream reset")
+
+// Direction represents which peer in a stream initiated the connection.
+type Direction int
+
+const (
+	// DirUnknown is the default direction.
+	DirUnknown Direction = iota
+	// DirInbound is for when the remote peer initiated a stream.
+	DirInbound
+	// DirOutbound is for when the local peer initiated a stream.
+	DirOutbound
+)
+
+func (d Direction) String() string {
+	switch d {
+	case DirInbound:
+		return "Inbound"
+	case DirOutbound:
+		return "Outbound"
+	default:
+		return "Unknown"
+	}
+}
+
+// Stats stores metadata pertaining to a given Stream.
+type Stats struct {
+	// Direction specifies whether this is an inbound or an outbound stream.
+	Direction Direction
+	// Opened is the timestamp when this stream was opened.
+	Opened time.Time
+	// Protocol is the protocol negotiated on this stream, empty until negotiation finished.
+	Protocol protocol.ID
+}
+
+// Stream represents a bidirectional channel between two peers, multiplexed over a single connection.
+//
+// A Stream is a net.Conn so it can be handed to code that expects one, but it also
+// supports closing each half independently and aborting the stream altogether.
+type Stream interface {
+	net.Conn
+
+	// ID returns an identifier that uniquely identifies this Stream within the connection.
+	ID() uint32
+
+	// Protocol returns the protocol negotiated on this stream.
+	Protocol() protocol.ID
+
+	// RemotePeer returns the peer on the other end of the stream.
+	RemotePeer() peer.ID
+
+	// Conn returns the connection this stream is multiplexed over.
+	Conn() Conn
+
+	// Scope returns the resource scope of the stream, against which handlers
+	// reserve the memory they need.
+	Scope() StreamScope
+
+	// CloseWrite closes the stream for writing but leaves it open for reading.
+	// The remote side will read io.EOF once it has consumed all buffered data.
+	CloseWrite() error
+
+	// CloseRead closes the stream for reading but leaves it open for writing.
+	// Any data the remote side sends afterwards is discarded.
+	CloseRead() error
+
+	// Reset closes both ends of the stream abortively.
+	// Pending and future reads and writes on either side fail with ErrReset.
+	Reset() error
+
+	// Stat returns metadata pertaining to this stream.
+	Stat() Stats
+}
+
+// StreamHandler is the type of function used to handle an inbound stream once its protocol has been negotiated.
+type StreamHandler func(Stream)
@@ -8,6 +8,7 @@ package peer
 import (
 	"errors"
 	"fmt"
+	"github.com/mr-tron/base58/base58"
 	mh "github.com/multiformats/go-multihash"
 	cr "p2p/crypto"
 )
@@ -74,3 +75,37 @@ func (id ID) ExtractPublicKey() (cr.PubKey, error) {
 	}
 	return pk, nil
 }
+
+// String returns the base58btc encoding of the peer ID, which is how peer IDs are printed and stored.
+func (id ID) String() string {
+	return base58.Encode([]byte(id))
+}
+
+// Decode parses a base58btc encoded peer ID.
+// @param s The encoded peer ID.
+// @return The decoded peer ID and nil if s is a valid multihash, otherwise an error is returned.
+func Decode(s string) (ID, error) {
+	b, err := base58.Decode(s)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse peer ID: %s", err)
+	}
+	if _, err := mh.Cast(b); err != nil {
+		return "", fmt.Errorf("failed to parse peer ID: %s", err)
+	}
+	return ID(b), nil
+}
+
+// MarshalText encodes the peer ID as base58btc, so that peer IDs are readable in config files.
+func (id ID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText decodes a base58btc encoded peer ID.
+func (id *ID) UnmarshalText(data []byte) error {
+	decoded, err := Decode(string(data))
+	if err != nil {
+		return err
+	}
+	*id = decoded
+	return nil
+}
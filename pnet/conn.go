@@ -0,0 +1,130 @@
+package pnet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"golang.org/x/crypto/salsa20/salsa"
+	"io"
+	"net"
+	"sync"
+)
+
+// nonceSize is the size of the XSalsa20 nonce each side sends first.
+const nonceSize = 24
+
+// protectedConn encrypts everything written to a connection with XSalsa20 keyed by the PSK
+// and a nonce of the local side, and decrypts what is read with the nonce of the remote side.
+type protectedConn struct {
+	net.Conn
+	psk [32]byte
+
+	writeMu sync.Mutex
+	writer  *xsalsa20
+
+	readMu sync.Mutex
+	reader *xsalsa20
+}
+
+// NewProtectedConn wraps conn so that it can only talk to a peer knowing the same psk.
+// The nonces are exchanged lazily, on the first write and the first read.
+func NewProtectedConn(psk PSK, conn net.Conn) (net.Conn, error) {
+	if len(psk) != pskSize {
+		return nil, fmt.Errorf("expected a swarm key of %d bytes, got %d", pskSize, len(psk))
+	}
+	pc := &protectedConn{Conn: conn}
+	copy(pc.psk[:], psk)
+	return pc, nil
+}
+
+// Read reads and decrypts data, reading the nonce of the remote side first.
+func (c *protectedConn) Read(b []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	if c.reader == nil {
+		nonce := make([]byte, nonceSize)
+		if _, err := io.ReadFull(c.Conn, nonce); err != nil {
+			return 0, err
+		}
+		c.reader = newXSalsa20(&c.psk, nonce)
+	}
+	n, err := c.Conn.Read(b)
+	c.reader.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+// Write encrypts and writes data, sending the local nonce first.
+func (c *protectedConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.writer == nil {
+		nonce := make([]byte, nonceSize)
+		if _, err := rand.Read(nonce); err != nil {
+			return 0, err
+		}
+		if _, err := c.Conn.Write(nonce); err != nil {
+			return 0, err
+		}
+		c.writer = newXSalsa20(&c.psk, nonce)
+	}
+	out := make([]byte, len(b))
+	c.writer.XORKeyStream(out, b)
+	return c.Conn.Write(out)
+}
+
+// xsalsa20 is an XSalsa20 key stream, a cipher.Stream, that can be consumed in buffers of any size. The key
+// stream of whole blocks is xored with the data at once, only the block a buffer ends in is kept for the next.
+type xsalsa20 struct {
+	subKey  [32]byte
+	counter [16]byte
+	block   [64]byte
+	used    int
+}
+
+func newXSalsa20(key *[32]byte, nonce []byte) *xsalsa20 {
+	s := &xsalsa20{used: len(xsalsa20{}.block)}
+	var hNonce [16]byte
+	copy(hNonce[:], nonce[:16])
+	salsa.HSalsa20(&s.subKey, &hNonce, key, &salsa.Sigma)
+	copy(s.counter[:8], nonce[16:])
+	return s
+}
+
+// XORKeyStream xors src with the next len(src) bytes of the key stream into dst.
+func (s *xsalsa20) XORKeyStream(dst, src []byte) {
+	// The rest of the current block first.
+	n := copy(dst, src[:min(len(src), len(s.block)-s.used)])
+	for i := 0; i < n; i++ {
+		dst[i] ^= s.block[s.used+i]
+	}
+	s.used += n
+	dst, src = dst[n:], src[n:]
+
+	if whole := len(src) / len(s.block) * len(s.block); whole > 0 {
+		salsa.XORKeyStream(dst[:whole], src[:whole], &s.counter, &s.subKey)
+		s.advance(uint64(whole / len(s.block)))
+		dst, src = dst[whole:], src[whole:]
+	}
+
+	if len(src) > 0 {
+		var zero [64]byte
+		salsa.XORKeyStream(s.block[:], zero[:], &s.counter, &s.subKey)
+		s.advance(1)
+		for i := range src {
+			dst[i] = src[i] ^ s.block[i]
+		}
+		s.used = len(src)
+	}
+}
+
+// advance moves the block counter n blocks forward.
+func (s *xsalsa20) advance(n uint64) {
+	binary.LittleEndian.PutUint64(s.counter[8:], binary.LittleEndian.Uint64(s.counter[8:])+n)
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,125 @@
+package pnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"golang.org/x/crypto/salsa20"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func testPSK(t *testing.T) PSK {
+	t.Helper()
+	psk := make(PSK, pskSize)
+	if _, err := rand.Read(psk); err != nil {
+		t.Fatal(err)
+	}
+	return psk
+}
+
+func TestXSalsa20MatchesReference(t *testing.T) {
+	var key [32]byte
+	nonce := make([]byte, nonceSize)
+	rand.Read(key[:])
+	rand.Read(nonce)
+	src := make([]byte, 5000)
+	rand.Read(src)
+
+	want := make([]byte, len(src))
+	salsa20.XORKeyStream(want, src, nonce, &key)
+
+	// Buffers ending inside blocks, on block boundaries and spanning several blocks.
+	for _, sizes := range [][]int{{5000}, {1, 63, 64, 65, 128, 4679}, {7, 7, 7, 200, 3, 4776}} {
+		s := newXSalsa20(&key, nonce)
+		got := make([]byte, len(src))
+		off := 0
+		for _, n := range sizes {
+			s.XORKeyStream(got[off:off+n], src[off:off+n])
+			off += n
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("key stream consumed in buffers of %v differs from salsa20.XORKeyStream", sizes)
+		}
+	}
+}
+
+func TestProtectedConnRoundTrip(t *testing.T) {
+	psk := testPSK(t)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	pa, err := NewProtectedConn(psk, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pb, err := NewProtectedConn(psk, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := make([]byte, 10000)
+	rand.Read(msg)
+	errs := make(chan error, 1)
+	go func() {
+		_, err := pa.Write(msg[:100])
+		if err == nil {
+			_, err = pa.Write(msg[100:])
+		}
+		errs <- err
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(pb, got); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Error("the data read differs from the data written")
+	}
+}
+
+func TestProtectedConnWithAnotherKey(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	pa, _ := NewProtectedConn(testPSK(t), a)
+	pb, _ := NewProtectedConn(testPSK(t), b)
+
+	msg := []byte("/multistream/1.0.0\n")
+	go pa.Write(msg)
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(pb, got); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(got, msg) {
+		t.Error("a peer with another key read the data in clear")
+	}
+}
+
+func TestPSKEncoding(t *testing.T) {
+	psk := testPSK(t)
+	var buf bytes.Buffer
+	if err := EncodeV1PSK(&buf, psk); err != nil {
+		t.Fatal(err)
+	}
+	got, err := DecodeV1PSK(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, psk) {
+		t.Error("the decoded key differs from the encoded one")
+	}
+
+	for _, key := range []string{
+		"/key/swarm/psk/1.0.0/\n/base16/\n00ff\n",
+		"/key/swarm/psk/2.0.0/\n/base16/\n" + strings.Repeat("00", pskSize) + "\n",
+		"/key/swarm/psk/1.0.0/\n/base32/\n" + strings.Repeat("00", pskSize) + "\n",
+	} {
+		if _, err := DecodeV1PSK(strings.NewReader(key)); err == nil {
+			t.Errorf("invalid key %q was decoded", key)
+		}
+	}
+}
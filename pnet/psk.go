@@ -0,0 +1,115 @@
+// Package pnet implements private networks: every raw connection is encrypted with a key
+// shared by all the members of the network before any other negotiation, so that hosts that
+// do not know the key cannot even complete a handshake with a member.
+//
+// The key file and the wire format are compatible with libp2p's swarm.key (pnet v1).
+package pnet
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// PSK is the 32 byte pre-shared key of a private network.
+type PSK []byte
+
+const (
+	// pskHeader is the first line of a swarm key file.
+	pskHeader = "/key/swarm/psk/1.0.0/"
+	// pskSize is the size of a decoded key.
+	pskSize = 32
+	// EnvKey is the environment variable which, when set to 1, makes hosts refuse to start without a PSK.
+	EnvKey = "LIBP2P_FORCE_PNET"
+)
+
+// ErrNotInPrivateNetwork is returned when EnvKey is set but no PSK is configured.
+var ErrNotInPrivateNetwork = errors.New("private network was not configured but is enforced by the environment")
+
+// ForcePrivateNetwork reports whether the environment requires every host to be in a private network.
+func ForcePrivateNetwork() bool {
+	return os.Getenv(EnvKey) == "1"
+}
+
+// DecodeV1PSK reads a swarm key in the /key/swarm/psk/1.0.0/ format: the header line, an encoding
+// line (/base16/, /base64/ or /bin/) and the encoded key.
+func DecodeV1PSK(r io.Reader) (PSK, error) {
+	reader := bufio.NewReader(r)
+	header, err := readLine(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading swarm key header: %v", err)
+	}
+	if header != pskHeader {
+		return nil, fmt.Errorf("expected swarm key header %q, got %q", pskHeader, header)
+	}
+	encoding, err := readLine(reader)
+	if err != nil {
+		return nil, fmt.Errorf("error reading swarm key encoding: %v", err)
+	}
+
+	var psk []byte
+	switch encoding {
+	case "/base16/":
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, fmt.Errorf("error reading swarm key: %v", err)
+		}
+		psk, err = hex.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding swarm key: %v", err)
+		}
+	case "/base64/":
+		line, err := readLine(reader)
+		if err != nil {
+			return nil, fmt.Errorf("error reading swarm key: %v", err)
+		}
+		psk, err = base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding swarm key: %v", err)
+		}
+	case "/bin/":
+		psk = make([]byte, pskSize)
+		if _, err := io.ReadFull(reader, psk); err != nil {
+			return nil, fmt.Errorf("error reading swarm key: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown swarm key encoding %q", encoding)
+	}
+	if len(psk) != pskSize {
+		return nil, fmt.Errorf("expected a swarm key of %d bytes, got %d", pskSize, len(psk))
+	}
+	return psk, nil
+}
+
+// LoadPSK reads a swarm key file.
+func LoadPSK(path string) (PSK, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening swarm key: %v", err)
+	}
+	defer file.Close()
+	return DecodeV1PSK(file)
+}
+
+// EncodeV1PSK writes psk in the /key/swarm/psk/1.0.0/ format with the base16 encoding.
+func EncodeV1PSK(w io.Writer, psk PSK) error {
+	if len(psk) != pskSize {
+		return fmt.Errorf("expected a swarm key of %d bytes, got %d", pskSize, len(psk))
+	}
+	_, err := fmt.Fprintf(w, "%s\n/base16/\n%s\n", pskHeader, hex.EncodeToString(psk))
+	return err
+}
+
+// readLine reads a line without its line ending.
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil && !(err == io.EOF && len(line) > 0) {
+		return "", err
+	}
+	return string(bytes.TrimRight(line, "\r\n")), nil
+}
@@ -0,0 +1,167 @@
+// Package ratelimit paces the traffic of streams with token bucket rate limiters, set globally, per peer and
+// per protocol, and adjustable while streams are running.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// Unlimited is the rate of a limiter letting everything through.
+const Unlimited = 0
+
+// DefaultBurst is the burst of the limiters created with a burst of 0: the bytes that go through at once
+// after a pause, and the most a single read or write is paced at.
+const DefaultBurst = 64 << 10
+
+// errInterrupted is returned by waits cut short to be started again with new settings.
+var errInterrupted = errors.New("wait interrupted")
+
+// Limiter is a token bucket holding up to burst bytes, refilled at rate bytes per second. It is safe for
+// concurrent use, and a limiter shared by several streams caps their traffic together.
+type Limiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	tokens  float64
+	last    time.Time
+	changed chan struct{}
+}
+
+// NewLimiter returns a limiter letting rate bytes per second through, in bursts of up to burst bytes.
+// A rate of Unlimited lets everything through and a burst of 0 is DefaultBurst.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst <= 0 {
+		burst = DefaultBurst
+	}
+	if rate < 0 {
+		rate = Unlimited
+	}
+	return &Limiter{rate: rate, burst: burst, tokens: float64(burst), last: time.Now(), changed: make(chan struct{})}
+}
+
+// Rate returns the rate of the limiter in bytes per second, Unlimited if it has none.
+func (l *Limiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// Burst returns the most bytes the limiter lets through at once.
+func (l *Limiter) Burst() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.burst
+}
+
+// SetRate changes the rate of the limiter, Unlimited removing the limit. Reads and writes waiting on the
+// limiter are paced at the new rate right away.
+func (l *Limiter) SetRate(rate float64) {
+	if rate < 0 {
+		rate = Unlimited
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.rate = rate
+	l.notify()
+}
+
+// SetBurst changes the burst of the limiter, DefaultBurst if burst is 0.
+func (l *Limiter) SetBurst(burst int) {
+	if burst <= 0 {
+		burst = DefaultBurst
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	l.burst = burst
+	l.tokens = math.Min(l.tokens, float64(burst))
+	l.notify()
+}
+
+// WaitN waits until n bytes may go through, or until ctx is done, in which case it returns the error of ctx.
+// More than the burst is let through in several steps.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	return l.waitN(ctx, n, nil)
+}
+
+// waitN is WaitN also returning errInterrupted once interrupt is closed.
+func (l *Limiter) waitN(ctx context.Context, n int, interrupt <-chan struct{}) error {
+	for n > 0 {
+		l.mu.Lock()
+		step := n
+		if step > l.burst {
+			step = l.burst
+		}
+		l.mu.Unlock()
+		if err := l.wait(ctx, step, interrupt); err != nil {
+			return err
+		}
+		n -= step
+	}
+	return nil
+}
+
+// wait waits until the bucket holds n bytes, at most the burst, and takes them.
+func (l *Limiter) wait(ctx context.Context, n int, interrupt <-chan struct{}) error {
+	for {
+		l.mu.Lock()
+		now := time.Now()
+		l.refill(now)
+		if l.rate == Unlimited {
+			l.mu.Unlock()
+			return nil
+		}
+		// A burst lowered below n while waiting lets n through once the bucket is full.
+		want := math.Min(float64(n), float64(l.burst))
+		if l.tokens >= want {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+		delay := time.Duration((want - l.tokens) / l.rate * float64(time.Second))
+		changed := l.changed
+		l.mu.Unlock()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-changed:
+			timer.Stop()
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-interrupt:
+			timer.Stop()
+			return errInterrupted
+		}
+	}
+}
+
+// refill adds the tokens earned since the last refill. l.mu must be held.
+func (l *Limiter) refill(now time.Time) {
+	if l.rate == Unlimited {
+		l.tokens = float64(l.burst)
+	} else if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.tokens = math.Min(float64(l.burst), l.tokens+elapsed*l.rate)
+	}
+	l.last = now
+}
+
+// notify wakes up the waiters so that they wait again with the new settings. l.mu must be held.
+func (l *Limiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
+
+// full reports whether the bucket is full, that is whether the limiter was idle for a while.
+func (l *Limiter) full() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	return l.tokens >= float64(l.burst)
+}
@@ -0,0 +1,279 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"sync"
+	"time"
+)
+
+// pruneInterval is how often the limiters of idle peers are forgotten.
+const pruneInterval = time.Minute
+
+// Limit holds the rates of the traffic received and sent, in bytes per second. Unlimited sets no limit.
+type Limit struct {
+	In  float64
+	Out float64
+}
+
+// limiters paces the traffic of one scope in both directions.
+type limiters struct {
+	in  *Limiter
+	out *Limiter
+}
+
+func newLimiters(l Limit, burst int) *limiters {
+	return &limiters{in: NewLimiter(l.In, burst), out: NewLimiter(l.Out, burst)}
+}
+
+func (ls *limiters) set(l Limit) {
+	ls.in.SetRate(l.In)
+	ls.out.SetRate(l.Out)
+}
+
+func (ls *limiters) limit() Limit {
+	return Limit{In: ls.in.Rate(), Out: ls.out.Rate()}
+}
+
+// get returns the limiter of the traffic received if in is set, of the traffic sent otherwise.
+func (ls *limiters) get(in bool) *Limiter {
+	if in {
+		return ls.in
+	}
+	return ls.out
+}
+
+// peerLimiters are the limiters of a peer, custom if set with SetPeerLimit rather than the default.
+type peerLimiters struct {
+	*limiters
+	custom bool
+}
+
+// Manager holds the limits streams are paced by: a global limit shared by every stream, a limit per peer
+// shared by the streams with that peer, and a limit per protocol shared by the streams of that protocol.
+// The traffic of a stream goes through all three. Limits can be changed at any time, and apply to the
+// streams already running.
+type Manager struct {
+	burst int
+
+	mu          sync.Mutex
+	global      *limiters
+	peerDefault Limit
+	peers       map[peer.ID]*peerLimiters
+	protocols   map[protocol.ID]*limiters
+	lastPrune   time.Time
+}
+
+// config holds the limits a Manager starts with.
+type config struct {
+	burst     int
+	global    Limit
+	peer      Limit
+	protocols map[protocol.ID]Limit
+}
+
+// Option configures a Manager created by NewManager.
+type Option func(cfg *config) error
+
+// NewManager returns a manager with the limits set by opts, no limit at all by default.
+func NewManager(opts ...Option) (*Manager, error) {
+	cfg := &config{burst: DefaultBurst, protocols: make(map[protocol.ID]Limit)}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	m := &Manager{
+		burst:       cfg.burst,
+		global:      newLimiters(cfg.global, cfg.burst),
+		peerDefault: cfg.peer,
+		peers:       make(map[peer.ID]*peerLimiters),
+		protocols:   make(map[protocol.ID]*limiters),
+		lastPrune:   time.Now(),
+	}
+	for pid, l := range cfg.protocols {
+		m.protocols[pid] = newLimiters(l, cfg.burst)
+	}
+	return m, nil
+}
+
+// WithGlobalLimit sets the limit of all the traffic paced by the manager.
+func WithGlobalLimit(l Limit) Option {
+	return func(cfg *config) error {
+		if err := checkLimit(l); err != nil {
+			return err
+		}
+		cfg.global = l
+		return nil
+	}
+}
+
+// WithPeerLimit sets the limit of the traffic with each peer.
+func WithPeerLimit(l Limit) Option {
+	return func(cfg *config) error {
+		if err := checkLimit(l); err != nil {
+			return err
+		}
+		cfg.peer = l
+		return nil
+	}
+}
+
+// WithProtocolLimit sets the limit of the traffic of the streams of protocol pid.
+func WithProtocolLimit(pid protocol.ID, l Limit) Option {
+	return func(cfg *config) error {
+		if err := checkLimit(l); err != nil {
+			return err
+		}
+		cfg.protocols[pid] = l
+		return nil
+	}
+}
+
+// WithBurst sets the bytes every limiter lets through at once after a pause, DefaultBurst by default.
+func WithBurst(burst int) Option {
+	return func(cfg *config) error {
+		if burst <= 0 {
+			return errors.New("burst must be positive")
+		}
+		cfg.burst = burst
+		return nil
+	}
+}
+
+// checkLimit refuses negative rates.
+func checkLimit(l Limit) error {
+	if l.In < 0 || l.Out < 0 {
+		return fmt.Errorf("invalid limit %+v: rates must not be negative", l)
+	}
+	return nil
+}
+
+// GlobalLimit returns the limit of all the traffic.
+func (m *Manager) GlobalLimit() Limit {
+	return m.global.limit()
+}
+
+// SetGlobalLimit changes the limit of all the traffic.
+func (m *Manager) SetGlobalLimit(l Limit) {
+	m.global.set(l)
+}
+
+// SetDefaultPeerLimit changes the limit of the traffic with each peer, except those given a limit of their
+// own with SetPeerLimit.
+func (m *Manager) SetDefaultPeerLimit(l Limit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.peerDefault = l
+	for _, pl := range m.peers {
+		if !pl.custom {
+			pl.set(l)
+		}
+	}
+}
+
+// PeerLimit returns the limit of the traffic with peer p.
+func (m *Manager) PeerLimit(p peer.ID) Limit {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pl, ok := m.peers[p]; ok {
+		return pl.limit()
+	}
+	return m.peerDefault
+}
+
+// SetPeerLimit gives peer p a limit of its own in place of the default one.
+func (m *Manager) SetPeerLimit(p peer.ID, l Limit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pl, ok := m.peers[p]
+	if !ok {
+		m.peers[p] = &peerLimiters{limiters: newLimiters(l, m.burst), custom: true}
+		return
+	}
+	pl.custom = true
+	pl.set(l)
+}
+
+// ClearPeerLimit puts peer p back under the default limit.
+func (m *Manager) ClearPeerLimit(p peer.ID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if pl, ok := m.peers[p]; ok {
+		pl.custom = false
+		pl.set(m.peerDefault)
+	}
+}
+
+// ProtocolLimit returns the limit of the traffic of protocol pid.
+func (m *Manager) ProtocolLimit(pid protocol.ID) Limit {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ls, ok := m.protocols[pid]; ok {
+		return ls.limit()
+	}
+	return Limit{}
+}
+
+// SetProtocolLimit changes the limit of the traffic of protocol pid. A limit of Unlimited both ways removes it.
+func (m *Manager) SetProtocolLimit(pid protocol.ID, l Limit) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ls, ok := m.protocols[pid]
+	switch {
+	case ok:
+		// Streams waiting on the limiters are released even if they are forgotten.
+		ls.set(l)
+		if l == (Limit{}) {
+			delete(m.protocols, pid)
+		}
+	case l != (Limit{}):
+		m.protocols[pid] = newLimiters(l, m.burst)
+	}
+}
+
+// limitersFor returns the limiters the traffic of a stream of protocol pid with peer p goes through, in the
+// direction given by in.
+func (m *Manager) limitersFor(p peer.ID, pid protocol.ID, in bool) []*Limiter {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.prune()
+
+	list := make([]*Limiter, 0, 3)
+	if l := m.global.get(in); l.Rate() != Unlimited {
+		list = append(list, l)
+	}
+	pl, ok := m.peers[p]
+	if !ok && m.peerDefault != (Limit{}) {
+		pl = &peerLimiters{limiters: newLimiters(m.peerDefault, m.burst)}
+		m.peers[p] = pl
+	}
+	if pl != nil {
+		if l := pl.get(in); l.Rate() != Unlimited {
+			list = append(list, l)
+		}
+	}
+	if ls, ok := m.protocols[pid]; ok {
+		if l := ls.get(in); l.Rate() != Unlimited {
+			list = append(list, l)
+		}
+	}
+	return list
+}
+
+// prune forgets the default limiters of the peers that were idle long enough for them to be full, as new
+// ones would be. m.mu must be held.
+func (m *Manager) prune() {
+	now := time.Now()
+	if now.Sub(m.lastPrune) < pruneInterval {
+		return
+	}
+	m.lastPrune = now
+	for p, pl := range m.peers {
+		if !pl.custom && pl.in.full() && pl.out.full() {
+			delete(m.peers, p)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"testing"
+	"time"
+)
+
+func TestLimiterPacing(t *testing.T) {
+	l := NewLimiter(100<<10, 10<<10)
+	start := time.Now()
+	// The burst goes through at once, the next 20 KiB take 200ms at 100 KiB/s.
+	if err := l.WaitN(context.Background(), 10<<10); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("the burst took %v", elapsed)
+	}
+	if err := l.WaitN(context.Background(), 20<<10); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Errorf("30 KiB at 100 KiB/s with a burst of 10 KiB took %v, want about 200ms", elapsed)
+	}
+}
+
+func TestLimiterWriterPacing(t *testing.T) {
+	l := NewLimiter(200<<10, 8<<10)
+	w := NewWriter(context.Background(), io.Discard, l)
+	start := time.Now()
+	if n, err := w.Write(make([]byte, 48<<10)); err != nil || n != 48<<10 {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if elapsed := time.Since(start); elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Errorf("48 KiB at 200 KiB/s with a burst of 8 KiB took %v, want about 200ms", elapsed)
+	}
+}
+
+func TestLimiterSetRateWakesWaiters(t *testing.T) {
+	l := NewLimiter(1, 1000)
+	if err := l.WaitN(context.Background(), 1000); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- l.WaitN(context.Background(), 1000)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	l.SetRate(Unlimited)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a wait went on after the limit was removed")
+	}
+}
+
+func TestLimiterWaitEndsWithContext(t *testing.T) {
+	l := NewLimiter(1, 1000)
+	l.WaitN(context.Background(), 1000)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.WaitN(ctx, 1000); err != context.DeadlineExceeded {
+		t.Errorf("WaitN = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestManagerLimiters(t *testing.T) {
+	const pid = protocol.ID("/p2p/_testing")
+	m, err := NewManager(WithGlobalLimit(Limit{In: 1000}), WithPeerLimit(Limit{Out: 2000}), WithProtocolLimit(pid, Limit{In: 3000, Out: 3000}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, bob := peer.ID("alice"), peer.ID("bob")
+	m.SetPeerLimit(bob, Limit{Out: 500})
+
+	rates := func(ls []*Limiter) []float64 {
+		var r []float64
+		for _, l := range ls {
+			r = append(r, l.Rate())
+		}
+		return r
+	}
+	for _, tc := range []struct {
+		p    peer.ID
+		pid  protocol.ID
+		in   bool
+		want []float64
+	}{
+		{alice, pid, true, []float64{1000, 3000}},
+		{alice, pid, false, []float64{2000, 3000}},
+		{bob, pid, false, []float64{500, 3000}},
+		{bob, "/other", false, []float64{500}},
+	} {
+		got := rates(m.limitersFor(tc.p, tc.pid, tc.in))
+		if len(got) != len(tc.want) {
+			t.Errorf("limiters of %s on %s, in %v: %v, want %v", tc.p, tc.pid, tc.in, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("limiters of %s on %s, in %v: %v, want %v", tc.p, tc.pid, tc.in, got, tc.want)
+				break
+			}
+		}
+	}
+
+	// Two streams with the same peer share its limiter.
+	if a, b := m.limitersFor(alice, pid, false), m.limitersFor(alice, "/other", false); a[0] != b[0] {
+		t.Error("the streams of a peer are paced by different limiters")
+	}
+	m.SetGlobalLimit(Limit{})
+	if got := rates(m.limitersFor(alice, pid, true)); len(got) != 1 || got[0] != 3000 {
+		t.Errorf("limiters once the global limit is removed: %v, want [3000]", got)
+	}
+}
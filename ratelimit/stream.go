@@ -0,0 +1,211 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"p2p/network"
+	"sync"
+	"time"
+)
+
+// NewReader returns a reader reading from r no faster than every limiter allows, until ctx is done.
+func NewReader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	return &reader{ctx: ctx, r: r, limiters: limiters}
+}
+
+type reader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []*Limiter
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if max := maxBurst(r.limiters); len(p) > max {
+		p = p[:max]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		for _, l := range r.limiters {
+			if werr := l.WaitN(r.ctx, n); werr != nil {
+				// The data is returned anyway, the next read fails.
+				return n, err
+			}
+		}
+	}
+	return n, err
+}
+
+// NewWriter returns a writer writing to w no faster than every limiter allows, until ctx is done.
+func NewWriter(ctx context.Context, w io.Writer, limiters ...*Limiter) io.Writer {
+	return &writer{ctx: ctx, w: w, limiters: limiters}
+}
+
+type writer struct {
+	ctx      context.Context
+	w        io.Writer
+	limiters []*Limiter
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if max := maxBurst(w.limiters); len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		for _, l := range w.limiters {
+			if err := l.WaitN(w.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// maxBurst returns the smallest burst of limiters, the most that goes through them at once.
+func maxBurst(limiters []*Limiter) int {
+	max := DefaultBurst
+	for i, l := range limiters {
+		if b := l.Burst(); i == 0 || b < max {
+			max = b
+		}
+	}
+	return max
+}
+
+// stream is a network.Stream whose reads and writes are paced by the limits of a Manager.
+type stream struct {
+	network.Stream
+	m      *Manager
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+	changed       chan struct{}
+}
+
+// Stream returns s with its reads and writes paced by the global limit of m, the limit of its remote peer
+// and the limit of its protocol. Waits end at the deadlines of the stream, and when it is closed or reset.
+func (m *Manager) Stream(s network.Stream) network.Stream {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &stream{Stream: s, m: m, ctx: ctx, cancel: cancel, changed: make(chan struct{})}
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	limiters := s.m.limitersFor(s.RemotePeer(), s.Protocol(), true)
+	if max := maxBurst(limiters); len(limiters) > 0 && len(p) > max {
+		p = p[:max]
+	}
+	n, err := s.Stream.Read(p)
+	if n > 0 && len(limiters) > 0 {
+		// The data is returned even if the wait is cut short, the next read fails.
+		_ = s.wait(limiters, n, true)
+	}
+	return n, err
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		limiters := s.m.limitersFor(s.RemotePeer(), s.Protocol(), false)
+		chunk := p
+		if max := maxBurst(limiters); len(limiters) > 0 && len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		if err := s.wait(limiters, len(chunk), false); err != nil {
+			return written, err
+		}
+		n, err := s.Stream.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// wait waits until n bytes may go through limiters, failing with os.ErrDeadlineExceeded once the read or
+// write deadline is reached and with net.ErrClosed once the stream is closed.
+func (s *stream) wait(limiters []*Limiter, n int, read bool) error {
+	for _, l := range limiters {
+		for {
+			s.mu.Lock()
+			deadline, changed := s.writeDeadline, s.changed
+			if read {
+				deadline = s.readDeadline
+			}
+			s.mu.Unlock()
+
+			ctx, cancel := s.ctx, context.CancelFunc(func() {})
+			if !deadline.IsZero() {
+				ctx, cancel = context.WithDeadline(s.ctx, deadline)
+			}
+			err := l.waitN(ctx, n, changed)
+			cancel()
+			switch {
+			case err == nil:
+			case errors.Is(err, errInterrupted):
+				// The deadline changed, wait again with the new one.
+				continue
+			case s.ctx.Err() != nil:
+				return net.ErrClosed
+			default:
+				return os.ErrDeadlineExceeded
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// deadlineChanged wakes up the waits so that they use the new deadlines. s.mu must be held.
+func (s *stream) deadlineChanged() {
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline, s.writeDeadline = t, t
+	s.deadlineChanged()
+	s.mu.Unlock()
+	return s.Stream.SetDeadline(t)
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.readDeadline = t
+	s.deadlineChanged()
+	s.mu.Unlock()
+	return s.Stream.SetReadDeadline(t)
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	s.writeDeadline = t
+	s.deadlineChanged()
+	s.mu.Unlock()
+	return s.Stream.SetWriteDeadline(t)
+}
+
+func (s *stream) Close() error {
+	s.cancel()
+	return s.Stream.Close()
+}
+
+func (s *stream) Reset() error {
+	s.cancel()
+	return s.Stream.Reset()
+}
@@ -0,0 +1,130 @@
+package rcmgr
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"p2p/peer"
+	protocol "p2p/protocols"
+)
+
+// Limit is the set of limits enforced on a single scope. A zero value means unlimited.
+type Limit struct {
+	Conns           int   `json:",omitempty"`
+	ConnsInbound    int   `json:",omitempty"`
+	ConnsOutbound   int   `json:",omitempty"`
+	Streams         int   `json:",omitempty"`
+	StreamsInbound  int   `json:",omitempty"`
+	StreamsOutbound int   `json:",omitempty"`
+	FD              int   `json:",omitempty"`
+	Memory          int64 `json:",omitempty"`
+}
+
+// LimitConfig holds the limits of every scope of the resource manager.
+// Peers, protocols and services without a specific entry get the matching default.
+type LimitConfig struct {
+	System    Limit
+	Transient Limit
+
+	PeerDefault Limit
+	Peer        map[peer.ID]Limit `json:",omitempty"`
+
+	ProtocolDefault Limit
+	Protocol        map[protocol.ID]Limit `json:",omitempty"`
+
+	ServiceDefault Limit
+	Service        map[string]Limit `json:",omitempty"`
+}
+
+// DefaultLimits returns limits suitable for a small node with a few hundred connections.
+func DefaultLimits() LimitConfig {
+	return LimitConfig{
+		System: Limit{
+			Conns:           512,
+			ConnsInbound:    256,
+			ConnsOutbound:   512,
+			Streams:         4096,
+			StreamsInbound:  2048,
+			StreamsOutbound: 4096,
+			FD:              256,
+			Memory:          1 << 30,
+		},
+		Transient: Limit{
+			Conns:           64,
+			ConnsInbound:    32,
+			ConnsOutbound:   64,
+			Streams:         256,
+			StreamsInbound:  128,
+			StreamsOutbound: 256,
+			FD:              64,
+			Memory:          64 << 20,
+		},
+		PeerDefault: Limit{
+			Conns:           8,
+			ConnsInbound:    4,
+			ConnsOutbound:   8,
+			Streams:         512,
+			StreamsInbound:  256,
+			StreamsOutbound: 512,
+			FD:              8,
+			Memory:          128 << 20,
+		},
+		ProtocolDefault: Limit{
+			Streams:         2048,
+			StreamsInbound:  1024,
+			StreamsOutbound: 2048,
+			Memory:          256 << 20,
+		},
+		ServiceDefault: Limit{
+			Streams:         2048,
+			StreamsInbound:  1024,
+			StreamsOutbound: 2048,
+			Memory:          256 << 20,
+		},
+	}
+}
+
+// peerLimit returns the limit of peer p.
+func (cfg *LimitConfig) peerLimit(p peer.ID) Limit {
+	if l, ok := cfg.Peer[p]; ok {
+		return l
+	}
+	return cfg.PeerDefault
+}
+
+// protocolLimit returns the limit of protocol pid.
+func (cfg *LimitConfig) protocolLimit(pid protocol.ID) Limit {
+	if l, ok := cfg.Protocol[pid]; ok {
+		return l
+	}
+	return cfg.ProtocolDefault
+}
+
+// serviceLimit returns the limit of service svc.
+func (cfg *LimitConfig) serviceLimit(svc string) Limit {
+	if l, ok := cfg.Service[svc]; ok {
+		return l
+	}
+	return cfg.ServiceDefault
+}
+
+// ReadLimitConfig reads a JSON limit config from r. Scopes missing from the
+// input keep the value they have in DefaultLimits. Peer IDs are base58 encoded.
+func ReadLimitConfig(r io.Reader) (LimitConfig, error) {
+	cfg := DefaultLimits()
+	if err := json.NewDecoder(r).Decode(&cfg); err != nil {
+		return LimitConfig{}, fmt.Errorf("error decoding limit config: %v", err)
+	}
+	return cfg, nil
+}
+
+// LoadLimitConfig reads a JSON limit config from the file at path.
+func LoadLimitConfig(path string) (LimitConfig, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return LimitConfig{}, fmt.Errorf("error opening limit config: %v", err)
+	}
+	defer file.Close()
+	return ReadLimitConfig(file)
+}
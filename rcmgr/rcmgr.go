@@ -0,0 +1,200 @@
+// Package rcmgr implements a network.ResourceManager that bounds the connections, streams,
+// file descriptors and memory used by a host.
+//
+// Usage is accounted in a hierarchy of scopes. Every connection and stream has its own scope
+// whose usage is also charged to its parent scopes: the transient scope until the remote peer
+// (for connections) or the protocol (for streams) is known, then the matching peer, protocol and
+// service scopes, and always the system scope. An operation fails if any scope on the way would
+// go over its limit.
+package rcmgr
+
+import (
+	"fmt"
+	"p2p/network"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"sync"
+)
+
+// resourceManager is the network.ResourceManager implementation.
+// A single lock guards every scope so that a reservation is checked and applied
+// against a whole chain of scopes atomically.
+type resourceManager struct {
+	mu     sync.Mutex
+	limits LimitConfig
+
+	system    *scope
+	transient *scope
+	peers     map[peer.ID]*scope
+	protocols map[protocol.ID]*scope
+	services  map[string]*scope
+}
+
+var _ network.ResourceManager = (*resourceManager)(nil)
+
+// NewResourceManager returns a resource manager enforcing the given limits.
+func NewResourceManager(limits LimitConfig) network.ResourceManager {
+	rm := &resourceManager{
+		limits:    limits,
+		peers:     make(map[peer.ID]*scope),
+		protocols: make(map[protocol.ID]*scope),
+		services:  make(map[string]*scope),
+	}
+	rm.system = newScope(rm, "system", limits.System)
+	rm.transient = newScope(rm, "transient", limits.Transient, rm.system)
+	return rm
+}
+
+// OpenConnection creates the scope of a new connection in the transient scope.
+func (rm *resourceManager) OpenConnection(dir network.Direction, usefd bool) (network.ConnScope, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	s := newScope(rm, "conn", Limit{}, rm.transient)
+	if err := s.addConn(dir, usefd); err != nil {
+		s.detach()
+		return nil, err
+	}
+	return &connScope{scope: s}, nil
+}
+
+// OpenStream creates the scope of a new stream to peer p in the transient scope.
+func (rm *resourceManager) OpenStream(p peer.ID, dir network.Direction) (network.StreamScope, error) {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+
+	s := newScope(rm, "stream", Limit{}, rm.transient, rm.peerScope(p))
+	if err := s.addStream(dir); err != nil {
+		s.detach()
+		return nil, err
+	}
+	return &streamScope{scope: s, peer: p}, nil
+}
+
+// ViewSystem returns the usage of the system scope.
+func (rm *resourceManager) ViewSystem() network.ScopeStat {
+	return rm.view(func() *scope { return rm.system })
+}
+
+// ViewTransient returns the usage of the transient scope.
+func (rm *resourceManager) ViewTransient() network.ScopeStat {
+	return rm.view(func() *scope { return rm.transient })
+}
+
+// ViewPeer returns the usage of the scope of peer p.
+func (rm *resourceManager) ViewPeer(p peer.ID) network.ScopeStat {
+	return rm.view(func() *scope { return rm.peers[p] })
+}
+
+// ViewProtocol returns the usage of the scope of protocol pid.
+func (rm *resourceManager) ViewProtocol(pid protocol.ID) network.ScopeStat {
+	return rm.view(func() *scope { return rm.protocols[pid] })
+}
+
+// ViewService returns the usage of the scope of service svc.
+func (rm *resourceManager) ViewService(svc string) network.ScopeStat {
+	return rm.view(func() *scope { return rm.services[svc] })
+}
+
+func (rm *resourceManager) view(get func() *scope) network.ScopeStat {
+	rm.mu.Lock()
+	defer rm.mu.Unlock()
+	if s := get(); s != nil {
+		return s.stat()
+	}
+	return network.ScopeStat{}
+}
+
+// Close is a no-op, the resource manager holds no background resources.
+func (rm *resourceManager) Close() error {
+	return nil
+}
+
+// peerScope returns the scope of peer p, creating it if needed. The lock must be held.
+func (rm *resourceManager) peerScope(p peer.ID) *scope {
+	s, ok := rm.peers[p]
+	if !ok {
+		s = newScope(rm, "peer:"+p.String(), rm.limits.peerLimit(p), rm.system)
+		s.onIdle = func() { delete(rm.peers, p) }
+		rm.peers[p] = s
+	}
+	return s
+}
+
+// protocolScope returns the scope of protocol pid, creating it if needed. The lock must be held.
+func (rm *resourceManager) protocolScope(pid protocol.ID) *scope {
+	s, ok := rm.protocols[pid]
+	if !ok {
+		s = newScope(rm, "protocol:"+string(pid), rm.limits.protocolLimit(pid), rm.system)
+		s.onIdle = func() { delete(rm.protocols, pid) }
+		rm.protocols[pid] = s
+	}
+	return s
+}
+
+// serviceScope returns the scope of service svc, creating it if needed. The lock must be held.
+func (rm *resourceManager) serviceScope(svc string) *scope {
+	s, ok := rm.services[svc]
+	if !ok {
+		s = newScope(rm, "service:"+svc, rm.limits.serviceLimit(svc), rm.system)
+		s.onIdle = func() { delete(rm.services, svc) }
+		rm.services[svc] = s
+	}
+	return s
+}
+
+// connScope is the network.ConnScope implementation.
+type connScope struct {
+	*scope
+}
+
+// SetPeer moves the connection from the transient scope to the scope of peer p.
+func (c *connScope) SetPeer(p peer.ID) error {
+	c.rm.mu.Lock()
+	defer c.rm.mu.Unlock()
+	if c.done {
+		return fmt.Errorf("conn scope already closed")
+	}
+	return c.move(c.rm.peerScope(p))
+}
+
+// BeginSpan creates a child span of the connection.
+func (c *connScope) BeginSpan() (network.ResourceScopeSpan, error) {
+	c.rm.mu.Lock()
+	defer c.rm.mu.Unlock()
+	if c.done {
+		return nil, fmt.Errorf("conn scope already closed")
+	}
+	return newScope(c.rm, "span", Limit{}, c.scope), nil
+}
+
+// streamScope is the network.StreamScope implementation.
+type streamScope struct {
+	*scope
+	peer     peer.ID
+	protocol *scope
+}
+
+// SetProtocol moves the stream from the transient scope to the scope of protocol pid.
+func (s *streamScope) SetProtocol(pid protocol.ID) error {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	if s.done {
+		return fmt.Errorf("stream scope already closed")
+	}
+	s.protocol = s.rm.protocolScope(pid)
+	return s.move(s.protocol, s.rm.peerScope(s.peer))
+}
+
+// SetService attaches the stream to the scope of service svc.
+func (s *streamScope) SetService(svc string) error {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	if s.done {
+		return fmt.Errorf("stream scope already closed")
+	}
+	if s.protocol == nil {
+		return fmt.Errorf("stream scope has no protocol")
+	}
+	return s.move(s.protocol, s.rm.peerScope(s.peer), s.rm.serviceScope(svc))
+}
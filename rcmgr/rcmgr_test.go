@@ -0,0 +1,157 @@
+package rcmgr
+
+import (
+	"errors"
+	"p2p/network"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"testing"
+)
+
+func TestPeerConnectionLimit(t *testing.T) {
+	alice, bob := peer.ID("alice"), peer.ID("bob")
+	rm := NewResourceManager(LimitConfig{
+		PeerDefault: Limit{ConnsInbound: 1},
+		Peer:        map[peer.ID]Limit{bob: {ConnsInbound: 2}},
+	})
+
+	first, err := rm.OpenConnection(network.DirInbound, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := first.SetPeer(alice); err != nil {
+		t.Fatal(err)
+	}
+	second, err := rm.OpenConnection(network.DirInbound, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := second.SetPeer(alice); !errors.Is(err, network.ErrResourceLimitExceeded) {
+		t.Fatalf("second connection of alice: SetPeer = %v, want ErrResourceLimitExceeded", err)
+	}
+	// A refused connection stays in the transient scope, and can go to a peer with room for it.
+	if got := rm.ViewTransient().NumConnsInbound; got != 1 {
+		t.Errorf("transient scope holds %d connections, want 1", got)
+	}
+	if err := second.SetPeer(bob); err != nil {
+		t.Fatalf("connection of bob: %v", err)
+	}
+	if got := rm.ViewTransient().NumConnsInbound; got != 0 {
+		t.Errorf("transient scope holds %d connections, want 0", got)
+	}
+	if got := rm.ViewSystem(); got.NumConnsInbound != 2 || got.NumFD != 2 {
+		t.Errorf("system scope holds %+v, want 2 connections and 2 file descriptors", got)
+	}
+
+	first.Done()
+	third, err := rm.OpenConnection(network.DirInbound, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := third.SetPeer(alice); err != nil {
+		t.Fatalf("connection of alice once the first one is done: %v", err)
+	}
+	third.Done()
+	second.Done()
+	if got := rm.ViewSystem(); got != (network.ScopeStat{}) {
+		t.Errorf("system scope holds %+v once every connection is done", got)
+	}
+	if got := rm.ViewPeer(alice); got != (network.ScopeStat{}) {
+		t.Errorf("scope of alice holds %+v once its connections are done", got)
+	}
+}
+
+func TestStreamLimits(t *testing.T) {
+	const pid = protocol.ID("/p2p/_testing")
+	p := peer.ID("alice")
+	rm := NewResourceManager(LimitConfig{
+		Transient: Limit{Streams: 2},
+		Protocol:  map[protocol.ID]Limit{pid: {StreamsOutbound: 1}},
+	})
+
+	var streams []network.StreamScope
+	for i := 0; i < 2; i++ {
+		s, err := rm.OpenStream(p, network.DirOutbound)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, s)
+	}
+	if _, err := rm.OpenStream(p, network.DirOutbound); !errors.Is(err, network.ErrResourceLimitExceeded) {
+		t.Fatalf("third stream in the transient scope: %v, want ErrResourceLimitExceeded", err)
+	}
+
+	if err := streams[0].SetProtocol(pid); err != nil {
+		t.Fatal(err)
+	}
+	if err := streams[1].SetProtocol(pid); !errors.Is(err, network.ErrResourceLimitExceeded) {
+		t.Fatalf("second stream of %s: %v, want ErrResourceLimitExceeded", pid, err)
+	}
+	// The stream that left the transient scope made room for another.
+	s, err := rm.OpenStream(p, network.DirOutbound)
+	if err != nil {
+		t.Fatalf("stream once another left the transient scope: %v", err)
+	}
+	streams = append(streams, s)
+	if got := rm.ViewPeer(p).NumStreamsOutbound; got != 3 {
+		t.Errorf("scope of the peer holds %d streams, want 3", got)
+	}
+	for _, s := range streams {
+		s.Done()
+	}
+	if got := rm.ViewProtocol(pid); got != (network.ScopeStat{}) {
+		t.Errorf("scope of %s holds %+v once its streams are done", pid, got)
+	}
+}
+
+func TestServiceMemory(t *testing.T) {
+	const pid = protocol.ID("/p2p/_testing")
+	rm := NewResourceManager(LimitConfig{
+		System:  Limit{Memory: 1 << 20},
+		Service: map[string]Limit{"svc": {Memory: 1024}},
+	})
+	s, err := rm.OpenStream(peer.ID("alice"), network.DirInbound)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetService("svc"); err == nil {
+		t.Error("a stream without protocol was attached to a service")
+	}
+	if err := s.SetProtocol(pid); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetService("svc"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.ReserveMemory(1000, network.ReservationPriorityAlways); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReserveMemory(100, network.ReservationPriorityAlways); !errors.Is(err, network.ErrResourceLimitExceeded) {
+		t.Fatalf("reservation over the memory of the service: %v, want ErrResourceLimitExceeded", err)
+	}
+	// A refused reservation is charged to no scope.
+	if got := rm.ViewSystem().Memory; got != 1000 {
+		t.Errorf("system scope holds %d bytes, want 1000", got)
+	}
+	s.ReleaseMemory(1000)
+
+	// Low priority reservations fail once the scope is 101/256 full.
+	if err := s.ReserveMemory(400, network.ReservationPriorityLow); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.ReserveMemory(100, network.ReservationPriorityLow); !errors.Is(err, network.ErrResourceLimitExceeded) {
+		t.Errorf("low priority reservation over 101/256 of the limit: %v, want ErrResourceLimitExceeded", err)
+	}
+	if err := s.ReserveMemory(100, network.ReservationPriorityHigh); err != nil {
+		t.Errorf("high priority reservation: %v", err)
+	}
+
+	s.Done()
+	if got := rm.ViewService("svc"); got != (network.ScopeStat{}) {
+		t.Errorf("scope of the service holds %+v once its stream is done", got)
+	}
+	if got := rm.ViewSystem(); got != (network.ScopeStat{}) {
+		t.Errorf("system scope holds %+v once the stream is done", got)
+	}
+}
@@ -0,0 +1,304 @@
+package rcmgr
+
+import (
+	"fmt"
+	"p2p/network"
+)
+
+// usage is the amount of each resource held in a scope.
+type usage struct {
+	connsIn    int
+	connsOut   int
+	streamsIn  int
+	streamsOut int
+	fd         int
+	memory     int64
+}
+
+func (u *usage) add(d usage) {
+	u.connsIn += d.connsIn
+	u.connsOut += d.connsOut
+	u.streamsIn += d.streamsIn
+	u.streamsOut += d.streamsOut
+	u.fd += d.fd
+	u.memory += d.memory
+}
+
+func (u *usage) sub(d usage) {
+	u.connsIn -= d.connsIn
+	u.connsOut -= d.connsOut
+	u.streamsIn -= d.streamsIn
+	u.streamsOut -= d.streamsOut
+	u.fd -= d.fd
+	u.memory -= d.memory
+}
+
+func (u *usage) isZero() bool {
+	return *u == usage{}
+}
+
+// scope is a node of the scope hierarchy. Every field is guarded by the lock of the resource manager.
+type scope struct {
+	rm      *resourceManager
+	name    string
+	limit   Limit
+	used    usage
+	parents []*scope
+
+	// refs is the number of scopes having this scope as a parent.
+	refs int
+	// onIdle is called once the scope holds nothing and has no children anymore.
+	onIdle func()
+	done   bool
+}
+
+func newScope(rm *resourceManager, name string, limit Limit, parents ...*scope) *scope {
+	for _, p := range parents {
+		p.refs++
+	}
+	return &scope{rm: rm, name: name, limit: limit, parents: parents}
+}
+
+// ancestors returns every scope charged along with s, s excluded.
+func (s *scope) ancestors() []*scope {
+	var res []*scope
+	seen := make(map[*scope]bool)
+	var walk func(*scope)
+	walk = func(cur *scope) {
+		for _, p := range cur.parents {
+			if !seen[p] {
+				seen[p] = true
+				res = append(res, p)
+				walk(p)
+			}
+		}
+	}
+	walk(s)
+	return res
+}
+
+// check returns an error if adding d to the usage of the scope goes over its limit.
+// Memory is allowed up to (prio+1)/256 of the limit.
+func (s *scope) check(d usage, prio uint8) error {
+	next := s.used
+	next.add(d)
+	l := s.limit
+	exceeded := func(resource string) error {
+		return fmt.Errorf("%s: cannot reserve %s: %w", s.name, resource, network.ErrResourceLimitExceeded)
+	}
+	if d.connsIn+d.connsOut > 0 {
+		if over(next.connsIn+next.connsOut, l.Conns) {
+			return exceeded("connection")
+		}
+		if d.connsIn > 0 && over(next.connsIn, l.ConnsInbound) {
+			return exceeded("inbound connection")
+		}
+		if d.connsOut > 0 && over(next.connsOut, l.ConnsOutbound) {
+			return exceeded("outbound connection")
+		}
+	}
+	if d.streamsIn+d.streamsOut > 0 {
+		if over(next.streamsIn+next.streamsOut, l.Streams) {
+			return exceeded("stream")
+		}
+		if d.streamsIn > 0 && over(next.streamsIn, l.StreamsInbound) {
+			return exceeded("inbound stream")
+		}
+		if d.streamsOut > 0 && over(next.streamsOut, l.StreamsOutbound) {
+			return exceeded("outbound stream")
+		}
+	}
+	if d.fd > 0 && over(next.fd, l.FD) {
+		return exceeded("file descriptor")
+	}
+	if d.memory > 0 && l.Memory > 0 && next.memory > l.Memory*(int64(prio)+1)/256 {
+		return exceeded(fmt.Sprintf("%d bytes of memory", d.memory))
+	}
+	return nil
+}
+
+// over reports whether n goes over limit, a zero limit being unlimited.
+func over(n, limit int) bool {
+	return limit > 0 && n > limit
+}
+
+// reserve charges d to the scope and all its ancestors, or to none of them if one would go over its limit.
+func (s *scope) reserve(d usage, prio uint8) error {
+	chain := append([]*scope{s}, s.ancestors()...)
+	for _, c := range chain {
+		if c.done {
+			return fmt.Errorf("%s: scope already closed", c.name)
+		}
+		if err := c.check(d, prio); err != nil {
+			return err
+		}
+	}
+	for _, c := range chain {
+		c.used.add(d)
+	}
+	return nil
+}
+
+// release returns d from the scope and all its ancestors. An ancestor that is already done gave back everything
+// it held, including d, to its own ancestors too, so those are left alone even when they are also reached through
+// a scope that is not done.
+func (s *scope) release(d usage) {
+	s.used.sub(d)
+	ancestors := s.ancestors()
+	released := make(map[*scope]bool)
+	for _, c := range ancestors {
+		if c.done {
+			released[c] = true
+			for _, a := range c.ancestors() {
+				released[a] = true
+			}
+		}
+	}
+	for _, c := range ancestors {
+		if released[c] {
+			continue
+		}
+		c.used.sub(d)
+		c.maybeIdle()
+	}
+}
+
+func (s *scope) addConn(dir network.Direction, usefd bool) error {
+	d := usage{}
+	if dir == network.DirInbound {
+		d.connsIn = 1
+	} else {
+		d.connsOut = 1
+	}
+	if usefd {
+		d.fd = 1
+	}
+	return s.reserve(d, network.ReservationPriorityAlways)
+}
+
+func (s *scope) addStream(dir network.Direction) error {
+	d := usage{}
+	if dir == network.DirInbound {
+		d.streamsIn = 1
+	} else {
+		d.streamsOut = 1
+	}
+	return s.reserve(d, network.ReservationPriorityAlways)
+}
+
+// move replaces the parents of the scope, moving what it holds from the
+// ancestors it leaves to the ancestors it joins.
+func (s *scope) move(parents ...*scope) error {
+	old := make(map[*scope]bool)
+	for _, a := range s.ancestors() {
+		old[a] = true
+	}
+	prev := s.parents
+	s.parents = parents
+	joined := s.ancestors()
+	s.parents = prev
+
+	kept := make(map[*scope]bool)
+	var added []*scope
+	for _, a := range joined {
+		if old[a] {
+			kept[a] = true
+		} else {
+			added = append(added, a)
+		}
+	}
+	for _, a := range added {
+		if err := a.check(s.used, network.ReservationPriorityAlways); err != nil {
+			return err
+		}
+	}
+
+	for _, a := range added {
+		a.used.add(s.used)
+	}
+	for _, p := range parents {
+		p.refs++
+	}
+	s.parents = parents
+	for a := range old {
+		if !kept[a] {
+			a.used.sub(s.used)
+		}
+	}
+	for _, p := range prev {
+		p.refs--
+	}
+	for a := range old {
+		a.maybeIdle()
+	}
+	return nil
+}
+
+// detach removes the scope from its parents.
+func (s *scope) detach() {
+	for _, p := range s.parents {
+		p.refs--
+	}
+	for _, a := range s.ancestors() {
+		a.maybeIdle()
+	}
+	s.parents = nil
+}
+
+// maybeIdle calls onIdle if the scope is no longer in use.
+func (s *scope) maybeIdle() {
+	if s.onIdle != nil && s.refs == 0 && s.used.isZero() {
+		s.onIdle()
+		s.onIdle = nil
+	}
+}
+
+func (s *scope) stat() network.ScopeStat {
+	return network.ScopeStat{
+		NumStreamsInbound:  s.used.streamsIn,
+		NumStreamsOutbound: s.used.streamsOut,
+		NumConnsInbound:    s.used.connsIn,
+		NumConnsOutbound:   s.used.connsOut,
+		NumFD:              s.used.fd,
+		Memory:             s.used.memory,
+	}
+}
+
+// ReserveMemory reserves size bytes in the scope and all its ancestors.
+func (s *scope) ReserveMemory(size int, prio uint8) error {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	if s.done {
+		return fmt.Errorf("%s: scope already closed", s.name)
+	}
+	return s.reserve(usage{memory: int64(size)}, prio)
+}
+
+// ReleaseMemory releases size bytes reserved with ReserveMemory.
+func (s *scope) ReleaseMemory(size int) {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.release(usage{memory: int64(size)})
+}
+
+// Stat returns the usage of the scope.
+func (s *scope) Stat() network.ScopeStat {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	return s.stat()
+}
+
+// Done releases everything the scope holds and removes it from its parents.
+func (s *scope) Done() {
+	s.rm.mu.Lock()
+	defer s.rm.mu.Unlock()
+	if s.done {
+		return
+	}
+	s.done = true
+	s.release(s.used)
+	s.detach()
+}
@@ -0,0 +1,333 @@
+// Package share publishes directories for peers to browse and fetch files from, each share visible to the
+// peers its access list allows.
+package share
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	mh "github.com/multiformats/go-multihash"
+	"io"
+	"os"
+	"p2p/peer"
+	"p2p/transfer"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned for a share or a file that does not exist or that the peer may not see.
+var ErrNotFound = errors.New("not found")
+
+// File is a file of a share.
+type File struct {
+	// Path is the slash separated path of the file relative to the root of the share.
+	Path    string    `json:"path"`
+	Size    uint64    `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Hash is the base58 encoded SHA2-256 multihash of the file.
+	Hash string `json:"hash"`
+}
+
+// Listing describes a share to a peer.
+type Listing struct {
+	Name       string `json:"name"`
+	Files      []File `json:"files,omitempty"`
+	TotalFiles int    `json:"total_files"`
+	TotalSize  uint64 `json:"total_size"`
+}
+
+// config holds the settings of a share.
+type config struct {
+	allowed map[peer.ID]bool
+	denied  map[peer.ID]bool
+}
+
+// Option configures a share published by Publish.
+type Option func(cfg *config) error
+
+// AllowPeers makes the share visible to ids only. A share is visible to every peer if this option is not given.
+func AllowPeers(ids ...peer.ID) Option {
+	return func(cfg *config) error {
+		if cfg.allowed == nil {
+			cfg.allowed = make(map[peer.ID]bool, len(ids))
+		}
+		for _, id := range ids {
+			cfg.allowed[id] = true
+		}
+		return nil
+	}
+}
+
+// DenyPeers hides the share from ids, even if AllowPeers allows them.
+func DenyPeers(ids ...peer.ID) Option {
+	return func(cfg *config) error {
+		if cfg.denied == nil {
+			cfg.denied = make(map[peer.ID]bool, len(ids))
+		}
+		for _, id := range ids {
+			cfg.denied[id] = true
+		}
+		return nil
+	}
+}
+
+// visibleTo reports whether a share configured by cfg is visible to p.
+func (cfg *config) visibleTo(p peer.ID) bool {
+	if cfg.denied[p] {
+		return false
+	}
+	return cfg.allowed == nil || cfg.allowed[p]
+}
+
+// share is a directory published by a catalog.
+type share struct {
+	dir string
+	cfg *config
+}
+
+// hashed is the hash of a file, valid as long as its size and modification time are unchanged.
+type hashed struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// Catalog is the set of directories a node shares. It is safe for concurrent use.
+type Catalog struct {
+	mu     sync.RWMutex
+	shares map[string]*share
+
+	hashMu sync.Mutex
+	hashes map[string]hashed
+
+	logf func(format string, args ...interface{})
+}
+
+// CatalogOption configures a Catalog created by NewCatalog.
+type CatalogOption func(c *Catalog)
+
+// WithLogger sets a function a catalog reports the files it leaves out of listings and the requests it fails to
+// serve to. Nothing is reported by default.
+func WithLogger(logf func(format string, args ...interface{})) CatalogOption {
+	return func(c *Catalog) {
+		c.logf = logf
+	}
+}
+
+// NewCatalog returns a catalog sharing nothing yet.
+func NewCatalog(opts ...CatalogOption) *Catalog {
+	c := &Catalog{shares: make(map[string]*share), hashes: make(map[string]hashed)}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// log reports an event to the logger set by WithLogger, if any.
+func (c *Catalog) log(format string, args ...interface{}) {
+	if c.logf != nil {
+		c.logf(format, args...)
+	}
+}
+
+// Publish shares the directory dir under name, replacing the share of the same name if there is one.
+func (c *Catalog) Publish(name, dir string, opts ...Option) error {
+	if err := checkShareName(name); err != nil {
+		return err
+	}
+	cfg := &config{}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return err
+		}
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return fmt.Errorf("error resolving directory: %v", err)
+	}
+	// Files are resolved below the real path of the directory, so that a link to it cannot move the share.
+	if abs, err = filepath.EvalSymlinks(abs); err != nil {
+		return fmt.Errorf("error resolving directory: %v", err)
+	}
+	info, err := os.Stat(abs)
+	if err != nil {
+		return fmt.Errorf("error reading directory: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.shares[name] = &share{dir: abs, cfg: cfg}
+	return nil
+}
+
+// Unpublish stops sharing name.
+func (c *Catalog) Unpublish(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.shares[name]; !ok {
+		return fmt.Errorf("share %q: %w", name, ErrNotFound)
+	}
+	delete(c.shares, name)
+	return nil
+}
+
+// Allow makes the share name visible to ids. A share visible to every peer stays so, unless they were denied.
+func (c *Catalog) Allow(name string, ids ...peer.ID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.shares[name]
+	if !ok {
+		return fmt.Errorf("share %q: %w", name, ErrNotFound)
+	}
+	for _, id := range ids {
+		delete(s.cfg.denied, id)
+		if s.cfg.allowed != nil {
+			s.cfg.allowed[id] = true
+		}
+	}
+	return nil
+}
+
+// Deny hides the share name from ids.
+func (c *Catalog) Deny(name string, ids ...peer.ID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.shares[name]
+	if !ok {
+		return fmt.Errorf("share %q: %w", name, ErrNotFound)
+	}
+	return DenyPeers(ids...)(s.cfg)
+}
+
+// Shares returns the names of the shares visible to p, sorted.
+func (c *Catalog) Shares(p peer.ID) []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var names []string
+	for name, s := range c.shares {
+		if s.cfg.visibleTo(p) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup returns the directory of the share name if it is visible to p.
+func (c *Catalog) lookup(p peer.ID, name string) (string, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s, ok := c.shares[name]
+	if !ok || !s.cfg.visibleTo(p) {
+		return "", fmt.Errorf("share %q: %w", name, ErrNotFound)
+	}
+	return s.dir, nil
+}
+
+// List returns the files of the share name as seen by p, hashing those that changed since they were last
+// listed.
+func (c *Catalog) List(p peer.ID, name string) (*Listing, error) {
+	dir, err := c.lookup(p, name)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := transfer.BuildManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	listing := &Listing{Name: name}
+	for _, entry := range manifest.Entries {
+		if entry.Type != transfer.EntryFile {
+			continue
+		}
+		hash, err := c.hash(filepath.Join(dir, filepath.FromSlash(entry.Path)))
+		if err != nil {
+			// A file removed or unreadable since the directory was read is left out.
+			c.log("not listing %s because %v", entry.Path, err)
+			continue
+		}
+		listing.Files = append(listing.Files, File{Path: entry.Path, Size: entry.Size, ModTime: entry.ModTime, Hash: hash})
+		listing.TotalFiles++
+		listing.TotalSize += entry.Size
+	}
+	return listing, nil
+}
+
+// Resolve returns the path on disk of the file at the slash separated path rel of the share name, if the share
+// is visible to p and the file is a regular file inside it.
+func (c *Catalog) Resolve(p peer.ID, name, rel string) (string, error) {
+	dir, err := c.lookup(p, name)
+	if err != nil {
+		return "", err
+	}
+	if rel == "" || path.IsAbs(rel) || path.Clean(rel) != rel || rel == ".." || strings.HasPrefix(rel, "../") ||
+		strings.Contains(rel, `\`) {
+		return "", fmt.Errorf("invalid path %q", rel)
+	}
+	// Symbolic links are followed as long as they stay inside the share.
+	real, err := filepath.EvalSymlinks(filepath.Join(dir, filepath.FromSlash(rel)))
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", rel, ErrNotFound)
+	}
+	if inside, err := filepath.Rel(dir, real); err != nil || inside == ".." || strings.HasPrefix(inside, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s: %w", rel, ErrNotFound)
+	}
+	info, err := os.Stat(real)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s: %w", rel, ErrNotFound)
+	}
+	return real, nil
+}
+
+// hash returns the base58 encoded SHA2-256 multihash of the file at p, computed again only if it changed.
+func (c *Catalog) hash(p string) (string, error) {
+	info, err := os.Stat(p)
+	if err != nil {
+		return "", err
+	}
+	c.hashMu.Lock()
+	h, ok := c.hashes[p]
+	c.hashMu.Unlock()
+	if ok && h.size == info.Size() && h.modTime.Equal(info.ModTime()) {
+		return h.hash, nil
+	}
+
+	file, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	sum, err := mh.Encode(hasher.Sum(nil), mh.SHA2_256)
+	if err != nil {
+		return "", err
+	}
+	h = hashed{size: info.Size(), modTime: info.ModTime(), hash: mh.Multihash(sum).B58String()}
+	c.hashMu.Lock()
+	c.hashes[p] = h
+	c.hashMu.Unlock()
+	return h.hash, nil
+}
+
+// checkShareName returns an error unless name can name a share.
+func checkShareName(name string) error {
+	if name == "" || len(name) > 255 || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid share name %q", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("invalid share name %q", name)
+		}
+	}
+	return nil
+}
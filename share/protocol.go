@@ -0,0 +1,209 @@
+package share
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	mh "github.com/multiformats/go-multihash"
+	"io"
+	"p2p/host"
+	"p2p/internal/wire"
+	"p2p/network"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"p2p/transfer"
+	"path"
+)
+
+const (
+	// ListProtocolID is the protocol negotiated on streams listing the shares of a peer and their files.
+	ListProtocolID protocol.ID = "/p2p/share/list/1.0.0"
+	// GetProtocolID is the protocol negotiated on streams fetching a file of a share.
+	GetProtocolID protocol.ID = "/p2p/share/get/1.0.0"
+)
+
+const (
+	// maxRequestSize bounds the requests a peer accepts.
+	maxRequestSize = 64 << 10
+	// maxMessageSize bounds the listings a peer accepts.
+	maxMessageSize = 64 << 20
+	// blockSize is the size of the frames the files fetched are sent in.
+	blockSize = 64 << 10
+)
+
+// request asks for the shares of a peer if Share is empty, for the files of Share otherwise, or for the file at
+// Path of Share on GetProtocolID.
+type request struct {
+	Share string `json:"share,omitempty"`
+	Path  string `json:"path,omitempty"`
+}
+
+// response answers a request. On GetProtocolID, a response without error is followed by the file, sent as by
+// transfer.UploadFile.
+type response struct {
+	Error    string   `json:"error,omitempty"`
+	NotFound bool     `json:"not_found,omitempty"`
+	Shares   []string `json:"shares,omitempty"`
+	Listing  *Listing `json:"listing,omitempty"`
+}
+
+// errorResponse returns the response reporting err.
+func errorResponse(err error) *response {
+	return &response{Error: err.Error(), NotFound: errors.Is(err, ErrNotFound)}
+}
+
+// err returns the error reported by r, nil if there is none.
+func (r *response) err() error {
+	if r.Error == "" {
+		return nil
+	}
+	return &remoteError{msg: r.Error, notFound: r.NotFound}
+}
+
+// remoteError is an error reported by the peer, which wraps ErrNotFound if it did not find what it was asked for.
+type remoteError struct {
+	msg      string
+	notFound bool
+}
+
+func (e *remoteError) Error() string {
+	return e.msg
+}
+
+func (e *remoteError) Is(target error) bool {
+	return e.notFound && target == ErrNotFound
+}
+
+// Register makes h serve c to its peers: the listings on ListProtocolID and the files on GetProtocolID, sent with
+// opts.
+func (c *Catalog) Register(h host.Host, opts ...transfer.Option) {
+	h.SetStreamHandler(ListProtocolID, func(s network.Stream) {
+		defer s.Close()
+		if err := c.ServeList(context.Background(), s, s.RemotePeer()); err != nil {
+			c.log("error listing shares to %s: %v", s.RemotePeer(), err)
+		}
+	})
+	h.SetStreamHandler(GetProtocolID, func(s network.Stream) {
+		defer s.Close()
+		if err := c.ServeGet(context.Background(), s, s.RemotePeer(), opts...); err != nil {
+			c.log("error sending shared file to %s: %v", s.RemotePeer(), err)
+		}
+	})
+}
+
+// ServeList answers the list request of p received over conn with the shares visible to p, or the files of
+// the one it asked for.
+func (c *Catalog) ServeList(ctx context.Context, conn io.ReadWriter, p peer.ID) error {
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	var req request
+	if err := wire.ReadMessage(conn, &req, maxRequestSize); err != nil {
+		return wire.ContextError(ctx, err)
+	}
+	resp := &response{}
+	if req.Share == "" {
+		resp.Shares = c.Shares(p)
+	} else if listing, err := c.List(p, req.Share); err != nil {
+		resp = errorResponse(err)
+	} else {
+		resp.Listing = listing
+	}
+	return wire.ContextError(ctx, wire.WriteMessage(conn, resp, maxMessageSize))
+}
+
+// ServeGet answers the get request of p received over conn with the file it asked for, sent with opts.
+func (c *Catalog) ServeGet(ctx context.Context, conn io.ReadWriter, p peer.ID, opts ...transfer.Option) error {
+	stop := wire.WatchContext(ctx, conn)
+	var req request
+	if err := wire.ReadMessage(conn, &req, maxRequestSize); err != nil {
+		stop()
+		return wire.ContextError(ctx, err)
+	}
+	file, err := c.Resolve(p, req.Share, req.Path)
+	resp := &response{}
+	if err != nil {
+		resp = errorResponse(err)
+	}
+	werr := wire.WriteMessage(conn, resp, maxMessageSize)
+	stop()
+	if err != nil {
+		return err
+	}
+	if werr != nil {
+		return wire.ContextError(ctx, werr)
+	}
+	return transfer.UploadFileContext(ctx, conn, path.Base(req.Path), file, blockSize, opts...)
+}
+
+// ListShares asks the peer on the other end of conn, a stream negotiating ListProtocolID, for the names of the
+// shares it lets the node see.
+func ListShares(ctx context.Context, conn io.ReadWriter) ([]string, error) {
+	resp, err := ask(ctx, conn, &request{})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Shares, nil
+}
+
+// List asks the peer on the other end of conn, a stream negotiating ListProtocolID, for the files of share. An
+// error wrapping ErrNotFound is returned if there is no such share or the node may not see it.
+func List(ctx context.Context, conn io.ReadWriter, share string) (*Listing, error) {
+	if share == "" {
+		return nil, errors.New("no share given")
+	}
+	resp, err := ask(ctx, conn, &request{Share: share})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Listing == nil {
+		return nil, errors.New("no listing received")
+	}
+	return resp.Listing, nil
+}
+
+// Fetch asks the peer on the other end of conn, a stream negotiating GetProtocolID, for file of share, and
+// stores it in the directory outputPath as transfer.ReceiveFile does with opts. The file must have the size and
+// hash it was listed with, its hash being left unchecked if empty, or the transfer is refused with an error
+// wrapping transfer.ErrRejected. An error wrapping ErrNotFound is returned if the peer does not have the file
+// or the node may not see its share.
+func Fetch(ctx context.Context, conn io.ReadWriter, share string, file File, outputPath string, opts ...transfer.Option) error {
+	var expected []byte
+	if file.Hash != "" {
+		sum, err := mh.FromB58String(file.Hash)
+		if err != nil {
+			return fmt.Errorf("invalid hash %q: %v", file.Hash, err)
+		}
+		expected = sum
+	}
+	if _, err := ask(ctx, conn, &request{Share: share, Path: file.Path}); err != nil {
+		return err
+	}
+	check := func(offer *transfer.Offer) error {
+		if offer.TotalSize != file.Size {
+			return fmt.Errorf("%s is %d bytes instead of the %d listed", file.Path, offer.TotalSize, file.Size)
+		}
+		if expected != nil && !bytes.Equal(offer.Digest, expected) {
+			return fmt.Errorf("%s changed since it was listed", file.Path)
+		}
+		return nil
+	}
+	return transfer.ReceiveFileContext(ctx, conn, outputPath, append(opts, transfer.WithOfferPolicy(check))...)
+}
+
+// ask sends req over conn and returns the response, or the error it reports.
+func ask(ctx context.Context, conn io.ReadWriter, req *request) (*response, error) {
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	if err := wire.WriteMessage(conn, req, maxMessageSize); err != nil {
+		return nil, wire.ContextError(ctx, err)
+	}
+	var resp response
+	if err := wire.ReadMessage(conn, &resp, maxMessageSize); err != nil {
+		return nil, wire.ContextError(ctx, err)
+	}
+	if err := resp.err(); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
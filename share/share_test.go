@@ -0,0 +1,160 @@
+package share
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"p2p/peer"
+	"p2p/transfer"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestShare returns a catalog sharing a directory as "docs", next to a file outside of it.
+func newTestShare(t *testing.T, opts ...Option) (*Catalog, string) {
+	t.Helper()
+	root := t.TempDir()
+	dir := filepath.Join(root, "docs")
+	for _, d := range []string{dir, filepath.Join(dir, "sub")} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, data := range map[string]string{
+		filepath.Join(root, "secret"):   "secret",
+		filepath.Join(dir, "a.txt"):     "a",
+		filepath.Join(dir, "sub/b.txt"): "bb",
+	} {
+		if err := os.WriteFile(name, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		filepath.Join(dir, "inside"):      "sub/b.txt",
+		filepath.Join(dir, "outside"):     "../secret",
+		filepath.Join(dir, "sub/up"):      "..",
+		filepath.Join(dir, "sub/escaped"): filepath.Join(root, "secret"),
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewCatalog()
+	if err := c.Publish("docs", dir, opts...); err != nil {
+		t.Fatal(err)
+	}
+	return c, dir
+}
+
+func TestResolveStaysInShare(t *testing.T) {
+	c, dir := newTestShare(t)
+	for _, rel := range []string{"a.txt", "sub/b.txt", "inside", "sub/up/a.txt"} {
+		got, err := c.Resolve("alice", "docs", rel)
+		if err != nil {
+			t.Errorf("Resolve(%q): %v", rel, err)
+			continue
+		}
+		if inside, err := filepath.Rel(dir, got); err != nil || strings.HasPrefix(inside, "..") {
+			t.Errorf("Resolve(%q) = %s, outside of the share", rel, got)
+		}
+	}
+	for _, rel := range []string{"", "..", "../secret", "sub/../../secret", "/etc/passwd", "./a.txt", `sub\b.txt`} {
+		if _, err := c.Resolve("alice", "docs", rel); err == nil {
+			t.Errorf("Resolve(%q) was not refused", rel)
+		}
+	}
+	// Links out of the share, directories and missing files are answered as missing.
+	for _, rel := range []string{"outside", "sub/escaped", "sub", "missing"} {
+		if _, err := c.Resolve("alice", "docs", rel); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Resolve(%q): %v, want ErrNotFound", rel, err)
+		}
+	}
+}
+
+func TestAccessLists(t *testing.T) {
+	alice, bob, mallory := peer.ID("alice"), peer.ID("bob"), peer.ID("mallory")
+	c, _ := newTestShare(t, AllowPeers(alice))
+	if _, err := c.Resolve(bob, "docs", "a.txt"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("file of a share bob may not see: %v, want ErrNotFound", err)
+	}
+	if got := c.Shares(bob); len(got) != 0 {
+		t.Errorf("shares of bob: %v, want none", got)
+	}
+	if err := c.Allow("docs", bob); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.Shares(bob); len(got) != 1 {
+		t.Errorf("shares of bob once allowed: %v, want [docs]", got)
+	}
+	if err := c.Deny("docs", mallory); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.List(mallory, "docs"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("listing of mallory: %v, want ErrNotFound", err)
+	}
+}
+
+func TestListAndFetch(t *testing.T) {
+	c, _ := newTestShare(t)
+
+	list := func(share string) (*Listing, []string, error) {
+		local, remote := net.Pipe()
+		defer local.Close()
+		go func() {
+			defer remote.Close()
+			c.ServeList(context.Background(), remote, "alice")
+		}()
+		if share == "" {
+			names, err := ListShares(context.Background(), local)
+			return nil, names, err
+		}
+		listing, err := List(context.Background(), local, share)
+		return listing, nil, err
+	}
+	if _, names, err := list(""); err != nil || len(names) != 1 || names[0] != "docs" {
+		t.Fatalf("ListShares = %v, %v, want [docs]", names, err)
+	}
+	if _, _, err := list("other"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("listing of a missing share: %v, want ErrNotFound", err)
+	}
+	listing, _, err := list("docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The files of the share, not the links out of it.
+	files := make(map[string]File)
+	for _, f := range listing.Files {
+		files[f.Path] = f
+	}
+	if _, ok := files["a.txt"]; !ok || len(files) > 3 {
+		t.Fatalf("listing of docs: %+v", listing.Files)
+	}
+	for _, f := range listing.Files {
+		if f.Path == "outside" || f.Path == "sub/escaped" {
+			t.Errorf("the link %s out of the share was listed", f.Path)
+		}
+	}
+
+	fetch := func(file File) error {
+		local, remote := net.Pipe()
+		defer local.Close()
+		go func() {
+			defer remote.Close()
+			c.ServeGet(context.Background(), remote, "alice")
+		}()
+		return Fetch(context.Background(), local, "docs", file, t.TempDir())
+	}
+	if err := fetch(files["a.txt"]); err != nil {
+		t.Errorf("fetching a.txt: %v", err)
+	}
+	if err := fetch(File{Path: "outside"}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("fetching a link out of the share: %v, want ErrNotFound", err)
+	}
+	changed := files["a.txt"]
+	changed.Size++
+	if err := fetch(changed); !errors.Is(err, transfer.ErrRejected) {
+		t.Errorf("fetching a file of another size than listed: %v, want ErrRejected", err)
+	}
+}
@@ -0,0 +1,78 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	mh "github.com/multiformats/go-multihash"
+	"hash"
+	"io"
+)
+
+// ErrChecksumMismatch is returned when the received data does not match the digest sent by the sender.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// supportedChecksum reports whether code is a multihash function transfers can be verified with.
+func supportedChecksum(code uint64) bool {
+	return code == mh.SHA2_256 || code == mh.BLAKE3
+}
+
+// newHasher returns the hash function of the multihash code.
+func newHasher(code uint64) (hash.Hash, error) {
+	if !supportedChecksum(code) {
+		return nil, fmt.Errorf("unsupported checksum %s", mh.Codes[code])
+	}
+	return mh.GetHasher(code)
+}
+
+// digest returns the multihash of the data read from r.
+func digest(r io.Reader, code uint64) ([]byte, error) {
+	hasher, err := newHasher(code)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return nil, err
+	}
+	return mh.Encode(hasher.Sum(nil), code)
+}
+
+// verifyDigest checks that the multihash expected is the digest computed by hasher.
+func verifyDigest(hasher hash.Hash, code uint64, expected []byte) error {
+	sum, err := mh.Encode(hasher.Sum(nil), code)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, expected) {
+		return ErrChecksumMismatch
+	}
+	return nil
+}
+
+// checkHeaderDigest checks that the digest of h, if it is not sent in the trailer, is a multihash of the checksum
+// function it announces.
+func checkHeaderDigest(h Header) error {
+	if !supportedChecksum(h.Checksum) {
+		return fmt.Errorf("unsupported checksum %s", mh.Codes[h.Checksum])
+	}
+	if len(h.Digest) == 0 {
+		return nil
+	}
+	decoded, err := mh.Decode(h.Digest)
+	if err != nil {
+		return fmt.Errorf("invalid digest: %v", err)
+	}
+	if decoded.Code != h.Checksum {
+		return fmt.Errorf("digest is a %s multihash but the checksum is %s", decoded.Name, mh.Codes[h.Checksum])
+	}
+	return nil
+}
+
+// checksumOf returns the multihash code of digest, 0 if it is not a valid multihash.
+func checksumOf(digest []byte) uint64 {
+	decoded, err := mh.Decode(digest)
+	if err != nil {
+		return 0
+	}
+	return decoded.Code
+}
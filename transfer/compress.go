@@ -0,0 +1,254 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"sync"
+)
+
+// Compression is a codec the frames of a transfer can be compressed with.
+type Compression uint8
+
+// Codecs known to transfers, by the identifier sent on the wire.
+const (
+	CompressionNone   Compression = 0
+	CompressionGzip   Compression = 1
+	CompressionZstd   Compression = 2
+	CompressionSnappy Compression = 3
+)
+
+const (
+	// maxCodecs bounds the number of codecs a sender may propose.
+	maxCodecs = 16
+	// sampleSize is the amount of data sampled to tell whether compressing a transfer is worth it.
+	sampleSize = 64 << 10
+	// sampleRatio is the compression ratio of the sample above which data is sent uncompressed.
+	sampleRatio = 0.9
+)
+
+// defaultCompression holds the codecs proposed and accepted by default, in order of preference.
+var defaultCompression = []Compression{CompressionZstd, CompressionSnappy, CompressionGzip}
+
+// String returns the name of the codec.
+func (c Compression) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	case CompressionSnappy:
+		return "snappy"
+	default:
+		return fmt.Sprintf("Compression(%d)", uint8(c))
+	}
+}
+
+// supportedCompression reports whether c is a codec transfers can use.
+func supportedCompression(c Compression) bool {
+	return c <= CompressionSnappy
+}
+
+// chooseCompression returns the first codec proposed by the sender that the receiver accepts,
+// CompressionNone if there is none.
+func chooseCompression(proposed, accepted []Compression) Compression {
+	for _, p := range proposed {
+		for _, a := range accepted {
+			if p == a && supportedCompression(p) {
+				return p
+			}
+		}
+	}
+	return CompressionNone
+}
+
+// codec compresses and decompresses the frames of a transfer, each on its own.
+type codec interface {
+	compress(dst, src []byte) ([]byte, error)
+	// decompress fails if src decompresses to more than MaxFrameSize bytes.
+	decompress(dst, src []byte) ([]byte, error)
+}
+
+// newCodec returns the codec of c, nil for CompressionNone.
+func newCodec(c Compression) (codec, error) {
+	switch c {
+	case CompressionNone:
+		return nil, nil
+	case CompressionGzip:
+		return &gzipCodec{}, nil
+	case CompressionZstd:
+		return zstdCodec{}, nil
+	case CompressionSnappy:
+		return snappyCodec{}, nil
+	default:
+		return nil, fmt.Errorf("unsupported compression %s", c)
+	}
+}
+
+// errFrameTooLarge is returned when a compressed frame decompresses to more than MaxFrameSize bytes.
+var errFrameTooLarge = fmt.Errorf("compressed frame is larger than %d bytes", MaxFrameSize)
+
+// gzipCodec compresses frames as gzip members.
+type gzipCodec struct {
+	w   *gzip.Writer
+	r   *gzip.Reader
+	buf bytes.Buffer
+}
+
+func (g *gzipCodec) compress(dst, src []byte) ([]byte, error) {
+	g.buf.Reset()
+	if g.w == nil {
+		g.w, _ = gzip.NewWriterLevel(&g.buf, gzip.BestSpeed)
+	} else {
+		g.w.Reset(&g.buf)
+	}
+	if _, err := g.w.Write(src); err != nil {
+		return nil, err
+	}
+	if err := g.w.Close(); err != nil {
+		return nil, err
+	}
+	return append(dst, g.buf.Bytes()...), nil
+}
+
+func (g *gzipCodec) decompress(dst, src []byte) ([]byte, error) {
+	var err error
+	if g.r == nil {
+		g.r, err = gzip.NewReader(bytes.NewReader(src))
+	} else {
+		err = g.r.Reset(bytes.NewReader(src))
+	}
+	if err != nil {
+		return nil, err
+	}
+	g.r.Multistream(false)
+	g.buf.Reset()
+	n, err := g.buf.ReadFrom(io.LimitReader(g.r, MaxFrameSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	return append(dst, g.buf.Bytes()...), nil
+}
+
+// zstd encoders and decoders are safe for concurrent use, every transfer shares the same ones.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec compresses frames as zstd frames.
+type zstdCodec struct{}
+
+// zstdCoders returns the shared zstd encoder and decoder.
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+		if zstdErr == nil {
+			zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MaxFrameSize))
+		}
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+func (zstdCodec) compress(dst, src []byte) ([]byte, error) {
+	enc, _, err := zstdCoders()
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(src, dst), nil
+}
+
+func (zstdCodec) decompress(dst, src []byte) ([]byte, error) {
+	_, dec, err := zstdCoders()
+	if err != nil {
+		return nil, err
+	}
+	out, err := dec.DecodeAll(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	if len(out)-len(dst) > MaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	return out, nil
+}
+
+// snappyCodec compresses frames as snappy blocks.
+type snappyCodec struct{}
+
+func (snappyCodec) compress(dst, src []byte) ([]byte, error) {
+	return append(dst, snappy.Encode(nil, src)...), nil
+}
+
+func (snappyCodec) decompress(dst, src []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	if n > MaxFrameSize {
+		return nil, errFrameTooLarge
+	}
+	out, err := snappy.Decode(nil, src)
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, out...), nil
+}
+
+// compressible reports whether the sample of some data shrinks enough when compressed for compressing
+// the data to be worth it. Already compressed data, like archives, images or video, does not.
+func compressible(sample []byte) bool {
+	if len(sample) == 0 {
+		return false
+	}
+	return float64(len(snappy.Encode(nil, sample))) < float64(len(sample))*sampleRatio
+}
+
+// sampleFile returns up to sampleSize bytes of file of the given size, taken from its start, middle and end.
+func sampleFile(file io.ReaderAt, size uint64) ([]byte, error) {
+	offsets, part := []uint64{0}, size
+	if size > sampleSize {
+		part = sampleSize / 3
+		offsets = []uint64{0, size/2 - part/2, size - part}
+	}
+	sample := make([]byte, 0, len(offsets)*int(part))
+	for _, off := range offsets {
+		buf := make([]byte, part)
+		n, err := file.ReadAt(buf, int64(off))
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		sample = append(sample, buf[:n]...)
+	}
+	return sample, nil
+}
+
+// codecsToPropose returns the codecs of cfg a sender proposes, leaving out CompressionNone.
+func codecsToPropose(cfg *config) []Compression {
+	var proposed []Compression
+	for _, c := range cfg.compression {
+		if c != CompressionNone {
+			proposed = append(proposed, c)
+		}
+	}
+	return proposed
+}
+
+// proposedCompression returns the codecs of cfg to propose for data whose sample is given, none if it does not compress.
+func proposedCompression(cfg *config, sample []byte) []Compression {
+	if !compressible(sample) {
+		return nil
+	}
+	return codecsToPropose(cfg)
+}
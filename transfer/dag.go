@@ -0,0 +1,674 @@
+package transfer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"io"
+	"os"
+	"p2p/blocks"
+	"p2p/blockstore"
+	"p2p/chunker"
+	"p2p/internal/wire"
+	"p2p/merkledag"
+	protocol "p2p/protocols"
+	"path/filepath"
+)
+
+// DAGProtocolID is the protocol negotiated on streams carrying a file as a Merkle DAG.
+const DAGProtocolID protocol.ID = "/p2p/transfer/dag/1.0.0"
+
+const (
+	// dagVersion is the version of the format of DAG headers.
+	dagVersion = 1
+	// maxWants bounds the blocks a receiver asks for at once.
+	maxWants = 256
+	// leafBatch is the number of leaves the receiver asks for at once, keeping at most that many in memory.
+	leafBatch = 32
+	// maxBlockSize bounds the blocks a receiver accepts.
+	maxBlockSize = chunker.MaxBlockSize + 64<<10
+)
+
+// DAGHeader describes the file sent as a Merkle DAG. It is sent first as a uint32 big endian length
+// followed by:
+//
+//	version  uint8
+//	name     uint16 length + UTF-8 bytes
+//	size     uint64
+//	mode     uint32 (os.FileMode permission bits)
+//	chunker  uint16 length + the chunker.FromString spec the file was split with
+//	root     uint16 length + CID of the root of the DAG
+//
+// The receiver answers with a status, then asks for the blocks it lacks: a uint32 count followed by as many
+// uint16 length prefixed CIDs, which the sender answers with the blocks in the same order, each a uint32
+// length followed by the data. A count of 0 ends the transfer, and the receiver sends a last status once
+// the file is stored.
+type DAGHeader struct {
+	Name    string
+	Size    uint64
+	Mode    uint32
+	Chunker string
+	Root    cid.Cid
+}
+
+// leafSpan is where a leaf lies in a file.
+type leafSpan struct {
+	offset int64
+	size   int
+}
+
+// fileDAG holds the DAG of a file: the leaves as spans of the file, read when they are needed, and the other
+// nodes in memory, less than a hundredth of the file.
+type fileDAG struct {
+	root   cid.Cid
+	leaves map[cid.Cid]leafSpan
+	nodes  map[cid.Cid][]byte
+	// order lists the leaves in the order of the file, a leaf found several times only once.
+	order []cid.Cid
+}
+
+// buildFileDAG splits the file into chunks as spec describes and builds its DAG.
+func buildFileDAG(file io.ReaderAt, size int64, spec string) (*fileDAG, error) {
+	spl, err := chunker.FromString(io.NewSectionReader(file, 0, size), spec)
+	if err != nil {
+		return nil, err
+	}
+	dag := &fileDAG{leaves: make(map[cid.Cid]leafSpan), nodes: make(map[cid.Cid][]byte)}
+	var offset int64
+	dag.root, err = merkledag.Build(spl, func(b *blocks.Block) error {
+		if b.Cid().Type() != cid.Raw {
+			dag.nodes[b.Cid()] = b.RawData()
+			return nil
+		}
+		if _, ok := dag.leaves[b.Cid()]; !ok {
+			dag.leaves[b.Cid()] = leafSpan{offset: offset, size: len(b.RawData())}
+			dag.order = append(dag.order, b.Cid())
+		}
+		offset += int64(len(b.RawData()))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if offset != size {
+		return nil, errors.New("file changed while it was being split")
+	}
+	return dag, nil
+}
+
+// readLeaf reads the leaf c from file, checking that the file still holds it.
+func (d *fileDAG) readLeaf(file io.ReaderAt, c cid.Cid) (*blocks.Block, error) {
+	s := d.leaves[c]
+	data := make([]byte, s.size)
+	if _, err := file.ReadAt(data, s.offset); err != nil && !(err == io.EOF && s.size == 0) {
+		return nil, fmt.Errorf("error reading file: %v", err)
+	}
+	b, err := blocks.NewBlockWithCid(data, c)
+	if err != nil {
+		return nil, errors.New("file changed while it was being sent")
+	}
+	return b, nil
+}
+
+// UploadDAG sends the file at inputPath as filename over conn as a Merkle DAG: the file is split into chunks
+// with the chunker set by WithChunker, each identified by its CID, and the receiver only asks for the chunks
+// it lacks. It returns once the receiver confirmed it stored the file, or with the error it reported.
+func UploadDAG(conn io.ReadWriter, filename, inputPath string, opts ...Option) error {
+	return UploadDAGContext(context.Background(), conn, filename, inputPath, opts...)
+}
+
+// UploadDAGContext is UploadDAG stopping the transfer once ctx is done, in which case it returns the error
+// of ctx. The progress of the chunks sent is reported to the function set by WithProgress.
+func UploadDAGContext(ctx context.Context, conn io.ReadWriter, filename, inputPath string, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	return wire.ContextError(ctx, uploadDAG(ctx, conn, filename, inputPath, cfg))
+}
+
+func uploadDAG(ctx context.Context, conn io.ReadWriter, filename, inputPath string, cfg *config) error {
+	file, err := os.Open(inputPath)
+	if err != nil {
+		return fmt.Errorf("error opening file: %v", err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error getting file info: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", inputPath)
+	}
+	dag, err := buildFileDAG(file, info.Size(), cfg.chunker)
+	if err != nil {
+		return err
+	}
+
+	header := DAGHeader{
+		Name:    filename,
+		Size:    uint64(info.Size()),
+		Mode:    uint32(info.Mode().Perm()),
+		Chunker: cfg.chunker,
+		Root:    dag.root,
+	}
+	sent, err := sendDAG(ctx, conn, header, func(c cid.Cid) ([]byte, bool, error) {
+		if data, ok := dag.nodes[c]; ok {
+			return data, false, nil
+		}
+		if _, ok := dag.leaves[c]; !ok {
+			return nil, false, fmt.Errorf("receiver asked for unknown block %s", c)
+		}
+		b, err := dag.readLeaf(file, c)
+		if err != nil {
+			return nil, false, err
+		}
+		return b.RawData(), true, nil
+	}, cfg)
+	if err != nil {
+		return err
+	}
+	cfg.logf("sent %s: %d of %d chunks, the receiver had the others", filename, sent, len(dag.order))
+	return nil
+}
+
+// UploadDAGFromStore sends the file whose DAG has root as filename over conn, reading its blocks from bs,
+// such as a blockstore holding content received earlier. The receiver splits its copy of the file with the
+// chunker set by WithChunker, which only finds the chunks it already has if it is the one the DAG was built
+// with.
+func UploadDAGFromStore(ctx context.Context, conn io.ReadWriter, filename string, root cid.Cid, bs merkledag.Getter, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+
+	b, err := bs.Get(ctx, root)
+	if err != nil {
+		return err
+	}
+	size, err := merkledag.FileSize(b)
+	if err != nil {
+		return err
+	}
+	header := DAGHeader{Name: filename, Size: size, Mode: 0644, Chunker: cfg.chunker, Root: root}
+	sent, err := sendDAG(ctx, conn, header, func(c cid.Cid) ([]byte, bool, error) {
+		b, err := bs.Get(ctx, c)
+		if err != nil {
+			return nil, false, err
+		}
+		return b.RawData(), c.Type() == cid.Raw, nil
+	}, cfg)
+	if err != nil {
+		return wire.ContextError(ctx, err)
+	}
+	cfg.logf("sent %s: %d chunks", filename, sent)
+	return nil
+}
+
+// sendDAG sends header over conn, then the blocks the receiver asks for, read with get which also tells
+// whether a block is a leaf. It returns the number of leaves sent once the receiver stored the file.
+func sendDAG(ctx context.Context, conn io.ReadWriter, header DAGHeader, get func(c cid.Cid) ([]byte, bool, error), cfg *config) (int, error) {
+	if err := writeDAGHeader(conn, header); err != nil {
+		return 0, err
+	}
+	if err := readStatus(conn); err != nil {
+		return 0, err
+	}
+
+	data := cfg.limit(ctx, conn)
+	prog := newTracker(header.Name, header.Size, 0, cfg.onProgress)
+	sent := 0
+	for {
+		wants, err := readWants(data)
+		if err != nil {
+			return sent, err
+		}
+		if len(wants) == 0 {
+			break
+		}
+		for _, c := range wants {
+			b, leaf, err := get(c)
+			if err != nil {
+				return sent, err
+			}
+			if leaf {
+				sent++
+				prog.add(uint64(len(b)))
+			}
+			if err := writeBlock(data, b); err != nil {
+				return sent, err
+			}
+		}
+	}
+	if err := readStatus(conn); err != nil {
+		return sent, err
+	}
+	prog.finish()
+	return sent, nil
+}
+
+// ReceiveDAG receives a file sent with UploadDAG over conn and stores it in the directory outputPath. If
+// outputPath already holds a file of the same name, such as an earlier version of the file, it is split the
+// same way and only the chunks it does not hold are asked for. The new file is written to a temporary file
+// and placed according to the policy set by WithConflictPolicy: ConflictOverwrite replaces the earlier
+// version. Every chunk is checked against its CID, and the file is offered to the policies and handler set
+// with WithOfferPolicy and WithOfferHandler before any chunk is sent. With WithBlockstore, the chunks are also
+// taken from the blockstore, and every block of the file is stored in it.
+func ReceiveDAG(conn io.ReadWriter, outputPath string, opts ...Option) error {
+	return ReceiveDAGContext(context.Background(), conn, outputPath, opts...)
+}
+
+// ReceiveDAGContext is ReceiveDAG stopping the transfer once ctx is done, in which case it returns the error
+// of ctx. The progress of the file is reported to the function set by WithProgress, the chunks found
+// locally counting as done.
+func ReceiveDAGContext(ctx context.Context, conn io.ReadWriter, outputPath string, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	return wire.ContextError(ctx, respond(conn, receiveDAG(ctx, conn, outputPath, cfg)))
+}
+
+func receiveDAG(ctx context.Context, conn io.ReadWriter, outputPath string, cfg *config) error {
+	header, err := readDAGHeader(conn)
+	if err != nil {
+		return err
+	}
+	if err := checkName(header.Name); err != nil {
+		return err
+	}
+	outputPath, err = decide(&Offer{
+		Peer:      remotePeer(conn),
+		Names:     []string{header.Name},
+		TotalSize: header.Size,
+		Dir:       outputPath,
+	}, cfg)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(outputPath, 0755); err != nil {
+		return fmt.Errorf("error creating output file directory: %v", err)
+	}
+	dest := filepath.Join(outputPath, header.Name)
+	if cfg.conflict == ConflictReject {
+		if _, err := os.Lstat(dest); err == nil {
+			return fmt.Errorf("%s: %w", header.Name, ErrFileExists)
+		}
+	}
+
+	// The earlier version of the file, if any, provides the chunks it shares with the new one.
+	local := &fileDAG{leaves: make(map[cid.Cid]leafSpan)}
+	var localFile *os.File
+	if info, err := os.Stat(dest); err == nil && info.Mode().IsRegular() {
+		if localFile, err = os.Open(dest); err == nil {
+			defer localFile.Close()
+			if dag, err := buildFileDAG(localFile, info.Size(), header.Chunker); err == nil {
+				local = dag
+			}
+		}
+	}
+	if err := writeStatus(conn, StatusOK, ""); err != nil {
+		return fmt.Errorf("error sending status: %v", err)
+	}
+
+	if cfg.pinner != nil {
+		// The blocks stored are kept from garbage collection until the root is pinned.
+		unlock := cfg.pinner.PinLock()
+		defer unlock()
+	}
+	tmp, written, reused, err := receiveLeaves(ctx, cfg.limit(ctx, conn), outputPath, header, local, localFile, cfg)
+	// The sender waits for wants until there are none, then for the status, even if the transfer failed.
+	if werr := writeWants(conn, nil); err == nil {
+		err = werr
+	}
+	if tmp != "" {
+		defer os.Remove(tmp)
+	}
+	if err != nil {
+		return err
+	}
+	if written != header.Size {
+		return fmt.Errorf("received %d bytes of a file of %d", written, header.Size)
+	}
+
+	mode := os.FileMode(header.Mode).Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	if err := os.Chmod(tmp, mode); err != nil {
+		return fmt.Errorf("error setting file mode: %v", err)
+	}
+	if cfg.pinner != nil {
+		if err := cfg.pinner.Pin(ctx, header.Root, true); err != nil {
+			return err
+		}
+	}
+	stored, err := placeFile(tmp, dest, cfg.conflict)
+	if err != nil {
+		return err
+	}
+	cfg.logf("stored %s, reusing %d of %d bytes", stored, reused, header.Size)
+	if cfg.onStored != nil {
+		cfg.onStored(stored)
+	}
+	return nil
+}
+
+// receiveLeaves writes the file whose DAG has the root of header to a temporary file in dir, returning its
+// path, the bytes written and how many of them came from the local file.
+func receiveLeaves(ctx context.Context, conn io.ReadWriter, dir string, header DAGHeader, local *fileDAG, localFile io.ReaderAt, cfg *config) (string, uint64, uint64, error) {
+	minChunk, err := chunker.MinSize(header.Chunker)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	links, err := merkledag.ResolveLeaves(ctx, header.Root, header.Size, uint64(minChunk), func(ctx context.Context, cids []cid.Cid) (map[cid.Cid]*blocks.Block, error) {
+		got := make(map[cid.Cid]*blocks.Block, len(cids))
+		for len(cids) > 0 {
+			batch := cids
+			if len(batch) > maxWants {
+				batch = batch[:maxWants]
+			}
+			cids = cids[len(batch):]
+			blks, err := fetchBlocks(ctx, conn, batch, cfg.blockstore)
+			if err != nil {
+				return nil, err
+			}
+			for _, b := range blks {
+				got[b.Cid()] = b
+			}
+		}
+		return got, nil
+	})
+	if err != nil {
+		return "", 0, 0, err
+	}
+	leaves := make([]cid.Cid, len(links))
+	for i, l := range links {
+		leaves[i] = l.Cid
+	}
+	tmp, err := os.CreateTemp(dir, "."+header.Name+".*.part")
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("error creating output file: %v", err)
+	}
+	written, reused, err := writeLeaves(ctx, conn, tmp, leaves, local, localFile, header, cfg)
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("error writing output file: %v", cerr)
+	}
+	return tmp.Name(), written, reused, err
+}
+
+// writeLeaves writes leaves to w in order, copying those found in the local file or in the blockstore of cfg
+// and asking for the others in batches. It returns the bytes written and how many of them were found locally.
+// Every leaf is put in the blockstore.
+func writeLeaves(ctx context.Context, conn io.ReadWriter, w io.Writer, leaves []cid.Cid, local *fileDAG, localFile io.ReaderAt, header DAGHeader, cfg *config) (uint64, uint64, error) {
+	prog := newTracker(header.Name, header.Size, 0, cfg.onProgress)
+	var written, reused uint64
+	for len(leaves) > 0 {
+		batch := leaves
+		if len(batch) > leafBatch {
+			batch = batch[:leafBatch]
+		}
+		leaves = leaves[len(batch):]
+
+		var wants []cid.Cid
+		have := make(map[cid.Cid]*blocks.Block, len(batch))
+		found := make(map[cid.Cid]bool)
+		for _, c := range batch {
+			if _, ok := have[c]; ok {
+				continue
+			}
+			have[c] = nil
+			if _, ok := local.leaves[c]; ok {
+				// A local file changed since it was split is read from the sender instead.
+				if b, err := local.readLeaf(localFile, c); err == nil {
+					have[c] = b
+					found[c] = true
+					if cfg.blockstore != nil {
+						if err := cfg.blockstore.Put(ctx, b); err != nil {
+							return written, reused, err
+						}
+					}
+					continue
+				}
+			}
+			if cfg.blockstore != nil {
+				if b, err := cfg.blockstore.Get(ctx, c); err == nil {
+					have[c] = b
+					found[c] = true
+					continue
+				}
+			}
+			wants = append(wants, c)
+		}
+		got, err := fetchBlocks(ctx, conn, wants, cfg.blockstore)
+		if err != nil {
+			return written, reused, err
+		}
+		for _, b := range got {
+			have[b.Cid()] = b
+		}
+
+		for _, c := range batch {
+			data := have[c].RawData()
+			if written+uint64(len(data)) > header.Size {
+				return written, reused, fmt.Errorf("received more than the %d bytes of the file", header.Size)
+			}
+			if _, err := w.Write(data); err != nil {
+				return written, reused, fmt.Errorf("error writing output file: %v", err)
+			}
+			written += uint64(len(data))
+			if found[c] {
+				reused += uint64(len(data))
+				prog.skip(uint64(len(data)))
+			} else {
+				prog.add(uint64(len(data)))
+			}
+		}
+	}
+	prog.finish()
+	return written, reused, nil
+}
+
+// fetchBlocks returns the blocks wants in the same order, read from store if it has them and asked from the
+// sender otherwise. The blocks received are checked against their CIDs and put in store.
+func fetchBlocks(ctx context.Context, conn io.ReadWriter, wants []cid.Cid, store blockstore.Blockstore) ([]*blocks.Block, error) {
+	got := make([]*blocks.Block, len(wants))
+	var missing []int
+	for i, c := range wants {
+		if store != nil {
+			if b, err := store.Get(ctx, c); err == nil {
+				got[i] = b
+				continue
+			}
+		}
+		missing = append(missing, i)
+	}
+	if len(missing) == 0 {
+		return got, nil
+	}
+
+	asked := make([]cid.Cid, len(missing))
+	for j, i := range missing {
+		asked[j] = wants[i]
+	}
+	if err := writeWants(conn, asked); err != nil {
+		return nil, err
+	}
+	for _, i := range missing {
+		data, err := readBlock(conn)
+		if err != nil {
+			return nil, err
+		}
+		if got[i], err = blocks.NewBlockWithCid(data, wants[i]); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+		}
+		if store != nil {
+			if err := store.Put(ctx, got[i]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return got, nil
+}
+
+// writeDAGHeader sends h on w.
+func writeDAGHeader(w io.Writer, h DAGHeader) error {
+	if len(h.Name) == 0 || len(h.Name) > 0xffff {
+		return fmt.Errorf("invalid file name length %d", len(h.Name))
+	}
+	if len(h.Chunker) > 0xffff {
+		return fmt.Errorf("invalid chunker length %d", len(h.Chunker))
+	}
+	root := h.Root.Bytes()
+	body := make([]byte, 0, 1+2+len(h.Name)+8+4+2+len(h.Chunker)+2+len(root))
+	body = append(body, dagVersion)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(h.Name)))
+	body = append(body, h.Name...)
+	body = binary.BigEndian.AppendUint64(body, h.Size)
+	body = binary.BigEndian.AppendUint32(body, h.Mode)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(h.Chunker)))
+	body = append(body, h.Chunker...)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(root)))
+	body = append(body, root...)
+
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(body)), uint32(len(body)))
+	if _, err := w.Write(append(buf, body...)); err != nil {
+		return fmt.Errorf("error sending header: %v", err)
+	}
+	return nil
+}
+
+// readDAGHeader receives a DAG header from r.
+func readDAGHeader(r io.Reader) (DAGHeader, error) {
+	var h DAGHeader
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return h, fmt.Errorf("error reading header length: %v", err)
+	}
+	if length > maxHeaderSize {
+		return h, fmt.Errorf("header of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return h, fmt.Errorf("error reading header: %v", err)
+	}
+
+	if len(body) < 1 || body[0] != dagVersion {
+		return h, errors.New("unsupported header version")
+	}
+	body = body[1:]
+	field := func() ([]byte, error) {
+		if len(body) < 2 || len(body) < 2+int(binary.BigEndian.Uint16(body)) {
+			return nil, errors.New("truncated header")
+		}
+		n := int(binary.BigEndian.Uint16(body))
+		b := body[2 : 2+n]
+		body = body[2+n:]
+		return b, nil
+	}
+	name, err := field()
+	if err != nil {
+		return h, err
+	}
+	h.Name = string(name)
+	if len(body) < 8+4 {
+		return h, errors.New("truncated header")
+	}
+	h.Size = binary.BigEndian.Uint64(body)
+	h.Mode = binary.BigEndian.Uint32(body[8:])
+	body = body[12:]
+	spec, err := field()
+	if err != nil {
+		return h, err
+	}
+	h.Chunker = string(spec)
+	if err := chunker.CheckSpec(h.Chunker); err != nil {
+		return h, err
+	}
+	root, err := field()
+	if err != nil {
+		return h, err
+	}
+	if h.Root, err = cid.Cast(root); err != nil {
+		return h, fmt.Errorf("invalid root: %v", err)
+	}
+	if t := h.Root.Type(); t != cid.Raw && t != cid.DagProtobuf {
+		return h, fmt.Errorf("root has unsupported codec %#x", t)
+	}
+	return h, nil
+}
+
+// writeWants asks for the blocks wants, none ending the transfer.
+func writeWants(w io.Writer, wants []cid.Cid) error {
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(wants)))
+	for _, c := range wants {
+		b := c.Bytes()
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(b)))
+		buf = append(buf, b...)
+	}
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("error sending wants: %v", err)
+	}
+	return nil
+}
+
+// readWants receives the CIDs of the blocks the receiver asks for.
+func readWants(r io.Reader) ([]cid.Cid, error) {
+	var count uint32
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("error reading wants: %v", err)
+	}
+	if count > maxWants {
+		return nil, fmt.Errorf("too many wants %d", count)
+	}
+	wants := make([]cid.Cid, count)
+	for i := range wants {
+		var length uint16
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("error reading wants: %v", err)
+		}
+		b := make([]byte, length)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("error reading wants: %v", err)
+		}
+		c, err := cid.Cast(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid want: %v", err)
+		}
+		wants[i] = c
+	}
+	return wants, nil
+}
+
+// writeBlock sends the data of a block: a uint32 length followed by the data.
+func writeBlock(w io.Writer, data []byte) error {
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	if _, err := w.Write(append(buf, data...)); err != nil {
+		return fmt.Errorf("error sending block: %v", err)
+	}
+	return nil
+}
+
+// readBlock receives the data of a block.
+func readBlock(r io.Reader) ([]byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("error reading block: %v", err)
+	}
+	if length > maxBlockSize {
+		return nil, fmt.Errorf("block of %d bytes is too large", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("error reading block: %v", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,486 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mh "github.com/multiformats/go-multihash"
+	"io"
+	"io/fs"
+	"os"
+	"p2p/internal/wire"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DirProtocolID is the protocol negotiated on streams carrying a directory transfer. Its files are sent as on
+// ProtocolID.
+const DirProtocolID protocol.ID = "/p2p/transfer/dir/1.0.0"
+
+// maxManifestSize bounds the manifest a receiver accepts.
+const maxManifestSize = 64 << 20
+
+// Types of the entries of a manifest.
+const (
+	EntryDir     = "dir"
+	EntryFile    = "file"
+	EntrySymlink = "symlink"
+)
+
+// ManifestEntry describes a file, directory or symbolic link of a directory transfer.
+type ManifestEntry struct {
+	// Path is the slash separated path of the entry relative to the root, "." for the root itself.
+	Path    string    `json:"path"`
+	Type    string    `json:"type"`
+	Size    uint64    `json:"size,omitempty"`
+	Mode    uint32    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	// Target is the target of a symbolic link, relative to the directory of the link.
+	Target string `json:"target,omitempty"`
+}
+
+// Manifest lists everything a directory transfer sends. It is sent before any file so that the receiver can
+// display the totals and reject the transfer up front.
+type Manifest struct {
+	// Root is the name of the directory sent, created in the output directory of the receiver.
+	Root       string          `json:"root"`
+	Entries    []ManifestEntry `json:"entries"`
+	TotalFiles int             `json:"total_files"`
+	TotalSize  uint64          `json:"total_size"`
+}
+
+// UploadDir sends the directory at inputPath with everything below it over conn. Relative paths, modes,
+// modification times and symbolic links are preserved. Symbolic links are sent as links and never followed,
+// the ones pointing outside the directory are skipped. Files are sent one after the other on conn, resuming
+// those the receiver kept part of from an interrupted transfer.
+func UploadDir(conn io.ReadWriter, inputPath string, opts ...Option) error {
+	return UploadDirContext(context.Background(), conn, inputPath, opts...)
+}
+
+// UploadDirContext is UploadDir stopping the transfer once ctx is done, in which case it returns the error
+// of ctx. The progress of the whole directory is reported to the function set by WithProgress.
+func UploadDirContext(ctx context.Context, conn io.ReadWriter, inputPath string, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	if err := attachService(conn); err != nil {
+		return err
+	}
+	defer protectPeer(conn, cfg)()
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	if err := uploadDir(ctx, conn, inputPath, cfg); err != nil {
+		return wire.ContextError(ctx, err)
+	}
+	return nil
+}
+
+// uploadDir sends the directory at inputPath over conn.
+func uploadDir(ctx context.Context, conn io.ReadWriter, inputPath string, cfg *config) error {
+	manifest, err := buildManifest(inputPath, func(p, reason string) {
+		cfg.logf("skipping %s which %s", p, reason)
+	})
+	if err != nil {
+		return err
+	}
+	cfg.logf("sending %s: %d files, %d bytes", manifest.Root, manifest.TotalFiles, manifest.TotalSize)
+
+	if err := writeManifest(conn, manifest); err != nil {
+		return err
+	}
+	if err := readStatus(conn); err != nil {
+		return err
+	}
+
+	prog := newTracker(manifest.Root, manifest.TotalSize, 0, cfg.onProgress)
+	for _, entry := range manifest.Entries {
+		if entry.Type != EntryFile {
+			continue
+		}
+		file, header, err := openUpload(entry.Path, filepath.Join(inputPath, filepath.FromSlash(entry.Path)), cfg)
+		if err != nil {
+			return err
+		}
+		if header.Size != entry.Size {
+			file.Close()
+			return fmt.Errorf("%s changed while it was being sent", entry.Path)
+		}
+		header.Offset, header.Length = 0, header.Size
+		err = sendRange(ctx, conn, file, header, defaultBlockSize, cfg, prog)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Path, err)
+		}
+	}
+
+	if err := readStatus(conn); err != nil {
+		return err
+	}
+	prog.finish()
+	return nil
+}
+
+// BuildManifest lists the directory at root. Entries other than directories, regular files and symbolic links
+// are skipped, as are symbolic links pointing outside root or through another link.
+func BuildManifest(root string) (*Manifest, error) {
+	return buildManifest(root, nil)
+}
+
+// buildManifest is BuildManifest telling skip, if not nil, about every entry it skips and why.
+func buildManifest(root string, skip func(p, reason string)) (*Manifest, error) {
+	root = filepath.Clean(root)
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory: %v", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	manifest := &Manifest{Root: filepath.Base(root)}
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := ManifestEntry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    uint32(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+		}
+		switch {
+		case info.IsDir():
+			entry.Type = EntryDir
+		case info.Mode().IsRegular():
+			entry.Type = EntryFile
+			entry.Size = uint64(info.Size())
+			manifest.TotalFiles++
+			manifest.TotalSize += entry.Size
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			if !SymlinkInRoot(entry.Path, filepath.ToSlash(target), linkIn(root)) {
+				if skip != nil {
+					skip(p, "links outside of "+root)
+				}
+				return nil
+			}
+			entry.Type = EntrySymlink
+			entry.Target = filepath.ToSlash(target)
+		default:
+			if skip != nil {
+				skip(p, "is not a regular file")
+			}
+			return nil
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory: %v", err)
+	}
+	return manifest, nil
+}
+
+// ReceiveDir receives a directory sent with UploadDir over conn and stores it in outputPath, under the name
+// of the directory sent. The manifest is checked before any file is received: the transfer is refused if an
+// entry would be stored outside the directory, if the check set by WithManifestCheck fails, or if the offer of
+// the directory is rejected by the policies and handler set with WithOfferPolicy and WithOfferHandler. If the directory
+// already exists, the policy set by WithConflictPolicy decides whether it is received under a new name, refused
+// or received into, replacing the files it has in common with the one sent. Symbolic links are created once
+// every file is stored, and directory modes and modification times are set last.
+func ReceiveDir(conn io.ReadWriter, outputPath string, opts ...Option) error {
+	return ReceiveDirContext(context.Background(), conn, outputPath, opts...)
+}
+
+// ReceiveDirContext is ReceiveDir stopping the transfer once ctx is done, in which case it returns the error
+// of ctx. The progress of the whole directory is reported to the function set by WithProgress.
+func ReceiveDirContext(ctx context.Context, conn io.ReadWriter, outputPath string, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	if err := attachService(conn); err != nil {
+		return err
+	}
+	defer protectPeer(conn, cfg)()
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	return wire.ContextError(ctx, receiveDir(ctx, conn, outputPath, cfg))
+}
+
+// receiveDir receives a directory over conn into outputPath.
+func receiveDir(ctx context.Context, conn io.ReadWriter, outputPath string, cfg *config) error {
+	manifest, err := readManifest(conn)
+	if err == nil {
+		err = validateManifest(manifest)
+	}
+	if err == nil && cfg.manifestCheck != nil {
+		err = cfg.manifestCheck(manifest)
+	}
+	if err == nil {
+		outputPath, err = decide(manifestOffer(manifest, remotePeer(conn), outputPath), cfg)
+	}
+	if err != nil {
+		return respond(conn, err)
+	}
+	cfg.logf("receiving %s: %d files, %d bytes", manifest.Root, manifest.TotalFiles, manifest.TotalSize)
+
+	if err := os.MkdirAll(outputPath, 0755); err != nil {
+		return respond(conn, fmt.Errorf("error creating output directory: %v", err))
+	}
+	root, err := resolveConflict(filepath.Join(outputPath, manifest.Root), cfg.conflict)
+	if err == nil {
+		err = ensureDir(outputPath, filepath.Base(root))
+	}
+	if err != nil {
+		return respond(conn, err)
+	}
+	if err := respond(conn, nil); err != nil {
+		return err
+	}
+
+	return respond(conn, receiveDirEntries(ctx, conn, root, manifest, cfg))
+}
+
+// receiveDirEntries receives the files of manifest over conn into root and creates its directories and links.
+// Entries replace what root already holds at their path, root being either new or chosen to be overwritten.
+// It stops at the first error, which the caller reports in place of the status of the file that failed.
+func receiveDirEntries(ctx context.Context, conn io.ReadWriter, root string, manifest *Manifest, cfg *config) error {
+	prog := newTracker(manifest.Root, manifest.TotalSize, 0, cfg.onProgress)
+	// Directories stay writable until every file is in place, their mode is set at the end.
+	for _, entry := range manifest.Entries {
+		if entry.Type == EntryDir {
+			if err := ensureDir(root, entry.Path); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entry := range manifest.Entries {
+		if entry.Type != EntryFile {
+			continue
+		}
+		header, err := readHeader(conn)
+		if err != nil {
+			return err
+		}
+		if header.Name != entry.Path || header.Size != entry.Size || header.Offset != 0 || header.Length != header.Size {
+			return fmt.Errorf("expected %s from the manifest, got %s", entry.Path, header.Name)
+		}
+		if err := ensureDir(root, path.Dir(entry.Path)); err != nil {
+			return err
+		}
+		dest := filepath.Join(root, filepath.FromSlash(entry.Path))
+		if _, err := receiveRange(ctx, conn, header, dest, ConflictOverwrite, cfg, prog); err != nil {
+			return err
+		}
+		if err := os.Chtimes(dest, entry.ModTime, entry.ModTime); err != nil {
+			return fmt.Errorf("error setting file time: %v", err)
+		}
+		// A failure is reported by the final status instead, which ends the transfer.
+		if err := respond(conn, nil); err != nil {
+			return err
+		}
+	}
+
+	// Links are created once every file is written, so that no file is ever written through a link.
+	for _, entry := range manifest.Entries {
+		if entry.Type != EntrySymlink {
+			continue
+		}
+		if err := ensureDir(root, path.Dir(entry.Path)); err != nil {
+			return err
+		}
+		// The links already in root, received or not, are checked as well as those of the manifest were.
+		if !SymlinkInRoot(entry.Path, entry.Target, linkIn(root)) {
+			return fmt.Errorf("link %q points outside of the directory", entry.Path)
+		}
+		dest := filepath.Join(root, filepath.FromSlash(entry.Path))
+		if info, err := os.Lstat(dest); err == nil {
+			if info.IsDir() {
+				return fmt.Errorf("%s exists and is a directory", dest)
+			}
+			if err := os.Remove(dest); err != nil {
+				return fmt.Errorf("error replacing link: %v", err)
+			}
+		}
+		if err := os.Symlink(filepath.FromSlash(entry.Target), dest); err != nil {
+			return fmt.Errorf("error creating link: %v", err)
+		}
+	}
+
+	// Deeper directories first, as setting the time of a directory must follow any change to its content.
+	var dirs []ManifestEntry
+	for _, entry := range manifest.Entries {
+		if entry.Type == EntryDir {
+			dirs = append(dirs, entry)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		return strings.Count(dirs[i].Path, "/") > strings.Count(dirs[j].Path, "/")
+	})
+	for _, entry := range dirs {
+		dest := filepath.Join(root, filepath.FromSlash(entry.Path))
+		if err := os.Chmod(dest, os.FileMode(entry.Mode).Perm()); err != nil {
+			return fmt.Errorf("error setting directory mode: %v", err)
+		}
+		if err := os.Chtimes(dest, entry.ModTime, entry.ModTime); err != nil {
+			return fmt.Errorf("error setting directory time: %v", err)
+		}
+	}
+	prog.finish()
+	return nil
+}
+
+// manifestOffer returns the offer of the directory described by manifest, sent by p, to be stored in dir.
+func manifestOffer(manifest *Manifest, p peer.ID, dir string) *Offer {
+	offer := &Offer{Peer: p, TotalSize: manifest.TotalSize, Manifest: manifest, Dir: dir}
+	for _, entry := range manifest.Entries {
+		if entry.Type == EntryFile {
+			offer.Names = append(offer.Names, path.Join(manifest.Root, entry.Path))
+		}
+	}
+	if data, err := json.Marshal(manifest); err == nil {
+		offer.Digest, _ = digest(bytes.NewReader(data), mh.SHA2_256)
+	}
+	return offer
+}
+
+// validateManifest checks that every entry of manifest stays inside the root and that its totals are right.
+func validateManifest(manifest *Manifest) error {
+	if err := checkName(manifest.Root); err != nil {
+		return err
+	}
+	links := make(map[string]bool)
+	for _, entry := range manifest.Entries {
+		if entry.Type == EntrySymlink {
+			links[entry.Path] = true
+		}
+	}
+	isLink := func(p string) bool { return links[p] }
+	seen := make(map[string]struct{}, len(manifest.Entries))
+	var files int
+	var size uint64
+	for _, entry := range manifest.Entries {
+		if err := checkRelPath(entry.Path); err != nil {
+			return err
+		}
+		if _, ok := seen[entry.Path]; ok {
+			return fmt.Errorf("duplicate path %q", entry.Path)
+		}
+		seen[entry.Path] = struct{}{}
+		switch entry.Type {
+		case EntryDir:
+		case EntryFile:
+			if entry.Path == "." {
+				return errors.New("the root is not a directory")
+			}
+			files++
+			size += entry.Size
+		case EntrySymlink:
+			if entry.Path == "." {
+				return errors.New("the root is not a directory")
+			}
+			if !SymlinkInRoot(entry.Path, entry.Target, isLink) {
+				return fmt.Errorf("link %q points outside of the directory", entry.Path)
+			}
+		default:
+			return fmt.Errorf("unknown type %q of %q", entry.Type, entry.Path)
+		}
+	}
+	if files != manifest.TotalFiles || size != manifest.TotalSize {
+		return errors.New("manifest totals do not match its entries")
+	}
+	return nil
+}
+
+// SymlinkInRoot reports whether a symbolic link to target at the slash separated path link, relative to a root,
+// points inside the root. Every element of target is resolved in turn, and isLink tells whether a path of the root
+// is a link: the target may end at a link, but may not go through one, as a link to "." followed by ".." would
+// leave the root.
+func SymlinkInRoot(link, target string, isLink func(p string) bool) bool {
+	if target == "" || path.IsAbs(target) || strings.ContainsAny(target, "\\\x00") {
+		return false
+	}
+	dir := path.Dir(link)
+	elems := strings.Split(target, "/")
+	for i, elem := range elems {
+		switch elem {
+		case "", ".":
+		case "..":
+			if dir == "." {
+				return false
+			}
+			dir = path.Dir(dir)
+		default:
+			dir = path.Join(dir, elem)
+			if i < len(elems)-1 && isLink(dir) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// linkIn returns a function telling whether the slash separated path p, relative to root, is a symbolic link.
+func linkIn(root string) func(p string) bool {
+	return func(p string) bool {
+		info, err := os.Lstat(filepath.Join(root, filepath.FromSlash(p)))
+		return err == nil && info.Mode()&fs.ModeSymlink != 0
+	}
+}
+
+// writeManifest sends manifest as a uint32 big endian length followed by its JSON encoding.
+func writeManifest(w io.Writer, manifest *Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	if len(data) > maxManifestSize {
+		return fmt.Errorf("manifest of %d bytes is too large", len(data))
+	}
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(data)), uint32(len(data)))
+	if _, err := w.Write(append(buf, data...)); err != nil {
+		return fmt.Errorf("error sending manifest: %v", err)
+	}
+	return nil
+}
+
+// readManifest receives a manifest from r.
+func readManifest(r io.Reader) (*Manifest, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("error reading manifest length: %v", err)
+	}
+	if length > maxManifestSize {
+		return nil, fmt.Errorf("manifest of %d bytes is too large", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("error reading manifest: %v", err)
+	}
+	var manifest Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("error decoding manifest: %v", err)
+	}
+	return &manifest, nil
+}
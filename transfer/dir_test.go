@@ -0,0 +1,183 @@
+package transfer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSymlinkInRoot(t *testing.T) {
+	tests := []struct {
+		link, target string
+		ok           bool
+	}{
+		{"a", "b", true},
+		{"a/b", "../c", true},
+		{"a/b", "c/../../d", true},
+		{"a", ".", true},
+		{"a", "..", false},
+		{"a", "../b", false},
+		{"a/b", "../../c", false},
+		{"a/b", "../c/../../d", false},
+		{"a", "/etc/passwd", false},
+		{"a", `..\b`, false},
+		{"a", "b\x00", false},
+		{"a", "", false},
+		{"m", "l", true},
+		{"m", "l/b", false},
+		{"m", "l/..", false},
+		{"a/m", "../l/../..", false},
+	}
+	isLink := func(p string) bool { return p == "l" }
+	for _, tt := range tests {
+		if got := SymlinkInRoot(tt.link, tt.target, isLink); got != tt.ok {
+			t.Errorf("SymlinkInRoot(%q, %q) = %v, want %v", tt.link, tt.target, got, tt.ok)
+		}
+	}
+}
+
+func TestValidateManifest(t *testing.T) {
+	tests := []struct {
+		name     string
+		manifest Manifest
+		ok       bool
+	}{
+		{"valid", Manifest{Root: "photos", TotalFiles: 1, TotalSize: 3, Entries: []ManifestEntry{
+			{Path: ".", Type: EntryDir},
+			{Path: "2023", Type: EntryDir},
+			{Path: "2023/a.jpg", Type: EntryFile, Size: 3},
+			{Path: "latest", Type: EntrySymlink, Target: "2023/a.jpg"},
+		}}, true},
+		{"traversal in root", Manifest{Root: "..", Entries: []ManifestEntry{{Path: ".", Type: EntryDir}}}, false},
+		{"separator in root", Manifest{Root: "a/b"}, false},
+		{"traversal in path", Manifest{Root: "photos", TotalFiles: 1, Entries: []ManifestEntry{
+			{Path: "../escape", Type: EntryFile},
+		}}, false},
+		{"nested traversal", Manifest{Root: "photos", TotalFiles: 1, Entries: []ManifestEntry{
+			{Path: "a/../../escape", Type: EntryFile},
+		}}, false},
+		{"absolute path", Manifest{Root: "photos", TotalFiles: 1, Entries: []ManifestEntry{
+			{Path: "/etc/passwd", Type: EntryFile},
+		}}, false},
+		{"link outside", Manifest{Root: "photos", Entries: []ManifestEntry{
+			{Path: "a/link", Type: EntrySymlink, Target: "../../secret"},
+		}}, false},
+		{"absolute link", Manifest{Root: "photos", Entries: []ManifestEntry{
+			{Path: "link", Type: EntrySymlink, Target: "/etc"},
+		}}, false},
+		{"chained links", Manifest{Root: "photos", Entries: []ManifestEntry{
+			{Path: "m", Type: EntrySymlink, Target: "l/.."},
+			{Path: "l", Type: EntrySymlink, Target: "."},
+		}}, false},
+		{"root link", Manifest{Root: "photos", Entries: []ManifestEntry{
+			{Path: ".", Type: EntrySymlink, Target: "a"},
+		}}, false},
+		{"root file", Manifest{Root: "photos", TotalFiles: 1, Entries: []ManifestEntry{
+			{Path: ".", Type: EntryFile},
+		}}, false},
+		{"duplicate", Manifest{Root: "photos", TotalFiles: 2, Entries: []ManifestEntry{
+			{Path: "a", Type: EntryFile},
+			{Path: "a", Type: EntryFile},
+		}}, false},
+		{"unknown type", Manifest{Root: "photos", Entries: []ManifestEntry{
+			{Path: "a", Type: "device"},
+		}}, false},
+		{"totals", Manifest{Root: "photos", TotalFiles: 1, TotalSize: 1, Entries: []ManifestEntry{
+			{Path: "a", Type: EntryFile, Size: 2},
+		}}, false},
+	}
+	for _, tt := range tests {
+		if err := validateManifest(&tt.manifest); (err == nil) != tt.ok {
+			t.Errorf("%s: validateManifest = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestBuildManifestSkipsLinksOutside(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("abc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("a.txt", filepath.Join(root, "inside")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+	if err := os.Symlink(t.TempDir(), filepath.Join(root, "outside")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("../escape", filepath.Join(root, "relative")); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := BuildManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateManifest(manifest); err != nil {
+		t.Fatalf("manifest of %s is invalid: %v", root, err)
+	}
+	found := make(map[string]string)
+	for _, entry := range manifest.Entries {
+		found[entry.Path] = entry.Type
+	}
+	want := map[string]string{".": EntryDir, "a.txt": EntryFile, "inside": EntrySymlink}
+	for p, typ := range want {
+		if found[p] != typ {
+			t.Errorf("entry %q is %q, want %q", p, found[p], typ)
+		}
+	}
+	for _, p := range []string{"outside", "relative"} {
+		if _, ok := found[p]; ok {
+			t.Errorf("link %q pointing outside was kept", p)
+		}
+	}
+}
+
+func TestBuildManifestSkipsChainedLinks(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink(".", filepath.Join(root, "l")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+	// Each link points inside the root on its own, but m goes through l to the parent of the root.
+	if err := os.Symlink("l/..", filepath.Join(root, "m")); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := BuildManifest(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := validateManifest(manifest); err != nil {
+		t.Fatalf("manifest of %s is invalid: %v", root, err)
+	}
+	for _, entry := range manifest.Entries {
+		if entry.Path == "m" {
+			t.Errorf("link through another link was kept")
+		}
+	}
+}
+
+func TestReceiveDirRefusesLinksThroughExistingLinks(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink(".", filepath.Join(root, "l")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+	cfg, err := newConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The manifest is valid on its own, but the root it is received into already holds a link l.
+	manifest := &Manifest{Root: "photos", Entries: []ManifestEntry{
+		{Path: ".", Type: EntryDir},
+		{Path: "m", Type: EntrySymlink, Target: "l/.."},
+	}}
+	if err := validateManifest(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := receiveDirEntries(context.Background(), nil, root, manifest, cfg); err == nil {
+		t.Error("a link going through a link of the directory was created")
+	}
+	if _, err := os.Lstat(filepath.Join(root, "m")); err == nil {
+		t.Error("link m exists")
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin
+
+package transfer
+
+import "errors"
+
+// diskFree is not supported on this platform, so that policies checking the free space reject every offer.
+func diskFree(dir string) (uint64, error) {
+	return 0, errors.New("free disk space is not available on this platform")
+}
@@ -0,0 +1,291 @@
+package transfer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"p2p/peer"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrRejected is returned when the receiver refuses an offer.
+var ErrRejected = errors.New("transfer rejected")
+
+// offerTTL is how long the decision taken on a file is reused for the other ranges of the same content.
+const offerTTL = 10 * time.Minute
+
+// Offer describes a transfer to the receiver before any data is sent.
+type Offer struct {
+	// Peer is the sender, empty if the stream does not tell.
+	Peer peer.ID
+	// Names holds the name of the file, or the paths of the files of a directory below its root.
+	Names []string
+	// TotalSize is the size of the file or of all the files of a directory.
+	TotalSize uint64
+	// Digest is the multihash of the file, or of the manifest of a directory.
+	Digest []byte
+	// Manifest is the manifest of a directory, nil for a file.
+	Manifest *Manifest
+	// Dir is the directory the transfer is stored in if it is accepted.
+	Dir string
+}
+
+// Decision is the answer of the receiver to an offer.
+type Decision struct {
+	Accept bool
+	// Dir replaces the output directory if set.
+	Dir string
+	// Reason is sent to the sender of a rejected offer.
+	Reason string
+}
+
+// Accept returns a decision accepting an offer into the output directory.
+func Accept() Decision {
+	return Decision{Accept: true}
+}
+
+// AcceptInto returns a decision accepting an offer into dir instead of the output directory.
+func AcceptInto(dir string) Decision {
+	return Decision{Accept: true, Dir: dir}
+}
+
+// Reject returns a decision refusing an offer, reason being sent to the sender.
+func Reject(reason string) Decision {
+	return Decision{Reason: reason}
+}
+
+// OfferHandler decides on an offer once every policy accepted it.
+type OfferHandler func(offer *Offer) Decision
+
+// OfferPolicy is a check run on every offer, which is rejected if it returns an error.
+type OfferPolicy func(offer *Offer) error
+
+// MaxSize returns a policy rejecting transfers larger than limit bytes, and those of unknown size.
+func MaxSize(limit uint64) OfferPolicy {
+	return func(offer *Offer) error {
+		if offer.TotalSize == UnknownSize {
+			return errors.New("size is unknown")
+		}
+		if offer.TotalSize > limit {
+			return fmt.Errorf("%d bytes is over the limit of %d bytes", offer.TotalSize, limit)
+		}
+		return nil
+	}
+}
+
+// AllowPeers returns a policy rejecting transfers from any peer but ids.
+func AllowPeers(ids ...peer.ID) OfferPolicy {
+	allowed := make(map[peer.ID]struct{}, len(ids))
+	for _, id := range ids {
+		allowed[id] = struct{}{}
+	}
+	return func(offer *Offer) error {
+		if _, ok := allowed[offer.Peer]; !ok || offer.Peer == "" {
+			return errors.New("peer is not allowed to send files")
+		}
+		return nil
+	}
+}
+
+// MinFreeSpace returns a policy rejecting transfers that would leave less than reserve bytes free on the
+// disk of the output directory. Transfers of unknown size are only rejected if less than reserve is free.
+func MinFreeSpace(reserve uint64) OfferPolicy {
+	return func(offer *Offer) error {
+		free, err := freeSpace(offer.Dir)
+		if err != nil {
+			return fmt.Errorf("error checking free disk space: %v", err)
+		}
+		size := offer.TotalSize
+		if size == UnknownSize {
+			size = 0
+		}
+		if free < reserve || free-reserve < size {
+			return fmt.Errorf("not enough disk space for %d bytes", size)
+		}
+		return nil
+	}
+}
+
+// freeSpace returns the space available in the directory dir, or in the closest of its parents that exists.
+func freeSpace(dir string) (uint64, error) {
+	for {
+		if _, err := os.Stat(dir); err == nil {
+			return diskFree(dir)
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return diskFree(dir)
+		}
+		dir = parent
+	}
+}
+
+// PromptOffer returns a handler asking about every offer on out and reading the answer from in:
+// y to accept, n to reject or the path of a directory to accept into. Offers are asked about one at a time.
+func PromptOffer(in io.Reader, out io.Writer) OfferHandler {
+	var mu sync.Mutex
+	reader := bufio.NewReader(in)
+	return func(offer *Offer) Decision {
+		mu.Lock()
+		defer mu.Unlock()
+
+		from := offer.Peer.String()
+		if offer.Peer == "" {
+			from = "an unknown peer"
+		}
+		if offer.Manifest != nil {
+			fmt.Fprintf(out, "%s offers the directory %s: %d files, %d bytes\n",
+				from, offer.Manifest.Root, offer.Manifest.TotalFiles, offer.TotalSize)
+		} else {
+			fmt.Fprintf(out, "%s offers %s: %d bytes\n", from, strings.Join(offer.Names, ", "), offer.TotalSize)
+		}
+		for {
+			fmt.Fprintf(out, "Accept into %s? [y]es, [n]o or another directory: ", offer.Dir)
+			line, err := reader.ReadString('\n')
+			answer := strings.TrimSpace(line)
+			switch {
+			case strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes"):
+				return Accept()
+			case strings.EqualFold(answer, "n") || strings.EqualFold(answer, "no"):
+				return Reject("declined by the receiver")
+			case answer != "":
+				if info, err := os.Stat(answer); err == nil && info.IsDir() {
+					return AcceptInto(answer)
+				}
+				fmt.Fprintf(out, "%s is not a directory\n", answer)
+			}
+			if err != nil {
+				return Reject("declined by the receiver")
+			}
+		}
+	}
+}
+
+// remotePeer returns the peer on the other end of conn if it is a stream that tells.
+func remotePeer(conn io.ReadWriter) peer.ID {
+	if s, ok := conn.(interface{ RemotePeer() peer.ID }); ok {
+		return s.RemotePeer()
+	}
+	return ""
+}
+
+// decide runs the policies of cfg on offer, then its handler, and returns the directory to store the
+// transfer in or an error wrapping ErrRejected.
+func decide(offer *Offer, cfg *config) (string, error) {
+	if err := checkPolicies(offer, cfg); err != nil {
+		return "", err
+	}
+	return askHandler(offer, cfg)
+}
+
+// checkPolicies runs the policies of cfg on offer, returning an error wrapping ErrRejected if one refuses it.
+func checkPolicies(offer *Offer, cfg *config) error {
+	for _, policy := range cfg.offerPolicies {
+		if err := policy(offer); err != nil {
+			return fmt.Errorf("%w: %v", ErrRejected, err)
+		}
+	}
+	return nil
+}
+
+// askHandler asks the handler of cfg about offer, and returns the directory to store the transfer in or an
+// error wrapping ErrRejected.
+func askHandler(offer *Offer, cfg *config) (string, error) {
+	decision := Accept()
+	if cfg.offerHandler != nil {
+		decision = cfg.offerHandler(offer)
+	}
+	if !decision.Accept {
+		if decision.Reason == "" {
+			return "", ErrRejected
+		}
+		return "", fmt.Errorf("%w: %s", ErrRejected, decision.Reason)
+	}
+	if decision.Dir != "" {
+		return decision.Dir, nil
+	}
+	return offer.Dir, nil
+}
+
+// decidedOffer is the answer of a handler on the content of a file, shared by the streams receiving its ranges.
+type decidedOffer struct {
+	done    chan struct{}
+	dir     string
+	err     error
+	expires time.Time
+}
+
+// offerDecisions holds the offers of files a handler accepted, by sender, output directory and content, so that
+// it is asked once for all the ranges of a file. It belongs to the option setting the handler: receivers given
+// another handler ask it again.
+type offerDecisions struct {
+	mu        sync.Mutex
+	decisions map[string]*decidedOffer
+}
+
+// newOfferDecisions returns an empty set of decisions.
+func newOfferDecisions() *offerDecisions {
+	return &offerDecisions{decisions: make(map[string]*decidedOffer)}
+}
+
+// decideFile decides on the offer of a single file. The policies are checked on every range, while the handler
+// is asked once for all the streams receiving ranges of the same content from the same peer, and its acceptance
+// reused while ranges keep arriving. A rejection is only shared with the ranges waiting for it, the next range
+// asks again.
+func decideFile(offer *Offer, cfg *config) (string, error) {
+	if err := checkPolicies(offer, cfg); err != nil {
+		return "", err
+	}
+	if cfg.offerHandler == nil || cfg.offerDecisions == nil {
+		return askHandler(offer, cfg)
+	}
+	return cfg.offerDecisions.decide(offer, cfg)
+}
+
+// decide returns the answer of the handler of cfg on offer, asking it unless it already accepted the same file.
+func (o *offerDecisions) decide(offer *Offer, cfg *config) (string, error) {
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%d\x00%x", offer.Peer, offer.Dir, offer.Names[0], offer.TotalSize, offer.Digest)
+
+	o.mu.Lock()
+	now := time.Now()
+	for k, d := range o.decisions {
+		if d.expires.Before(now) && isClosed(d.done) {
+			delete(o.decisions, k)
+		}
+	}
+	d, ok := o.decisions[key]
+	if !ok {
+		d = &decidedOffer{done: make(chan struct{})}
+		o.decisions[key] = d
+	}
+	d.expires = now.Add(offerTTL)
+	o.mu.Unlock()
+
+	if ok {
+		<-d.done
+		return d.dir, d.err
+	}
+	d.dir, d.err = askHandler(offer, cfg)
+	if d.err != nil {
+		o.mu.Lock()
+		delete(o.decisions, key)
+		o.mu.Unlock()
+	}
+	close(d.done)
+	return d.dir, d.err
+}
+
+// isClosed reports whether the channel c is closed.
+func isClosed(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
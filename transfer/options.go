@@ -0,0 +1,248 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	mh "github.com/multiformats/go-multihash"
+	"io"
+	"p2p/blockstore"
+	"p2p/chunker"
+	"p2p/connmgr"
+	"p2p/ratelimit"
+)
+
+const (
+	// defaultBlockSize is the size of the frames of parallel transfers.
+	defaultBlockSize = 64 << 10
+	// defaultChunkSize is the default size of the ranges of parallel transfers.
+	defaultChunkSize = 8 << 20
+	// defaultParallelism is the default number of ranges sent at once by parallel transfers.
+	defaultParallelism = 4
+	// defaultChunker splits the files of DAG transfers at boundaries found in their content.
+	defaultChunker = "rabin"
+)
+
+// config holds the settings of a transfer.
+type config struct {
+	checksum       uint64
+	chunkSize      int
+	parallelism    int
+	onStored       func(path string)
+	manifestCheck  func(m *Manifest) error
+	conflict       ConflictPolicy
+	offerPolicies  []OfferPolicy
+	offerHandler   OfferHandler
+	offerDecisions *offerDecisions
+	onProgress     func(p Progress)
+	logger         func(format string, args ...interface{})
+	compression    []Compression
+	limiter        *ratelimit.Limiter
+	chunker        string
+	blockstore     blockstore.Blockstore
+	pinner         *blockstore.Pinner
+	connManager    connmgr.ConnManager
+}
+
+// Option configures a transfer.
+type Option func(cfg *config) error
+
+// newConfig returns the default settings overridden by opts.
+func newConfig(opts []Option) (*config, error) {
+	cfg := &config{
+		checksum:    mh.SHA2_256,
+		chunkSize:   defaultChunkSize,
+		parallelism: defaultParallelism,
+		compression: defaultCompression,
+		chunker:     defaultChunker,
+	}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// limit returns conn with its reads and writes paced by the limiter of cfg until ctx is done, or conn itself
+// if there is none. The optional interfaces of conn are not kept, it only carries the data of a transfer.
+func (cfg *config) limit(ctx context.Context, conn io.ReadWriter) io.ReadWriter {
+	if cfg.limiter == nil {
+		return conn
+	}
+	return struct {
+		io.Reader
+		io.Writer
+	}{ratelimit.NewReader(ctx, conn, cfg.limiter), ratelimit.NewWriter(ctx, conn, cfg.limiter)}
+}
+
+// logf reports an event of the transfer to the logger set by WithLogger, if any.
+func (cfg *config) logf(format string, args ...interface{}) {
+	if cfg.logger != nil {
+		cfg.logger(format, args...)
+	}
+}
+
+// WithLogger sets a function the transfer reports what it does to, such as resuming a file, skipping entries of a
+// directory or dropping a peer of a swarm download. Nothing is reported by default.
+func WithLogger(logf func(format string, args ...interface{})) Option {
+	return func(cfg *config) error {
+		cfg.logger = logf
+		return nil
+	}
+}
+
+// WithChecksum sets the multihash function the sender digests the file with, mh.SHA2_256
+// (the default) or mh.BLAKE3.
+func WithChecksum(code uint64) Option {
+	return func(cfg *config) error {
+		if !supportedChecksum(code) {
+			return fmt.Errorf("unsupported checksum %s", mh.Codes[code])
+		}
+		cfg.checksum = code
+		return nil
+	}
+}
+
+// WithChunkSize sets the size of the ranges a parallel transfer splits the file into, 8 MiB by default.
+func WithChunkSize(size int) Option {
+	return func(cfg *config) error {
+		if size <= 0 {
+			return errors.New("chunk size must be positive")
+		}
+		cfg.chunkSize = size
+		return nil
+	}
+}
+
+// WithParallelism sets the number of ranges a parallel transfer sends at once, each on its own stream, 4 by default.
+func WithParallelism(n int) Option {
+	return func(cfg *config) error {
+		if n <= 0 {
+			return errors.New("parallelism must be positive")
+		}
+		cfg.parallelism = n
+		return nil
+	}
+}
+
+// WithStoredCallback sets a function the receiver calls with the path of every file it stored. Since the
+// ranges of a file may arrive on several streams, it is called by the one receiving the last range.
+func WithStoredCallback(fn func(path string)) Option {
+	return func(cfg *config) error {
+		cfg.onStored = fn
+		return nil
+	}
+}
+
+// WithManifestCheck sets a function the receiver of a directory calls with its manifest before any file is
+// sent, refusing the transfer if it returns an error.
+func WithManifestCheck(check func(m *Manifest) error) Option {
+	return func(cfg *config) error {
+		cfg.manifestCheck = check
+		return nil
+	}
+}
+
+// WithConflictPolicy sets what the receiver does when a file or directory it receives already exists,
+// ConflictRename by default.
+func WithConflictPolicy(policy ConflictPolicy) Option {
+	return func(cfg *config) error {
+		switch policy {
+		case ConflictRename, ConflictReject, ConflictOverwrite:
+		default:
+			return fmt.Errorf("unknown conflict policy %s", policy)
+		}
+		cfg.conflict = policy
+		return nil
+	}
+}
+
+// WithOfferPolicy adds policies the receiver checks every offer against, before asking the handler set by
+// WithOfferHandler. The offer is rejected as soon as one of them returns an error.
+func WithOfferPolicy(policies ...OfferPolicy) Option {
+	return func(cfg *config) error {
+		cfg.offerPolicies = append(cfg.offerPolicies, policies...)
+		return nil
+	}
+}
+
+// WithOfferHandler sets the function the receiver asks whether to accept an offer, once it passed every policy.
+// Offers are accepted into the output directory by default. The receivers given the same option ask handler once
+// for all the ranges of a file sent over several streams, as long as it accepts.
+func WithOfferHandler(handler OfferHandler) Option {
+	decisions := newOfferDecisions()
+	return func(cfg *config) error {
+		cfg.offerHandler = handler
+		cfg.offerDecisions = decisions
+		return nil
+	}
+}
+
+// WithProgress sets a function called with the progress of the transfer as data is sent or received,
+// at most every 200ms and once the transfer is complete. NewProgressBar returns one drawing a progress bar.
+func WithProgress(fn func(p Progress)) Option {
+	return func(cfg *config) error {
+		cfg.onProgress = fn
+		return nil
+	}
+}
+
+// WithCompression sets the codecs a sender proposes to compress the data with, in order of preference, and
+// the codecs a receiver accepts. Zstandard, Snappy and gzip are used by default, and CompressionNone alone
+// disables compression.
+func WithCompression(codecs ...Compression) Option {
+	return func(cfg *config) error {
+		for _, c := range codecs {
+			if !supportedCompression(c) {
+				return fmt.Errorf("unsupported compression %s", c)
+			}
+		}
+		cfg.compression = codecs
+		return nil
+	}
+}
+
+// WithRateLimiter paces the data of the transfer with limiter, both when sending and receiving. A limiter
+// shared by several transfers caps them together, and its rate can be changed while they run. Streams of a
+// host created with host.WithRateLimiter are paced by its limits as well.
+func WithRateLimiter(limiter *ratelimit.Limiter) Option {
+	return func(cfg *config) error {
+		cfg.limiter = limiter
+		return nil
+	}
+}
+
+// WithChunker sets how UploadDAG splits the file into chunks, a chunker.FromString spec: "rabin" (the default)
+// cuts at boundaries found in the content, so that an edit only changes the chunks around it, and
+// "size-262144" in chunks of a fixed size. DownloadSwarm refuses the files split in smaller chunks than it cuts.
+func WithChunker(spec string) Option {
+	return func(cfg *config) error {
+		if err := chunker.CheckSpec(spec); err != nil {
+			return err
+		}
+		cfg.chunker = spec
+		return nil
+	}
+}
+
+// WithBlockstore makes the receiver of a DAG transfer put every block of the file in bs, so that it can serve
+// the file again with UploadDAGFromStore, and take the chunks bs already has from it. If pins is not nil, the
+// root of the file is pinned recursively in it once the file is stored.
+func WithBlockstore(bs blockstore.Blockstore, pins *blockstore.Pinner) Option {
+	return func(cfg *config) error {
+		cfg.blockstore = bs
+		cfg.pinner = pins
+		return nil
+	}
+}
+
+// WithConnManager tags the peer of the transfer with "active-transfer" in cm and protects it while the transfer
+// runs, so that cm does not close its connection to make room for others. Usually the connection manager of the
+// host, host.ConnManager().
+func WithConnManager(cm connmgr.ConnManager) Option {
+	return func(cfg *config) error {
+		cfg.connManager = cm
+		return nil
+	}
+}
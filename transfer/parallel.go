@@ -0,0 +1,110 @@
+package transfer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"p2p/internal/wire"
+	"sync"
+)
+
+// StreamOpener opens a new stream to the receiver of a parallel transfer, negotiating ProtocolID.
+type StreamOpener func(ctx context.Context) (io.ReadWriteCloser, error)
+
+// UploadFileParallel sends the file at inputPath as filename in ranges of the chunk size set by
+// WithChunkSize, each on its own stream opened with open. Up to the parallelism set by WithParallelism
+// ranges are sent at once. The receiver writes every range at its offset and stores the file once the
+// last range arrived, so ranges already received by an interrupted transfer are not sent again. Every stream
+// is interrupted once ctx is done, and the progress of the whole file is reported to the function set by
+// WithProgress.
+func UploadFileParallel(ctx context.Context, open StreamOpener, filename, inputPath string, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	file, header, err := openUpload(filename, inputPath, cfg)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	sendCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	prog := newTracker(filename, header.Size, 0, cfg.onProgress)
+	ranges := make(chan Header)
+	go func() {
+		defer close(ranges)
+		// An empty file is still sent as one empty range so that the receiver creates it.
+		for offset := uint64(0); offset < header.Size || offset == 0; offset += uint64(cfg.chunkSize) {
+			r := header
+			r.Offset = offset
+			r.Length = header.Size - offset
+			if r.Length > uint64(cfg.chunkSize) {
+				r.Length = uint64(cfg.chunkSize)
+			}
+			select {
+			case ranges <- r:
+			case <-sendCtx.Done():
+				return
+			}
+			if header.Size == 0 {
+				return
+			}
+		}
+	}()
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	for i := 0; i < cfg.parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range ranges {
+				if err := sendRangeOnStream(sendCtx, open, file, r, cfg, prog); err != nil {
+					fail(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// sendCtx is also canceled by the first failure, only ctx tells whether the caller stopped the transfer.
+	if firstErr != nil {
+		return wire.ContextError(ctx, firstErr)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	prog.finish()
+	return nil
+}
+
+// sendRangeOnStream sends the range of file described by r on a new stream.
+func sendRangeOnStream(ctx context.Context, open StreamOpener, file io.ReaderAt, r Header, cfg *config, prog *tracker) error {
+	s, err := open(ctx)
+	if err != nil {
+		return fmt.Errorf("error opening stream: %v", err)
+	}
+	defer s.Close()
+	if err := attachService(s); err != nil {
+		return err
+	}
+	defer protectPeer(s, cfg)()
+	stop := wire.WatchContext(ctx, s)
+	defer stop()
+	if err := sendRange(ctx, s, file, r, defaultBlockSize, cfg, prog); err != nil {
+		return fmt.Errorf("range %d+%d: %w", r.Offset, r.Length, err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progressInterval is the least time between two progress reports of a transfer.
+const progressInterval = 200 * time.Millisecond
+
+// Progress describes how far a transfer went.
+type Progress struct {
+	// Name is the name of the file, or of the root of a directory.
+	Name string
+	// Done counts the bytes of the transfer already sent or received, including those kept from an interrupted transfer.
+	Done uint64
+	// Total is the size of the transfer, UnknownSize until the end of data of unknown size.
+	Total uint64
+	// Rate is the throughput of the transfer so far in bytes per second.
+	Rate float64
+	// ETA is the time left at the current throughput, 0 if it is not known yet.
+	ETA time.Duration
+}
+
+// Complete reports whether every byte of the transfer is done.
+func (p Progress) Complete() bool {
+	return p.Done >= p.Total
+}
+
+// tracker counts the bytes of a transfer, possibly over several streams, and reports its progress.
+// A nil tracker counts nothing.
+type tracker struct {
+	name  string
+	total uint64
+	fn    func(Progress)
+	start time.Time
+
+	mu          sync.Mutex
+	done        uint64
+	transferred uint64
+	last        time.Time
+	reported    bool
+}
+
+// newTracker returns a tracker reporting to fn, starting at done bytes out of total, or nil if fn is nil.
+func newTracker(name string, total, done uint64, fn func(Progress)) *tracker {
+	if fn == nil {
+		return nil
+	}
+	return &tracker{name: name, total: total, done: done, fn: fn, start: time.Now()}
+}
+
+// skip counts n bytes the transfer does not need to send, as they were received by an interrupted transfer.
+func (t *tracker) skip(n uint64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done += n
+}
+
+// add counts n bytes sent or received, reporting the progress at most every progressInterval and when complete.
+func (t *tracker) add(n uint64) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.done += n
+	t.transferred += n
+	now := time.Now()
+	if now.Sub(t.last) < progressInterval && t.done < t.total {
+		return
+	}
+	t.last = now
+	t.reported = t.done >= t.total
+	t.fn(t.progress(now))
+}
+
+// finish reports the final progress of the transfer, unless it was already reported as complete.
+func (t *tracker) finish() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.reported {
+		return
+	}
+	t.reported = true
+	if t.total == UnknownSize {
+		t.total = t.done
+	}
+	t.fn(t.progress(time.Now()))
+}
+
+// progress returns the progress at the time now. t.mu must be held.
+func (t *tracker) progress(now time.Time) Progress {
+	p := Progress{Name: t.name, Done: t.done, Total: t.total}
+	if elapsed := now.Sub(t.start).Seconds(); elapsed > 0 {
+		p.Rate = float64(t.transferred) / elapsed
+	}
+	if p.Rate > 0 && t.done < t.total && t.total != UnknownSize {
+		p.ETA = time.Duration(float64(t.total-t.done) / p.Rate * float64(time.Second))
+	}
+	return p
+}
+
+// NewProgressBar returns a progress function drawing a progress bar on a single line of the terminal w,
+// moving to the next line once the transfer is complete.
+func NewProgressBar(w io.Writer) func(Progress) {
+	const width = 30
+	var mu sync.Mutex
+	return func(p Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		if p.Total == UnknownSize {
+			fmt.Fprintf(w, "\r%s %s %s/s  ", p.Name, formatBytes(float64(p.Done)), formatBytes(p.Rate))
+			return
+		}
+		ratio := 1.0
+		if p.Total > 0 {
+			ratio = float64(p.Done) / float64(p.Total)
+		}
+		filled := int(ratio * width)
+		bar := strings.Repeat("=", filled) + strings.Repeat(" ", width-filled)
+		eta := "--"
+		if p.ETA > 0 {
+			eta = p.ETA.Round(time.Second).String()
+		}
+		fmt.Fprintf(w, "\r%s [%s] %3.0f%% %s/%s %s/s ETA %s  ",
+			p.Name, bar, ratio*100, formatBytes(float64(p.Done)), formatBytes(float64(p.Total)), formatBytes(p.Rate), eta)
+		if p.Complete() {
+			fmt.Fprintln(w)
+		}
+	}
+}
+
+// formatBytes returns n bytes in a human readable unit.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
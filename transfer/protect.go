@@ -0,0 +1,59 @@
+package transfer
+
+import (
+	"io"
+	"p2p/connmgr"
+	"p2p/peer"
+	"sync"
+)
+
+const (
+	// activeTransferTag is the tag of the connection manager on the peers a transfer is running with.
+	activeTransferTag = "active-transfer"
+	// activeTransferValue is the value of activeTransferTag.
+	activeTransferValue = 100
+)
+
+// activePeer is a peer transfers are running with, tagged in a connection manager.
+type activePeer struct {
+	cm connmgr.ConnManager
+	p  peer.ID
+}
+
+// active counts the transfers running with every tagged peer, which keeps its tag until the last one is done.
+var active = struct {
+	sync.Mutex
+	transfers map[activePeer]int
+}{transfers: make(map[activePeer]int)}
+
+// protectPeer tags and protects the peer on the other end of conn in the connection manager of cfg for the
+// duration of a transfer, and returns the function removing the tag once the transfer is done. Nothing is done
+// without a connection manager, or if conn does not tell its peer.
+func protectPeer(conn io.ReadWriter, cfg *config) func() {
+	p := remotePeer(conn)
+	if cfg.connManager == nil || p == "" {
+		return func() {}
+	}
+	key := activePeer{cm: cfg.connManager, p: p}
+	active.Lock()
+	if active.transfers[key] == 0 {
+		key.cm.TagPeer(p, activeTransferTag, activeTransferValue)
+		key.cm.Protect(p, activeTransferTag)
+	}
+	active.transfers[key]++
+	active.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			active.Lock()
+			defer active.Unlock()
+			if active.transfers[key]--; active.transfers[key] > 0 {
+				return
+			}
+			delete(active.transfers, key)
+			key.cm.Unprotect(p, activeTransferTag)
+			key.cm.UntagPeer(p, activeTransferTag)
+		})
+	}
+}
@@ -0,0 +1,275 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	protocol "p2p/protocols"
+)
+
+// ProtocolID is the protocol negotiated on streams carrying a file transfer.
+const ProtocolID protocol.ID = "/p2p/transfer/1.0.0"
+
+// version is the version of the header format, written first in every header. A receiver refuses the headers
+// of any other version.
+const version = 1
+
+// UnknownSize is the size of data whose length is not known before it is sent. Its digest is then sent
+// after the data, in a trailer.
+const UnknownSize = ^uint64(0)
+
+const (
+	// MaxFrameSize is the largest payload a single frame may carry, before and after decompression.
+	MaxFrameSize = 1 << 20
+	// compressedFrame is the bit of the size of a frame set if its payload is compressed.
+	compressedFrame = 1 << 31
+	// maxHeaderSize bounds the header a receiver accepts.
+	maxHeaderSize = 64 << 10
+)
+
+// Status codes sent by the receiver when it answers a header and once a transfer is over.
+const (
+	StatusOK               uint8 = 0
+	StatusError            uint8 = 1
+	StatusChecksumMismatch uint8 = 2
+	StatusRejected         uint8 = 3
+)
+
+// Header describes the file sent on a transfer stream. It is sent before the data frames as a
+// uint32 big endian length followed by:
+//
+//	version  uint8
+//	name     uint16 length + UTF-8 bytes
+//	size     uint64 (UnknownSize if not known)
+//	mode     uint32 (os.FileMode permission bits)
+//	checksum uint64 (multihash code of the digest)
+//	digest   uint16 length + multihash of the file, empty if it is sent in the trailer
+//	offset   uint64 (start of the range of the file sent on the stream)
+//	length   uint64 (length of the range, UnknownSize if the size is)
+//	codecs   uint8 count + uint8 Compression each (the codecs the sender proposes, in order of preference)
+type Header struct {
+	Name     string
+	Size     uint64
+	Mode     uint32
+	Checksum uint64
+	Digest   []byte
+	Offset   uint64
+	Length   uint64
+	Codecs   []Compression
+}
+
+// Packet represents a frame of the data of a file: a uint32 big endian size followed by exactly Size bytes.
+// The top bit of the size is set if the data is compressed with the codec chosen by the receiver.
+// A frame of size 0 ends the data.
+type Packet struct {
+	Size       int32
+	Data       []byte
+	Compressed bool
+}
+
+// writeHeader sends h on w.
+func writeHeader(w io.Writer, h Header) error {
+	if len(h.Name) == 0 || len(h.Name) > 0xffff {
+		return fmt.Errorf("invalid file name length %d", len(h.Name))
+	}
+	if len(h.Digest) > 0xffff {
+		return fmt.Errorf("invalid digest length %d", len(h.Digest))
+	}
+	if len(h.Codecs) > maxCodecs {
+		return fmt.Errorf("too many codecs %d", len(h.Codecs))
+	}
+	if err := checkRange(h); err != nil {
+		return err
+	}
+	body := make([]byte, 0, 1+2+len(h.Name)+8+4+8+2+len(h.Digest)+8+8+1+len(h.Codecs))
+	body = append(body, version)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(h.Name)))
+	body = append(body, h.Name...)
+	body = binary.BigEndian.AppendUint64(body, h.Size)
+	body = binary.BigEndian.AppendUint32(body, h.Mode)
+	body = binary.BigEndian.AppendUint64(body, h.Checksum)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(h.Digest)))
+	body = append(body, h.Digest...)
+	body = binary.BigEndian.AppendUint64(body, h.Offset)
+	body = binary.BigEndian.AppendUint64(body, h.Length)
+	body = append(body, uint8(len(h.Codecs)))
+	for _, c := range h.Codecs {
+		body = append(body, uint8(c))
+	}
+
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, 4+len(body)), uint32(len(body)))
+	if _, err := w.Write(append(buf, body...)); err != nil {
+		return fmt.Errorf("error sending header: %v", err)
+	}
+	return nil
+}
+
+// readHeader receives a header from r.
+func readHeader(r io.Reader) (Header, error) {
+	var h Header
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return h, fmt.Errorf("error reading header length: %v", err)
+	}
+	if length > maxHeaderSize {
+		return h, fmt.Errorf("header of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return h, fmt.Errorf("error reading header: %v", err)
+	}
+
+	if len(body) < 1 {
+		return h, errors.New("truncated header")
+	}
+	if body[0] != version {
+		return h, fmt.Errorf("unsupported header version %d, expected %d", body[0], version)
+	}
+	body = body[1:]
+	if len(body) < 2 {
+		return h, errors.New("truncated header")
+	}
+	nameLen := int(binary.BigEndian.Uint16(body))
+	body = body[2:]
+	if len(body) < nameLen+8+4+8+2 {
+		return h, errors.New("truncated header")
+	}
+	h.Name = string(body[:nameLen])
+	body = body[nameLen:]
+	h.Size = binary.BigEndian.Uint64(body)
+	h.Mode = binary.BigEndian.Uint32(body[8:])
+	h.Checksum = binary.BigEndian.Uint64(body[12:])
+	digestLen := int(binary.BigEndian.Uint16(body[20:]))
+	body = body[22:]
+	if len(body) < digestLen+8+8+1 {
+		return h, errors.New("truncated header")
+	}
+	h.Digest = append([]byte(nil), body[:digestLen]...)
+	body = body[digestLen:]
+	h.Offset = binary.BigEndian.Uint64(body)
+	h.Length = binary.BigEndian.Uint64(body[8:])
+	codecs := int(body[16])
+	body = body[17:]
+	if codecs > maxCodecs || len(body) < codecs {
+		return h, errors.New("invalid codecs")
+	}
+	for _, c := range body[:codecs] {
+		h.Codecs = append(h.Codecs, Compression(c))
+	}
+	return h, checkRange(h)
+}
+
+// checkRange checks that the range of h lies within the file. Data of unknown size is always sent whole.
+func checkRange(h Header) error {
+	if h.Size == UnknownSize {
+		if h.Offset != 0 || h.Length != UnknownSize {
+			return errors.New("a range of data of unknown size")
+		}
+		return nil
+	}
+	if h.Offset > h.Size || h.Length > h.Size-h.Offset {
+		return fmt.Errorf("invalid range %d+%d of a file of %d bytes", h.Offset, h.Length, h.Size)
+	}
+	return nil
+}
+
+// writeTrailer sends the digest of data sent without one in its header: a uint16 length followed by the multihash.
+func writeTrailer(w io.Writer, digest []byte) error {
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(digest)), uint16(len(digest)))
+	if _, err := w.Write(append(buf, digest...)); err != nil {
+		return fmt.Errorf("error sending trailer: %v", err)
+	}
+	return nil
+}
+
+// readTrailer receives the digest sent after the data.
+func readTrailer(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("error reading trailer: %v", err)
+	}
+	digest := make([]byte, length)
+	if _, err := io.ReadFull(r, digest); err != nil {
+		return nil, fmt.Errorf("error reading trailer: %v", err)
+	}
+	return digest, nil
+}
+
+// writeStatus sends the outcome of a transfer: a status code followed by a uint16 length prefixed message.
+func writeStatus(w io.Writer, code uint8, msg string) error {
+	if len(msg) > 0xffff {
+		msg = msg[:0xffff]
+	}
+	buf := []byte{code}
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// readStatus receives the outcome of a transfer, returning an error if the receiver reported one.
+func readStatus(r io.Reader) error {
+	var buf [3]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return fmt.Errorf("error reading transfer status: %v", err)
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(buf[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return fmt.Errorf("error reading transfer status: %v", err)
+	}
+	switch buf[0] {
+	case StatusOK:
+		return nil
+	case StatusChecksumMismatch:
+		return fmt.Errorf("receiver failed: %w", ErrChecksumMismatch)
+	case StatusRejected:
+		if len(msg) == 0 {
+			return fmt.Errorf("receiver refused: %w", ErrRejected)
+		}
+		return fmt.Errorf("receiver refused: %w: %s", ErrRejected, msg)
+	default:
+		return fmt.Errorf("receiver failed: %s", msg)
+	}
+}
+
+// sendPacket sends a Packet struct over w.
+func sendPacket(w io.Writer, packet Packet) error {
+	if packet.Size < 0 || packet.Size > MaxFrameSize || int(packet.Size) != len(packet.Data) {
+		return fmt.Errorf("invalid packet size %d", packet.Size)
+	}
+	size := uint32(packet.Size)
+	if packet.Compressed {
+		size |= compressedFrame
+	}
+	buf := make([]byte, 4, 4+len(packet.Data))
+	binary.BigEndian.PutUint32(buf, size)
+	buf = append(buf, packet.Data...)
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("error sending packet: %v", err)
+	}
+	return nil
+}
+
+// receivePacket receives a Packet struct from r, reading exactly the number of bytes announced.
+// buf is used to hold the data if it is large enough.
+func receivePacket(r io.Reader, buf []byte) (Packet, error) {
+	var packet Packet
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return packet, fmt.Errorf("error decoding packet size: %v", err)
+	}
+	packet.Compressed = size&compressedFrame != 0
+	packet.Size = int32(size &^ compressedFrame)
+	if packet.Size > MaxFrameSize {
+		return packet, fmt.Errorf("invalid packet size %d", packet.Size)
+	}
+	if cap(buf) >= int(packet.Size) {
+		packet.Data = buf[:packet.Size]
+	} else {
+		packet.Data = make([]byte, packet.Size)
+	}
+	if _, err := io.ReadFull(r, packet.Data); err != nil {
+		return packet, fmt.Errorf("error reading packet data: %v", err)
+	}
+	return packet, nil
+}
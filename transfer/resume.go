@@ -0,0 +1,303 @@
+package transfer
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// checkpointInterval is the amount of data received on a stream between two saves of the state of a partial file.
+const checkpointInterval = 4 << 20
+
+// span is a range [Start, End) of a file.
+type span struct {
+	Start uint64 `json:"start"`
+	End   uint64 `json:"end"`
+}
+
+// partialState is the sidecar record kept next to a partial file, saved as JSON.
+type partialState struct {
+	// Size and Digest identify the content being received.
+	Size   uint64 `json:"size"`
+	Digest []byte `json:"digest"`
+	// Done holds the sorted, non overlapping ranges of the partial file known to be written to disk.
+	Done []span `json:"done"`
+}
+
+// partial is a file being received, possibly over several streams at once, which survives disconnects and restarts.
+type partial struct {
+	path      string
+	statePath string
+
+	mu       sync.Mutex
+	file     *os.File
+	state    partialState
+	refs     int
+	finished bool
+	progress *tracker
+}
+
+// partials holds the partial files streams are currently writing to, by path.
+var (
+	partialsMu sync.Mutex
+	partials   = make(map[string]*partial)
+)
+
+// partialPaths returns the paths of the partial file and of its state record for the file dest.
+func partialPaths(dest string) (string, string) {
+	part := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".part")
+	return part, part + ".state"
+}
+
+// acquirePartial returns the partial file for the content described by h to be stored at dest, shared with
+// the other streams receiving it and resumed if a previous transfer of the same content was interrupted.
+// It must be released.
+func acquirePartial(dest string, h Header) (*partial, error) {
+	path, statePath := partialPaths(dest)
+	name := filepath.Base(dest)
+
+	partialsMu.Lock()
+	defer partialsMu.Unlock()
+	if p, ok := partials[path]; ok {
+		if p.state.Size != h.Size || string(p.state.Digest) != string(h.Digest) {
+			return nil, fmt.Errorf("another transfer of %s is in progress", name)
+		}
+		p.refs++
+		return p, nil
+	}
+
+	p := &partial{path: path, statePath: statePath, refs: 1}
+	state, err := loadPartialState(statePath)
+	if err == nil && state.Size == h.Size && string(state.Digest) == string(h.Digest) {
+		if file, err := os.OpenFile(path, os.O_RDWR, 0600); err == nil {
+			p.file = file
+			p.state = *state
+		}
+	}
+	if p.file == nil {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("error creating output file: %v", err)
+		}
+		p.file = file
+		p.state = partialState{Size: h.Size, Digest: h.Digest}
+		if err := p.saveState(); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	// Ranges are written at their offset, the file is allocated to its full size upfront.
+	if err := p.file.Truncate(int64(h.Size)); err != nil {
+		p.file.Close()
+		return nil, fmt.Errorf("error allocating output file: %v", err)
+	}
+	partials[path] = p
+	return p, nil
+}
+
+// release stops sharing the partial file with the stream, closing it once no stream uses it.
+func (p *partial) release() {
+	partialsMu.Lock()
+	defer partialsMu.Unlock()
+	p.refs--
+	if p.refs > 0 {
+		return
+	}
+	delete(partials, p.path)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.finished {
+		p.file.Close()
+	}
+}
+
+// WriteAt writes data at offset off of the partial file.
+func (p *partial) WriteAt(b []byte, off int64) (int, error) {
+	return p.file.WriteAt(b, off)
+}
+
+// doneFrom returns how much of the range [start, end) is already written, counting from start.
+func (p *partial) doneFrom(start, end uint64) uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, s := range p.state.Done {
+		if s.Start <= start && start < s.End {
+			if s.End > end {
+				return end - start
+			}
+			return s.End - start
+		}
+	}
+	return 0
+}
+
+// markDone flushes the partial file to disk and records the range [start, end) as written.
+// It returns whether the whole file is now written.
+func (p *partial) markDone(start, end uint64) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return true, nil
+	}
+	if start < end {
+		if err := p.file.Sync(); err != nil {
+			return false, fmt.Errorf("error writing output file: %v", err)
+		}
+		p.state.Done = mergeSpans(append(p.state.Done, span{Start: start, End: end}))
+		if err := p.saveState(); err != nil {
+			return false, err
+		}
+	}
+	return p.state.Size == 0 ||
+		(len(p.state.Done) == 1 && p.state.Done[0].Start == 0 && p.state.Done[0].End == p.state.Size), nil
+}
+
+// tracker returns the tracker counting the bytes of the partial file received by every stream, reporting to fn.
+func (p *partial) tracker(name string, fn func(Progress)) *tracker {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.progress == nil {
+		var done uint64
+		for _, s := range p.state.Done {
+			done += s.End - s.Start
+		}
+		p.progress = newTracker(name, p.state.Size, done, fn)
+	}
+	return p.progress
+}
+
+// claim returns true to the first caller once the whole file is written, which must then finish it.
+func (p *partial) claim() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.finished {
+		return false
+	}
+	p.finished = true
+	return true
+}
+
+// finish checks the digest of the fully written partial file, then moves it to dest with the given mode
+// according to policy and deletes its state, returning the path the file was stored at. The partial file
+// is deleted if its digest does not match or if it cannot be stored because dest exists.
+func (p *partial) finish(dest string, mode os.FileMode, policy ConflictPolicy) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	hasher, err := newHasher(checksumOf(p.state.Digest))
+	if err != nil {
+		p.file.Close()
+		return "", err
+	}
+	if _, err := io.Copy(hasher, io.NewSectionReader(p.file, 0, int64(p.state.Size))); err != nil {
+		p.file.Close()
+		return "", fmt.Errorf("error reading output file: %v", err)
+	}
+	if err := verifyDigest(hasher, checksumOf(p.state.Digest), p.state.Digest); err != nil {
+		p.file.Close()
+		os.Remove(p.path)
+		os.Remove(p.statePath)
+		return "", err
+	}
+
+	if err := p.file.Chmod(mode); err != nil {
+		p.file.Close()
+		return "", fmt.Errorf("error setting output file mode: %v", err)
+	}
+	if err := p.file.Close(); err != nil {
+		return "", fmt.Errorf("error writing output file: %v", err)
+	}
+	stored, err := placeFile(p.path, dest, policy)
+	if errors.Is(err, ErrFileExists) {
+		os.Remove(p.path)
+	}
+	if err != nil {
+		return "", err
+	}
+	os.Remove(p.statePath)
+	return stored, nil
+}
+
+// saveState writes the state record, through a temporary file so that a crash never leaves a truncated record.
+func (p *partial) saveState() error {
+	data, err := json.Marshal(p.state)
+	if err != nil {
+		return err
+	}
+	tmp := p.statePath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("error saving transfer state: %v", err)
+	}
+	if err := os.Rename(tmp, p.statePath); err != nil {
+		return fmt.Errorf("error saving transfer state: %v", err)
+	}
+	return nil
+}
+
+// mergeSpans sorts spans and merges the ones that overlap or touch.
+func mergeSpans(spans []span) []span {
+	sort.Slice(spans, func(i, j int) bool {
+		return spans[i].Start < spans[j].Start
+	})
+	merged := spans[:0]
+	for _, s := range spans {
+		if n := len(merged); n > 0 && s.Start <= merged[n-1].End {
+			if s.End > merged[n-1].End {
+				merged[n-1].End = s.End
+			}
+			continue
+		}
+		merged = append(merged, s)
+	}
+	return merged
+}
+
+// loadPartialState reads a state record.
+func loadPartialState(path string) (*partialState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var state partialState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return &state, nil
+}
+
+// writeOffset accepts the range the sender announced, telling it the codec to compress frames with and
+// how much of the range was already received.
+func writeOffset(w io.Writer, codec Compression, offset uint64) error {
+	buf := binary.BigEndian.AppendUint64([]byte{StatusOK, 0, 0, uint8(codec)}, offset)
+	if _, err := w.Write(buf); err != nil {
+		return fmt.Errorf("error sending offset: %v", err)
+	}
+	return nil
+}
+
+// readOffset receives the codec chosen by the receiver among the ones proposed and how much of a range
+// of the given length it already has, or the error it refused the range with.
+func readOffset(r io.Reader, proposed []Compression, length uint64) (Compression, uint64, error) {
+	if err := readStatus(r); err != nil {
+		return 0, 0, err
+	}
+	var buf [9]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return 0, 0, fmt.Errorf("error reading offset: %v", err)
+	}
+	codec := Compression(buf[0])
+	if codec != CompressionNone && chooseCompression([]Compression{codec}, proposed) != codec {
+		return 0, 0, fmt.Errorf("receiver chose compression %s which was not proposed", codec)
+	}
+	offset := binary.BigEndian.Uint64(buf[1:])
+	if offset > length {
+		return 0, 0, errors.New("receiver asked for an offset past the end of the range")
+	}
+	return codec, offset, nil
+}
@@ -0,0 +1,188 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrFileExists is returned when a received file or directory already exists and the conflict policy is ConflictReject.
+var ErrFileExists = errors.New("file already exists")
+
+// ConflictPolicy decides what happens when a received file already exists in the output directory.
+type ConflictPolicy int
+
+const (
+	// ConflictRename stores the received file under a free name, "report (1).pdf" for "report.pdf".
+	ConflictRename ConflictPolicy = iota
+	// ConflictReject refuses the transfer with ErrFileExists.
+	ConflictReject
+	// ConflictOverwrite replaces the existing file.
+	ConflictOverwrite
+)
+
+// maxNameLength is the longest path element accepted, the limit of most file systems.
+const maxNameLength = 255
+
+// String returns the name of the policy.
+func (c ConflictPolicy) String() string {
+	switch c {
+	case ConflictRename:
+		return "rename"
+	case ConflictReject:
+		return "reject"
+	case ConflictOverwrite:
+		return "overwrite"
+	default:
+		return fmt.Sprintf("ConflictPolicy(%d)", int(c))
+	}
+}
+
+// checkName returns an error unless name is usable as a single path element: it must be valid UTF-8 without
+// separators or control characters, must not be "." or "..", and must not collide with the partial files
+// of other transfers.
+func checkName(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("invalid file name %q", name)
+	case len(name) > maxNameLength:
+		return fmt.Errorf("file name %q is too long", name)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("file name %q is not valid UTF-8", name)
+	case strings.ContainsAny(name, `/\`):
+		return fmt.Errorf("file name %q contains a path separator", name)
+	}
+	for _, r := range name {
+		if r < 0x20 || r == 0x7f {
+			return fmt.Errorf("file name %q contains a control character", name)
+		}
+	}
+	if strings.HasPrefix(name, ".") &&
+		(strings.HasSuffix(name, ".part") || strings.HasSuffix(name, ".part.state") || strings.HasSuffix(name, ".part.state.tmp")) {
+		return fmt.Errorf("file name %q is reserved for partial files", name)
+	}
+	return nil
+}
+
+// checkRelPath returns an error unless p is a clean, slash separated path relative to the root that stays
+// inside it, "." being the root itself. Absolute and parent-relative paths are refused.
+func checkRelPath(p string) error {
+	if p == "." {
+		return nil
+	}
+	if path.IsAbs(p) || filepath.IsAbs(filepath.FromSlash(p)) || filepath.VolumeName(p) != "" {
+		return fmt.Errorf("absolute path %q", p)
+	}
+	if path.Clean(p) != p {
+		return fmt.Errorf("path %q is not clean", p)
+	}
+	for _, elem := range strings.Split(p, "/") {
+		if elem == ".." {
+			return fmt.Errorf("path %q leaves the directory", p)
+		}
+		if err := checkName(elem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureDir creates the directory rel, a path checked with checkRelPath, below root. Every element of the path
+// that already exists must be a directory and not a link, so that nothing is ever written outside root.
+func ensureDir(root, rel string) error {
+	dir := root
+	if rel == "." {
+		return nil
+	}
+	for _, elem := range strings.Split(rel, "/") {
+		dir = filepath.Join(dir, elem)
+		info, err := os.Lstat(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, os.ErrExist) {
+				return fmt.Errorf("error creating directory: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error creating directory: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s exists and is not a directory", dir)
+		}
+	}
+	return nil
+}
+
+// placeFile moves the complete file tmp to dest according to policy, returning the path it was stored at.
+// Unless the policy is ConflictOverwrite, an existing file is never replaced, even if it appears concurrently.
+func placeFile(tmp, dest string, policy ConflictPolicy) (string, error) {
+	if policy == ConflictOverwrite {
+		if info, err := os.Lstat(dest); err == nil && info.IsDir() {
+			return "", fmt.Errorf("%s: %w and is a directory", filepath.Base(dest), ErrFileExists)
+		}
+		if err := os.Rename(tmp, dest); err != nil {
+			return "", fmt.Errorf("error moving output file into place: %v", err)
+		}
+		return dest, nil
+	}
+
+	for i := 1; ; i++ {
+		candidate := dest
+		if i > 1 {
+			candidate = numberedName(dest, i-1)
+		}
+		// A hard link fails if the destination exists, which makes the check and the move atomic.
+		err := os.Link(tmp, candidate)
+		switch {
+		case err == nil:
+			os.Remove(tmp)
+			return candidate, nil
+		case errors.Is(err, os.ErrExist):
+		default:
+			// Hard links are not supported everywhere, fall back to a check before renaming.
+			_, statErr := os.Lstat(candidate)
+			if errors.Is(statErr, os.ErrNotExist) {
+				if err := os.Rename(tmp, candidate); err != nil {
+					return "", fmt.Errorf("error moving output file into place: %v", err)
+				}
+				return candidate, nil
+			}
+			if statErr != nil {
+				return "", fmt.Errorf("error moving output file into place: %v", statErr)
+			}
+		}
+		if policy == ConflictReject {
+			return "", fmt.Errorf("%s: %w", filepath.Base(dest), ErrFileExists)
+		}
+	}
+}
+
+// resolveConflict returns where to create the directory or file dest according to policy.
+func resolveConflict(dest string, policy ConflictPolicy) (string, error) {
+	if _, err := os.Lstat(dest); errors.Is(err, os.ErrNotExist) || policy == ConflictOverwrite {
+		return dest, nil
+	}
+	if policy == ConflictReject {
+		return "", fmt.Errorf("%s: %w", filepath.Base(dest), ErrFileExists)
+	}
+	for i := 1; ; i++ {
+		candidate := numberedName(dest, i)
+		if _, err := os.Lstat(candidate); errors.Is(err, os.ErrNotExist) {
+			return candidate, nil
+		}
+	}
+}
+
+// numberedName returns the name of the i-th copy of the file at p, "report (1).pdf" for "report.pdf".
+func numberedName(p string, i int) string {
+	dir, base := filepath.Split(p)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = ""
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(base, ext), i, ext))
+}
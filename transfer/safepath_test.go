@@ -0,0 +1,202 @@
+package transfer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"report.pdf", true},
+		{".hidden", true},
+		{"résumé.txt", true},
+		{"", false},
+		{".", false},
+		{"..", false},
+		{"a/b", false},
+		{`a\b`, false},
+		{"../etc/passwd", false},
+		{"bell\a", false},
+		{"del\x7f", false},
+		{"bad\xff", false},
+		{strings.Repeat("a", maxNameLength+1), false},
+		{".report.pdf.part", false},
+		{".report.pdf.part.state", false},
+		{".report.pdf.part.state.tmp", false},
+		{"report.pdf.part", true},
+	}
+	for _, tt := range tests {
+		if err := checkName(tt.name); (err == nil) != tt.ok {
+			t.Errorf("checkName(%q) = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+func TestCheckRelPath(t *testing.T) {
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{".", true},
+		{"a", true},
+		{"a/b/c.txt", true},
+		{"..", false},
+		{"../a", false},
+		{"a/../../b", false},
+		{"a/..", false},
+		{"/etc/passwd", false},
+		{"a//b", false},
+		{"a/./b", false},
+		{"a/", false},
+		{"", false},
+		{`a\..\b`, false},
+		{"a/.b.part", false},
+	}
+	for _, tt := range tests {
+		if err := checkRelPath(tt.path); (err == nil) != tt.ok {
+			t.Errorf("checkRelPath(%q) = %v, want ok %v", tt.path, err, tt.ok)
+		}
+	}
+}
+
+func TestEnsureDirRefusesLinks(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "file"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		rel string
+		ok  bool
+	}{
+		{".", true},
+		{"a/b", true},
+		{"a/b/c", true},
+		{"link", false},
+		{"link/sub", false},
+		{"file", false},
+		{"file/sub", false},
+	}
+	for _, tt := range tests {
+		if err := ensureDir(root, tt.rel); (err == nil) != tt.ok {
+			t.Errorf("ensureDir(%q) = %v, want ok %v", tt.rel, err, tt.ok)
+		}
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("ensureDir created %d entries outside the root", len(entries))
+	}
+}
+
+func TestPlaceFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		dest     string
+		policy   ConflictPolicy
+		want     string
+		err      error
+	}{
+		{"free", nil, "report.pdf", ConflictRename, "report.pdf", nil},
+		{"rename", []string{"report.pdf"}, "report.pdf", ConflictRename, "report (1).pdf", nil},
+		{"rename twice", []string{"report.pdf", "report (1).pdf"}, "report.pdf", ConflictRename, "report (2).pdf", nil},
+		{"rename without extension", []string{"notes"}, "notes", ConflictRename, "notes (1)", nil},
+		{"rename dot file", []string{".profile"}, ".profile", ConflictRename, ".profile (1)", nil},
+		{"reject", []string{"report.pdf"}, "report.pdf", ConflictReject, "", ErrFileExists},
+		{"reject free", nil, "report.pdf", ConflictReject, "report.pdf", nil},
+		{"overwrite", []string{"report.pdf"}, "report.pdf", ConflictOverwrite, "report.pdf", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.existing {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte("old"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tmp := filepath.Join(dir, ".incoming.part")
+			if err := os.WriteFile(tmp, []byte("new"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := placeFile(tmp, filepath.Join(dir, tt.dest), tt.policy)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("placeFile = %v, want %v", err, tt.err)
+			}
+			for _, name := range tt.existing {
+				data, _ := os.ReadFile(filepath.Join(dir, name))
+				if name != tt.want && string(data) != "old" {
+					t.Errorf("%s was replaced", name)
+				}
+			}
+			if err != nil {
+				return
+			}
+			if stored != filepath.Join(dir, tt.want) {
+				t.Errorf("stored at %s, want %s", stored, tt.want)
+			}
+			if data, _ := os.ReadFile(stored); string(data) != "new" {
+				t.Errorf("%s holds %q, want the received file", stored, data)
+			}
+			if _, err := os.Lstat(tmp); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("temporary file left behind")
+			}
+		})
+	}
+}
+
+func TestPlaceFileOverwriteDirectory(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "report"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, ".incoming.part")
+	if err := os.WriteFile(tmp, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := placeFile(tmp, filepath.Join(dir, "report"), ConflictOverwrite); !errors.Is(err, ErrFileExists) {
+		t.Errorf("placeFile over a directory = %v, want %v", err, ErrFileExists)
+	}
+}
+
+func TestResolveConflict(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		policy   ConflictPolicy
+		want     string
+		err      error
+	}{
+		{"free", nil, ConflictReject, "photos", nil},
+		{"rename", []string{"photos"}, ConflictRename, "photos (1)", nil},
+		{"rename twice", []string{"photos", "photos (1)"}, ConflictRename, "photos (2)", nil},
+		{"reject", []string{"photos"}, ConflictReject, "", ErrFileExists},
+		{"overwrite", []string{"photos"}, ConflictOverwrite, "photos", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, name := range tt.existing {
+				if err := os.Mkdir(filepath.Join(dir, name), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := resolveConflict(filepath.Join(dir, "photos"), tt.policy)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("resolveConflict = %v, want %v", err, tt.err)
+			}
+			if err == nil && got != filepath.Join(dir, tt.want) {
+				t.Errorf("resolveConflict = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
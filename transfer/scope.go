@@ -0,0 +1,59 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"p2p/network"
+)
+
+// ServiceName is the service of the resource manager the streams of transfers are attached to, so that the
+// memory of all the transfers of a host can be limited together.
+const ServiceName = "p2p.transfer"
+
+// scoped is implemented by the streams of a host, whose memory is accounted in a resource scope.
+type scoped interface {
+	Scope() network.StreamScope
+}
+
+// attachService attaches conn to ServiceName if it is a stream of a host. Other connections are left alone.
+func attachService(conn io.ReadWriter) error {
+	s, ok := conn.(scoped)
+	if !ok {
+		return nil
+	}
+	if err := s.Scope().SetService(ServiceName); err != nil {
+		return fmt.Errorf("error attaching stream to service %s: %v", ServiceName, err)
+	}
+	return nil
+}
+
+// reserveMemory reserves size bytes for the buffers of a transfer over conn in its scope, if it is a stream of
+// a host, and returns the function releasing them once the buffers are no longer used.
+func reserveMemory(conn io.ReadWriter, size int) (func(), error) {
+	s, ok := conn.(scoped)
+	if !ok {
+		return func() {}, nil
+	}
+	if err := s.Scope().ReserveMemory(size, network.ReservationPriorityMedium); err != nil {
+		return nil, fmt.Errorf("error reserving memory for transfer: %w", err)
+	}
+	return func() { s.Scope().ReleaseMemory(size) }, nil
+}
+
+// sendMemory returns the memory used at most by the buffers of sendStream sending frames of blockSize bytes,
+// compressed if the receiver is offered codecs.
+func sendMemory(header Header, blockSize int) int {
+	if len(header.Codecs) == 0 {
+		return blockSize
+	}
+	return 2 * blockSize
+}
+
+// receiveMemory returns the memory used at most by a frameReader of frames compressed with compression,
+// along with the chunk buffer of chunk bytes its data is read into.
+func receiveMemory(compression Compression, chunk int) int {
+	if compression == CompressionNone {
+		return MaxFrameSize + chunk
+	}
+	return 2*MaxFrameSize + chunk
+}
@@ -0,0 +1,452 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	mh "github.com/multiformats/go-multihash"
+	"hash"
+	"io"
+	"os"
+	"p2p/internal/wire"
+	"path/filepath"
+)
+
+// Meta describes the data sent with Send.
+type Meta struct {
+	// Name is what the receiver calls the data, a single path element.
+	Name string
+	// Size is the length of the data, UnknownSize if it is not known in advance.
+	Size uint64
+	// Mode holds the permission bits of a file storing the data.
+	Mode uint32
+	// Digest is the multihash of the data. If it is nil, the sender computes it while sending the data
+	// with the function set by WithChecksum, and sends it after the data.
+	Digest []byte
+}
+
+// Send sends meta and the data read from r until io.EOF over conn, then waits for the receiver to confirm
+// it got the data whole. Data of unknown size is sent as it is read, in frames of the default size. The
+// transfer stops once ctx is done, in which case the error of ctx is returned. Send can be answered by
+// Receive, or by ReceiveFile which stores the data as a file.
+func Send(ctx context.Context, conn io.ReadWriter, meta Meta, r io.Reader, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	header := Header{
+		Name:     meta.Name,
+		Size:     meta.Size,
+		Mode:     meta.Mode,
+		Checksum: cfg.checksum,
+		Digest:   meta.Digest,
+		Length:   meta.Size,
+	}
+	if len(meta.Digest) > 0 {
+		header.Checksum = checksumOf(meta.Digest)
+	}
+	if err := checkHeaderDigest(header); err != nil {
+		return err
+	}
+	if len(codecsToPropose(cfg)) > 0 {
+		// The start of the data tells whether it is worth compressing.
+		br := bufio.NewReaderSize(r, sampleSize)
+		sample, _ := br.Peek(sampleSize)
+		header.Codecs = proposedCompression(cfg, sample)
+		r = br
+	}
+	return send(ctx, conn, header, r, defaultBlockSize, cfg)
+}
+
+// send sends header and the data read from r over conn, in frames of blockSize bytes, stopping once ctx is done.
+func send(ctx context.Context, conn io.ReadWriter, header Header, r io.Reader, blockSize int, cfg *config) error {
+	if err := attachService(conn); err != nil {
+		return err
+	}
+	release, err := reserveMemory(conn, sendMemory(header, blockSize))
+	if err != nil {
+		return err
+	}
+	defer release()
+	defer protectPeer(conn, cfg)()
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+
+	prog := newTracker(header.Name, header.Size, 0, cfg.onProgress)
+	if err := sendStream(cfg.limit(ctx, conn), header, r, blockSize, cfg, prog); err != nil {
+		return wire.ContextError(ctx, err)
+	}
+	prog.finish()
+	return nil
+}
+
+// sendStream sends header and the data of the range it describes, read from r, over conn and waits for
+// the receiver's status, counting the bytes sent with prog. The part of the range the receiver already
+// has is skipped in r, and reported to the logger of cfg. The digest is computed on the fly and sent in
+// the trailer if header has none.
+// Every frame is compressed on its own with the codec chosen by the receiver, unless that does not shrink it.
+func sendStream(conn io.ReadWriter, header Header, r io.Reader, blockSize int, cfg *config, prog *tracker) error {
+	if err := writeHeader(conn, header); err != nil {
+		return err
+	}
+	// The receiver answers with the codec it chose and the amount of the range it already has from an
+	// interrupted transfer.
+	compression, skip, err := readOffset(conn, header.Codecs, header.Length)
+	if err != nil {
+		return err
+	}
+	enc, err := newCodec(compression)
+	if err != nil {
+		return err
+	}
+	if skip > 0 {
+		if len(header.Digest) == 0 {
+			return errors.New("receiver asked to resume data sent without a digest")
+		}
+		if skip < header.Length {
+			cfg.logf("resuming %s from byte %d", header.Name, header.Offset+skip)
+		}
+		if err := skipReader(r, skip); err != nil {
+			return fmt.Errorf("error reading file: %v", err)
+		}
+	}
+	prog.skip(skip)
+
+	var hasher hash.Hash
+	if len(header.Digest) == 0 {
+		if hasher, err = newHasher(header.Checksum); err != nil {
+			return err
+		}
+		r = io.TeeReader(r, hasher)
+	}
+	if header.Length != UnknownSize {
+		// Never send more than announced, even if the file grew since it was opened.
+		r = io.LimitReader(r, int64(header.Length-skip))
+	}
+
+	buffer := make([]byte, blockSize)
+	var compressed []byte
+	for {
+		bytesRead, err := io.ReadFull(r, buffer)
+		if bytesRead > 0 {
+			packet := Packet{Size: int32(bytesRead), Data: buffer[:bytesRead]}
+			if enc != nil {
+				var cerr error
+				if compressed, cerr = enc.compress(compressed[:0], packet.Data); cerr == nil && len(compressed) < bytesRead {
+					packet = Packet{Size: int32(len(compressed)), Data: compressed, Compressed: true}
+				}
+			}
+			if err := sendPacket(conn, packet); err != nil {
+				return err
+			}
+			prog.add(uint64(bytesRead))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error reading file: %v", err)
+		}
+	}
+	if err := sendPacket(conn, Packet{}); err != nil {
+		return err
+	}
+	if hasher != nil {
+		sum, err := mh.Encode(hasher.Sum(nil), header.Checksum)
+		if err != nil {
+			return err
+		}
+		if err := writeTrailer(conn, sum); err != nil {
+			return err
+		}
+	}
+
+	return readStatus(conn)
+}
+
+// skipReader advances r by n bytes, seeking if it can.
+func skipReader(r io.Reader, n uint64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(int64(n), io.SeekCurrent)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, int64(n))
+	return err
+}
+
+// Receive receives the data sent with Send over conn, which must be read until io.EOF and closed. Reading
+// fails with an error wrapping ErrChecksumMismatch if the data does not match its digest, which is checked
+// once it is read whole. Close tells the sender whether the data was received whole and matched its digest.
+// The transfer is offered to the policies and handler set with WithOfferPolicy and WithOfferHandler first,
+// with an empty Dir, and stops once ctx is done, in which case reading returns an error.
+func Receive(ctx context.Context, conn io.ReadWriter, opts ...Option) (Meta, io.ReadCloser, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return Meta{}, nil, err
+	}
+	if err := attachService(conn); err != nil {
+		return Meta{}, nil, err
+	}
+	unprotect := protectPeer(conn, cfg)
+	watching := wire.WatchContext(ctx, conn)
+	stop := func() {
+		watching()
+		unprotect()
+	}
+
+	header, err := readHeader(conn)
+	if err == nil {
+		err = checkName(header.Name)
+	}
+	if err == nil {
+		err = checkHeaderDigest(header)
+	}
+	if err == nil && (header.Offset != 0 || header.Length != header.Size) {
+		err = errors.New("ranges of a file can only be received with ReceiveFile")
+	}
+	if err == nil {
+		_, err = decide(&Offer{
+			Peer:      remotePeer(conn),
+			Names:     []string{header.Name},
+			TotalSize: header.Size,
+			Digest:    header.Digest,
+		}, cfg)
+	}
+	compression := chooseCompression(header.Codecs, cfg.compression)
+	release := func() {}
+	if err == nil {
+		release, err = reserveMemory(conn, receiveMemory(compression, 0))
+	}
+	if err == nil {
+		if err = writeOffset(conn, compression, 0); err != nil {
+			release()
+		}
+	}
+	if err != nil {
+		err = respond(conn, err)
+		stop()
+		return Meta{}, nil, wire.ContextError(ctx, err)
+	}
+
+	meta := Meta{Name: header.Name, Size: header.Size, Mode: header.Mode, Digest: header.Digest}
+	in, err := newIncoming(conn, cfg.limit(ctx, conn), header, compression, newTracker(header.Name, header.Size, 0, cfg.onProgress))
+	if err != nil {
+		release()
+		stop()
+		return Meta{}, nil, err
+	}
+	in.ctx, in.stop = ctx, func() {
+		release()
+		stop()
+	}
+	return meta, in, nil
+}
+
+// frameReader reads the data frames of a range as a stream, decompressing them, and returns io.EOF after
+// the frame of size 0. It fails if the frames add up to more or less than expected bytes, unless that is UnknownSize.
+type frameReader struct {
+	r        io.Reader
+	codec    codec
+	expected uint64
+	received uint64
+	buf      []byte
+	out      []byte
+	data     []byte
+	err      error
+}
+
+// newFrameReader returns a reader of the frames read from r, compressed with compression and expected
+// to carry expected bytes.
+func newFrameReader(r io.Reader, compression Compression, expected uint64) (*frameReader, error) {
+	c, err := newCodec(compression)
+	if err != nil {
+		return nil, err
+	}
+	return &frameReader{r: r, codec: c, expected: expected, buf: make([]byte, 64<<10)}, nil
+}
+
+// Read reads the data of the frames into p.
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.data) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		packet, err := receivePacket(f.r, f.buf)
+		if len(packet.Data) > len(f.buf) {
+			// Keep the larger buffer for the next frames, the memory reserved for the reader covers it.
+			f.buf = packet.Data
+		}
+		if err == nil && packet.Compressed {
+			if f.codec == nil {
+				err = errors.New("sender sent a compressed frame without compression")
+			} else if f.out, err = f.codec.decompress(f.out[:0], packet.Data); err != nil {
+				err = fmt.Errorf("error decompressing frame: %v", err)
+			} else {
+				packet.Data, packet.Size = f.out, int32(len(f.out))
+			}
+		}
+		switch {
+		case err != nil:
+			f.err = err
+		case packet.Size == 0 && !packet.Compressed:
+			f.err = io.EOF
+			if f.expected != UnknownSize && f.received != f.expected {
+				f.err = fmt.Errorf("received %d bytes out of %d", f.received, f.expected)
+			}
+		case f.expected != UnknownSize && f.received+uint64(packet.Size) > f.expected:
+			f.err = errors.New("sender sent more data than announced")
+		default:
+			f.data = packet.Data
+			f.received += uint64(packet.Size)
+		}
+	}
+	n := copy(p, f.data)
+	f.data = f.data[n:]
+	return n, nil
+}
+
+// incoming is the data of a whole file read as a stream, checked against its digest once it is read.
+type incoming struct {
+	conn   io.ReadWriter
+	header Header
+	frames *frameReader
+	hasher hash.Hash
+	prog   *tracker
+	err    error
+
+	// ctx and stop are set for the readers returned by Receive, which report the outcome on Close.
+	ctx    context.Context
+	stop   func()
+	closed bool
+}
+
+// newIncoming returns the reader of the data described by header, whose frames are read from data, conn
+// paced by the rate limiter of the transfer, and compressed with compression.
+func newIncoming(conn io.ReadWriter, data io.Reader, header Header, compression Compression, prog *tracker) (*incoming, error) {
+	hasher, err := newHasher(header.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := newFrameReader(data, compression, header.Size)
+	if err != nil {
+		return nil, err
+	}
+	return &incoming{conn: conn, header: header, frames: frames, hasher: hasher, prog: prog}, nil
+}
+
+// Read reads the data into p, returning io.EOF once it is read whole and matched its digest.
+func (in *incoming) Read(p []byte) (int, error) {
+	if in.err != nil {
+		return 0, in.err
+	}
+	n, err := in.frames.Read(p)
+	in.hasher.Write(p[:n])
+	in.prog.add(uint64(n))
+	if err == io.EOF {
+		if err = in.verify(); err == nil {
+			in.prog.finish()
+			err = io.EOF
+		}
+	}
+	in.err = err
+	return n, err
+}
+
+// verify checks the data read against the digest of the header, or the one sent in the trailer.
+func (in *incoming) verify() error {
+	expected := in.header.Digest
+	if len(expected) == 0 {
+		var err error
+		if expected, err = readTrailer(in.conn); err != nil {
+			return err
+		}
+	}
+	if err := verifyDigest(in.hasher, in.header.Checksum, expected); err != nil {
+		return fmt.Errorf("%s: %w", in.header.Name, err)
+	}
+	return nil
+}
+
+// Close tells the sender whether the data was read whole and matched its digest, returning the error otherwise.
+func (in *incoming) Close() error {
+	if in.closed {
+		return nil
+	}
+	in.closed = true
+	defer in.stop()
+
+	err := in.err
+	switch {
+	case err == io.EOF:
+		err = nil
+	case err == nil:
+		err = errors.New("receiver stopped reading before the end of the data")
+		// The sender is still sending and only reads the status once it is done, the rest of the data is
+		// discarded if the stream can do it, otherwise the stream is closed.
+		switch c := in.conn.(type) {
+		case interface{ CloseRead() error }:
+			_ = c.CloseRead()
+		case io.Closer:
+			_ = c.Close()
+			return err
+		}
+	}
+	return wire.ContextError(in.ctx, respond(in.conn, err))
+}
+
+// receiveWhole receives data sent without a digest in its header, which cannot be resumed, into a temporary
+// file and moves it to dest according to policy once it is complete and matched the digest of the trailer.
+func receiveWhole(ctx context.Context, conn io.ReadWriter, header Header, dest string, policy ConflictPolicy, cfg *config) (string, error) {
+	if err := checkHeaderDigest(header); err != nil {
+		return "", err
+	}
+	mode := os.FileMode(header.Mode).Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	// A name of its own keeps it apart from the partial file of a transfer of the same name.
+	file, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*.part")
+	if err != nil {
+		return "", fmt.Errorf("error creating output file: %v", err)
+	}
+	tmp := file.Name()
+	compression := chooseCompression(header.Codecs, cfg.compression)
+	release, err := reserveMemory(conn, receiveMemory(compression, 32<<10))
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+	defer release()
+	if err := writeOffset(conn, compression, 0); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+
+	in, err := newIncoming(conn, cfg.limit(ctx, conn), header, compression, newTracker(header.Name, header.Size, 0, cfg.onProgress))
+	if err == nil {
+		_, err = io.Copy(file, in)
+	}
+	if err == nil {
+		err = file.Chmod(mode)
+	}
+	if cerr := file.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("error writing output file: %v", cerr)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	stored, err := placeFile(tmp, dest, policy)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if cfg.onStored != nil {
+		cfg.onStored(stored)
+	}
+	return stored, nil
+}
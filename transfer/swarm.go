@@ -0,0 +1,705 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ipfs/go-cid"
+	"io"
+	"os"
+	"p2p/blocks"
+	"p2p/chunker"
+	"p2p/internal/wire"
+	"p2p/merkledag"
+	"p2p/peer"
+	protocol "p2p/protocols"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BlocksProtocolID is the protocol negotiated on streams serving the blocks of files to swarm downloads.
+const BlocksProtocolID protocol.ID = "/p2p/transfer/blocks/1.0.0"
+
+const (
+	// maxPeerFailures is the number of failed requests in a row after which a swarm download stops asking a peer.
+	maxPeerFailures = 3
+	// stallTimeout is how long a peer asked for blocks may send nothing before the request is given up on.
+	stallTimeout = 15 * time.Second
+	// batchTarget is how long the blocks a peer is asked for at once take at the rate it sent the previous ones.
+	batchTarget = 2 * time.Second
+	// maxBatchBytes bounds the blocks a peer is asked for at once, which are kept in memory until received.
+	maxBatchBytes = 8 << 20
+	// defaultLeafSize is the expected size of a block before any was received.
+	defaultLeafSize = 256 << 10
+)
+
+// PeerOpener opens a new stream to peer p, negotiating BlocksProtocolID.
+type PeerOpener func(ctx context.Context, p peer.ID) (io.ReadWriteCloser, error)
+
+// ServeBlocks answers the requests of a swarm download received over conn with the blocks of bs, such as a
+// blockstore holding the files of the node, until the downloader is done. The downloader asks for blocks
+// like the receiver of a DAG transfer, and every block is answered with a uint8, 1 followed by the block if bs
+// has it and 0 otherwise.
+func ServeBlocks(ctx context.Context, conn io.ReadWriter, bs merkledag.Getter, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+
+	data := cfg.limit(ctx, conn)
+	for {
+		wants, err := readWants(data)
+		if err != nil {
+			return wire.ContextError(ctx, err)
+		}
+		if len(wants) == 0 {
+			return nil
+		}
+		for _, c := range wants {
+			b, err := bs.Get(ctx, c)
+			if err != nil {
+				if _, err := data.Write([]byte{0}); err != nil {
+					return wire.ContextError(ctx, fmt.Errorf("error sending block: %v", err))
+				}
+				continue
+			}
+			if _, err := data.Write([]byte{1}); err != nil {
+				return wire.ContextError(ctx, fmt.Errorf("error sending block: %v", err))
+			}
+			if err := writeBlock(data, b.RawData()); err != nil {
+				return wire.ContextError(ctx, err)
+			}
+		}
+	}
+}
+
+// DownloadSwarm downloads the file whose DAG has root from peers at once, and stores it as filename in the
+// directory outputPath, placed according to the policy set by WithConflictPolicy. The peers serve the blocks
+// of the file with ServeBlocks on the streams opened with open.
+//
+// The nodes of the DAG are fetched level by level, then the chunks of the file, which must be split with the
+// chunker set by WithChunker or one cutting chunks as large: the DAG is refused as soon as it links more chunks
+// than a file of its size split that way has, or more bytes. Every peer is asked for a few blocks at a time, as
+// many as it sent in the last seconds, and asked for more as soon as it sent them, so that fast peers send most
+// of the file. Once every block was asked for, the blocks a slow peer still has to send are asked to the idle
+// peers as well, and the first copy received is kept. A peer failing to send blocks too many times in a row, or
+// sending a block that does not match its CID, is no longer asked, and its blocks are asked to the others. Every block is checked against its CID. With WithBlockstore, the blocks
+// the blockstore has are not asked for, every block received is stored in it, and the root is pinned.
+func DownloadSwarm(ctx context.Context, open PeerOpener, peers []peer.ID, root cid.Cid, filename, outputPath string, opts ...Option) error {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
+	}
+	if err := checkName(filename); err != nil {
+		return err
+	}
+	if len(peers) == 0 {
+		return errors.New("no peer to download from")
+	}
+	if err := os.MkdirAll(outputPath, 0755); err != nil {
+		return fmt.Errorf("error creating output file directory: %v", err)
+	}
+	dest := filepath.Join(outputPath, filename)
+	if cfg.conflict == ConflictReject {
+		if _, err := os.Lstat(dest); err == nil {
+			return fmt.Errorf("%s: %w", filename, ErrFileExists)
+		}
+	}
+
+	if cfg.pinner != nil {
+		// The blocks stored are kept from garbage collection until the root is pinned.
+		unlock := cfg.pinner.PinLock()
+		defer unlock()
+	}
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	sw := newSwarm(open, peers, cfg)
+	defer sw.close()
+
+	tmp, err := os.CreateTemp(outputPath, "."+filename+".*.part")
+	if err != nil {
+		return fmt.Errorf("error creating output file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	err = sw.download(dctx, root, filename, tmp)
+	if cerr := tmp.Close(); err == nil && cerr != nil {
+		err = fmt.Errorf("error writing output file: %v", cerr)
+	}
+	if err != nil {
+		return wire.ContextError(ctx, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return fmt.Errorf("error setting file mode: %v", err)
+	}
+	if cfg.pinner != nil {
+		if err := cfg.pinner.Pin(ctx, root, true); err != nil {
+			return err
+		}
+	}
+	stored, err := placeFile(tmp.Name(), dest, cfg.conflict)
+	if err != nil {
+		return err
+	}
+	cfg.logf("stored %s, downloaded from %s", stored, sw.summary())
+	if cfg.onStored != nil {
+		cfg.onStored(stored)
+	}
+	return nil
+}
+
+// swarmLeaf is a chunk of a file downloaded by a swarm download.
+type swarmLeaf struct {
+	offset int64
+	size   uint64
+}
+
+// swarm is the set of peers a file is downloaded from.
+type swarm struct {
+	open  PeerOpener
+	cfg   *config
+	peers []*swarmPeer
+}
+
+func newSwarm(open PeerOpener, peers []peer.ID, cfg *config) *swarm {
+	sw := &swarm{open: open, cfg: cfg}
+	seen := make(map[peer.ID]bool, len(peers))
+	for _, p := range peers {
+		if !seen[p] {
+			seen[p] = true
+			sw.peers = append(sw.peers, &swarmPeer{id: p})
+		}
+	}
+	return sw
+}
+
+// close ends the requests of the peers still asked for blocks.
+func (sw *swarm) close() {
+	for _, sp := range sw.peers {
+		sp.mu.Lock()
+		if sp.conn != nil {
+			_ = writeWants(sp.conn, nil)
+		}
+		sp.mu.Unlock()
+		sp.reset()
+	}
+}
+
+// summary tells how many bytes each peer sent.
+func (sw *swarm) summary() string {
+	s := ""
+	for i, sp := range sw.peers {
+		if i > 0 {
+			s += ", "
+		}
+		s += fmt.Sprintf("%s: %d bytes", sp.id, sp.received)
+	}
+	return s
+}
+
+// download writes the file whose DAG has root to file.
+func (sw *swarm) download(ctx context.Context, root cid.Cid, name string, file io.WriterAt) error {
+	blks, err := sw.fetchNodes(ctx, []cid.Cid{root})
+	if err != nil {
+		return err
+	}
+	rootBlock := blks[root]
+	size, err := merkledag.FileSize(rootBlock)
+	if err != nil {
+		return err
+	}
+	prog := newTracker(name, size, 0, sw.cfg.onProgress)
+	if root.Type() == cid.Raw {
+		if _, err := file.WriteAt(rootBlock.RawData(), 0); err != nil {
+			return fmt.Errorf("error writing output file: %v", err)
+		}
+		prog.add(size)
+		prog.finish()
+		return nil
+	}
+
+	minChunk, err := chunker.MinSize(sw.cfg.chunker)
+	if err != nil {
+		return err
+	}
+	leaves, err := merkledag.ResolveLeaves(ctx, root, size, uint64(minChunk), func(ctx context.Context, cids []cid.Cid) (map[cid.Cid]*blocks.Block, error) {
+		if len(cids) == 1 && cids[0] == root {
+			return blks, nil
+		}
+		return sw.fetchNodes(ctx, cids)
+	})
+	if err != nil {
+		return err
+	}
+	var offset uint64
+	spans := make(map[cid.Cid][]swarmLeaf, len(leaves))
+	var wants []cid.Cid
+	for _, l := range leaves {
+		if len(spans[l.Cid]) == 0 {
+			wants = append(wants, l.Cid)
+		}
+		spans[l.Cid] = append(spans[l.Cid], swarmLeaf{offset: int64(offset), size: l.Size})
+		offset += l.Size
+	}
+	if offset != size {
+		return fmt.Errorf("chunks of %d bytes for a file of %d", offset, size)
+	}
+
+	// A chunk found several times in the file is written at each of its offsets.
+	write := func(b *blocks.Block) error {
+		for _, s := range spans[b.Cid()] {
+			if uint64(len(b.RawData())) != s.size {
+				return fmt.Errorf("%w: chunk %s of %d bytes instead of %d", ErrChecksumMismatch, b.Cid(), len(b.RawData()), s.size)
+			}
+			if _, err := file.WriteAt(b.RawData(), s.offset); err != nil {
+				return fmt.Errorf("error writing output file: %v", err)
+			}
+		}
+		return nil
+	}
+	var missing []cid.Cid
+	for _, c := range wants {
+		if sw.cfg.blockstore != nil {
+			if b, err := sw.cfg.blockstore.Get(ctx, c); err == nil {
+				if err := write(b); err != nil {
+					return err
+				}
+				prog.skip(uint64(len(b.RawData())) * uint64(len(spans[c])))
+				continue
+			}
+		}
+		missing = append(missing, c)
+	}
+	err = sw.fetch(ctx, missing, func(b *blocks.Block) error {
+		if err := write(b); err != nil {
+			return err
+		}
+		if sw.cfg.blockstore != nil {
+			if err := sw.cfg.blockstore.Put(ctx, b); err != nil {
+				return err
+			}
+		}
+		prog.add(uint64(len(b.RawData())) * uint64(len(spans[b.Cid()])))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	prog.finish()
+	return nil
+}
+
+// fetchNodes returns the blocks cids, taken from the blockstore of the download if it has them and fetched
+// from the peers otherwise.
+func (sw *swarm) fetchNodes(ctx context.Context, cids []cid.Cid) (map[cid.Cid]*blocks.Block, error) {
+	var mu sync.Mutex
+	got := make(map[cid.Cid]*blocks.Block, len(cids))
+	var missing []cid.Cid
+	for _, c := range cids {
+		if sw.cfg.blockstore != nil {
+			if b, err := sw.cfg.blockstore.Get(ctx, c); err == nil {
+				got[c] = b
+				continue
+			}
+		}
+		missing = append(missing, c)
+	}
+	err := sw.fetch(ctx, missing, func(b *blocks.Block) error {
+		if sw.cfg.blockstore != nil {
+			if err := sw.cfg.blockstore.Put(ctx, b); err != nil {
+				return err
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		got[b.Cid()] = b
+		return nil
+	})
+	return got, err
+}
+
+// fetch asks the peers for the blocks cids and passes every block received to deliver, which is called
+// once per block, possibly by several goroutines at once.
+func (sw *swarm) fetch(ctx context.Context, cids []cid.Cid, deliver func(b *blocks.Block) error) error {
+	if len(cids) == 0 {
+		return nil
+	}
+	ph := newSwarmPhase(cids, sw.peers)
+	if err := ph.check(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ph.fail(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, sp := range sw.peers {
+		if sp.dropped {
+			continue
+		}
+		wg.Add(1)
+		go func(sp *swarmPeer) {
+			defer wg.Done()
+			sw.work(ctx, ph, sp, deliver)
+		}(sp)
+	}
+	wg.Wait()
+	return ph.err
+}
+
+// work asks sp for the blocks ph hands out until there are none left.
+func (sw *swarm) work(ctx context.Context, ph *swarmPhase, sp *swarmPeer, deliver func(b *blocks.Block) error) {
+	for {
+		items := ph.take(sp)
+		if items == nil {
+			return
+		}
+		start := time.Now()
+		got, err := sw.request(ctx, sp, items)
+		received := 0
+		for i, it := range items {
+			if got[i] == nil {
+				// Without an error, the peer does not have the block.
+				ph.release(sp, it, err == nil)
+				continue
+			}
+			received += len(got[i].RawData())
+			if ph.complete(sp, it, len(got[i].RawData())) {
+				if err := deliver(got[i]); err != nil {
+					ph.fail(err)
+					return
+				}
+			}
+		}
+
+		sp.mu.Lock()
+		aborted := sp.aborted
+		sp.aborted = false
+		sp.mu.Unlock()
+		switch {
+		case err == nil:
+			sp.failures = 0
+			ph.measure(sp, received, time.Since(start))
+		case aborted || ctx.Err() != nil:
+			// The request was given up on as another peer sent its blocks first.
+		case errors.Is(err, ErrChecksumMismatch):
+			sw.cfg.logf("no longer downloading from %s because %v", sp.id, err)
+			ph.drop(sp, err)
+			return
+		default:
+			sp.failures++
+			if sp.failures >= maxPeerFailures {
+				sw.cfg.logf("no longer downloading from %s because %v", sp.id, err)
+				ph.drop(sp, err)
+				return
+			}
+		}
+	}
+}
+
+// request asks sp for the blocks of items over its stream, opened if needed, and returns them in the same
+// order, nil for those it does not have. The stream is closed if the request fails, and the blocks received
+// until then are returned.
+func (sw *swarm) request(ctx context.Context, sp *swarmPeer, items []*swarmItem) ([]*blocks.Block, error) {
+	got := make([]*blocks.Block, len(items))
+	conn, err := sw.conn(ctx, sp)
+	if err != nil {
+		return got, err
+	}
+	// A peer sending nothing for too long is given up on by closing its stream.
+	stall := time.AfterFunc(stallTimeout, func() { _ = conn.Close() })
+	defer stall.Stop()
+
+	data := sw.cfg.limit(ctx, conn)
+	wants := make([]cid.Cid, len(items))
+	for i, it := range items {
+		wants[i] = it.c
+	}
+	err = writeWants(data, wants)
+	for i := 0; i < len(items) && err == nil; i++ {
+		var have [1]byte
+		if _, err = io.ReadFull(data, have[:]); err != nil {
+			err = fmt.Errorf("error reading block: %v", err)
+			break
+		}
+		stall.Reset(stallTimeout)
+		if have[0] == 0 {
+			continue
+		}
+		var b []byte
+		if b, err = readBlock(data); err != nil {
+			break
+		}
+		if got[i], err = blocks.NewBlockWithCid(b, items[i].c); err != nil {
+			err = fmt.Errorf("%w: %v", ErrChecksumMismatch, err)
+		}
+	}
+	if err != nil {
+		sp.reset()
+		return got, fmt.Errorf("peer %s: %w", sp.id, err)
+	}
+	return got, nil
+}
+
+// conn returns the stream to sp, opening it if needed.
+func (sw *swarm) conn(ctx context.Context, sp *swarmPeer) (io.ReadWriteCloser, error) {
+	sp.mu.Lock()
+	conn := sp.conn
+	sp.mu.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	conn, err := sw.open(ctx, sp.id)
+	if err != nil {
+		return nil, fmt.Errorf("error opening stream to %s: %v", sp.id, err)
+	}
+	sp.mu.Lock()
+	sp.conn, sp.stop = conn, wire.WatchContext(ctx, conn)
+	sp.mu.Unlock()
+	return conn, nil
+}
+
+// swarmPeer is a peer a swarm download asks for blocks.
+type swarmPeer struct {
+	id       peer.ID
+	failures int
+
+	// rate, received and dropped are guarded by the mutex of the phase.
+	rate     float64
+	received uint64
+	dropped  bool
+
+	mu      sync.Mutex
+	conn    io.ReadWriteCloser
+	stop    func()
+	aborted bool
+}
+
+// reset closes the stream to sp, if any.
+func (sp *swarmPeer) reset() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.conn == nil {
+		return
+	}
+	sp.stop()
+	_ = sp.conn.Close()
+	sp.conn, sp.stop = nil, nil
+}
+
+// abort gives up on the request sp is answering.
+func (sp *swarmPeer) abort() {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.conn != nil {
+		sp.aborted = true
+		_ = sp.conn.Close()
+	}
+}
+
+// swarmItem is a block wanted by a swarm download.
+type swarmItem struct {
+	c    cid.Cid
+	done bool
+	// tried holds the peers that do not have the block, inflight the ones asked for it.
+	tried    map[peer.ID]bool
+	inflight map[*swarmPeer]bool
+}
+
+// swarmPhase hands out blocks to the peers of a swarm download, and tracks which were received.
+type swarmPhase struct {
+	mu        sync.Mutex
+	cond      *sync.Cond
+	queue     []*swarmItem
+	inflight  map[*swarmItem]bool
+	remaining int
+	peers     []*swarmPeer
+	avgSize   float64
+	err       error
+}
+
+func newSwarmPhase(cids []cid.Cid, peers []*swarmPeer) *swarmPhase {
+	ph := &swarmPhase{inflight: make(map[*swarmItem]bool), peers: peers, avgSize: defaultLeafSize}
+	ph.cond = sync.NewCond(&ph.mu)
+	for _, c := range cids {
+		ph.queue = append(ph.queue, &swarmItem{c: c, tried: make(map[peer.ID]bool), inflight: make(map[*swarmPeer]bool)})
+	}
+	ph.remaining = len(ph.queue)
+	return ph
+}
+
+// take returns the blocks sp is asked for next, waiting until there are some, or nil once there are none left.
+func (ph *swarmPhase) take(sp *swarmPeer) []*swarmItem {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	for {
+		if ph.err != nil || ph.remaining == 0 || sp.dropped {
+			return nil
+		}
+		// A peer is asked for what it sends in batchTarget, two blocks until it sent some.
+		n := 2
+		if sp.rate > 0 {
+			n = int(sp.rate * batchTarget.Seconds() / ph.avgSize)
+		}
+		if max := int(maxBatchBytes / ph.avgSize); n > max {
+			n = max
+		}
+		if n > maxWants {
+			n = maxWants
+		}
+		if n < 1 {
+			n = 1
+		}
+
+		var batch []*swarmItem
+		queue := ph.queue[:0]
+		for i, it := range ph.queue {
+			if len(batch) == n {
+				queue = append(queue, ph.queue[i:]...)
+				break
+			}
+			if it.done {
+				continue
+			}
+			if it.tried[sp.id] {
+				queue = append(queue, it)
+				continue
+			}
+			it.inflight[sp] = true
+			ph.inflight[it] = true
+			batch = append(batch, it)
+		}
+		ph.queue = queue
+		if len(batch) > 0 {
+			return batch
+		}
+
+		// Once every block was asked for, the peer is asked for a block the slowest peer is still to send.
+		var dup *swarmItem
+		var slowest float64
+		for it := range ph.inflight {
+			if it.tried[sp.id] || it.inflight[sp] || len(it.inflight) > 1 {
+				continue
+			}
+			for other := range it.inflight {
+				if dup == nil || other.rate < slowest {
+					dup, slowest = it, other.rate
+				}
+			}
+		}
+		if dup != nil {
+			dup.inflight[sp] = true
+			return []*swarmItem{dup}
+		}
+		ph.cond.Wait()
+	}
+}
+
+// complete records it, of size bytes, as received from sp, and reports whether it was the first copy. The
+// other peers asked for it are given up on.
+func (ph *swarmPhase) complete(sp *swarmPeer, it *swarmItem, size int) bool {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	delete(it.inflight, sp)
+	sp.received += uint64(size)
+	if it.done {
+		return false
+	}
+	it.done = true
+	delete(ph.inflight, it)
+	ph.avgSize += (float64(size) - ph.avgSize) / 8
+	for other := range it.inflight {
+		other.abort()
+	}
+	ph.remaining--
+	ph.cond.Broadcast()
+	return true
+}
+
+// release hands it out again, to the other peers if sp does not have it.
+func (ph *swarmPhase) release(sp *swarmPeer, it *swarmItem, dontHave bool) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	delete(it.inflight, sp)
+	if dontHave {
+		it.tried[sp.id] = true
+	}
+	if !it.done && len(it.inflight) == 0 {
+		delete(ph.inflight, it)
+		ph.queue = append(ph.queue, it)
+		if ph.err == nil && !ph.canGet(it) {
+			ph.err = fmt.Errorf("no peer has block %s", it.c)
+		}
+	}
+	ph.cond.Broadcast()
+}
+
+// measure records that sp sent size bytes in d.
+func (ph *swarmPhase) measure(sp *swarmPeer, size int, d time.Duration) {
+	if size == 0 || d <= 0 {
+		return
+	}
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	rate := float64(size) / d.Seconds()
+	if sp.rate == 0 {
+		sp.rate = rate
+	} else {
+		sp.rate = (sp.rate + rate) / 2
+	}
+}
+
+// drop stops asking sp for blocks because of err.
+func (ph *swarmPhase) drop(sp *swarmPeer, err error) {
+	sp.reset()
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	sp.dropped = true
+	if ph.err == nil {
+		if cerr := ph.check(); cerr != nil {
+			ph.err = fmt.Errorf("%v, last error: %v", cerr, err)
+		}
+	}
+	ph.cond.Broadcast()
+}
+
+// fail stops the phase because of err.
+func (ph *swarmPhase) fail(err error) {
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	if ph.err == nil {
+		ph.err = err
+	}
+	ph.cond.Broadcast()
+}
+
+// check returns an error if a block waiting to be handed out cannot be got from any peer.
+func (ph *swarmPhase) check() error {
+	for _, it := range ph.queue {
+		if !it.done && len(it.inflight) == 0 && !ph.canGet(it) {
+			if len(it.tried) == 0 {
+				return errors.New("no peer left to download from")
+			}
+			return fmt.Errorf("no peer has block %s", it.c)
+		}
+	}
+	return nil
+}
+
+// canGet reports whether a peer may still send it.
+func (ph *swarmPhase) canGet(it *swarmItem) bool {
+	for _, sp := range ph.peers {
+		if !sp.dropped && !it.tried[sp.id] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,184 @@
+package tftp
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// Client reads and writes files on TFTP servers.
+type Client struct {
+	cfg *config
+}
+
+// NewClient returns a client. WithBlockSize, WithWindowSize and WithTimeout set the options it asks servers
+// for; servers that do not support options send 512 bytes blocks one at a time instead.
+func NewClient(opts ...Option) (*Client, error) {
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.blockSize == 0 {
+		cfg.blockSize = DefaultBlockSize
+	}
+	if cfg.windowSize == 0 {
+		cfg.windowSize = 1
+	}
+	return &Client{cfg: cfg}, nil
+}
+
+// Get reads the file filename from the server at addr, "host:port" or "host" for port 69, writes it to w and
+// returns the number of bytes received.
+func (c *Client) Get(addr, filename string, w io.Writer) (int64, error) {
+	sess, err := c.dial(addr)
+	if err != nil {
+		return 0, err
+	}
+	request := requestPacket(opRRQ, filename, c.cfg.mode, c.options(0))
+	if err := sess.send(request); err != nil {
+		sess.conn.Close()
+		return 0, fmt.Errorf("error sending request: %v", err)
+	}
+	// The server answers with an OACK if it supports options, with the first block otherwise.
+	var first *packet
+	err = sess.await(sess.resend, func(p *packet) (bool, error) {
+		switch p.op {
+		case opOACK:
+			return true, c.acceptOptions(sess, p)
+		case opDATA:
+			first = p
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		sess.conn.Close()
+		return 0, err
+	}
+	if first == nil {
+		if err := sess.send(ackPacket(0)); err != nil {
+			sess.conn.Close()
+			return 0, err
+		}
+	}
+
+	dst := w
+	var netascii *netasciiWriter
+	if c.cfg.mode == ModeNetascii {
+		netascii = newNetasciiWriter(w)
+		dst = netascii
+	}
+	n, err := sess.receiveData(dst, first, func() error {
+		if netascii != nil {
+			return netascii.flush()
+		}
+		return nil
+	})
+	if err != nil {
+		sess.conn.Close()
+		return n, err
+	}
+	// The data is complete, the acknowledgement of the last block is sent again in the background if lost.
+	go func() {
+		sess.dally()
+		sess.conn.Close()
+	}()
+	return n, nil
+}
+
+// Put writes the data read from r to the file filename on the server at addr and returns the number of bytes
+// sent. size is announced to the server with the tsize option in octet mode, unless it is negative.
+func (c *Client) Put(addr, filename string, r io.Reader, size int64) (int64, error) {
+	sess, err := c.dial(addr)
+	if err != nil {
+		return 0, err
+	}
+	defer sess.conn.Close()
+	request := requestPacket(opWRQ, filename, c.cfg.mode, c.options(size))
+	if err := sess.send(request); err != nil {
+		return 0, fmt.Errorf("error sending request: %v", err)
+	}
+	// The server answers with an OACK if it supports options, with the acknowledgement of block 0 otherwise.
+	err = sess.await(sess.resend, func(p *packet) (bool, error) {
+		switch p.op {
+		case opOACK:
+			return true, c.acceptOptions(sess, p)
+		case opACK:
+			return p.block == 0, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if c.cfg.mode == ModeNetascii {
+		r = newNetasciiReader(r)
+	}
+	return sess.sendData(r)
+}
+
+// dial opens the socket of a new transfer with the server at addr.
+func (c *Client) dial(addr string) (*session, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(DefaultPort))
+	}
+	remote, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("error resolving %s: %v", addr, err)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("error opening socket: %v", err)
+	}
+	return newSession(conn, remote, false, c.cfg), nil
+}
+
+// options returns the options of a request. size is the size announced by a write request, 0 for a read
+// request which asks the server for the size of the file.
+func (c *Client) options(size int64) []option {
+	var options []option
+	if c.cfg.blockSize != DefaultBlockSize {
+		options = append(options, option{optBlockSize, strconv.Itoa(c.cfg.blockSize)})
+	}
+	if c.cfg.timeout != defaultTimeout {
+		options = append(options, option{optTimeout, strconv.Itoa(int(c.cfg.timeout.Seconds()))})
+	}
+	if size >= 0 && c.cfg.mode == ModeOctet {
+		options = append(options, option{optSize, strconv.FormatInt(size, 10)})
+	}
+	if c.cfg.windowSize != 1 {
+		options = append(options, option{optWindowSize, strconv.Itoa(c.cfg.windowSize)})
+	}
+	return options
+}
+
+// acceptOptions applies the options acknowledged by the server to sess. Options the client did not ask for,
+// or with values it cannot use, fail the transfer with an error sent to the server, as RFC 2347 requires.
+func (c *Client) acceptOptions(sess *session, oack *packet) error {
+	for _, o := range oack.options {
+		var ok bool
+		switch o.name {
+		case optBlockSize:
+			var n uint64
+			n, ok = parseUint(o.value, MinBlockSize, uint64(c.cfg.blockSize))
+			ok = ok && c.cfg.blockSize != DefaultBlockSize
+			sess.blockSize = int(n)
+		case optTimeout:
+			ok = c.cfg.timeout != defaultTimeout && o.value == strconv.Itoa(int(c.cfg.timeout.Seconds()))
+		case optSize:
+			_, ok = parseUint(o.value, 0, 1<<63-1)
+		case optWindowSize:
+			var n uint64
+			n, ok = parseUint(o.value, 1, uint64(c.cfg.windowSize))
+			ok = ok && c.cfg.windowSize != 1
+			sess.windowSize = int(n)
+		}
+		if !ok {
+			sess.sendError(ErrCodeBadOptions, fmt.Sprintf("unexpected option %s=%s", o.name, o.value))
+			return fmt.Errorf("server acknowledged the unexpected option %s=%s", o.name, o.value)
+		}
+	}
+	sess.growBuffer()
+	return nil
+}
@@ -0,0 +1,145 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Handler provides the files of a Server.
+type Handler interface {
+	// ReadFile opens filename for a client reading it (RRQ), and returns its size, or -1 if it is not known.
+	ReadFile(filename string, remote net.Addr) (io.ReadCloser, int64, error)
+	// WriteFile creates filename for a client writing it (WRQ). size is the size announced with the tsize
+	// option, -1 if the client did not announce it. The writer is closed once every block is received; if the
+	// transfer fails, it is closed with CloseWithError(err) instead if it has such a method.
+	WriteFile(filename string, size int64, remote net.Addr) (io.WriteCloser, error)
+}
+
+// ErrAccessViolation is returned by handlers for files clients may not read or write.
+var ErrAccessViolation = &Error{Code: ErrCodeAccessViolation, Message: "access violation"}
+
+// dirHandler serves the files below a directory.
+type dirHandler struct {
+	root     string
+	writable bool
+}
+
+// DirHandler returns a handler serving the files below root. Clients may only write files if writable is set,
+// replacing existing files once they are completely received. Names leaving root are refused.
+func DirHandler(root string, writable bool) Handler {
+	return &dirHandler{root: root, writable: writable}
+}
+
+// path returns the path of filename below the root. Leading slashes are ignored, as network boot clients often
+// send absolute names. Symbolic links are resolved, and names whose directory or existing file resolves outside
+// the root are refused, so that a link below the root cannot give access to the rest of the file system.
+func (d *dirHandler) path(filename string) (string, error) {
+	name := strings.TrimLeft(filepath.FromSlash(filename), string(filepath.Separator))
+	if name == "" || strings.ContainsRune(name, 0) || filepath.VolumeName(name) != "" {
+		return "", ErrAccessViolation
+	}
+	name = filepath.Clean(name)
+	if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", ErrAccessViolation
+	}
+	root, err := filepath.EvalSymlinks(d.root)
+	if err != nil {
+		return "", err
+	}
+	dir, err := filepath.EvalSymlinks(filepath.Dir(filepath.Join(root, name)))
+	if err != nil {
+		return "", err
+	}
+	if !within(root, dir) {
+		return "", ErrAccessViolation
+	}
+	path := filepath.Join(dir, filepath.Base(name))
+	target, err := filepath.EvalSymlinks(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return path, nil
+	case err != nil:
+		return "", err
+	case !within(root, target):
+		return "", ErrAccessViolation
+	}
+	return target, nil
+}
+
+// within reports whether path is root or below it. Both must be clean paths with their links resolved.
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (d *dirHandler) ReadFile(filename string, _ net.Addr) (io.ReadCloser, int64, error) {
+	path, err := d.path(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, 0, ErrAccessViolation
+	}
+	return file, info.Size(), nil
+}
+
+func (d *dirHandler) WriteFile(filename string, _ int64, _ net.Addr) (io.WriteCloser, error) {
+	if !d.writable {
+		return nil, ErrAccessViolation
+	}
+	path, err := d.path(filename)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := os.Stat(path); err == nil && !info.Mode().IsRegular() {
+		return nil, ErrAccessViolation
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.part")
+	if err != nil {
+		return nil, err
+	}
+	return &pendingFile{File: tmp, path: path}, nil
+}
+
+// pendingFile is a file being written, renamed to its path once complete.
+type pendingFile struct {
+	*os.File
+	path string
+}
+
+func (f *pendingFile) Close() error {
+	if err := f.File.Chmod(0644); err != nil {
+		f.CloseWithError(err)
+		return err
+	}
+	if err := f.File.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error storing %s: %v", filepath.Base(f.path), err)
+	}
+	return nil
+}
+
+// CloseWithError discards the file.
+func (f *pendingFile) CloseWithError(error) error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
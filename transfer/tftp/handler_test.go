@@ -0,0 +1,73 @@
+package tftp
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirHandlerRefusesLinksOutside(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "boot.img"), []byte("boot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "dir")); err != nil {
+		t.Skipf("symbolic links not supported: %v", err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "file")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("boot.img", filepath.Join(root, "inside")); err != nil {
+		t.Fatal(err)
+	}
+	h := DirHandler(root, true)
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"boot.img", true},
+		{"/boot.img", true},
+		{"inside", true},
+		{"../secret", false},
+		{"dir/secret", false},
+		{"file", false},
+	}
+	for _, tt := range tests {
+		r, _, err := h.ReadFile(tt.name, nil)
+		if tt.ok {
+			if err != nil {
+				t.Errorf("ReadFile(%q) = %v", tt.name, err)
+				continue
+			}
+			data, _ := io.ReadAll(r)
+			r.Close()
+			if string(data) != "boot" {
+				t.Errorf("ReadFile(%q) read %q", tt.name, data)
+			}
+		} else if !errors.Is(err, ErrAccessViolation) {
+			t.Errorf("ReadFile(%q) = %v, want %v", tt.name, err, ErrAccessViolation)
+		}
+	}
+
+	for _, name := range []string{"dir/new", "dir/secret", "file"} {
+		if w, err := h.WriteFile(name, -1, nil); !errors.Is(err, ErrAccessViolation) {
+			if err == nil {
+				w.Close()
+			}
+			t.Errorf("WriteFile(%q) = %v, want %v", name, err, ErrAccessViolation)
+		}
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "secret")); string(data) != "secret" {
+		t.Errorf("file outside the root was replaced")
+	}
+	if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Errorf("%d entries outside the root, want 1", len(entries))
+	}
+}
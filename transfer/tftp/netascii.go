@@ -0,0 +1,95 @@
+package tftp
+
+import (
+	"bufio"
+	"io"
+)
+
+// netasciiReader translates the data read from r to netascii: LF becomes CR LF and CR becomes CR NUL.
+type netasciiReader struct {
+	r       *bufio.Reader
+	pending byte
+	hasNext bool
+}
+
+func newNetasciiReader(r io.Reader) *netasciiReader {
+	return &netasciiReader{r: bufio.NewReader(r)}
+}
+
+func (n *netasciiReader) Read(p []byte) (int, error) {
+	i := 0
+	for i < len(p) {
+		if n.hasNext {
+			p[i] = n.pending
+			n.hasNext = false
+			i++
+			continue
+		}
+		c, err := n.r.ReadByte()
+		if err != nil {
+			if i > 0 && err == io.EOF {
+				return i, nil
+			}
+			return i, err
+		}
+		switch c {
+		case '\n':
+			p[i], n.pending, n.hasNext = '\r', '\n', true
+		case '\r':
+			p[i], n.pending, n.hasNext = '\r', 0, true
+		default:
+			p[i] = c
+		}
+		i++
+	}
+	return i, nil
+}
+
+// netasciiWriter translates netascii written to it back to local text: CR LF becomes LF and CR NUL becomes CR.
+// flush must be called once all the data is written.
+type netasciiWriter struct {
+	w  io.Writer
+	cr bool
+}
+
+func newNetasciiWriter(w io.Writer) *netasciiWriter {
+	return &netasciiWriter{w: w}
+}
+
+func (n *netasciiWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, c := range p {
+		if n.cr {
+			n.cr = false
+			switch c {
+			case '\n':
+				out = append(out, '\n')
+				continue
+			case 0:
+				out = append(out, '\r')
+				continue
+			default:
+				out = append(out, '\r')
+			}
+		}
+		if c == '\r' {
+			n.cr = true
+			continue
+		}
+		out = append(out, c)
+	}
+	if _, err := n.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes a CR that ended the data.
+func (n *netasciiWriter) flush() error {
+	if !n.cr {
+		return nil
+	}
+	n.cr = false
+	_, err := n.w.Write([]byte{'\r'})
+	return err
+}
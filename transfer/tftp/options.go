@@ -0,0 +1,113 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// defaultTimeout is how long a packet is waited for before the last one is sent again.
+	defaultTimeout = 3 * time.Second
+	// defaultRetries is the number of times a packet is sent again before a transfer is abandoned.
+	defaultRetries = 5
+	// defaultMaxWindowSize is the largest window a server accepts unless set with WithWindowSize.
+	defaultMaxWindowSize = 64
+)
+
+// config holds the settings of a client or a server.
+type config struct {
+	timeout    time.Duration
+	retries    int
+	blockSize  int
+	windowSize int
+	mode       string
+	logf       func(format string, args ...interface{})
+}
+
+// Option configures a Client or a Server.
+type Option func(cfg *config) error
+
+// newConfig returns the default settings overridden by opts. blockSize and windowSize are left at 0 when unset,
+// as their defaults differ between clients and servers.
+func newConfig(opts []Option) (*config, error) {
+	cfg := &config{
+		timeout: defaultTimeout,
+		retries: defaultRetries,
+		mode:    ModeOctet,
+	}
+	for _, opt := range opts {
+		if err := opt(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// WithTimeout sets how long a packet is waited for before the last one is sent again, 3s by default. A client
+// asks the server to use the same timeout with the timeout option, which only takes whole seconds up to 255.
+func WithTimeout(timeout time.Duration) Option {
+	return func(cfg *config) error {
+		if timeout < time.Second || timeout > 255*time.Second {
+			return errors.New("timeout must be between 1s and 255s")
+		}
+		cfg.timeout = timeout
+		return nil
+	}
+}
+
+// WithRetries sets the number of times a packet is sent again before a transfer is abandoned, 5 by default.
+func WithRetries(n int) Option {
+	return func(cfg *config) error {
+		if n < 0 {
+			return errors.New("retries must not be negative")
+		}
+		cfg.retries = n
+		return nil
+	}
+}
+
+// WithBlockSize sets the block size a client asks for with the blksize option, or the largest one a server
+// accepts. Clients use the 512 bytes blocks of RFC 1350 by default, and servers accept up to MaxBlockSize.
+func WithBlockSize(size int) Option {
+	return func(cfg *config) error {
+		if size < MinBlockSize || size > MaxBlockSize {
+			return fmt.Errorf("block size must be between %d and %d", MinBlockSize, MaxBlockSize)
+		}
+		cfg.blockSize = size
+		return nil
+	}
+}
+
+// WithWindowSize sets the number of blocks a client asks to send before each acknowledgement with the
+// windowsize option, or the largest window a server accepts. Clients use windows of one block by default,
+// and servers accept up to 64.
+func WithWindowSize(n int) Option {
+	return func(cfg *config) error {
+		if n < 1 || n > MaxWindowSize {
+			return fmt.Errorf("window size must be between 1 and %d", MaxWindowSize)
+		}
+		cfg.windowSize = n
+		return nil
+	}
+}
+
+// WithMode sets the transfer mode of a client, ModeOctet (the default) or ModeNetascii.
+func WithMode(mode string) Option {
+	return func(cfg *config) error {
+		if mode != ModeOctet && mode != ModeNetascii {
+			return fmt.Errorf("unsupported mode %q", mode)
+		}
+		cfg.mode = mode
+		return nil
+	}
+}
+
+// WithLogger sets a function a server reports the transfers it serves and their failures to.
+// Nothing is reported by default.
+func WithLogger(logf func(format string, args ...interface{})) Option {
+	return func(cfg *config) error {
+		cfg.logf = logf
+		return nil
+	}
+}
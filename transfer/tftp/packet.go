@@ -0,0 +1,219 @@
+package tftp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Opcodes of the TFTP packets, RFC 1350 and RFC 2347 for OACK.
+const (
+	opRRQ   uint16 = 1
+	opWRQ   uint16 = 2
+	opDATA  uint16 = 3
+	opACK   uint16 = 4
+	opERROR uint16 = 5
+	opOACK  uint16 = 6
+)
+
+// Error codes of ERROR packets.
+const (
+	ErrCodeNotDefined        uint16 = 0
+	ErrCodeFileNotFound      uint16 = 1
+	ErrCodeAccessViolation   uint16 = 2
+	ErrCodeDiskFull          uint16 = 3
+	ErrCodeIllegalOperation  uint16 = 4
+	ErrCodeUnknownTransferID uint16 = 5
+	ErrCodeFileExists        uint16 = 6
+	ErrCodeNoSuchUser        uint16 = 7
+	ErrCodeBadOptions        uint16 = 8
+)
+
+// Transfer modes of RFC 1350. The mail mode is obsolete and refused.
+const (
+	ModeOctet    = "octet"
+	ModeNetascii = "netascii"
+)
+
+// Options negotiated by RFC 2348 (blksize), RFC 2349 (timeout and tsize) and RFC 7440 (windowsize).
+const (
+	optBlockSize  = "blksize"
+	optTimeout    = "timeout"
+	optSize       = "tsize"
+	optWindowSize = "windowsize"
+)
+
+const (
+	// DefaultBlockSize is the size of the DATA blocks of RFC 1350, used unless blksize is negotiated.
+	DefaultBlockSize = 512
+	// MinBlockSize and MaxBlockSize bound the blksize option.
+	MinBlockSize = 8
+	MaxBlockSize = 65464
+	// MaxWindowSize bounds the windowsize option.
+	MaxWindowSize = 65535
+	// maxPacketSize is the size of the largest packet: a DATA packet of MaxBlockSize bytes.
+	maxPacketSize = MaxBlockSize + 4
+)
+
+// Error is an ERROR packet, sent or received by either end of a transfer.
+type Error struct {
+	Code    uint16
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("tftp error %d: %s", e.Code, e.Message)
+}
+
+// option is a name and value pair of a request or OACK, kept in order.
+type option struct {
+	name  string
+	value string
+}
+
+// packet is a decoded TFTP packet. Only the fields of its opcode are set.
+type packet struct {
+	op       uint16
+	filename string
+	mode     string
+	options  []option
+	block    uint16
+	data     []byte
+	err      *Error
+}
+
+// option returns the value of the option name, matched case-insensitively.
+func (p *packet) option(name string) (string, bool) {
+	for _, o := range p.options {
+		if strings.EqualFold(o.name, name) {
+			return o.value, true
+		}
+	}
+	return "", false
+}
+
+// errMalformed is returned for packets that cannot be decoded.
+var errMalformed = errors.New("malformed packet")
+
+// parsePacket decodes b. The data of a DATA packet is a slice of b.
+func parsePacket(b []byte) (*packet, error) {
+	if len(b) < 2 {
+		return nil, errMalformed
+	}
+	p := &packet{op: binary.BigEndian.Uint16(b)}
+	body := b[2:]
+	switch p.op {
+	case opRRQ, opWRQ:
+		fields, err := splitStrings(body)
+		if err != nil || len(fields) < 2 || len(fields)%2 != 0 {
+			return nil, errMalformed
+		}
+		p.filename, p.mode = fields[0], strings.ToLower(fields[1])
+		p.options = parseOptions(fields[2:])
+	case opOACK:
+		fields, err := splitStrings(body)
+		if err != nil || len(fields)%2 != 0 {
+			return nil, errMalformed
+		}
+		p.options = parseOptions(fields)
+	case opDATA:
+		if len(body) < 2 {
+			return nil, errMalformed
+		}
+		p.block, p.data = binary.BigEndian.Uint16(body), body[2:]
+	case opACK:
+		if len(body) < 2 {
+			return nil, errMalformed
+		}
+		p.block = binary.BigEndian.Uint16(body)
+	case opERROR:
+		if len(body) < 2 {
+			return nil, errMalformed
+		}
+		msg := body[2:]
+		if i := bytes.IndexByte(msg, 0); i >= 0 {
+			msg = msg[:i]
+		}
+		p.err = &Error{Code: binary.BigEndian.Uint16(body), Message: string(msg)}
+	default:
+		return nil, fmt.Errorf("unknown opcode %d", p.op)
+	}
+	return p, nil
+}
+
+// splitStrings splits b into the zero-terminated strings it is made of.
+func splitStrings(b []byte) ([]string, error) {
+	var fields []string
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, 0)
+		if i < 0 {
+			return nil, errMalformed
+		}
+		fields = append(fields, string(b[:i]))
+		b = b[i+1:]
+	}
+	return fields, nil
+}
+
+func parseOptions(fields []string) []option {
+	options := make([]option, 0, len(fields)/2)
+	for i := 0; i+1 < len(fields); i += 2 {
+		options = append(options, option{name: strings.ToLower(fields[i]), value: fields[i+1]})
+	}
+	return options
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(append(b, s...), 0)
+}
+
+func appendOptions(b []byte, options []option) []byte {
+	for _, o := range options {
+		b = appendString(appendString(b, o.name), o.value)
+	}
+	return b
+}
+
+// requestPacket encodes a RRQ or WRQ.
+func requestPacket(op uint16, filename, mode string, options []option) []byte {
+	b := binary.BigEndian.AppendUint16(nil, op)
+	b = appendString(appendString(b, filename), mode)
+	return appendOptions(b, options)
+}
+
+// oackPacket encodes an OACK acknowledging options.
+func oackPacket(options []option) []byte {
+	return appendOptions(binary.BigEndian.AppendUint16(nil, opOACK), options)
+}
+
+// dataPacket encodes the DATA packet of block into buf, reusing its memory.
+func dataPacket(buf []byte, block uint16, data []byte) []byte {
+	b := binary.BigEndian.AppendUint16(buf[:0], opDATA)
+	b = binary.BigEndian.AppendUint16(b, block)
+	return append(b, data...)
+}
+
+// ackPacket encodes the ACK of block.
+func ackPacket(block uint16) []byte {
+	b := binary.BigEndian.AppendUint16(make([]byte, 0, 4), opACK)
+	return binary.BigEndian.AppendUint16(b, block)
+}
+
+// errorPacket encodes an ERROR packet.
+func errorPacket(code uint16, msg string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, opERROR)
+	b = binary.BigEndian.AppendUint16(b, code)
+	return appendString(b, msg)
+}
+
+// parseUint parses the value of an option, between min and max.
+func parseUint(value string, min, max uint64) (uint64, bool) {
+	n, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || n < min || n > max {
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,327 @@
+package tftp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultPort is the port TFTP servers listen on.
+const DefaultPort = 69
+
+// Server answers the read and write requests of TFTP clients, each transfer on its own UDP socket.
+type Server struct {
+	handler Handler
+	cfg     *config
+
+	mu     sync.Mutex
+	conn   *net.UDPConn
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewServer returns a server providing the files of handler. WithBlockSize and WithWindowSize set the largest
+// block size and window the server accepts, and WithTimeout and WithRetries how it retransmits.
+func NewServer(handler Handler, opts ...Option) (*Server, error) {
+	if handler == nil {
+		return nil, errors.New("handler is required")
+	}
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.blockSize == 0 {
+		cfg.blockSize = MaxBlockSize
+	}
+	if cfg.windowSize == 0 {
+		cfg.windowSize = defaultMaxWindowSize
+	}
+	return &Server{handler: handler, cfg: cfg}, nil
+}
+
+// ListenAndServe listens on the UDP address addr, ":69" for the standard port, and serves requests until the
+// server is closed.
+func (s *Server) ListenAndServe(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return fmt.Errorf("error resolving %s: %v", addr, err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("error listening on %s: %v", addr, err)
+	}
+	return s.Serve(conn)
+}
+
+// Serve serves the requests received on conn until the server is closed, which closes conn.
+func (s *Server) Serve(conn *net.UDPConn) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	s.conn = conn
+	s.mu.Unlock()
+
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, remote, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+		req, err := parsePacket(buf[:n])
+		if err != nil || (req.op != opRRQ && req.op != opWRQ) {
+			// Late packets of finished transfers end up here, they are not worth an answer.
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveRequest(req, remote)
+		}()
+	}
+}
+
+// Addr returns the address the server listens on, nil if it is not serving.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// Close stops serving requests and waits for the transfers in progress to end.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	if s.conn != nil {
+		err = s.conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.cfg.logf != nil {
+		s.cfg.logf(format, args...)
+	}
+}
+
+// serveRequest runs the transfer requested by req from a new socket, whose port is the transfer ID of the server.
+func (s *Server) serveRequest(req *packet, remote *net.UDPAddr) {
+	local := s.conn.LocalAddr().(*net.UDPAddr)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		s.logf("error opening a socket for %s: %v", remote, err)
+		return
+	}
+	defer conn.Close()
+	sess := newSession(conn, remote, true, s.cfg)
+
+	if req.mode != ModeOctet && req.mode != ModeNetascii {
+		sess.sendError(ErrCodeIllegalOperation, fmt.Sprintf("unsupported mode %q", req.mode))
+		s.logf("refused %s from %s: unsupported mode %q", req.filename, remote, req.mode)
+		return
+	}
+	options, size := s.negotiate(req, sess)
+	sess.growBuffer()
+
+	var n int64
+	if req.op == opRRQ {
+		n, err = s.serveRead(sess, req, options, remote)
+	} else {
+		n, err = s.serveWrite(sess, req, options, size, remote)
+	}
+	op := "read"
+	if req.op == opWRQ {
+		op = "write"
+	}
+	if err != nil {
+		s.logf("error serving %s of %s to %s after %d bytes: %v", op, req.filename, remote, n, err)
+		return
+	}
+	s.logf("served %s of %s to %s: %d bytes", op, req.filename, remote, n)
+}
+
+// negotiate applies the options of req the server supports to sess, and returns them with the values to
+// acknowledge and the size announced by a writing client, -1 if it did not. Unknown options and options with
+// invalid values are ignored, as RFC 2347 allows.
+func (s *Server) negotiate(req *packet, sess *session) ([]option, int64) {
+	var accepted []option
+	size := int64(-1)
+	seen := make(map[string]bool)
+	for _, o := range req.options {
+		if seen[o.name] {
+			continue
+		}
+		seen[o.name] = true
+		switch o.name {
+		case optBlockSize:
+			if n, ok := parseUint(o.value, MinBlockSize, math.MaxUint16); ok {
+				sess.blockSize = minInt(int(n), s.cfg.blockSize)
+				accepted = append(accepted, option{o.name, strconv.Itoa(sess.blockSize)})
+			}
+		case optTimeout:
+			if n, ok := parseUint(o.value, 1, 255); ok {
+				sess.timeout = time.Duration(n) * time.Second
+				accepted = append(accepted, option{o.name, o.value})
+			}
+		case optSize:
+			if n, ok := parseUint(o.value, 0, math.MaxInt64); ok {
+				if req.op == opWRQ {
+					size = int64(n)
+				}
+				accepted = append(accepted, option{o.name, o.value})
+			}
+		case optWindowSize:
+			if n, ok := parseUint(o.value, 1, MaxWindowSize); ok {
+				sess.windowSize = minInt(int(n), s.cfg.windowSize)
+				accepted = append(accepted, option{o.name, strconv.Itoa(sess.windowSize)})
+			}
+		}
+	}
+	return accepted, size
+}
+
+// serveRead sends a file to a client.
+func (s *Server) serveRead(sess *session, req *packet, options []option, remote net.Addr) (int64, error) {
+	file, size, err := s.handler.ReadFile(req.filename, remote)
+	if err != nil {
+		sess.sendError(errorCode(err), errorMessage(err))
+		return 0, err
+	}
+	defer file.Close()
+
+	// The size of a file sent as netascii is not known before it is translated.
+	for i := 0; i < len(options); i++ {
+		if options[i].name != optSize {
+			continue
+		}
+		if size < 0 || req.mode != ModeOctet {
+			options = append(options[:i], options[i+1:]...)
+			i--
+			continue
+		}
+		options[i].value = strconv.FormatInt(size, 10)
+	}
+	if len(options) > 0 {
+		if err := sess.send(oackPacket(options)); err != nil {
+			return 0, err
+		}
+		err := sess.await(sess.resend, func(p *packet) (bool, error) {
+			return p.op == opACK && p.block == 0, nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	var r io.Reader = file
+	if req.mode == ModeNetascii {
+		r = newNetasciiReader(file)
+	}
+	return sess.sendData(r)
+}
+
+// serveWrite receives a file from a client.
+func (s *Server) serveWrite(sess *session, req *packet, options []option, size int64, remote net.Addr) (int64, error) {
+	file, err := s.handler.WriteFile(req.filename, size, remote)
+	if err != nil {
+		sess.sendError(errorCode(err), errorMessage(err))
+		return 0, err
+	}
+	answer := ackPacket(0)
+	if len(options) > 0 {
+		answer = oackPacket(options)
+	}
+	if err := sess.send(answer); err != nil {
+		closeWithError(file, err)
+		return 0, err
+	}
+
+	var w io.Writer = file
+	var netascii *netasciiWriter
+	if req.mode == ModeNetascii {
+		netascii = newNetasciiWriter(file)
+		w = netascii
+	}
+	finished := false
+	n, err := sess.receiveData(w, nil, func() error {
+		finished = true
+		if netascii != nil {
+			if err := netascii.flush(); err != nil {
+				closeWithError(file, err)
+				return err
+			}
+		}
+		return file.Close()
+	})
+	if err != nil {
+		if !finished {
+			closeWithError(file, err)
+		}
+		return n, err
+	}
+	sess.dally()
+	return n, nil
+}
+
+// closeWithError closes w after a failed transfer.
+func closeWithError(w io.WriteCloser, err error) {
+	if c, ok := w.(interface{ CloseWithError(error) error }); ok {
+		_ = c.CloseWithError(err)
+		return
+	}
+	_ = w.Close()
+}
+
+// errorMessage returns the message of the ERROR packet reporting err.
+func errorMessage(err error) string {
+	var tftpErr *Error
+	if errors.As(err, &tftpErr) {
+		return tftpErr.Message
+	}
+	switch errorCode(err) {
+	case ErrCodeFileNotFound:
+		return "file not found"
+	case ErrCodeAccessViolation:
+		return "access violation"
+	case ErrCodeFileExists:
+		return "file already exists"
+	default:
+		return "cannot open file"
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
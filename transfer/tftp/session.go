@@ -0,0 +1,341 @@
+package tftp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// minReadBuffer is the least receive buffer of the sockets of windowed transfers.
+const minReadBuffer = 1 << 20
+
+// ErrTimeout is returned when the other end of a transfer stops answering.
+var ErrTimeout = errors.New("transfer timed out")
+
+// session is one transfer, exchanged over its own UDP socket with the transfer ID (address and port) of the
+// other end, as RFC 1350 requires.
+type session struct {
+	conn   *net.UDPConn
+	remote *net.UDPAddr
+	// locked is false until a client learns the transfer ID of the server from its first answer.
+	locked bool
+
+	timeout    time.Duration
+	retries    int
+	blockSize  int
+	windowSize int
+
+	buf  []byte
+	last []byte
+}
+
+func newSession(conn *net.UDPConn, remote *net.UDPAddr, locked bool, cfg *config) *session {
+	return &session{
+		conn:       conn,
+		remote:     remote,
+		locked:     locked,
+		timeout:    cfg.timeout,
+		retries:    cfg.retries,
+		blockSize:  DefaultBlockSize,
+		windowSize: 1,
+		buf:        make([]byte, maxPacketSize+1),
+	}
+}
+
+// growBuffer enlarges the receive buffer of the socket to hold whole windows of blocks, as the blocks past a
+// full buffer are dropped and only sent again after a timeout. The system may cap the size.
+func (s *session) growBuffer() {
+	if s.windowSize > 1 {
+		_ = s.conn.SetReadBuffer(maxInt(minReadBuffer, 2*s.windowSize*(s.blockSize+4)))
+	}
+}
+
+// send sends b to the other end, keeping it to send again if no answer comes in time.
+func (s *session) send(b []byte) error {
+	s.last = b
+	_, err := s.conn.WriteToUDP(b, s.remote)
+	return err
+}
+
+// resend sends the last packet again.
+func (s *session) resend() error {
+	_, err := s.conn.WriteToUDP(s.last, s.remote)
+	return err
+}
+
+// sendError tells the other end the transfer failed. There is no answer to wait for.
+func (s *session) sendError(code uint16, msg string) {
+	_, _ = s.conn.WriteToUDP(errorPacket(code, msg), s.remote)
+}
+
+// receive returns the next packet of the other end, failing with a timeout error at deadline. Packets from
+// other transfer IDs are answered with an error, and malformed packets ignored. The data of a DATA packet is
+// only valid until the next call.
+func (s *session) receive(deadline time.Time) (*packet, error) {
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		return nil, err
+	}
+	for {
+		n, addr, err := s.conn.ReadFromUDP(s.buf)
+		if err != nil {
+			return nil, err
+		}
+		if s.locked && !sameAddr(addr, s.remote) {
+			_, _ = s.conn.WriteToUDP(errorPacket(ErrCodeUnknownTransferID, "unknown transfer ID"), addr)
+			continue
+		}
+		p, err := parsePacket(s.buf[:n])
+		if err != nil {
+			continue
+		}
+		if !s.locked {
+			s.remote, s.locked = addr, true
+		}
+		return p, nil
+	}
+}
+
+// await waits for handle to accept a packet, calling resend each time none is accepted within the timeout, up
+// to s.retries times. An ERROR packet ends the wait with its error.
+func (s *session) await(resend func() error, handle func(p *packet) (bool, error)) error {
+	for tries := 0; ; tries++ {
+		deadline := time.Now().Add(s.timeout)
+		for {
+			p, err := s.receive(deadline)
+			if isTimeout(err) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if p.op == opERROR {
+				return p.err
+			}
+			done, err := handle(p)
+			if err != nil || done {
+				return err
+			}
+		}
+		if tries >= s.retries {
+			return ErrTimeout
+		}
+		if err := resend(); err != nil {
+			return err
+		}
+	}
+}
+
+// sendData sends the data read from r as DATA blocks numbered from 1, windowSize blocks at a time, and returns
+// once the last block, shorter than blockSize, is acknowledged. Block numbers wrap around to 0 after 65535.
+func (s *session) sendData(r io.Reader) (int64, error) {
+	var (
+		window [][]byte
+		spare  [][]byte
+		base   uint16 = 1
+		sent   int64
+		eof    bool
+	)
+	sendWindow := func() error {
+		for _, pkt := range window {
+			if _, err := s.conn.WriteToUDP(pkt, s.remote); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for {
+		for !eof && len(window) < s.windowSize {
+			var pkt []byte
+			if n := len(spare); n > 0 {
+				pkt, spare = spare[n-1], spare[:n-1]
+			} else {
+				pkt = make([]byte, 4+s.blockSize)
+			}
+			pkt = pkt[:4+s.blockSize]
+			n, err := io.ReadFull(r, pkt[4:])
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+			} else if err != nil {
+				s.sendError(errorCode(err), "error reading file")
+				return sent, fmt.Errorf("error reading file: %v", err)
+			}
+			binary.BigEndian.PutUint16(pkt, opDATA)
+			binary.BigEndian.PutUint16(pkt[2:], base+uint16(len(window)))
+			window = append(window, pkt[:4+n])
+		}
+		if len(window) == 0 {
+			return sent, nil
+		}
+		if err := sendWindow(); err != nil {
+			return sent, err
+		}
+		restarted := false
+		err := s.await(sendWindow, func(p *packet) (bool, error) {
+			if p.op != opACK {
+				return false, nil
+			}
+			acked := int(p.block - base + 1)
+			if acked >= 1 && acked <= len(window) {
+				for _, pkt := range window[:acked] {
+					sent += int64(len(pkt) - 4)
+					spare = append(spare, pkt)
+				}
+				window = window[acked:]
+				base += uint16(acked)
+				return true, nil
+			}
+			// With windows of more blocks, the receiver acknowledges the last block before a gap again to get
+			// the rest of the window sent again, once. With single blocks this is a duplicate ACK, ignored to avoid
+			// the Sorcerer's Apprentice syndrome.
+			if p.block == base-1 && s.windowSize > 1 && !restarted {
+				restarted = true
+				return false, sendWindow()
+			}
+			return false, nil
+		})
+		if err != nil {
+			return sent, err
+		}
+	}
+}
+
+// receiveData writes the DATA blocks of the other end to w, starting with first if it is not nil, and
+// acknowledges them every windowSize blocks. Once the last block is written, finish is called before it is
+// acknowledged, so that a failure to store the data is reported to the sender.
+func (s *session) receiveData(w io.Writer, first *packet, finish func() error) (int64, error) {
+	var (
+		expected uint16 = 1
+		received int64
+		inWindow int
+		tries    int
+		gap      bool
+	)
+	for p := first; ; p = nil {
+		if p == nil {
+			var err error
+			p, err = s.receive(time.Now().Add(s.timeout))
+			if isTimeout(err) {
+				if tries >= s.retries {
+					return received, ErrTimeout
+				}
+				tries++
+				if inWindow > 0 {
+					err = s.send(ackPacket(expected - 1))
+					inWindow = 0
+				} else {
+					err = s.resend()
+				}
+				if err != nil {
+					return received, err
+				}
+				continue
+			}
+			if err != nil {
+				return received, err
+			}
+		}
+		switch p.op {
+		case opERROR:
+			return received, p.err
+		case opOACK:
+			// The acknowledgement of the options was lost.
+			if expected == 1 {
+				if err := s.resend(); err != nil {
+					return received, err
+				}
+			}
+		case opDATA:
+			if p.block != expected {
+				// A block sent again because its acknowledgement was lost is acknowledged again, a block past a
+				// gap only once, to get the sender to start over after the last block received.
+				if ahead := p.block - expected; ahead < 0x8000 {
+					if gap {
+						continue
+					}
+					gap = true
+				}
+				if err := s.send(ackPacket(expected - 1)); err != nil {
+					return received, err
+				}
+				inWindow = 0
+				continue
+			}
+			if len(p.data) > s.blockSize {
+				s.sendError(ErrCodeIllegalOperation, "block larger than the block size")
+				return received, fmt.Errorf("block %d is larger than %d bytes", p.block, s.blockSize)
+			}
+			if _, err := w.Write(p.data); err != nil {
+				s.sendError(errorCode(err), "error writing file")
+				return received, fmt.Errorf("error writing file: %v", err)
+			}
+			received += int64(len(p.data))
+			expected++
+			inWindow++
+			tries = 0
+			gap = false
+			if len(p.data) < s.blockSize {
+				if finish != nil {
+					if err := finish(); err != nil {
+						s.sendError(errorCode(err), "error storing file")
+						return received, fmt.Errorf("error storing file: %v", err)
+					}
+				}
+				return received, s.send(ackPacket(p.block))
+			}
+			if inWindow >= s.windowSize {
+				if err := s.send(ackPacket(p.block)); err != nil {
+					return received, err
+				}
+				inWindow = 0
+			}
+		}
+	}
+}
+
+// dally waits one timeout after the last block was acknowledged, acknowledging it again if the sender did not
+// get the acknowledgement and sends the block again.
+func (s *session) dally() {
+	deadline := time.Now().Add(s.timeout)
+	for {
+		p, err := s.receive(deadline)
+		if err != nil {
+			return
+		}
+		if p.op == opDATA {
+			_ = s.resend()
+		}
+	}
+}
+
+// errorCode returns the code of the ERROR packet reporting err.
+func errorCode(err error) uint16 {
+	var tftpErr *Error
+	switch {
+	case errors.As(err, &tftpErr):
+		return tftpErr.Code
+	case errors.Is(err, os.ErrNotExist):
+		return ErrCodeFileNotFound
+	case errors.Is(err, os.ErrPermission):
+		return ErrCodeAccessViolation
+	case errors.Is(err, os.ErrExist):
+		return ErrCodeFileExists
+	case errors.Is(err, syscall.ENOSPC):
+		return ErrCodeDiskFull
+	default:
+		return ErrCodeNotDefined
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+func sameAddr(a, b *net.UDPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
@@ -1,305 +1,274 @@
+// Package transfer sends files over a stream with the protocol ProtocolID: a binary header describing the
+// file, the data in length-prefixed frames and a status sent back by the receiver.
 package transfer
 
 import (
-	"bufio"
-	"bytes"
-	"encoding/binary"
-	"flag"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
-	"path"
-	"strconv"
+	"p2p/internal/wire"
+	"path/filepath"
 	"strings"
 )
 
-// Packet represents a custom payload packet that contains the data and its size.
-type Packet struct {
-	Size int32
-	Data []byte
+// UploadFile sends the file at inputPath as filename over conn, in frames of at most blockSize bytes,
+// and waits for the receiver to confirm it stored the file. If the receiver kept part of the file from
+// an interrupted transfer, only the rest is sent. An error wrapping ErrChecksumMismatch is
+// returned if the data the receiver got does not match the digest of the file.
+func UploadFile(conn io.ReadWriter, filename, inputPath string, blockSize int, opts ...Option) error {
+	return UploadFileContext(context.Background(), conn, filename, inputPath, blockSize, opts...)
 }
 
-const (
-	HOST       = "localhost"
-	PORT       = "8080"
-	TYPE       = "tcp"
-	filename   = "random.txt"
-	inputPath  = "testingSender/random.txt"
-	outputPath = "testingReceiver"
-)
-
-func main() {
-	// Call uploadFile and receiveFile with your specific parameters
-	//	I need to check the command line for the mode = (sender/receiver)
-
-	mode := flag.String("mode", "sender", "To run as a sender or receiver")
-	flag.Parse()
-
-	// If sender
-
-	if *mode == "sender" {
-		println("Starting program as sender....")
-		tcpServer, err := net.ResolveTCPAddr(TYPE, HOST+":"+PORT)
-		println("tcpServer", tcpServer.String())
-		if err != nil {
-			fmt.Errorf("Error in 'ResolveTCPAddr': %s", err.Error())
-		}
-		conn, err := net.Dial(TYPE, tcpServer.String())
-		if err != nil {
-			errstr := fmt.Errorf("Error in 'Dial': %s", err.Error())
-			println(errstr.Error())
-		} else {
-			println("connection ", conn)
-		}
-		err = UploadFile(conn, filename, inputPath, 64)
-		if err != nil {
-			fmt.Errorf("Error in 'uploadFile': %s", err.Error())
-		}
+// UploadFileContext is UploadFile stopping the transfer once ctx is done, in which case it returns the error
+// of ctx. The progress of the transfer is reported to the function set by WithProgress.
+func UploadFileContext(ctx context.Context, conn io.ReadWriter, filename, inputPath string, blockSize int, opts ...Option) error {
+	if blockSize <= 0 || blockSize > MaxFrameSize {
+		return fmt.Errorf("block size must be between 1 and %d", MaxFrameSize)
 	}
-
-	// else if receiver
-	if *mode == "receiver" {
-		println("Starting program as receiver....")
-		listen, err := net.Listen(TYPE, HOST+":"+PORT)
-		if err != nil {
-			errormsg := fmt.Errorf("Error in 'Listen': %s", err.Error())
-			println(errormsg.Error())
-		}
-		defer listen.Close()
-
-		receiverConn, err := listen.Accept()
-		if err != nil {
-			errormsg := fmt.Errorf("Error in 'Accept': %s", err.Error())
-			println(errormsg.Error())
-		}
-
-		err = ReceiveFile(receiverConn, outputPath)
-		if err != nil {
-			errormsg := fmt.Errorf("Error in 'receiveFile': %s", err.Error())
-			println(errormsg.Error())
-
-		}
+	cfg, err := newConfig(opts)
+	if err != nil {
+		return err
 	}
+	file, header, err := openUpload(filename, inputPath, cfg)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
+	header.Offset, header.Length = 0, header.Size
+	return send(ctx, conn, header, file, blockSize, cfg)
 }
 
-// UploadFile sends a file to a connected receiver over the specified net.Conn.
-func UploadFile(conn net.Conn, filename, inputPath string, blockSize int) error {
+// openUpload opens the file at inputPath and returns the header describing it, with its digest.
+func openUpload(filename, inputPath string, cfg *config) (*os.File, Header, error) {
 	file, err := os.Open(inputPath)
-	fmt.Printf("opening %s with inputPath %s \n", filename, inputPath)
 	if err != nil {
-		return fmt.Errorf("error opening file: %v", err)
+		return nil, Header{}, fmt.Errorf("error opening file: %v", err)
 	}
-	defer file.Close()
 
 	fileInfo, err := file.Stat()
-	println("file size : ", fileInfo.Size())
-	println("file name : ", fileInfo.Name())
-
 	if err != nil {
-		return fmt.Errorf("error getting file info: %v", err)
+		file.Close()
+		return nil, Header{}, fmt.Errorf("error getting file info: %v", err)
+	}
+	if !fileInfo.Mode().IsRegular() {
+		file.Close()
+		return nil, Header{}, fmt.Errorf("%s is not a regular file", inputPath)
 	}
 
-	conn.Write([]byte(filename + "\n"))
-	conn.Write([]byte(strconv.FormatInt(fileInfo.Size(), 10) + "\n"))
-
-	buffer := make([]byte, blockSize)
+	// The digest is computed in a first pass so that it can be sent in the header.
+	sum, err := digest(io.NewSectionReader(file, 0, fileInfo.Size()), cfg.checksum)
+	if err != nil {
+		file.Close()
+		return nil, Header{}, fmt.Errorf("error hashing file: %v", err)
+	}
 
-	for {
-		bytesRead, err := file.Read(buffer)
+	header := Header{
+		Name:     filename,
+		Size:     uint64(fileInfo.Size()),
+		Mode:     uint32(fileInfo.Mode().Perm()),
+		Checksum: cfg.checksum,
+		Digest:   sum,
+	}
+	if len(codecsToPropose(cfg)) > 0 {
+		// Samples of the file tell whether it is worth compressing.
+		sample, err := sampleFile(file, header.Size)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("error reading file: %v", err)
-		}
-
-		if bytesRead > 0 {
-			packet := Packet{
-				Size: int32(bytesRead),
-				Data: buffer[:bytesRead],
-			}
-
-			sendPacket(conn, packet)
+			file.Close()
+			return nil, Header{}, fmt.Errorf("error reading file: %v", err)
 		}
+		header.Codecs = proposedCompression(cfg, sample)
 	}
+	return file, header, nil
+}
 
-	return nil
+// sendRange sends the range of file described by header over conn, paced by the rate limiter of cfg, and waits
+// for the receiver's status, counting the bytes sent with prog.
+func sendRange(ctx context.Context, conn io.ReadWriter, file io.ReaderAt, header Header, blockSize int, cfg *config, prog *tracker) error {
+	release, err := reserveMemory(conn, sendMemory(header, blockSize))
+	if err != nil {
+		return err
+	}
+	defer release()
+	return sendStream(cfg.limit(ctx, conn), header, io.NewSectionReader(file, int64(header.Offset), int64(header.Length)), blockSize, cfg, prog)
 }
 
-// sendPacket sends a Packet struct over a net.Conn connection.
-func sendPacket(conn net.Conn, packet Packet) error {
-	var buf bytes.Buffer
+// ReceiveFile receives a file, or a range of a file, sent with UploadFile or UploadFileParallel over conn
+// and stores it in the directory outputPath. The data is written to a partial file, shared by the streams
+// receiving ranges of the same file, which only replaces the file in outputPath once it is complete and
+// its digest matches the one sent by the sender. An error wrapping ErrChecksumMismatch is returned otherwise.
+// If the transfer is interrupted, the partial file is kept and the next transfer of the same content
+// only sends what is missing. Before any data is sent, the file is offered to the policies and handler
+// set with WithOfferPolicy and WithOfferHandler, once for all the ranges of the file, and an error
+// wrapping ErrRejected is returned if they refuse it. The sender is told whether the data was stored.
+func ReceiveFile(conn io.ReadWriter, outputPath string, opts ...Option) error {
+	return ReceiveFileContext(context.Background(), conn, outputPath, opts...)
+}
 
-	err := binary.Write(&buf, binary.BigEndian, packet.Size)
+// ReceiveFileContext is ReceiveFile stopping the transfer once ctx is done, in which case it returns the error
+// of ctx and keeps the partial file. The progress of the file is reported to the function set by WithProgress,
+// counting the ranges received on other streams.
+func ReceiveFileContext(ctx context.Context, conn io.ReadWriter, outputPath string, opts ...Option) error {
+	cfg, err := newConfig(opts)
 	if err != nil {
-		return fmt.Errorf("error encoding packet size: %v", err)
+		return err
 	}
-	fmt.Println("SENDER_BLK_PACK_SIZE", packet.Size)
-	_, err = buf.Write(packet.Data)
-	if err != nil {
-		return fmt.Errorf("error writing packet data to buffer: %v", err)
+	if err := attachService(conn); err != nil {
+		return err
 	}
-	fmt.Println("SENDER_BLK_PACK_data", packet.Data)
-	_, err = conn.Write(buf.Bytes())
-	if err != nil {
-		return fmt.Errorf("error sending packet: %v", err)
-	}
-
-	return nil
+	defer protectPeer(conn, cfg)()
+	stop := wire.WatchContext(ctx, conn)
+	defer stop()
+	return wire.ContextError(ctx, respond(conn, receiveFile(ctx, conn, outputPath, cfg)))
 }
 
-//func ReceiveFile(conn net.Conn, outputPath string) error {
-//	reader := bufio.NewReader(conn)
-//
-//	filename, err := reader.ReadString('\n')
-//	if err != nil {
-//		return fmt.Errorf("error reading filename: %v", err)
-//	}
-//	filename = strings.TrimSpace(filename)
-//
-//	fileSizeStr, err := reader.ReadString('\n')
-//	if err != nil {
-//		return fmt.Errorf("error reading file size: %v", err)
-//	}
-//	fileSizeStr = strings.TrimSpace(fileSizeStr)
-//	fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
-//	if err != nil {
-//		return fmt.Errorf("error parsing file size: %v", err)
-//	}
-//
-//	err = os.MkdirAll(outputPath, 0755)
-//
-//	if err != nil {
-//		fmt.Println(4)
-//		return fmt.Errorf("error creating output file directory: %v", err)
-//	}
-//
-//	cleanFPath := strings.Replace(path.Join(outputPath, filename), "\r", "", -1)
-//	cleanFPath = strings.Replace(cleanFPath, "\x00", "", -1)
-//	cleanFPath = strings.Replace(cleanFPath, "\x01", "", -1)
-//	cleanFPath = strings.Replace(cleanFPath, "\v", "", -1)
-//	fmt.Printf("%q", cleanFPath)
-//	outputFile, err := os.Create(cleanFPath)
-//	if err != nil {
-//		fmt.Println(5)
-//		return fmt.Errorf("error creating output file: %v", err)
-//	}
-//
-//	defer outputFile.Close()
-//
-//	var receivedBytes int64
-//	for receivedBytes < fileSize {
-//		packet, err := receivePacket(conn)
-//		if err != nil {
-//			return err
-//		}
-//
-//		outputFile.Write(packet.Data)
-//		receivedBytes += int64(packet.Size)
-//	}
-//
-//	return nil
-//}
-
-// ReceiveFile receives a file from a connected sender over the specified net.Conn.
-func ReceiveFile(conn net.Conn, outputPath string) error {
-	reader := bufio.NewReader(conn)
-	println("reader size: ", reader.Size())
-
-	filename, err := reader.ReadString('\n')
-	if err != nil {
-		fmt.Println(1)
-		return fmt.Errorf("error reading filename: %v", err)
+// respond sends the status matching err, the outcome of a transfer, and returns err.
+func respond(w io.Writer, err error) error {
+	switch {
+	case errors.Is(err, ErrChecksumMismatch):
+		_ = writeStatus(w, StatusChecksumMismatch, err.Error())
+		return err
+	case errors.Is(err, ErrRejected):
+		// Only the reason is sent, the sender wraps it in ErrRejected again.
+		reason := strings.TrimPrefix(strings.TrimPrefix(err.Error(), ErrRejected.Error()), ": ")
+		_ = writeStatus(w, StatusRejected, reason)
+		return err
+	case err != nil:
+		_ = writeStatus(w, StatusError, err.Error())
+		return err
 	}
-	filename = strings.TrimSpace(filename)
+	return writeStatus(w, StatusOK, "")
+}
 
-	fileSizeStr, err := reader.ReadString('\n')
+// receiveFile stores the range received over conn in outputPath.
+func receiveFile(ctx context.Context, conn io.ReadWriter, outputPath string, cfg *config) error {
+	header, err := readHeader(conn)
 	if err != nil {
-		fmt.Println(2)
-		return fmt.Errorf("error reading file size: %v", err)
+		return err
 	}
-	fileSizeInfo := strings.TrimSpace(fileSizeStr)
-	fileSizeInfo = fileSizeInfo[len(fileSizeInfo)-3:]
-	println("File size found ", fileSizeInfo)
-	fileSize, err := strconv.ParseInt(fileSizeInfo, 10, 16)
+	// The name is refused rather than cleaned up, a sender has no reason to send a path.
+	if err := checkName(header.Name); err != nil {
+		return err
+	}
+
+	outputPath, err = decideFile(&Offer{
+		Peer:      remotePeer(conn),
+		Names:     []string{header.Name},
+		TotalSize: header.Size,
+		Digest:    header.Digest,
+		Dir:       outputPath,
+	}, cfg)
 	if err != nil {
-		fmt.Println(3)
-		return fmt.Errorf("error parsing file size: %v", err)
+		return err
 	}
 
 	err = os.MkdirAll(outputPath, 0755)
-
 	if err != nil {
-		fmt.Println(4)
 		return fmt.Errorf("error creating output file directory: %v", err)
 	}
+	dest := filepath.Join(outputPath, header.Name)
+	if cfg.conflict == ConflictReject {
+		// Refuse before any data is sent, the check is done again once the file is complete.
+		if _, err := os.Lstat(dest); err == nil {
+			return fmt.Errorf("%s: %w", header.Name, ErrFileExists)
+		}
+	}
+	if header.Size == UnknownSize || len(header.Digest) == 0 {
+		_, err = receiveWhole(ctx, conn, header, dest, cfg.conflict, cfg)
+		return err
+	}
+	_, err = receiveRange(ctx, conn, header, dest, cfg.conflict, cfg, nil)
+	return err
+}
 
-	cleanFPath := strings.Replace(path.Join(outputPath, filename), "\r", "", -1)
-	cleanFPath = strings.Replace(cleanFPath, "\x00", "", -1)
-	cleanFPath = strings.Replace(cleanFPath, "\x01", "", -1)
-	cleanFPath = strings.Replace(cleanFPath, "\v", "", -1)
-	fmt.Printf("%q", cleanFPath)
-	outputFile, err := os.Create(cleanFPath)
+// receiveRange receives the range described by header over conn into the partial file of dest, and moves
+// the file to dest according to policy if it was the last range missing, returning the path it was stored at.
+// The bytes received are counted with prog, or with the tracker of the partial file if prog is nil.
+func receiveRange(ctx context.Context, conn io.ReadWriter, header Header, dest string, policy ConflictPolicy, cfg *config, prog *tracker) (string, error) {
+	if err := checkHeaderDigest(header); err != nil {
+		return "", err
+	}
+	if len(header.Digest) == 0 {
+		return "", errors.New("a range of a file sent without its digest")
+	}
+	mode := os.FileMode(header.Mode).Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	name := filepath.Base(dest)
+	part, err := acquirePartial(dest, header)
 	if err != nil {
-		fmt.Println(5)
-		return fmt.Errorf("error creating output file: %v", err)
+		return "", err
 	}
-	defer outputFile.Close()
+	defer part.release()
 
-	var receivedBytes int64
-	fmt.Println("Full file size", fileSize)
-	for receivedBytes < int64(fileSize) {
-		packet, err := receivePacket(conn)
+	start, end := header.Offset, header.Offset+header.Length
+	pos := start + part.doneFrom(start, end)
+	if pos > start && pos < end {
+		cfg.logf("resuming %s from byte %d", name, pos)
+	}
+	compression := chooseCompression(header.Codecs, cfg.compression)
+	if err := writeOffset(conn, compression, pos-start); err != nil {
+		return "", err
+	}
+	if prog == nil {
+		prog = part.tracker(name, cfg.onProgress)
+	} else {
+		prog.skip(pos - start)
+	}
 
-		if err != nil {
-			fmt.Println(6)
-			return err
+	frames, err := newFrameReader(cfg.limit(ctx, conn), compression, end-pos)
+	if err != nil {
+		return "", err
+	}
+	release, err := reserveMemory(conn, receiveMemory(compression, 64<<10))
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	buf := make([]byte, 64<<10)
+	saved := pos
+	for {
+		n, err := frames.Read(buf)
+		if n > 0 {
+			if _, werr := part.WriteAt(buf[:n], int64(pos)); werr != nil {
+				err = fmt.Errorf("error writing output file: %v", werr)
+			} else {
+				pos += uint64(n)
+				prog.add(uint64(n))
+			}
 		}
-		fmt.Println("PSIZE", packet.Size)
-
-		if len(packet.Data) == 0 {
+		if err == io.EOF {
 			break
-		} else {
-			outputFile.Write(packet.Data)
-			receivedBytes += int64(packet.Size)
+		}
+		if err != nil {
+			// Keep what was received so far for the next attempt.
+			_, _ = part.markDone(start, pos)
+			return "", err
+		}
+		if pos-saved >= checkpointInterval {
+			if _, err := part.markDone(start, pos); err != nil {
+				return "", err
+			}
+			saved = pos
 		}
 	}
 
-	return nil
-}
-
-// receivePacket receives a Packet struct from a net.Conn connection.
-func receivePacket(conn net.Conn) (Packet, error) {
-	var packet Packet
-
-	//d, err := io.ReadAll(conn)
-	//
-	//if err != nil {
-	//	return packet, fmt.Errorf("error decoding packet size: %v", err)
-	//}
-	//
-	//fmt.Println(d)
-
-	err := binary.Read(conn, binary.BigEndian, &packet.Size)
-	if err != nil {
-		return packet, fmt.Errorf("error decoding packet size: %v", err)
+	complete, err := part.markDone(start, end)
+	if err != nil || !complete || !part.claim() {
+		return "", err
 	}
-
-	fmt.Println("RECPACK SIZE", packet.Size)
-
-	packet.Size = 8
-	packet.Data = make([]byte, 8)
-
-	_, err = io.ReadAtLeast(conn, packet.Data, int(packet.Size))
+	stored, err := part.finish(dest, mode, policy)
 	if err != nil {
-		return packet, fmt.Errorf("error reading packet data: %v", err)
+		if errors.Is(err, ErrChecksumMismatch) {
+			return "", fmt.Errorf("%s: %w", name, err)
+		}
+		return "", err
 	}
-
-	packet.Data = []byte(strings.Replace(string(packet.Data), "\x00", "", -1))
-	packet.Data = []byte(strings.Replace(string(packet.Data), "\x01", "", -1))
-	//packet.Data = []byte(strings.Replace(string(packet.Data), "\x0c", "", -1))
-
-	return packet, nil
+	if cfg.onStored != nil {
+		cfg.onStored(stored)
+	}
+	return stored, nil
 }